@@ -0,0 +1,39 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// I2cdetect scans the I2C bus connected to the Teensy pins 18 (SDA) and 19
+// (SCL) and prints the result in the same form as the Linux i2cdetect tool.
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+	"github.com/embeddedgo/imxrt/hal/lpi2c/i2cscan"
+	"github.com/embeddedgo/imxrt/hal/lpi2c/lpi2c1"
+
+	"github.com/embeddedgo/imxrt/devboard/teensy4/board/pins"
+)
+
+func main() {
+	// Used IO pins
+	sda := pins.P18 // AD_B1_01
+	scl := pins.P19 // AD_B1_00
+
+	// Setup LPI2C driver
+	master := lpi2c1.Master()
+	master.Setup(lpi2c.Std100k)
+	master.UsePin(scl, lpi2c.SCL)
+	master.UsePin(sda, lpi2c.SDA)
+	master.SetTimeout(100 * time.Millisecond)
+
+	for {
+		res := i2cscan.Scan(master, 0x08, 0x77, i2cscan.Auto)
+		fmt.Println()
+		i2cscan.PrintGrid(os.Stdout, &res)
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Usbhost uses the USB Host port of the Teensy 4.1 (USB2 controller) to
+// enumerate the connected devices (also these connected through hubs) and
+// prints their interfaces on the system console.
+package main
+
+import (
+	"embedded/rtos"
+	"fmt"
+
+	"github.com/embeddedgo/imxrt/hal/gpio"
+	"github.com/embeddedgo/imxrt/hal/iomux"
+	"github.com/embeddedgo/imxrt/hal/usb"
+
+	_ "github.com/embeddedgo/imxrt/devboard/teensy4/board/system"
+)
+
+// logger is a class driver that only logs the offered interfaces.
+type logger struct{}
+
+func (logger) Attach(d *usb.HostDevice, intf []byte) bool {
+	fmt.Printf(
+		"attach: addr=%d %s %04x:%04x interface=%d class=%02x/%02x/%02x\n",
+		d.Addr(), d.Speed(), d.VendorID(), d.ProductID(),
+		intf[2], intf[5], intf[6], intf[7],
+	)
+	return false
+}
+
+func (logger) Detach(d *usb.HostDevice) {}
+
+var host *usb.Host
+
+func main() {
+	// The Teensy 4.1 USB Host port VBUS is controlled by EMC_40.
+	vbus := gpio.UsePin(iomux.EMC_40, true)
+	vbus.SetDirOut(true)
+
+	host = usb.NewHost(2, func(on bool) {
+		if on {
+			vbus.Set()
+		} else {
+			vbus.Clear()
+		}
+	})
+	host.Register(logger{})
+	host.Init(rtos.IntPrioLow)
+
+	select {}
+}
+
+//go:interrupthandler
+func USB_OTG2_Handler() {
+	host.ISR()
+}
@@ -3,7 +3,9 @@
 // license that can be found in the LICENSE file.
 
 // Package ccm provides simple interface to the CCGR registrs. As a side effect
-// it also access to the peripheral registers in user mode.
+// it also access to the peripheral registers in user mode. It also provides
+// functions that calculate the clock root frequencies from the current CCM
+// configuration.
 package ccm
 
 import (
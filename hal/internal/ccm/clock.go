@@ -0,0 +1,97 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ccm
+
+import (
+	"github.com/embeddedgo/imxrt/p/ccm"
+	"github.com/embeddedgo/imxrt/p/ccm_analog"
+)
+
+// The functions below calculate the frequencies of the clock roots used by
+// the HAL drivers based on the current CCM and CCM_ANALOG configuration. They
+// assume the 24 MHz oscillator as the reference clock for all PLLs.
+
+const oscFreq = 24_000_000
+
+// PLL2 returns the frequency of the System PLL (PLL2) in Hz.
+func PLL2() int64 {
+	ca := ccm_analog.CCM_ANALOG()
+	cfg := ca.PLL_SYS.Load()
+	if cfg&ccm_analog.PLL_SYS_BYPASS != 0 {
+		return oscFreq
+	}
+	mul := int64(20 + 2*(cfg&ccm_analog.PLL_SYS_DIV_SELECT))
+	f := oscFreq * mul
+	if denom := int64(ca.PLL_SYS_DENOM.Load()); denom != 0 {
+		f += oscFreq * int64(ca.PLL_SYS_NUM.Load()) / denom
+	}
+	return f
+}
+
+// PLL3 returns the frequency of the USB1 PLL (PLL3) in Hz.
+func PLL3() int64 {
+	cfg := ccm_analog.CCM_ANALOG().PLL_USB1.Load()
+	if cfg&ccm_analog.PLL_USB_BYPASS != 0 {
+		return oscFreq
+	}
+	mul := int64(20 + 2*(cfg&ccm_analog.PLL_USB_DIV_SELECT>>ccm_analog.PLL_USB_DIV_SELECTn))
+	return oscFreq * mul
+}
+
+// pfd returns the frequency of the n-th PFD output of the PLL that runs at
+// pllFreq, where pfdReg is the value of the corresponding PFD register.
+func pfd(pllFreq int64, pfdReg ccm_analog.PFD, n int) int64 {
+	frac := int64(pfdReg >> uint(n*8) & 0x3f)
+	if frac < 12 {
+		frac = 12 // values below 12 are reserved
+	}
+	return pllFreq * 18 / frac
+}
+
+// PLL3SW returns the frequency of the pll3_sw_clk in Hz.
+func PLL3SW() int64 {
+	if ccm.CCM().CCSR.LoadBits(ccm.PLL3_SW_CLK_SEL) != 0 {
+		return oscFreq // pll3 bypass clock
+	}
+	return PLL3()
+}
+
+// UARTClkRoot returns the frequency of the LPUART clock root in Hz.
+func UARTClkRoot() int64 {
+	cscdr1 := ccm.CCM().CSCDR1.Load()
+	f := int64(oscFreq)
+	if cscdr1&ccm.UART_CLK_SEL == 0 {
+		f = PLL3SW() / 6 // pll3_80m
+	}
+	return f / int64(cscdr1&ccm.UART_CLK_PODF>>ccm.UART_CLK_PODFn+1)
+}
+
+// LPSPIClkRoot returns the frequency of the LPSPI clock root in Hz.
+func LPSPIClkRoot() int64 {
+	cbcmr := ccm.CCM().CBCMR.Load()
+	ca := ccm_analog.CCM_ANALOG()
+	var f int64
+	switch cbcmr & ccm.LPSPI_CLK_SEL {
+	case ccm.LPSPI_CLK_SEL_0:
+		f = pfd(PLL3(), ca.PFD_480.Load(), 1)
+	case ccm.LPSPI_CLK_SEL_1:
+		f = pfd(PLL3(), ca.PFD_480.Load(), 0)
+	case ccm.LPSPI_CLK_SEL_2:
+		f = PLL2()
+	default:
+		f = pfd(PLL2(), ca.PFD_528.Load(), 2)
+	}
+	return f / int64(cbcmr&ccm.LPSPI_PODF>>ccm.LPSPI_PODFn+1)
+}
+
+// LPI2CClkRoot returns the frequency of the LPI2C clock root in Hz.
+func LPI2CClkRoot() int64 {
+	cscdr2 := ccm.CCM().CSCDR2.Load()
+	f := int64(oscFreq)
+	if cscdr2&ccm.LPI2C_CLK_SEL == 0 {
+		f = PLL3SW() / 8 // pll3_sw_clk / 8
+	}
+	return f / int64(cscdr2&ccm.LPI2C_CLK_PODF>>ccm.LPI2C_CLK_PODFn+1)
+}
@@ -5,6 +5,7 @@
 package lpi2c
 
 import (
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/embeddedgo/device/bus/i2cbus"
@@ -41,44 +42,52 @@ type conn struct {
 	rn     int8
 	open   bool
 	wr     bool
+
+	arbLost bool
+	logn    int16 // < 0 means the transaction can't be retried
+	log     [32]byte
 }
 
-// NewConn implements the i2cbus.Master interface.
-func (d *Master) NewConn(a i2cbus.Addr) i2cbus.Conn {
-	c := &conn{d: d, a: a}
+// AppendStart appends to cmds the commands that address the slave device a in
+// write (read == false) or read (read == true) direction and returns the
+// extended slice. It supports the 7-bit and 10-bit addresses (i2cbus.A10) and
+// the High Speed mode (i2cbus.HS). The returned commands can be passed to
+// WriteCmds followed by the Send or Recv commands.
+//
+// In case of the 10-bit address the read sequence consists of the Start
+// command with the first address byte (11110XX0), the Send command with the
+// second address byte and the repeated Start command with the first address
+// byte with the read bit set (11110XX1). In case of the High Speed mode the
+// sequence is preceded by the StartNACK command with the master code (see
+// SetID).
+func (d *Master) AppendStart(cmds []int16, a i2cbus.Addr, read bool) []int16 {
 	start := Start
-	i := 0
 	if a&i2cbus.HS != 0 {
-		// High Speed mode
-		cmd := StartNACK | 0x08 | int16(d.id&3)
-		c.wstart[i] = cmd
-		c.rstart[i] = cmd
-		i++
+		cmds = append(cmds, StartNACK|0x08|int16(d.id&3))
 		start = StartHS
 	}
 	if a&i2cbus.A10 == 0 {
 		// 7b address
 		cmd := start | int16(a&0x7f)<<1
-		c.wstart[i] = cmd
-		c.rstart[i] = cmd | 1
-		i++
-		c.wn = int8(i)
-		c.rn = int8(i)
-	} else {
-		// 10b address
-		cmd0 := start | 0xf0 | int16(a&0x300)>>7
-		c.wstart[i] = cmd0
-		c.rstart[i] = cmd0
-		i++
-		cmd1 := Send | int16(a&0xff)
-		c.wstart[i] = cmd1
-		c.rstart[i] = cmd1
-		i++
-		c.wn = int8(i)
-		c.rstart[i] = cmd0 | 1
-		i++
-		c.rn = int8(i)
+		if read {
+			cmd |= 1
+		}
+		return append(cmds, cmd)
+	}
+	// 10b address
+	cmd0 := start | 0xf0 | int16(a&0x300)>>7
+	cmds = append(cmds, cmd0, Send|int16(a&0xff))
+	if read {
+		cmds = append(cmds, cmd0|1)
 	}
+	return cmds
+}
+
+// NewConn implements the i2cbus.Master interface.
+func (d *Master) NewConn(a i2cbus.Addr) i2cbus.Conn {
+	c := &conn{d: d, a: a}
+	c.wn = int8(len(d.AppendStart(c.wstart[:0], a, false)))
+	c.rn = int8(len(d.AppendStart(c.rstart[:0], a, true)))
 	return c
 }
 
@@ -97,6 +106,7 @@ func startWrite(c *conn) {
 	if !open {
 		c.open = true
 		c.d.Lock()
+		txnStart(c.d)
 	}
 	if !c.wr {
 		c.wr = true
@@ -108,15 +118,61 @@ func startWrite(c *conn) {
 	}
 }
 
+// logWrite appends p to the log of the current transaction used to retry it
+// after the arbitration loss. The log is disabled (logn < 0) if there is not
+// enough space in it or the transaction already contains a read operation.
+func logWrite(c *conn, p []byte) {
+	if c.logn < 0 {
+		return
+	}
+	if int(c.logn)+len(p) > len(c.log) {
+		c.logn = -1
+		return
+	}
+	c.logn += int16(copy(c.log[c.logn:], p))
+}
+
+// retry checks whether the operation that failed with the error err (try
+// times already) can be retried. If so, it waits for the bus idle state and
+// replays the logged part of the transaction (always starts the write if
+// start is true). Otherwise it resets the log.
+func retry(c *conn, err error, try int, start bool) bool {
+	d := c.d
+	if err == nil || !c.arbLost {
+		if err != nil {
+			c.logn = 0
+		}
+		return false
+	}
+	if try >= d.retries || c.logn < 0 {
+		atomic.AddUint32(&d.stats.Failed, 1)
+		c.logn = 0
+		return false
+	}
+	atomic.AddUint32(&d.stats.Retries, 1)
+	waitBusIdle(d)
+	if c.logn != 0 || start {
+		startWrite(c)
+		d.Write(c.log[:c.logn])
+	}
+	return true
+}
+
 // Write implements the i2cbus.Conn interface and the io.Writer interface.
 func (c *conn) Write(p []byte) (n int, err error) {
-	startWrite(c)
-	if len(p) != 0 {
-		c.d.Write(p)
-		c.d.Flush() // ensure p isn't used after return
+	for try := 0; ; try++ {
+		startWrite(c)
+		if len(p) != 0 {
+			c.d.Write(p)
+			c.d.Flush() // ensure p isn't used after return
+		}
+		err = connErr(c)
+		if !retry(c, err, try, true) {
+			break
+		}
 	}
-	err = connErr(c)
 	if err == nil {
+		logWrite(c, p)
 		n = len(p)
 	}
 	return
@@ -129,10 +185,19 @@ func (c *conn) WriteString(s string) (n int, err error) {
 
 // WriteByte implements the i2cbus.Conn interface and the io.ByteWriter
 // interface.
-func (c *conn) WriteByte(b byte) error {
-	startWrite(c)
-	c.d.WriteCmd(Send | int16(b))
-	return connErr(c)
+func (c *conn) WriteByte(b byte) (err error) {
+	for try := 0; ; try++ {
+		startWrite(c)
+		c.d.WriteCmd(Send | int16(b))
+		err = connErr(c)
+		if !retry(c, err, try, true) {
+			break
+		}
+	}
+	if err == nil {
+		logWrite(c, []byte{b})
+	}
+	return
 }
 
 func startRead(c *conn, m int) {
@@ -140,12 +205,18 @@ func startRead(c *conn, m int) {
 	if !open {
 		c.open = true
 		c.d.Lock()
+		txnStart(c.d)
 	}
-	c.wr = false
 	i := 0
 	if open && c.rstart[0]>>8 == StartNACK>>8 {
 		i = 1 // already in the High Speed mode
 	}
+	if c.wr && c.a&i2cbus.A10 != 0 {
+		// The slave addressed by the preceding write remains addressed so
+		// the repeated Start with the first address byte is enough.
+		i = int(c.rn) - 1
+	}
+	c.wr = false
 	n := c.rn
 	if m != 0 {
 		c.rstart[n] = Recv | int16(m-1)
@@ -160,11 +231,18 @@ func (c *conn) Read(p []byte) (n int, err error) {
 	if n > 256 {
 		n = 256
 	}
-	startRead(c, n)
-	c.d.Read(p)
-	err = connErr(c)
+	for try := 0; ; try++ {
+		startRead(c, n)
+		c.d.Read(p)
+		err = connErr(c)
+		if !retry(c, err, try, false) {
+			break
+		}
+	}
 	if err != nil {
 		n = 0
+	} else {
+		c.logn = -1 // the read data can't be replayed
 	}
 	return
 }
@@ -172,39 +250,61 @@ func (c *conn) Read(p []byte) (n int, err error) {
 // ReadByte implements the i2cbus.Conn interface and the io.ByteReader
 // interface.
 func (c *conn) ReadByte() (b byte, err error) {
-	startRead(c, 1)
-	b = c.d.ReadByte()
-	err = connErr(c)
+	for try := 0; ; try++ {
+		startRead(c, 1)
+		b = c.d.ReadByte()
+		err = connErr(c)
+		if !retry(c, err, try, false) {
+			break
+		}
+	}
+	if err == nil {
+		c.logn = -1 // the read data can't be replayed
+	}
 	return
 }
 
 // Close implements the i2cbus.Conn interface and the io.Closer interface.
-func (c *conn) Close() error {
+func (c *conn) Close() (err error) {
 	if !c.open {
 		return nil // already closed
 	}
 	d := c.d
-	d.Clear(MSDF)
-	d.WriteCmd(Stop)
-	d.Wait(MSDF)
-	err := connErr(c)
+	for try := 0; ; try++ {
+		d.Clear(MSDF)
+		d.WriteCmd(Stop)
+		d.Wait(MSDF)
+		err = connErr(c)
+		if !retry(c, err, try, true) {
+			break
+		}
+	}
 	if err == nil {
+		txnEnd(d)
 		d.Unlock()
 		c.open = false
 		c.wr = false
 	}
+	c.logn = 0
 	return err
 }
 
 func connErr(c *conn) (err error) {
 	d := c.d
 	err = d.Err(true)
+	c.arbLost = false
 	if err != nil {
-		if err.(*MasterError).Status&MasterErrFlags == MNDF {
-			err = i2cbus.ErrACK
+		if e, ok := err.(*MasterError); ok {
+			switch {
+			case e.Status&MasterErrFlags == MNDF:
+				err = i2cbus.ErrACK
+			case e.Status&MALF != 0:
+				c.arbLost = true
+			}
 		}
 		err = &i2cbus.MasterError{Name: d.name, Err: err}
-		c.d.Unlock()
+		txnEnd(d)
+		d.Unlock()
 		c.open = false
 		c.wr = false
 	}
@@ -0,0 +1,38 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c
+
+type DriverError uint8
+
+const (
+	// ErrTimeout is returned by Err if the operation has been aborted because
+	// of the timeout.
+	ErrTimeout DriverError = iota + 1
+
+	// ErrCanceled is returned by Err if the operation has been aborted by the
+	// Cancel method.
+	ErrCanceled
+
+	// ErrBusStuck is returned by Recover if the bus couldn't be released.
+	ErrBusStuck
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrTimeout:
+		return "lpi2c: timeout"
+	case ErrCanceled:
+		return "lpi2c: canceled"
+	case ErrBusStuck:
+		return "lpi2c: bus stuck"
+	}
+	return ""
+}
+
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
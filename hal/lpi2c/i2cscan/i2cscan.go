@@ -0,0 +1,162 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package i2cscan allows to discover devices on the I2C bus. It probes 7-bit
+// addresses the same way the Linux i2cdetect tool does and can print the
+// results in the familiar i2cdetect grid.
+package i2cscan
+
+import (
+	"io"
+
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+)
+
+// Mode specifies the probing method.
+type Mode uint8
+
+const (
+	// Auto uses Read for the address ranges occupied by EEPROMs and similar
+	// devices that can be corrupted by the Quick Write (0x30-0x37, 0x50-0x5f)
+	// and Quick otherwise.
+	Auto Mode = iota
+
+	// Quick probes using the zero-length write transaction (SMBus Quick
+	// Command). It can confuse some write-only devices and can change the
+	// write protection state of some EEPROMs.
+	Quick
+
+	// Read probes using the one byte read transaction. It can lock the bus if
+	// used with some write-only devices.
+	Read
+)
+
+// Result describes the outcome of probing a single address.
+type Result uint8
+
+const (
+	NotProbed Result = iota // the address hasn't been probed
+	Absent                  // no device (NACK)
+	Present                 // device acknowledged its address
+	ArbLost                 // arbitration lost (another master on the bus?)
+	Timeout                 // timeout (SCL held low by a device?)
+	BusError                // other error
+)
+
+func (r Result) String() string {
+	switch r {
+	case NotProbed:
+		return "not probed"
+	case Absent:
+		return "absent"
+	case Present:
+		return "present"
+	case ArbLost:
+		return "arbitration lost"
+	case Timeout:
+		return "timeout"
+	case BusError:
+		return "bus error"
+	}
+	return ""
+}
+
+// Probe checks whether a device responds to the 7-bit address addr. Use
+// d.SetTimeout to avoid waiting forever for a device that holds SCL low. The
+// returned error is the one returned by d.Err, if any. Probe leaves the Rx FIFO
+// empty.
+func Probe(d *lpi2c.Master, addr uint8, mode Mode) (Result, error) {
+	a := int16(addr&0x7f) << 1
+	if mode == Auto {
+		mode = Quick
+		if addr >= 0x30 && addr <= 0x37 || addr >= 0x50 && addr <= 0x5f {
+			mode = Read
+		}
+	}
+	d.Lock()
+	if mode == Quick {
+		d.WriteCmd(lpi2c.Start | a)
+	} else {
+		d.WriteCmd(lpi2c.Start | a | 1)
+		d.WriteCmd(lpi2c.Recv | 0)
+		d.ReadByte()
+	}
+	d.Clear(lpi2c.MSDF)
+	d.WriteCmd(lpi2c.Stop)
+	d.Wait(lpi2c.MSDF)
+	err := d.Err(true)
+	if p := d.Periph(); p.MFSR.LoadBits(lpi2c.RXCOUNT) != 0 {
+		// Don't leave any received data for the next user of d.
+		p.MCR.SetBits(lpi2c.MRRF)
+	}
+	d.Unlock()
+	switch e := err.(type) {
+	case nil:
+		return Present, nil
+	case *lpi2c.MasterError:
+		switch {
+		case e.Status&lpi2c.MALF != 0:
+			return ArbLost, err
+		case e.Status&lpi2c.MPLTF != 0:
+			return Timeout, err
+		case e.Status&lpi2c.MNDF != 0:
+			return Absent, err
+		}
+	case lpi2c.DriverError:
+		if e.Timeout() {
+			return Timeout, err
+		}
+	}
+	return BusError, err
+}
+
+// Scan probes the addresses from first to last inclusive. The i2cdetect
+// default range is 0x08-0x77, the remaining addresses are reserved.
+func Scan(d *lpi2c.Master, first, last uint8, mode Mode) (res [128]Result) {
+	for a := int(first); a <= int(last) && a < len(res); a++ {
+		res[a], _ = Probe(d, uint8(a), mode)
+	}
+	return
+}
+
+// PrintGrid prints res as the i2cdetect grid. The found devices are printed
+// as their hexadecimal addresses, the absent ones as "--", the arbitration
+// loss as "AL", the timeout as "TO", other errors as "??".
+func PrintGrid(w io.Writer, res *[128]Result) error {
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, 3+16*3+1)
+	buf = append(buf, "   "...)
+	for i := 0; i < 16; i++ {
+		buf = append(buf, ' ', ' ', hex[i])
+	}
+	buf = append(buf, '\n')
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	for row := 0; row < len(res); row += 16 {
+		buf = append(buf[:0], hex[row>>4], '0', ':')
+		for a := row; a < row+16; a++ {
+			buf = append(buf, ' ')
+			switch res[a] {
+			case NotProbed:
+				buf = append(buf, ' ', ' ')
+			case Absent:
+				buf = append(buf, '-', '-')
+			case Present:
+				buf = append(buf, hex[a>>4], hex[a&15])
+			case ArbLost:
+				buf = append(buf, 'A', 'L')
+			case Timeout:
+				buf = append(buf, 'T', 'O')
+			default:
+				buf = append(buf, '?', '?')
+			}
+		}
+		buf = append(buf, '\n')
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -18,3 +18,12 @@ func NewMasterDMA(p *lpi2c.Periph) *lpi2c.Master {
 	dmairq.SetISR(dc, m.DMAISR)
 	return m
 }
+
+func NewSlaveDMA(p *lpi2c.Periph) *lpi2c.Slave {
+	d := dma.DMA(0)
+	d.EnableClock(true)
+	dc := d.AllocChannel(false)
+	s := lpi2c.NewSlave(p, dc)
+	dmairq.SetISR(dc, s.DMAISR)
+	return s
+}
@@ -0,0 +1,19 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c1dma
+
+import _ "unsafe"
+
+//go:interrupthandler
+func _LPI2C1_Handler() {
+	if master != nil {
+		master.ISR()
+	}
+	if slave != nil {
+		slave.ISR()
+	}
+}
+
+//go:linkname _LPI2C1_Handler IRQ28_Handler
@@ -0,0 +1,23 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c1dma
+
+import (
+	"embedded/rtos"
+
+	"github.com/embeddedgo/imxrt/hal/irq"
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+	"github.com/embeddedgo/imxrt/hal/lpi2c/internal"
+)
+
+var slave *lpi2c.Slave
+
+func Slave() *lpi2c.Slave {
+	if slave == nil {
+		slave = internal.NewSlaveDMA(lpi2c.LPI2C(1))
+		irq.LPI2C1.Enable(rtos.IntPrioLow, 0)
+	}
+	return slave
+}
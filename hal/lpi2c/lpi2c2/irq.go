@@ -0,0 +1,19 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c2
+
+import _ "unsafe"
+
+//go:interrupthandler
+func _LPI2C2_Handler() {
+	if master != nil {
+		master.ISR()
+	}
+	if slave != nil {
+		slave.ISR()
+	}
+}
+
+//go:linkname _LPI2C2_Handler IRQ29_Handler
@@ -6,7 +6,6 @@ package lpi2c2
 
 import (
 	"embedded/rtos"
-	_ "unsafe"
 
 	"github.com/embeddedgo/imxrt/hal/dma"
 	"github.com/embeddedgo/imxrt/hal/irq"
@@ -22,8 +21,3 @@ func Master() *lpi2c.Master {
 	}
 	return master
 }
-
-//go:interrupthandler
-func _LPI2C2_Handler() { master.ISR() }
-
-//go:linkname _LPI2C2_Handler IRQ29_Handler
@@ -0,0 +1,23 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c4
+
+import (
+	"embedded/rtos"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/irq"
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+)
+
+var slave *lpi2c.Slave
+
+func Slave() *lpi2c.Slave {
+	if slave == nil {
+		slave = lpi2c.NewSlave(lpi2c.LPI2C(4), dma.Channel{})
+		irq.LPI2C4.Enable(rtos.IntPrioLow, 0)
+	}
+	return slave
+}
@@ -6,7 +6,6 @@ package lpi2c4dma
 
 import (
 	"embedded/rtos"
-	_ "unsafe"
 
 	"github.com/embeddedgo/imxrt/hal/irq"
 	"github.com/embeddedgo/imxrt/hal/lpi2c"
@@ -22,8 +21,3 @@ func Master() *lpi2c.Master {
 	}
 	return master
 }
-
-//go:interrupthandler
-func _LPI2C4_Handler() { master.ISR() }
-
-//go:linkname _LPI2C4_Handler IRQ31_Handler
@@ -9,9 +9,12 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/internal/ccm"
+	"github.com/embeddedgo/imxrt/hal/iomux"
 )
 
 // A Master is a driver for the LPI2C peripheral. It provides two kinds of
@@ -61,6 +64,11 @@ import (
 // a case users of the low-level interface must gain an exclusive access to the
 // driver using the embedded mutex and wait for the Stop Condition before
 // unlocking the Master.
+//
+// Any method that waits for the ISR or DMA can be aborted because of the
+// timeout (see SetTimeout) or by calling Cancel from another goroutine. In
+// such case the driver resets the FIFOs, releases the bus and ignores all
+// subsequent methods calls until the error returned by Err is cleared.
 type Master struct {
 	sync.Mutex
 
@@ -82,7 +90,24 @@ type Master struct {
 	rn    int32
 	rdone rtos.Note
 
+	wev  uint32 // incremented by ISR before wdone.Wakeup
+	wev0 uint32 // value of wev when the write was scheduled
+	rev  uint32 // incremented by ISR before rdone.Wakeup
+	rev0 uint32 // value of rev when the read/wait was scheduled
+
+	cancel   uint32
+	err      error
+	timeout  time.Duration
+	deadline time.Time
+	txn      bool // multi-operation transaction in progress, deadline set
+
 	dma dma.Channel
+
+	scl, sda    iomux.Pin // set by UsePin, used by Recover
+	autoRecover bool
+
+	retries int
+	stats   Stats
 }
 
 // NewMaster returns a new master-mode driver for p. If valid DMA channel is
@@ -90,7 +115,7 @@ type Master struct {
 func NewMaster(p *Periph, dma dma.Channel) *Master {
 	return &Master{
 		name: string([]byte{'L', 'P', 'I', '2', 'C', '1' + byte(num(p))}),
-		p:    p, dma: dma,
+		p:    p, dma: dma, timeout: -1, scl: -1, sda: -1,
 	}
 }
 
@@ -104,11 +129,14 @@ func (d *Master) Periph() *Periph {
 // sclClk = clk / ((CLKHI + CLKLO + 2 + sclLatency) << divN)
 //
 // sclLatency = roundDown((2 + FILTSCL) >> divN)
+//
+// The predefined timings assume the default 60 MHz LPI2C clock root (see
+// Setup and NewSpeed for other clock configurations).
 const (
-	clk  = 60_000_000 // peripheral clock (PLL_USB1 / 8)
-	div2 = 1          // divide the 60 MHz clock by 2 (30 MHz)
-	div4 = 2          // divide the 60 MHz clock by 4 (15 MHz)
-	div8 = 3          // divide the 60 MHz clock by 8 (7.5 MHz)
+	clkNom = 60_000_000 // nominal peripheral clock (PLL_USB1 / 8)
+	div2   = 1          // divide the 60 MHz clock by 2 (30 MHz)
+	div4   = 2          // divide the 60 MHz clock by 4 (15 MHz)
+	div8   = 3          // divide the 60 MHz clock by 8 (7.5 MHz)
 
 	// Values copied from Table 47-5. LPI2C Example Timing Configurations.
 	fahs = 2<<30 | 17<<SETHOLDn | 40<<CLKLOn | 31<<CLKHIn | 8<<DATAVDn
@@ -134,6 +162,10 @@ const (
 
 // Speed encodes the timing configuration that determines the maximum
 // communication speed (the actual speed depends also on the SCL rise time).
+//
+// Encoding: bits 0-29 contain the MCCR0 fields, bits 6,7,14 contain the
+// prescaler, bits 30-33 contain the glitch filter length and bits 34-63
+// contain the MCCR1 fields (High Speed mode).
 type Speed uint64
 
 const (
@@ -153,14 +185,90 @@ const dmaSlots = "" +
 	string(rune(dma.LPI2C3)) +
 	string(rune(dma.LPI2C4))
 
-func (d *Master) Setup(sp Speed) {
+// NewSpeed calculates the timing configuration that gives the highest SCL
+// frequency not greater than freqHz for the current frequency of the LPI2C
+// clock root (LPI2C_CLK_ROOT, read from CCM). It returns the calculated Speed
+// and the achieved SCL frequency (assuming zero SCL rise time). The High Speed
+// mode timing is calculated for the highest frequency not greater than
+// 3.4 MHz allowed by the selected prescaler.
+func NewSpeed(freqHz int) (sp Speed, achievedHz int) {
+	clk := int(ccm.LPI2CClkRoot())
+	sp = calcSpeed(clk, freqHz)
+	return sp, sclFreq(clk, sp)
+}
+
+// sclTiming calculates CLKHI, CLKLO, SETHOLD, DATAVD for the SCL frequency
+// not greater than freq. It returns false if the CLKLO or CLKHI is out of
+// range.
+func sclTiming(pclk, lat, freq int) (t MCCR, ok bool) {
+	cycles := (pclk+freq-1)/freq - 2 - lat // CLKHI + CLKLO
+	clkhi := max(cycles/3, 1)              // CLKLO = 2 * CLKHI
+	clklo := max(cycles-clkhi, 2)
+	if clklo > 63 {
+		clkhi += clklo - 63
+		clklo = 63
+	}
+	ok = clkhi <= 63
+	clkhi = min(clkhi, 63)
+	sethold := max(clklo/2, 2)
+	datavd := max(clkhi/4, 1)
+	t = MCCR(datavd)<<DATAVDn | MCCR(sethold)<<SETHOLDn |
+		MCCR(clkhi)<<CLKHIn | MCCR(clklo)<<CLKLOn
+	return t, ok
+}
+
+// calcSpeed calculates the timing configuration for the peripheral clock clk.
+func calcSpeed(clk, freq int) Speed {
+	freq = max(freq, 1)
+	filt := min(clk/20e6, 15) // 50 ns glitch filter
+	for pre := 0; ; pre++ {
+		pclk := clk >> uint(pre)
+		lat := (2 + filt) >> uint(pre)
+		t, ok := sclTiming(pclk, lat, freq)
+		if !ok && pre < 7 {
+			continue
+		}
+		hs, _ := sclTiming(pclk, lat, 3.4e6)
+		return Speed(t) | Speed(filt)<<30 | Speed(pre&3)<<6 |
+			Speed(pre&4)<<12 | Speed(hs)<<34
+	}
+}
+
+// sclFreq returns the SCL frequency for the peripheral clock clk and the
+// timing configuration sp, assuming zero SCL rise time.
+func sclFreq(clk int, sp Speed) int {
+	pre := uint(sp>>6&3 | sp>>12&4)
+	lat := int(2+sp>>30&15) >> pre
+	cycles := int(MCCR(sp)>>CLKHIn&63+MCCR(sp)>>CLKLOn&63) + 2 + lat
+	return clk >> pre / cycles
+}
+
+// Setup enables the LPI2C clock, resets the peripheral and configures the
+// master timing according to sp. The predefined Speed constants are
+// recalculated (see NewSpeed) if the LPI2C clock root frequency differs from
+// the default 60 MHz. Setup returns the SCL frequency (assuming zero SCL rise
+// time).
+func (d *Master) Setup(sp Speed) int {
+	clk := int(ccm.LPI2CClkRoot())
+	if clk != clkNom {
+		switch sp {
+		case Slow50k:
+			sp = calcSpeed(clk, 50e3)
+		case Std100k:
+			sp = calcSpeed(clk, 100e3)
+		case Fast400k, FastHS:
+			sp = calcSpeed(clk, 400e3)
+		case FastPlus1M, FastPlusHS:
+			sp = calcSpeed(clk, 1e6)
+		}
+	}
 	p := d.p
 	p.EnableClock(true)
 	p.MCR.Store(MRST)
 	p.MCR.Store(0)
 	p.MCCR0.Store(MCCR(sp) & (DATAVD | SETHOLD | CLKHI | CLKLO))
 	p.MCCR1.Store(MCCR(sp>>34) & (DATAVD | SETHOLD | CLKHI | CLKLO))
-	pre := MCFGR1(sp) >> 6 & 3 // max. supported MPRESCALE is 3
+	pre := MCFGR1(sp)>>6&3 | MCFGR1(sp)>>12&4
 	p.MCFGR1.Store(pre << MPRESCALEn)
 	gf := MCFGR2(sp>>30) & 0xf // the used encoding supports MFILT <= 15
 	bi := (MCFGR2(sp)>>CLKLOn&63 + MCFGR2(sp)>>SETHOLDn&63 + 2) * 2
@@ -178,6 +286,40 @@ func (d *Master) Setup(sp Speed) {
 		dc.SetMux(dma.Mux(dmaSlots[num(d.p)]) | dma.En)
 	}
 	p.MCR.Store(MEN)
+	return sclFreq(clk, sp)
+}
+
+// SetPinLowTimeout enables the Pin Low Timeout detection (MSR[PLTF]) if t > 0
+// or disables it if t <= 0. If sda is true both SCL and SDA pins are
+// monitored, otherwise only SCL. It returns the actual timeout which may be
+// rounded down and is limited to the maximum supported by the prescaler set by
+// Setup. Call it after Setup.
+//
+// Be careful, the LPI2C master holds SCL low itself if it waits for the next
+// command/data in the Tx FIFO or for the free space in the Rx FIFO (see the
+// comment in Setup) so t should be much longer than any such pause. It's
+// intended mainly for SMBus that requires the 25-35 ms clock low timeout.
+func (d *Master) SetPinLowTimeout(t time.Duration, sda bool) time.Duration {
+	p := d.p
+	clk := int64(ccm.LPI2CClkRoot())
+	pre := uint(p.MCFGR1.LoadBits(MPRESCALE) >> MPRESCALEn)
+	unit := 256 << pre // prescaled clock cycles
+	n := int64(0)
+	if t > 0 {
+		t = min(t, 10*time.Second) // avoid overflow, more than max. anyway
+		n = clk * int64(t) / (int64(unit) * int64(time.Second))
+		n = min(n, int64(PINLOW>>PINLOWn))
+	}
+	mcr := p.MCR.Load()
+	p.MCR.Store(mcr &^ MEN)
+	if sda {
+		p.MCFGR1.SetBits(MTIMECFG)
+	} else {
+		p.MCFGR1.ClearBits(MTIMECFG)
+	}
+	p.MCFGR3.Store(MCFGR3(n) << PINLOWn)
+	p.MCR.Store(mcr)
+	return time.Duration(n * int64(unit) * int64(time.Second) / clk)
 }
 
 // MasterError contains value of the Master Status Register with one or more
@@ -204,16 +346,35 @@ func (e *MasterError) Error() string {
 	return "lpi2c master: " + strings.Join(es, ",")
 }
 
-// Err returns the content of the MSR register wrapped into the MasterError type
-// if any error flag (see MasterErrFlags) is set. Othewrise it returns nil.
-// If clear is true Err clears the Tx FIFO and the error flags in the MSR
-// register and if the LPI2C peripheral is in the busy state (MSR[MBF] is set)
-// it also releases the bus by writing the Stop command into Tx FIFO.
+// Err returns ErrTimeout or ErrCanceled if the last operation has been
+// aborted. Otherwise it returns the content of the MSR register wrapped into
+// the MasterError type if any error flag (see MasterErrFlags) is set. Othewrise
+// it returns nil. If clear is true Err clears the reported error. In case of
+// the MasterError it clears the Tx FIFO and the error flags in the MSR register
+// and if the LPI2C peripheral is in the busy state (MSR[MBF] is set) it also
+// releases the bus by writing the Stop command into Tx FIFO. If the automatic
+// bus recovery is enabled (see SetAutoRecover) and the Pin Low Timeout flag is
+// set Err performs the bus recovery instead (see Recover). Err with clear set
+// to true modifies the peripheral state so if the Master is shared by multiple
+// goroutines it must be called only by the goroutine that holds the lock (Err
+// doesn't lock the Master itself because it's typically called at the end of
+// the locked transaction).
 func (d *Master) Err(clear bool) error {
+	if err := d.err; err != nil {
+		if clear {
+			d.err = nil
+		}
+		return err
+	}
 	p := d.p
 	status := p.MSR.Load()
 	if e := status & MasterErrFlags; e != 0 {
-		if clear {
+		if clear && e&MALF != 0 {
+			atomic.AddUint32(&d.stats.ArbLost, 1)
+		}
+		if clear && e&MPLTF != 0 && d.autoRecover {
+			recoverBus(d)
+		} else if clear {
 			p.MCR.SetBits(MRTF) // clear Tx FIFOs
 			p.MSR.Store(e)      // clear the error flags
 			if p.MSR.LoadBits(MBF) != 0 {
@@ -225,6 +386,146 @@ func (d *Master) Err(clear bool) error {
 	return nil
 }
 
+// SetTimeout sets the timeout for every subsequent call of the method that
+// waits for the ISR or DMA. The transactions performed using the i2cbus.Conn
+// interface are timed as a whole. Use timeout < 0 to wait forever (default).
+func (d *Master) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// Cancel aborts the method that currently waits for the ISR or DMA. It is
+// intended to be called by another goroutine. It has no effect if there is no
+// operation in progress.
+func (d *Master) Cancel() {
+	atomic.StoreUint32(&d.cancel, 1)
+	d.wdone.Wakeup()
+	d.rdone.Wakeup()
+}
+
+// Stats contains the multi-master arbitration statistics.
+type Stats struct {
+	ArbLost uint32 // number of arbitration losses reported by Err
+	Retries uint32 // number of transactions retried by the i2cbus.Conn
+	Failed  uint32 // number of arbitration losses not followed by retry
+}
+
+// Stats returns the arbitration statistics. If reset is true the statistics
+// are reset after reading.
+func (d *Master) Stats(reset bool) (s Stats) {
+	if reset {
+		s.ArbLost = atomic.SwapUint32(&d.stats.ArbLost, 0)
+		s.Retries = atomic.SwapUint32(&d.stats.Retries, 0)
+		s.Failed = atomic.SwapUint32(&d.stats.Failed, 0)
+	} else {
+		s.ArbLost = atomic.LoadUint32(&d.stats.ArbLost)
+		s.Retries = atomic.LoadUint32(&d.stats.Retries)
+		s.Failed = atomic.LoadUint32(&d.stats.Failed)
+	}
+	return
+}
+
+// SetRetries sets the number of times the transaction performed using the
+// i2cbus.Conn interface (see NewConn) is retried after the arbitration loss
+// (default 0). Before retry the connection waits for the bus idle state and
+// replays the already written part of the transaction. Only transactions that
+// don't contain a read operation before the failed one and write no more than
+// 32 bytes before it can be retried.
+func (d *Master) SetRetries(n int) {
+	d.retries = n
+}
+
+// waitBusIdle waits for the end of the transaction performed by another
+// master. The LPI2C peripheral considers the bus idle if both SCL and SDA are
+// high for the time configured in MCFGR2[BUSIDLE] (set by Setup).
+func waitBusIdle(d *Master) {
+	end := time.Now().Add(stuckBusTimeout * time.Millisecond)
+	for d.p.MSR.LoadBits(MBBF) != 0 && time.Now().Before(end) {
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// begin prepares the driver to a new operation. It returns false if the
+// driver is in the error state.
+func begin(d *Master) bool {
+	if d.err != nil {
+		return false
+	}
+	if !d.txn {
+		setDeadline(d)
+	}
+	return true
+}
+
+// setDeadline sets the deadline of the operation or transaction that starts now.
+// It also forgets Cancel called when there was nothing in progress.
+func setDeadline(d *Master) {
+	atomic.StoreUint32(&d.cancel, 0)
+	if d.timeout >= 0 {
+		d.deadline = time.Now().Add(d.timeout)
+	} else {
+		d.deadline = time.Time{}
+	}
+}
+
+// txnStart starts the transaction that consists of multiple operations. The
+// deadline is set once for the whole transaction.
+func txnStart(d *Master) {
+	setDeadline(d)
+	d.txn = true
+}
+
+// txnEnd ends the transaction started by txnStart.
+func txnEnd(d *Master) {
+	d.txn = false
+}
+
+// sleep waits for the event signaled by ISR/DMAISR using the note n and the
+// event counter ev. The ev0 is the value of ev at the time the event has been
+// scheduled. It returns false if the operation has been aborted.
+func sleep(d *Master, n *rtos.Note, ev *uint32, ev0 uint32) bool {
+	for atomic.LoadUint32(ev) == ev0 {
+		if atomic.SwapUint32(&d.cancel, 0) != 0 {
+			abort(d, ErrCanceled)
+			return false
+		}
+		timeout := time.Duration(-1)
+		if !d.deadline.IsZero() {
+			if timeout = time.Until(d.deadline); timeout < 0 {
+				timeout = 0
+			}
+		}
+		if !n.Sleep(timeout) && atomic.LoadUint32(ev) == ev0 {
+			abort(d, ErrTimeout)
+			return false
+		}
+		n.Clear()
+	}
+	return true
+}
+
+// abort stops the ISR and DMA, resets the FIFOs and releases the bus.
+func abort(d *Master, err error) {
+	p := d.p
+	atomic.StoreInt32(&d.wn, 0)
+	atomic.StoreInt32(&d.rn, 0)
+	p.MIER.Store(0)
+	if dc := d.dma; dc.IsValid() {
+		dc.DisableReq()
+		for dc.TCD().CSR.LoadBits(dma.ACTIVE) != 0 {
+		}
+		dc.ClearInt()
+	}
+	p.MDER.Store(0)
+	p.MCR.SetBits(MRTF | MRRF)
+	if p.MSR.LoadBits(MBF) != 0 {
+		p.MTDR.Store(Stop) // release the bus
+	}
+	d.wcmds = nil
+	d.wdata = nil
+	d.rdata = nil
+	d.err = err
+}
+
 // WriteCmds starts writing commands into the Tx FIFO in the background using
 // interrupts and/or DMA. WriteCmd is no-op if len(cmds) == 0.
 //
@@ -243,7 +544,7 @@ func (d *Master) Err(clear bool) error {
 // passed to WriteCmds may also cause the FIFO error because there is no
 // guarantee that they will all get into the Tx FIFO on time.
 func (d *Master) WriteCmds(cmds []int16) {
-	if len(cmds) == 0 {
+	if len(cmds) == 0 || !begin(d) {
 		return
 	}
 	// Can't use DMA for commands because the DMA request/channel is shared
@@ -255,7 +556,7 @@ func (d *Master) WriteCmds(cmds []int16) {
 
 // Write is like WriteCmds but writes only Send commands with the provided data.
 func (d *Master) Write(p []byte) {
-	if len(p) == 0 {
+	if len(p) == 0 || !begin(d) {
 		return
 	}
 	if d.dma.IsValid() && len(p) >= 2*dma.MemAlign {
@@ -269,7 +570,7 @@ func (d *Master) Write(p []byte) {
 			masterWrite(d, ptr, dmaStart, false)
 		}
 		masterWriteDMA(d, dmaPtr, dmaN)
-		if dmaEnd == len(p) {
+		if dmaEnd == len(p) || d.err != nil {
 			return
 		}
 		p = p[dmaEnd:]
@@ -285,8 +586,11 @@ func (d *Master) WriteString(s string) {
 // WriteCmd works like WriteCmds but writes only one command word into the Tx
 // FIFO.
 func (d *Master) WriteCmd(cmd int16) {
-	if d.wn != 0 {
-		masterWaitWrite(d)
+	if !begin(d) {
+		return
+	}
+	if d.wn != 0 && !masterWaitWrite(d) {
+		return
 	}
 	p := d.p
 	if p.MFSR.LoadBits(TXCOUNT)>>TXCOUNTn != txFIFOLen {
@@ -296,6 +600,7 @@ func (d *Master) WriteCmd(cmd int16) {
 	d.wbuf = cmd
 	d.wcmds = &d.wbuf
 	d.wi = 0
+	d.wev0 = atomic.LoadUint32(&d.wev)
 	atomic.StoreInt32(&d.wn, 1)
 	// The ISR may already finish here so the next line may reenable IRQs.
 	p.MIER.Store(MTDF | MasterErrFlags)
@@ -308,19 +613,22 @@ const (
 
 const MasterErrFlags = MNDF | MALF | MFEF | MPLTF
 
-// Wait until the ISR will end the previously scheduled transfer.
-func masterWaitWrite(d *Master) {
+// Wait until the ISR will end the previously scheduled transfer. It returns
+// false if the transfer has been aborted.
+func masterWaitWrite(d *Master) bool {
 	// Wait for the ISR to end the previously scheduled transfer.
-	d.wdone.Sleep(-1)
-	d.wdone.Clear()
+	if !sleep(d, &d.wdone, &d.wev, d.wev0) {
+		return false
+	}
 	d.wcmds = nil
 	d.wdata = nil
 	d.wn = 0
+	return true
 }
 
 func masterWrite(d *Master, ptr unsafe.Pointer, n int, cmd bool) {
-	if d.wn != 0 {
-		masterWaitWrite(d)
+	if d.err != nil || d.wn != 0 && !masterWaitWrite(d) {
+		return
 	}
 	p := d.p
 	// To speed things up, first try to write directly into the FIFO.
@@ -346,6 +654,7 @@ func masterWrite(d *Master, ptr unsafe.Pointer, n int, cmd bool) {
 	}
 	// The remaining data/commands will be writtend to the FIFO by the ISR.
 	d.wi = 0
+	d.wev0 = atomic.LoadUint32(&d.wev)
 	atomic.StoreInt32(&d.wn, int32(n-i))
 	// The ISR may already finish here so the next line may reenable IRQs.
 	p.MIER.Store(MTDF | MasterErrFlags)
@@ -354,8 +663,8 @@ func masterWrite(d *Master, ptr unsafe.Pointer, n int, cmd bool) {
 const dmaMaxMajorIter = 1<<dma.ELINKn - 1 // = 32767
 
 func masterWriteDMA(d *Master, ptr unsafe.Pointer, n int) {
-	if d.wn != 0 {
-		masterWaitWrite(d)
+	if d.err != nil || d.wn != 0 && !masterWaitWrite(d) {
+		return
 	}
 	rtos.CacheMaint(rtos.DCacheFlush, ptr, n)
 	const dmaChunk = 4 // eqals 1 x S32b and 4 x D8b, <=txFIFOLen
@@ -386,19 +695,22 @@ func masterWriteDMA(d *Master, ptr unsafe.Pointer, n int) {
 			tcdio.ELINK_CITER.Store(int16(m))
 			tcdio.ELINK_BITER.Store(int16(m))
 		}
+		d.wev0 = atomic.LoadUint32(&d.wev)
 		dma.EnableReq() // accept DMA requests from Tx FIFO
 		if n == 0 {
 			break // we don't have to wait for the end of write
 		}
-		d.wdone.Sleep(-1) // wait until the major loop complete
-		d.wdone.Clear()
+		// Wait until the major loop complete.
+		if !sleep(d, &d.wdone, &d.wev, d.wev0) {
+			break
+		}
 	}
 }
 
 // Read reads len(p) data bytes from Rx FIFO. The read data is valid if Err
 // returns nil.
 func (d *Master) Read(p []byte) {
-	if len(p) == 0 {
+	if len(p) == 0 || !begin(d) {
 		return
 	}
 	if d.dma.IsValid() && len(p) >= 2*dma.MemAlign {
@@ -412,7 +724,7 @@ func (d *Master) Read(p []byte) {
 			masterRead(d, ptr, dmaStart)
 		}
 		masterReadDMA(d, unsafe.Pointer(dmaPtr), dmaN)
-		if dmaEnd == len(p) {
+		if dmaEnd == len(p) || d.err != nil {
 			return
 		}
 		p = p[dmaEnd:]
@@ -422,29 +734,34 @@ func (d *Master) Read(p []byte) {
 
 // ReadByte works like Read but reads only one byte from the Rx FIFO.
 func (d *Master) ReadByte() byte {
+	if !begin(d) {
+		return 0
+	}
 	p := d.p
 	v := p.MRDR.Load()
-	if v&RXEMPTY != 0 {
+	if v&RXEMPTY == 0 {
 		return byte(v)
 	}
 	d.rdata = &d.rbuf
 	d.ri = 0
 	p.MFCR.Store(0)
 	flags := MRDF | MasterErrFlags
+	d.rev0 = atomic.LoadUint32(&d.rev)
 	atomic.StoreInt32(&d.rn, 1)
 	if d.wn > 0 /* can avoid atomic.Load because of the above atomic.Store */ {
 		flags |= MTDF
 	}
 	// The ISR may already finish here so the next line may reenable IRQs.
 	p.MIER.Store(flags)
-	d.rdone.Sleep(-1)
-	d.rdone.Clear()
+	if !sleep(d, &d.rdone, &d.rev, d.rev0) {
+		return 0
+	}
 	return d.rbuf
 }
 
 func masterRead(d *Master, ptr *byte, n int) {
 	p := d.p
-	if p.MSR.Load()&MasterErrFlags != 0 {
+	if d.err != nil || p.MSR.Load()&MasterErrFlags != 0 {
 		return
 	}
 	// Avoid interrupts if there is data in the FIFO.
@@ -466,20 +783,20 @@ func masterRead(d *Master, ptr *byte, n int) {
 	d.ri = 0
 	p.MFCR.Store(MFCR(min(n, rxFIFOLen)-1) << RXWATERn)
 	flags := MRDF | MasterErrFlags
+	d.rev0 = atomic.LoadUint32(&d.rev)
 	atomic.StoreInt32(&d.rn, int32(n))
 	if d.wn > 0 /* can avoid atomic.Load because of the above atomic.Store */ {
 		flags |= MTDF
 	}
 	// The ISR may already finish here so the next line may reenable IRQs.
 	p.MIER.Store(flags)
-	d.rdone.Sleep(-1)
-	d.rdone.Clear()
+	sleep(d, &d.rdone, &d.rev, d.rev0)
 	d.rdata = nil
 }
 
 func masterReadDMA(d *Master, ptr unsafe.Pointer, n int) {
-	if d.wn == -2 {
-		masterWaitWrite(d) // wait for the end of DMA write
+	if d.err != nil || d.wn == -2 && !masterWaitWrite(d) {
+		return // aborted while waiting for the end of DMA write
 	}
 	rtos.CacheMaint(rtos.DCacheFlushInval, ptr, n)
 	const dmaChunk = 4 // equals 4 x S8b and 1 x D32b, <=rxFIFOLen
@@ -510,10 +827,10 @@ func masterReadDMA(d *Master, ptr unsafe.Pointer, n int) {
 			tcdio.ELINK_CITER.Store(int16(m))
 			tcdio.ELINK_BITER.Store(int16(m))
 		}
-		dma.EnableReq()   // accept DMA requests from Rx FIFO
-		d.rdone.Sleep(-1) // wait until the major loop complete
-		d.rdone.Clear()
-		if n == 0 {
+		d.rev0 = atomic.LoadUint32(&d.rev)
+		dma.EnableReq() // accept DMA requests from Rx FIFO
+		// Wait until the major loop complete.
+		if !sleep(d, &d.rdone, &d.rev, d.rev0) || n == 0 {
 			break
 		}
 	}
@@ -524,7 +841,7 @@ func masterReadDMA(d *Master, ptr unsafe.Pointer, n int) {
 // FIFO. Return from Flush doesn't mean the written commands/data were or even
 // will be executed/sent.
 func (d *Master) Flush() {
-	if d.wn != 0 {
+	if begin(d) && d.wn != 0 {
 		masterWaitWrite(d)
 	}
 }
@@ -560,7 +877,7 @@ func (d *Master) Clear(flags MSR) {
 // should clear the flag you want to wait for.
 func (d *Master) Wait(flags MSR) {
 	flags &= MEPF | MSDF | MDMF | MTDF
-	if flags == 0 {
+	if flags == 0 || !begin(d) {
 		return
 	}
 	flags |= MasterErrFlags
@@ -568,14 +885,14 @@ func (d *Master) Wait(flags MSR) {
 	if p.MSR.LoadBits(flags) != 0 {
 		return
 	}
+	d.rev0 = atomic.LoadUint32(&d.rev)
 	atomic.StoreInt32(&d.rn, -int32(flags))
 	if flags&MTDF == 0 && d.wn > 0 /* no atomic.Load because of the above atomic.Store */ {
 		flags |= MTDF
 	}
 	// The ISR may already finish here so the next line may reenable IRQs.
 	p.MIER.Store(flags)
-	d.rdone.Sleep(-1)
-	d.rdone.Clear()
+	sleep(d, &d.rdone, &d.rev, d.rev0)
 }
 
 // ISR is the interrupt handler for the LPI2C peripheral used by Master.
@@ -594,10 +911,12 @@ func (d *Master) ISR() {
 	if sr&MasterErrFlags != 0 {
 		if atomic.LoadInt32(&d.wn) > 0 {
 			d.wn = -1
+			atomic.StoreUint32(&d.wev, d.wev+1)
 			d.wdone.Wakeup()
 		}
 		if atomic.LoadInt32(&d.rn) != 0 {
 			d.rn = 0
+			atomic.StoreUint32(&d.rev, d.rev+1)
 			d.rdone.Wakeup()
 		}
 		return
@@ -623,6 +942,7 @@ func (d *Master) ISR() {
 		if m == n {
 			// Done
 			d.wn = -1 // avoid rentry because of possible race on MIER
+			atomic.StoreUint32(&d.wev, d.wev+1)
 			d.wdone.Wakeup()
 		} else {
 			ie = MTDF | MasterErrFlags
@@ -663,6 +983,7 @@ func (d *Master) ISR() {
 	}
 	if done {
 		d.rn = 0 // avoid rentry because of possible race on MIER
+		atomic.StoreUint32(&d.rev, d.rev+1)
 		d.rdone.Wakeup()
 	}
 
@@ -700,8 +1021,10 @@ func (d *Master) ISR() {
 func (d *Master) DMAISR() {
 	d.dma.ClearInt()
 	if atomic.LoadInt32(&d.wn) == -2 {
+		atomic.StoreUint32(&d.wev, d.wev+1)
 		d.wdone.Wakeup()
 	} else {
+		atomic.StoreUint32(&d.rev, d.rev+1)
 		d.rdone.Wakeup()
 	}
 }
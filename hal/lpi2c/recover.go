@@ -0,0 +1,128 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c
+
+import (
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/gpio"
+	"github.com/embeddedgo/imxrt/hal/iomux"
+)
+
+// Recover tries to release the I2C bus held by a slave device (typically a
+// slave that was reset or lost some clock pulses in the middle of the read
+// transaction and now holds SDA low). It temporarily switches the SCL and SDA
+// pins (configured by UsePin) to GPIO, generates up to nine SCL pulses until
+// the slave releases SDA, generates the Stop Condition, restores the pin mux
+// and resets the LPI2C master (the current configuration is preserved). It
+// also clears the error returned by Err. Recover returns ErrBusStuck if SCL or
+// SDA is still low at the end of the recovery procedure or the pins haven't
+// been configured by UsePin (in such case the recovery isn't performed).
+//
+// See also "I2C Stuck Bus: Prevention and Workarounds" (Analog Devices AN-686).
+func (d *Master) Recover() error {
+	d.Lock()
+	err := recoverBus(d)
+	d.Unlock()
+	return err
+}
+
+// SetAutoRecover enables or disables the automatic bus recovery (see Recover)
+// by the Err method if the Pin Low Timeout flag is set. The Pin Low Timeout
+// detection must be enabled using SetPinLowTimeout. See Err for the locking
+// requirements.
+func (d *Master) SetAutoRecover(en bool) {
+	d.autoRecover = en
+}
+
+const recoverHalfPeriod = 5 * time.Microsecond // 100 kHz
+
+func udelay(t time.Duration) {
+	end := time.Now().Add(t)
+	for time.Now().Before(end) {
+	}
+}
+
+// waitHigh waits for b to be released by all devices (SCL can be held low by
+// a slave that stretches the clock). It returns false on timeout.
+func waitHigh(b gpio.Bit) bool {
+	end := time.Now().Add(stuckBusTimeout * time.Millisecond)
+	for b.Load() == 0 {
+		if time.Now().After(end) {
+			return false
+		}
+	}
+	return true
+}
+
+func recoverBus(d *Master) error {
+	if d.scl < 0 || d.sda < 0 {
+		return ErrBusStuck // SCL/SDA pins not set by UsePin
+	}
+	p := d.p
+	p.MIER.Store(0)
+	mcr := p.MCR.Load()
+	p.MCR.Store(mcr &^ MEN)
+
+	sclAF, sdaAF := d.scl.AltFunc(), d.sda.AltFunc()
+	scl := gpio.UsePin(d.scl, false)
+	sda := gpio.UsePin(d.sda, false)
+	scl.Port().EnableClock(true)
+	sda.Port().EnableClock(true)
+	d.scl.SetAltFunc(iomux.GPIO | iomux.SION) // SION allows to sample SCL
+	d.sda.SetAltFunc(iomux.GPIO | iomux.SION)
+	// The pads are still configured as open-drain outputs with pull-ups.
+	scl.Set()
+	scl.SetDirOut(true)
+	sda.Set()
+	sda.SetDirOut(true)
+
+	ok := waitHigh(scl)
+	for i := 0; ok && i < 9 && sda.Load() == 0; i++ {
+		scl.Clear()
+		udelay(recoverHalfPeriod)
+		scl.Set()
+		ok = waitHigh(scl)
+		udelay(recoverHalfPeriod)
+	}
+	if ok {
+		// Generate the Stop Condition.
+		scl.Clear()
+		udelay(recoverHalfPeriod)
+		sda.Clear()
+		udelay(recoverHalfPeriod)
+		scl.Set()
+		ok = waitHigh(scl)
+		udelay(recoverHalfPeriod)
+		sda.Set()
+		udelay(recoverHalfPeriod)
+		ok = ok && sda.Load() != 0
+	}
+	scl.SetDirOut(false)
+	sda.SetDirOut(false)
+	d.scl.SetAltFunc(sclAF)
+	d.sda.SetAltFunc(sdaAF)
+
+	// Reset the master logic preserving its configuration.
+	mcfgr1 := p.MCFGR1.Load()
+	mcfgr2 := p.MCFGR2.Load()
+	mcfgr3 := p.MCFGR3.Load()
+	mccr0 := p.MCCR0.Load()
+	mccr1 := p.MCCR1.Load()
+	p.MCR.Store(MRST)
+	p.MCR.Store(0)
+	p.MCFGR1.Store(mcfgr1)
+	p.MCFGR2.Store(mcfgr2)
+	p.MCFGR3.Store(mcfgr3)
+	p.MCCR0.Store(mccr0)
+	p.MCCR1.Store(mccr1)
+	abort(d, nil) // reset the driver state
+	p.MSR.Store(MasterErrFlags | MEPF | MSDF | MDMF)
+	p.MCR.Store(mcr &^ (MRST | MRTF | MRRF))
+	if !ok {
+		return ErrBusStuck
+	}
+	return nil
+}
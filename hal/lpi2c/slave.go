@@ -0,0 +1,412 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpi2c
+
+import (
+	"embedded/rtos"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/internal/ccm"
+)
+
+// A Slave is a driver for the LPI2C peripheral used in slave mode. It allows
+// to emulate an I2C device (e.g. EEPROM, sensor, register file).
+//
+// The driver provides a transaction oriented interface. Every transfer
+// addressed to the slave (from START or repeated START to the next repeated
+// START or STOP) is handled in two steps. First, the Accept method waits for
+// the address match and returns the received address and the transfer
+// direction. Next, the Read method (master writes) or the Write method (master
+// reads) transfers the data. The slave stretches the SCL clock until the data
+// is provided or consumed by the goroutine that calls these methods so the
+// latency of the goroutine only slows down the bus.
+//
+// Example (register file emulation):
+//
+//	for {
+//		_, read, err := s.Accept()
+//		if err != nil {
+//			continue
+//		}
+//		if read {
+//			n, _ := s.Write(regs[reg:])
+//			reg += n
+//		} else if n, _ := s.Read(buf[:]); n != 0 {
+//			reg = int(buf[0])
+//			reg += copy(regs[reg:], buf[1:n])
+//		}
+//	}
+//
+// After Accept returns without error the Read or Write method (according to
+// the transfer direction) must be called to release the bus.
+type Slave struct {
+	p       *Periph
+	dma     dma.Channel
+	note    rtos.Note
+	buf     *byte
+	n       int32  // length of buf
+	i       int32  // number of bytes transfered by the ISR
+	dn      int32  // number of bytes transfered by DMA
+	state   uint32 // written by the thread mode code and the ISR
+	ev      uint32 // incremented by ISR before note.Wakeup
+	status  SSR    // error flags of the last transfer
+	cancel  uint32
+	timeout time.Duration
+}
+
+// Slave states.
+const (
+	slaveIdle = iota // waiting for address
+	slaveAddr        // address received, waiting for Accept
+	slaveRx          // master writes, slave receives
+	slaveTx          // master reads, slave transmits
+	slaveDone        // transfer ended by repeated START or STOP
+)
+
+const slaveErrFlags = SBEF | SFEF
+
+// SlaveError contains value of the Slave Status Register with one or more
+// error flags (SBEF, SFEF) set.
+type SlaveError struct {
+	Status SSR // value of the Slave Status Register
+}
+
+func (e *SlaveError) Error() string {
+	var a [2]string
+	es := a[:0:2]
+	if e.Status&SBEF != 0 {
+		es = append(es, "Bit")
+	}
+	if e.Status&SFEF != 0 {
+		es = append(es, "FIFO")
+	}
+	return "lpi2c slave: " + strings.Join(es, ",")
+}
+
+// NewSlave returns a new slave-mode driver for p. If valid DMA channel is
+// given, the DMA will be used for bigger data transfers. The DMA channel
+// shares the DMAMUX slot with the Master so the Master and the Slave of the
+// same peripheral must not use DMA at the same time.
+func NewSlave(p *Periph, dma dma.Channel) *Slave {
+	return &Slave{p: p, dma: dma, timeout: -1}
+}
+
+// Periph returns the underlying LPI2C peripheral.
+func (d *Slave) Periph() *Periph {
+	return d.p
+}
+
+// Setup enables the LPI2C clock, resets the slave logic and configures the
+// address matching. The cfg parameter selects the address configuration
+// (ADDRCFG_0 to ADDRCFG_7) and optional features (SGCEN, SHSMEN). The addr0
+// and addr1 parameters are the 7-bit or 10-bit slave addresses compared
+// against the received address, as described by ADDRCFG. Use ADDRCFG_2 to
+// respond to two addresses and ADDRCFG_6 to respond to the range of addresses
+// from addr0 to addr1. The slave is enabled at the end of Setup.
+func (d *Slave) Setup(cfg SCFGR1, addr0, addr1 uint16) {
+	p := d.p
+	p.EnableClock(true)
+	p.SCR.Store(SRST)
+	p.SCR.Store(0)
+	cfg &= SADDRCFG | SGCEN | SHSMEN
+	p.SCFGR1.Store(cfg | SADRSTALL | SRXSTALL | STXDSTALL)
+	clk := int(ccm.LPI2CClkRoot())
+	filt := SCFGR2(min(clk/20e6, 15))     // 50 ns glitch filter
+	datavd := SCFGR2(min(clk/10e6, 63))   // 100 ns data valid delay
+	clkhold := SCFGR2(min(clk/4e6+1, 15)) // 250 ns clock hold time
+	p.SCFGR2.Store(filt<<SFILTSDAn | filt<<SFILTSCLn | datavd<<SDATAVDn |
+		clkhold<<SCLKHOLDn)
+	p.SAMR.Store(SAMR(addr0)<<ADDR0n&ADDR0 | SAMR(addr1)<<ADDR1n&ADDR1)
+	if dc := d.dma; dc.IsValid() {
+		dc.DisableReq()
+		dc.DisableErrInt()
+		dc.ClearInt()
+		dc.SetMux(dma.Mux(dmaSlots[num(d.p)]) | dma.En)
+	}
+	d.state = slaveIdle
+	p.SIER.Store(SAVF)
+	p.SCR.Store(SEN | SFILTEN)
+}
+
+// SetTimeout sets the timeout for every subsequent call of the Accept, Read
+// and Write methods. Use timeout < 0 to wait forever (default).
+func (d *Slave) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// Cancel aborts the method that currently waits for the master. It is intended
+// to be called by another goroutine. If there is no such method in progress
+// the next one is aborted.
+func (d *Slave) Cancel() {
+	atomic.StoreUint32(&d.cancel, 1)
+	d.note.Wakeup()
+}
+
+// wait waits until the ISR sets the state different from st.
+func wait(d *Slave, st uint32) error {
+	timeout := d.timeout
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		ev := atomic.LoadUint32(&d.ev)
+		d.note.Clear()
+		if atomic.LoadUint32(&d.state) != st {
+			return nil
+		}
+		if atomic.SwapUint32(&d.cancel, 0) != 0 {
+			return ErrCanceled
+		}
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout < 0 {
+				timeout = 0
+			}
+		}
+		if !d.note.Sleep(timeout) && atomic.LoadUint32(&d.ev) == ev {
+			return ErrTimeout
+		}
+	}
+}
+
+// Accept waits for the transfer addressed to the slave. It returns the
+// received address (7-bit or 10-bit, 0 for the general call) and the transfer
+// direction (read is true if the master reads from the slave). The SCL clock
+// is stretched until the subsequent Read or Write call.
+func (d *Slave) Accept() (addr uint16, read bool, err error) {
+	if err = wait(d, slaveIdle); err != nil {
+		return
+	}
+	sasr := d.p.SASR.Load() // releases the address stall
+	if sasr&ANV != 0 {
+		// Should not happen.
+		endTransfer(d)
+		return 0, false, &SlaveError{d.p.SSR.Load()}
+	}
+	raddr := uint16(sasr & RADDR >> RADDRn)
+	return raddr >> 1, raddr&1 != 0, nil
+}
+
+// endTransfer returns the driver to the idle state and reenables the address
+// interrupt.
+func endTransfer(d *Slave) {
+	p := d.p
+	p.SIER.Store(0)
+	p.STAR.Store(0)
+	p.SCR.SetBits(SRTF) // discard the byte prefetched by Write (if any)
+	d.buf = nil
+	atomic.StoreUint32(&d.state, slaveIdle)
+	p.SIER.Store(SAVF)
+}
+
+// transfer performs the data phase of the transfer accepted by Accept.
+func transfer(d *Slave, buf []byte, st uint32) (n int, err error) {
+	p := d.p
+	p.SIER.Store(0)
+	d.buf = unsafe.SliceData(buf)
+	d.n = int32(len(buf))
+	d.i = 0
+	d.dn = 0
+	d.status = 0
+	p.STAR.Store(0)
+	ie := SRSF | SSDF | slaveErrFlags
+	dc := d.dma
+	if dc.IsValid() && len(buf) >= 2*dma.MemAlign {
+		n := len(buf)
+		if st == slaveRx {
+			n-- // the last byte is handled by ISR to NACK it
+		}
+		n = min(n, dmaMaxMajorIter)
+		d.dn = int32(n)
+		ptr := unsafe.Pointer(&buf[0])
+		tcd := dma.TCD{
+			ATTR:        dma.S8b | dma.D8b,
+			ML_NBYTES:   1,
+			ELINK_CITER: int16(n),
+			ELINK_BITER: int16(n),
+			CSR:         dma.DREQ | dma.INTMAJOR,
+		}
+		der := TDDE
+		if st == slaveRx {
+			rtos.CacheMaint(rtos.DCacheFlushInval, ptr, len(buf))
+			tcd.SADDR = unsafe.Pointer(p.SRDR.Addr())
+			tcd.DADDR = ptr
+			tcd.DOFF = 1
+			der = RDDE
+		} else {
+			rtos.CacheMaint(rtos.DCacheFlush, ptr, len(buf))
+			tcd.SADDR = ptr
+			tcd.SOFF = 1
+			tcd.DADDR = unsafe.Pointer(p.STDR.Addr())
+		}
+		dc.WriteTCD(&tcd)
+		dc.EnableReq()
+		p.SDER.Store(der)
+	} else if st == slaveRx {
+		if len(buf) <= 1 {
+			p.STAR.Store(TXNACK)
+		}
+		ie |= SRDF
+	} else {
+		ie |= STDF
+	}
+	atomic.StoreUint32(&d.state, st)
+	p.SIER.Store(ie)
+	err = wait(d, st)
+	if err != nil {
+		// Abort the transfer. Disabling the slave releases the stretched SCL.
+		p.SIER.Store(0)
+		stopDMA(d)
+		atomic.StoreUint32(&d.state, slaveDone)
+		p.SCR.Store(0)
+		p.SCR.Store(SEN | SFILTEN)
+	}
+	n = int(d.i)
+	if st == slaveRx && d.dn != 0 {
+		rtos.CacheMaint(rtos.DCacheInval, unsafe.Pointer(&buf[0]), len(buf))
+	}
+	if err == nil && d.status != 0 {
+		err = &SlaveError{d.status}
+	}
+	endTransfer(d)
+	return min(n, len(buf)), err
+}
+
+// Read receives the data written by the master into p. It returns the number
+// of received bytes when the master ends the transfer (repeated START or
+// STOP). The slave NACKs the last byte that fits in p. The subsequent bytes
+// (if the master ignores NACK) are discarded.
+func (d *Slave) Read(p []byte) (n int, err error) {
+	return transfer(d, p, slaveRx)
+}
+
+// Write sends the data from p to the master. It returns the number of bytes
+// loaded into the transmit data register when the master ends the transfer
+// (NACK followed by repeated START or STOP). The LPI2C loads the next byte
+// while the current one is being sent so n may exceed the number of bytes read
+// by the master by one. If the master reads more than len(p) bytes it receives
+// 0xFF.
+func (d *Slave) Write(p []byte) (n int, err error) {
+	return transfer(d, p, slaveTx)
+}
+
+// stopDMA stops the DMA and updates the number of transfered bytes.
+//
+//go:nosplit
+func stopDMA(d *Slave) {
+	dc := d.dma
+	if d.dn == 0 || !dc.IsValid() {
+		return
+	}
+	dc.DisableReq()
+	tcd := dc.TCD()
+	for tcd.CSR.LoadBits(dma.ACTIVE) != 0 {
+	}
+	d.p.SDER.Store(0)
+	n := d.dn
+	if tcd.CSR.LoadBits(dma.DONE) == 0 {
+		n -= int32(tcd.ELINK_CITER.Load())
+	}
+	d.i += n
+	d.dn = 0
+}
+
+// ISR handles the slave interrupts. It must be called from the LPI2C
+// interrupt handler if the Slave is used.
+//
+//go:nosplit
+//go:nowritebarrierrec
+func (d *Slave) ISR() {
+	p := d.p
+	ie := p.SIER.Load()
+	p.SIER.Store(0) // disable all IRQs and fix it later
+	if ie == 0 {
+		return // blocked by the thread mode code
+	}
+	sr := p.SSR.Load()
+	st := atomic.LoadUint32(&d.state)
+	switch st {
+	case slaveRx:
+		if ie&SRDF != 0 && sr&SRDF != 0 {
+			b := byte(p.SRDR.Load())
+			if i := d.i; i < d.n {
+				*(*byte)(unsafe.Add(unsafe.Pointer(d.buf), i)) = b
+				d.i = i + 1
+				if i+2 == d.n {
+					p.STAR.Store(TXNACK) // NACK the last byte
+				}
+			}
+		}
+	case slaveTx:
+		if ie&STDF != 0 && sr&STDF != 0 {
+			b := byte(0xff)
+			if i := d.i; i < d.n {
+				b = *(*byte)(unsafe.Add(unsafe.Pointer(d.buf), i))
+			}
+			p.STDR.Store(uint32(b))
+			d.i++
+		}
+	}
+	if e := sr & slaveErrFlags; e != 0 {
+		p.SSR.Store(e)
+		d.status |= e
+	}
+	if (st == slaveRx || st == slaveTx) && sr&(SRSF|SSDF) != 0 {
+		// The end of the transfer.
+		p.SSR.Store(SRSF | SSDF)
+		stopDMA(d)
+		atomic.StoreUint32(&d.state, slaveDone)
+		atomic.StoreUint32(&d.ev, d.ev+1)
+		d.note.Wakeup()
+		return // the thread mode code will reenable the interrupts
+	}
+	if st == slaveIdle {
+		if sr&SAVF != 0 {
+			// The SCL is stalled until SASR is read by Accept.
+			p.SSR.Store(SRSF | SSDF)
+			atomic.StoreUint32(&d.state, slaveAddr)
+			atomic.StoreUint32(&d.ev, d.ev+1)
+			d.note.Wakeup()
+			return
+		}
+		p.SSR.Store(SRSF | SSDF)
+	}
+	if st == slaveAddr {
+		return
+	}
+	p.SIER.Store(ie)
+}
+
+// DMAISR is a DMA interrupt handler for the DMA channel used by Slave.
+//
+//go:nosplit
+//go:nowritebarrierrec
+func (d *Slave) DMAISR() {
+	d.dma.ClearInt()
+	p := d.p
+	ie := p.SIER.Load()
+	p.SIER.Store(0)
+	if d.dn == 0 {
+		p.SIER.Store(ie)
+		return // the transfer has already been ended by ISR
+	}
+	// Handle the rest of the transfer using ISR.
+	stopDMA(d)
+	if ie != 0 {
+		if atomic.LoadUint32(&d.state) == slaveRx {
+			if d.i+1 == d.n {
+				p.STAR.Store(TXNACK)
+			}
+			ie |= SRDF
+		} else {
+			ie |= STDF
+		}
+	}
+	p.SIER.Store(ie)
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smbus
+
+import (
+	"github.com/embeddedgo/device/bus/i2cbus"
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+)
+
+// DriverError represents the SMBus specific errors detected by the driver.
+type DriverError uint8
+
+const (
+	// ErrTimeout is returned if the SCL line has been held low longer than
+	// the SMBus clock low timeout (see Setup).
+	ErrTimeout DriverError = iota + 1
+
+	// ErrPEC is returned if the received Packet Error Code doesn't match the
+	// calculated one.
+	ErrPEC
+
+	// ErrBlockSize is returned if the block length is out of the 1-255 range
+	// or the byte count received from the device exceeds the buffer length.
+	ErrBlockSize
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrTimeout:
+		return "smbus: clock low timeout"
+	case ErrPEC:
+		return "smbus: PEC error"
+	case ErrBlockSize:
+		return "smbus: bad block size"
+	}
+	return ""
+}
+
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
+
+// busErr converts the error returned by lpi2c.Master.Err to the SMBus one.
+func busErr(err error) error {
+	if e, ok := err.(*lpi2c.MasterError); ok {
+		switch {
+		case e.Status&lpi2c.MPLTF != 0:
+			return ErrTimeout
+		case e.Status&lpi2c.MasterErrFlags == lpi2c.MNDF:
+			return i2cbus.ErrACK
+		}
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smbus
+
+// crc8 updates the Packet Error Code (CRC-8, polynomial x⁸+x²+x+1) with the
+// bytes from p.
+func crc8(crc byte, p ...byte) byte {
+	for _, b := range p {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// PEC returns the Packet Error Code calculated over all bytes of the SMBus
+// transaction in p, including the address bytes (the 7-bit address shifted
+// left with the R/W bit in the LSB).
+func PEC(p []byte) byte {
+	return crc8(0, p...)
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pmbus provides the PMBus command codes and the conversion functions
+// for the PMBus data formats (Linear, ULinear16, Direct). It doesn't depend
+// on any hardware so it can be used (and tested) on any platform.
+package pmbus
+
+import "math"
+
+// Selected PMBus command codes.
+const (
+	PAGE                = 0x00
+	OPERATION           = 0x01
+	ON_OFF_CONFIG       = 0x02
+	CLEAR_FAULTS        = 0x03
+	WRITE_PROTECT       = 0x10
+	CAPABILITY          = 0x19
+	VOUT_MODE           = 0x20
+	VOUT_COMMAND        = 0x21
+	VOUT_MAX            = 0x24
+	VOUT_MARGIN_HIGH    = 0x25
+	VOUT_MARGIN_LOW     = 0x26
+	COEFFICIENTS        = 0x30
+	VOUT_OV_FAULT_LIMIT = 0x40
+	VOUT_UV_FAULT_LIMIT = 0x44
+	IOUT_OC_FAULT_LIMIT = 0x46
+	OT_FAULT_LIMIT      = 0x4f
+	OT_WARN_LIMIT       = 0x51
+	VIN_OV_FAULT_LIMIT  = 0x55
+	VIN_UV_FAULT_LIMIT  = 0x59
+	STATUS_BYTE         = 0x78
+	STATUS_WORD         = 0x79
+	STATUS_VOUT         = 0x7a
+	STATUS_IOUT         = 0x7b
+	STATUS_INPUT        = 0x7c
+	STATUS_TEMP         = 0x7d
+	STATUS_CML          = 0x7e
+	READ_VIN            = 0x88
+	READ_IIN            = 0x89
+	READ_VOUT           = 0x8b
+	READ_IOUT           = 0x8c
+	READ_TEMPERATURE_1  = 0x8d
+	READ_TEMPERATURE_2  = 0x8e
+	READ_FAN_SPEED_1    = 0x90
+	READ_DUTY_CYCLE     = 0x94
+	READ_FREQUENCY      = 0x95
+	READ_POUT           = 0x96
+	READ_PIN            = 0x97
+	PMBUS_REVISION      = 0x98
+	MFR_ID              = 0x99
+	MFR_MODEL           = 0x9a
+	MFR_REVISION        = 0x9b
+)
+
+// Linear decodes the value in the Linear data format (11-bit two's complement
+// mantissa in bits 0-10, 5-bit two's complement exponent in bits 11-15).
+func Linear(v uint16) float64 {
+	m := int(int16(v<<5) >> 5)
+	e := int(int16(v) >> 11)
+	return math.Ldexp(float64(m), e)
+}
+
+// ToLinear encodes x in the Linear data format using the smallest exponent
+// that allows to represent x (so with the best possible precision). The values
+// out of range are saturated.
+func ToLinear(x float64) uint16 {
+	e := -16
+	m := math.Round(math.Ldexp(x, -e))
+	for (m < -1024 || m > 1023) && e < 15 {
+		e++
+		m = math.Round(math.Ldexp(x, -e))
+	}
+	m = math.Max(math.Min(m, 1023), -1024)
+	return uint16(e)<<11 | uint16(int(m))&0x7ff
+}
+
+// Mode returns the mode (bits 5-7) of the VOUT_MODE value.
+func Mode(voutMode uint8) int {
+	return int(voutMode >> 5)
+}
+
+// VOUT_MODE modes.
+const (
+	ModeLinear = 0
+	ModeVID    = 1
+	ModeDirect = 2
+	ModeIEEE   = 3 // IEEE 754 half precision (PMBus 1.3)
+)
+
+// ULinear16 decodes the output voltage related value in the ULinear16 data
+// format (16-bit unsigned mantissa) using the exponent from the VOUT_MODE
+// value (bits 0-4, two's complement).
+func ULinear16(v uint16, voutMode uint8) float64 {
+	e := int(int8(voutMode<<3) >> 3)
+	return math.Ldexp(float64(v), e)
+}
+
+// ToULinear16 encodes x in the ULinear16 data format using the exponent from
+// the VOUT_MODE value. The values out of range are saturated.
+func ToULinear16(x float64, voutMode uint8) uint16 {
+	e := int(int8(voutMode<<3) >> 3)
+	m := math.Round(math.Ldexp(x, -e))
+	return uint16(math.Max(math.Min(m, 65535), 0))
+}
+
+// Coeffs contains the coefficients of the Direct data format as returned by
+// the COEFFICIENTS command or specified in the device datasheet.
+//
+// X = (Y * 10^-R - B) / M, Y = (M * X + B) * 10^R
+type Coeffs struct {
+	M int16
+	B int16
+	R int8
+}
+
+// Decode converts the value y in the Direct data format to the real world
+// value.
+func (c Coeffs) Decode(y int16) float64 {
+	return (float64(y)*math.Pow10(-int(c.R)) - float64(c.B)) / float64(c.M)
+}
+
+// Encode converts the real world value x to the Direct data format. The
+// values out of range are saturated.
+func (c Coeffs) Encode(x float64) int16 {
+	y := math.Round((float64(c.M)*x + float64(c.B)) * math.Pow10(int(c.R)))
+	return int16(math.Max(math.Min(y, math.MaxInt16), math.MinInt16))
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pmbus
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLinear(t *testing.T) {
+	tests := []struct {
+		v uint16
+		x float64
+	}{
+		{0x0000, 0},
+		{0xca80, 5},           // e = -7, m = 640
+		{0xd3ff, 1023.0 / 64}, // e = -6, m = 1023
+		{0x07ff, -1},          // e = 0, m = -1
+		{0x0001, 1},           // e = 0, m = 1
+		{0x7bff, 1023 << 15},
+		{0x7c00, -1024 << 15},
+		{0x8001, 1.0 / 65536},
+	}
+	for _, tc := range tests {
+		if x := Linear(tc.v); x != tc.x {
+			t.Errorf("Linear(%#04x) = %g, want %g", tc.v, x, tc.x)
+		}
+	}
+}
+
+func TestToLinearRoundTrip(t *testing.T) {
+	for _, x := range []float64{
+		0, 1, -1, 5, 3.3, 12.05, -12.05, 0.001, -0.001, 1023, 1024, -1025,
+		65535, 1e6, -1e6, 3.3e7,
+	} {
+		v := ToLinear(x)
+		y := Linear(v)
+		// The 11-bit mantissa gives the relative error below 2^-10 (the
+		// absolute error below 2^-17 for the values near zero).
+		if d := math.Abs(y - x); d > math.Abs(x)/1024 && d > 1.0/(1<<17) {
+			t.Errorf("Linear(ToLinear(%g)) = %g (%#04x)", x, y, v)
+		}
+		if ToLinear(y) != v {
+			t.Errorf("ToLinear(%g) != %#04x", y, v)
+		}
+	}
+	// The smallest exponent gives the best precision.
+	if v := ToLinear(5); v != 0xca80 {
+		t.Errorf("ToLinear(5) = %#04x, want 0xca80", v)
+	}
+}
+
+func TestToLinearSaturation(t *testing.T) {
+	tests := []struct {
+		x float64
+		v uint16
+	}{
+		{1e9, 0x7bff},
+		{math.Inf(1), 0x7bff},
+		{-1e9, 0x7c00},
+		{math.Inf(-1), 0x7c00},
+		{1e-9, 0x8000},
+		{-1e-9, 0x8000},
+	}
+	for _, tc := range tests {
+		if v := ToLinear(tc.x); v != tc.v {
+			t.Errorf("ToLinear(%g) = %#04x, want %#04x", tc.x, v, tc.v)
+		}
+	}
+}
+
+func TestULinear16(t *testing.T) {
+	tests := []struct {
+		v    uint16
+		mode uint8
+		x    float64
+	}{
+		{0x0600, 0x17, 3},          // e = -9
+		{0x0600, 0x40 | 0x17, 3},   // the mode bits are ignored
+		{0x34d0, 0x14, 3.30078125}, // e = -12
+		{0xffff, 0x10, 65535.0 / 65536},
+		{0x0003, 0x01, 6}, // e = 1
+		{0x0000, 0x17, 0},
+	}
+	for _, tc := range tests {
+		if x := ULinear16(tc.v, tc.mode); x != tc.x {
+			t.Errorf(
+				"ULinear16(%#04x, %#02x) = %g, want %g",
+				tc.v, tc.mode, x, tc.x,
+			)
+		}
+		if v := ToULinear16(tc.x, tc.mode); v != tc.v {
+			t.Errorf(
+				"ToULinear16(%g, %#02x) = %#04x, want %#04x",
+				tc.x, tc.mode, v, tc.v,
+			)
+		}
+	}
+	if v := ToULinear16(3.3, 0x17); v != 1690 {
+		t.Errorf("ToULinear16(3.3, 0x17) = %d, want 1690", v)
+	}
+	if v := ToULinear16(200, 0x17); v != 0xffff {
+		t.Errorf("ToULinear16(200, 0x17) = %#04x, want 0xffff", v)
+	}
+	if v := ToULinear16(-1, 0x17); v != 0 {
+		t.Errorf("ToULinear16(-1, 0x17) = %#04x, want 0", v)
+	}
+	if m := Mode(0x40 | 0x17); m != ModeDirect {
+		t.Errorf("Mode(0x57) = %d, want %d", m, ModeDirect)
+	}
+}
+
+func TestCoeffs(t *testing.T) {
+	c := Coeffs{M: 100, B: 50, R: 1}
+	if y := c.Encode(1.5); y != 2000 {
+		t.Errorf("Encode(1.5) = %d, want 2000", y)
+	}
+	if x := c.Decode(2000); math.Abs(x-1.5) > 1e-12 {
+		t.Errorf("Decode(2000) = %g, want 1.5", x)
+	}
+	c = Coeffs{M: 19995, B: 0, R: -1}
+	for _, x := range []float64{0, 0.5, 1, 1.5, -1.5, 12} {
+		y := c.Encode(x)
+		if d := math.Abs(c.Decode(y) - x); d > 10/19995.0 {
+			t.Errorf("Decode(Encode(%g)) = %g", x, c.Decode(y))
+		}
+	}
+	if y := c.Encode(1e3); y != math.MaxInt16 {
+		t.Errorf("Encode(1e3) = %d, want %d", y, math.MaxInt16)
+	}
+	if y := c.Encode(-1e3); y != math.MinInt16 {
+		t.Errorf("Encode(-1e3) = %d, want %d", y, math.MinInt16)
+	}
+}
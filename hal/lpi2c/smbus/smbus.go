@@ -0,0 +1,319 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package smbus implements the System Management Bus protocol on top of the
+// low-level interface of the LPI2C master driver. It supports all SMBus
+// command forms (except Host Notify), the optional Packet Error Checking and
+// the clock low timeout.
+//
+// Example:
+//
+//	d := lpi2c1.Master()
+//	d.Setup(lpi2c.Std100k)
+//	smbus.Setup(d)
+//	gauge := smbus.NewDevice(d, 0x0b)
+//	gauge.SetPEC(true)
+//	v, err := gauge.ReadWordData(0x09) // Voltage
+package smbus
+
+import (
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/lpi2c"
+)
+
+// SMBus timing.
+const (
+	// ClockLowTimeout is the timeout used by Setup. SMBus requires the master
+	// to detect the SCL held low for more than 25-35 ms.
+	ClockLowTimeout = 30 * time.Millisecond
+
+	// countTimeout limits the time of waiting for the byte count of the block
+	// read (including the address phase and the clock stretching).
+	countTimeout = 100 * time.Millisecond
+)
+
+// AlertAddr is the SMBus Alert Response Address.
+const AlertAddr = 0x0c
+
+// Setup enables the SMBus clock low timeout detection in the LPI2C master.
+// Call it after d.Setup. It returns the actual timeout that should be checked
+// against the 25-35 ms range if the LPI2C clock prescaler (determined by the
+// selected speed) is small.
+func Setup(d *lpi2c.Master) time.Duration {
+	return d.SetPinLowTimeout(ClockLowTimeout, false)
+}
+
+// A Device represents an SMBus slave device.
+type Device struct {
+	d    *lpi2c.Master
+	addr uint8
+	pec  bool
+	cmds [6]int16
+	wbuf [2]byte
+	rbuf [2]byte
+}
+
+// NewDevice returns a new Device with the 7-bit address addr.
+func NewDevice(d *lpi2c.Master, addr uint8) *Device {
+	return &Device{d: d, addr: addr & 0x7f}
+}
+
+// Master returns the underlying LPI2C master driver.
+func (c *Device) Master() *lpi2c.Master {
+	return c.d
+}
+
+// Addr returns the 7-bit address of the device.
+func (c *Device) Addr() uint8 {
+	return c.addr
+}
+
+// SetPEC enables or disables the Packet Error Checking.
+func (c *Device) SetPEC(en bool) {
+	c.pec = en
+}
+
+// PEC reports whether the Packet Error Checking is enabled.
+func (c *Device) PEC() bool {
+	return c.pec
+}
+
+// stop generates the Stop Condition, waits for it and unlocks the master.
+func stop(d *lpi2c.Master) error {
+	d.Clear(lpi2c.MSDF)
+	d.WriteCmd(lpi2c.Stop)
+	d.Wait(lpi2c.MSDF)
+	err := d.Err(true)
+	d.Unlock()
+	return busErr(err)
+}
+
+// transfer performs the SMBus transaction that consists of the write phase
+// (the command code if cmd >= 0, the byte count if block is true and the data
+// bytes w) followed by the read phase if r != nil (len(r) bytes). The PEC byte
+// is appended to the last phase if enabled.
+func transfer(c *Device, cmd int, block bool, w, r []byte) error {
+	d := c.d
+	a := int16(c.addr) << 1
+	d.Lock()
+	cs := c.cmds[:0]
+	crc := byte(0)
+	if cmd >= 0 || len(w) != 0 || r == nil {
+		cs = append(cs, lpi2c.Start|a)
+		crc = crc8(crc, byte(a))
+		if cmd >= 0 {
+			cs = append(cs, lpi2c.Send|int16(cmd))
+			crc = crc8(crc, byte(cmd))
+		}
+		if block {
+			cs = append(cs, lpi2c.Send|int16(len(w)))
+			crc = crc8(crc, byte(len(w)))
+		}
+		d.WriteCmds(cs)
+		cs = cs[len(cs):] // the ISR may still use the written commands
+		d.Write(w)
+		crc = crc8(crc, w...)
+		if r == nil && c.pec {
+			d.WriteCmd(lpi2c.Send | int16(crc))
+		}
+	}
+	pec := byte(0)
+	if r != nil {
+		n := len(r)
+		if c.pec {
+			n++
+		}
+		cs = append(cs, lpi2c.Start|a|1, lpi2c.Recv|int16(n-1))
+		crc = crc8(crc, byte(a|1))
+		d.WriteCmds(cs)
+		d.Read(r)
+		if c.pec {
+			pec = d.ReadByte()
+		}
+	}
+	err := stop(d)
+	if err == nil && r != nil && c.pec && crc8(crc, r...) != pec {
+		err = ErrPEC
+	}
+	return err
+}
+
+// readCount polls the Rx FIFO for the byte count of the block read. It doesn't
+// use interrupts to minimize the latency because the remaining part of the
+// block must be requested before the first data byte is received.
+func readCount(d *lpi2c.Master) (cnt byte, ok bool) {
+	p := d.Periph()
+	deadline := time.Now().Add(countTimeout)
+	for {
+		if v := p.MRDR.Load(); v&lpi2c.RXEMPTY == 0 {
+			return byte(v), true
+		}
+		if p.MSR.LoadBits(lpi2c.MasterErrFlags) != 0 ||
+			time.Now().After(deadline) {
+			return 0, false
+		}
+	}
+}
+
+// blockRead performs the transaction that consists of the write phase (see
+// transfer) and the block read phase.
+func blockRead(c *Device, cmd int, wblock bool, w, r []byte) (n int, err error) {
+	d := c.d
+	a := int16(c.addr) << 1
+	d.Lock()
+	cs := c.cmds[:0]
+	cs = append(cs, lpi2c.Start|a, lpi2c.Send|int16(cmd))
+	crc := crc8(0, byte(a), byte(cmd))
+	if wblock {
+		cs = append(cs, lpi2c.Send|int16(len(w)))
+		crc = crc8(crc, byte(len(w)))
+		d.WriteCmds(cs)
+		cs = cs[len(cs):]
+		d.Write(w)
+		crc = crc8(crc, w...)
+	}
+	// Request two bytes: the byte count and the first data byte (or PEC). The
+	// remaining bytes are requested while the second one is being received.
+	cs = append(cs, lpi2c.Start|a|1, lpi2c.Recv|0, lpi2c.Recv|0)
+	crc = crc8(crc, byte(a|1))
+	d.WriteCmds(cs)
+	d.Flush()
+	cnt, ok := readCount(d)
+	if !ok {
+		err = stop(d)
+		if err == nil {
+			err = ErrTimeout
+		}
+		return 0, err
+	}
+	m := int(cnt) // the number of bytes to receive after the byte count
+	if c.pec {
+		m++
+	}
+	switch {
+	case int(cnt) > len(r):
+		d.ReadByte() // the second requested byte has been NACKed
+		stop(d)
+		return 0, ErrBlockSize
+	case m == 0:
+		d.ReadByte() // discard the superfluous byte
+	case m > 1:
+		d.WriteCmd(lpi2c.Recv | int16(m-2))
+	}
+	r = r[:cnt]
+	d.Read(r)
+	pec := byte(0)
+	if c.pec {
+		pec = d.ReadByte()
+	}
+	if err = stop(d); err != nil {
+		return 0, err
+	}
+	if c.pec && crc8(crc8(crc, cnt), r...) != pec {
+		return 0, ErrPEC
+	}
+	return int(cnt), nil
+}
+
+// Quick performs the Quick Command transaction. The read parameter is sent as
+// the R/W bit.
+func (c *Device) Quick(read bool) error {
+	d := c.d
+	a := int16(c.addr) << 1
+	if read {
+		a |= 1
+	}
+	d.Lock()
+	c.cmds[0] = lpi2c.Start | a
+	d.WriteCmds(c.cmds[:1])
+	return stop(d)
+}
+
+// SendByte performs the Send Byte transaction.
+func (c *Device) SendByte(b byte) error {
+	c.wbuf[0] = b
+	return transfer(c, -1, false, c.wbuf[:1], nil)
+}
+
+// ReceiveByte performs the Receive Byte transaction.
+func (c *Device) ReceiveByte() (b byte, err error) {
+	err = transfer(c, -1, false, nil, c.rbuf[:1])
+	return c.rbuf[0], err
+}
+
+// WriteByteData performs the Write Byte transaction.
+func (c *Device) WriteByteData(cmd, b byte) error {
+	c.wbuf[0] = b
+	return transfer(c, int(cmd), false, c.wbuf[:1], nil)
+}
+
+// ReadByteData performs the Read Byte transaction.
+func (c *Device) ReadByteData(cmd byte) (b byte, err error) {
+	err = transfer(c, int(cmd), false, nil, c.rbuf[:1])
+	return c.rbuf[0], err
+}
+
+// WriteWordData performs the Write Word transaction.
+func (c *Device) WriteWordData(cmd byte, v uint16) error {
+	c.wbuf[0] = byte(v)
+	c.wbuf[1] = byte(v >> 8)
+	return transfer(c, int(cmd), false, c.wbuf[:2], nil)
+}
+
+// ReadWordData performs the Read Word transaction.
+func (c *Device) ReadWordData(cmd byte) (v uint16, err error) {
+	err = transfer(c, int(cmd), false, nil, c.rbuf[:2])
+	return uint16(c.rbuf[0]) | uint16(c.rbuf[1])<<8, err
+}
+
+// ProcessCall performs the Process Call transaction.
+func (c *Device) ProcessCall(cmd byte, v uint16) (uint16, error) {
+	c.wbuf[0] = byte(v)
+	c.wbuf[1] = byte(v >> 8)
+	err := transfer(c, int(cmd), false, c.wbuf[:2], c.rbuf[:2])
+	return uint16(c.rbuf[0]) | uint16(c.rbuf[1])<<8, err
+}
+
+// WriteBlock performs the Block Write transaction. The length of p must be in
+// the 1-255 range (SMBus 2.0 devices accept up to 32 bytes).
+func (c *Device) WriteBlock(cmd byte, p []byte) error {
+	if len(p) == 0 || len(p) > 255 {
+		return ErrBlockSize
+	}
+	return transfer(c, int(cmd), true, p, nil)
+}
+
+// ReadBlock performs the Block Read transaction. It returns the number of
+// bytes read into p. ReadBlock returns ErrBlockSize if the byte count sent by
+// the device exceeds len(p).
+//
+// The remaining part of the block is requested by polling the LPI2C FIFO
+// during the reception of the first data byte so ReadBlock should be called
+// from a goroutine that isn't delayed by long running interrupt handlers.
+func (c *Device) ReadBlock(cmd byte, p []byte) (n int, err error) {
+	return blockRead(c, int(cmd), false, nil, p)
+}
+
+// BlockProcessCall performs the Block Write - Block Read Process Call
+// transaction. See WriteBlock and ReadBlock for more information.
+func (c *Device) BlockProcessCall(cmd byte, w, r []byte) (n int, err error) {
+	if len(w) == 0 || len(w) > 255 {
+		return 0, ErrBlockSize
+	}
+	return blockRead(c, int(cmd), true, w, r)
+}
+
+// Alert performs the Receive Byte transaction with the Alert Response Address
+// and returns the address of the device that asserted the SMBALERT# signal.
+// If more devices assert SMBALERT# the one with the lowest address wins the
+// arbitration and releases its SMBALERT#. Call Alert repeatedly as long as
+// the SMBALERT# line (usually connected to a GPIO pin configured to generate
+// an interrupt on the falling edge) remains low.
+func Alert(d *lpi2c.Master, pec bool) (addr uint8, err error) {
+	c := NewDevice(d, AlertAddr)
+	c.pec = pec
+	b, err := c.ReceiveByte()
+	return b >> 1, err
+}
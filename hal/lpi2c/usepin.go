@@ -37,6 +37,7 @@ func (p *Periph) Pins(sig Signal) []iomux.Pin {
 //
 // Only certain pins can be used forLPI2C peripheral (see datasheet). UsePin
 // returns true on succes or false if it isn't possible to use a pin as a sig.
+// The SCL and SDA pins are remembered for the bus recovery (see Recover).
 func (d *Master) UsePin(pin iomux.Pin, sig Signal) bool {
 	n := num(d.p)
 	af, sel, daisy := periph.AltFunc(pins[:], alts[:], n*5+int(sig), pin)
@@ -49,6 +50,12 @@ func (d *Master) UsePin(pin iomux.Pin, sig Signal) bool {
 		iosel[sel].Store(int32(daisy))
 	}
 	pin.Setup(iomux.Drive2 | iomux.OpenDrain | iomux.Pull | iomux.Up22k | iomux.Hys)
+	switch sig {
+	case SCL:
+		d.scl = pin
+	case SDA:
+		d.sda = pin
+	}
 	return true
 }
 
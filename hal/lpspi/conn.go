@@ -0,0 +1,366 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/gpio"
+)
+
+// A Conn represents a connection to the SPI slave device. It remembers the
+// device specific configuration (SPI mode, clock speed, bit order, word size,
+// chip select) so you don't have to build the TCR commands by yourself.
+//
+// The first transfer method called locks the Master and asserts the chip
+// select. The Close method deasserts the chip select and unlocks the Master so
+// all transfers between them are performed in one SPI transaction.
+//
+// The chip select can be controlled by the LPSPI peripheral (PCSx pin) or by
+// software (GPIO pin). The hardware controlled PCS is kept asserted between
+// the subsequent write-only transfers using the continuous transfer mode.
+// Because of the LPSPI bug described in WriteCmd the bidirectional transfers
+// (Read*, WriteRead*) can't use this mode. Instead, they are sent as frames of
+// up to 4096 bits that keep the PCS asserted from the preceding writes to the
+// end of the frame. So the PCS is deasserted after every bidirectional
+// transfer and every 4096 bits of the longer ones. The word sizes that don't
+// divide 32 and the BYSW mode aren't supported by the frame packing so in
+// such case the PCS is deasserted after every word of the bidirectional
+// transfer. Use the software controlled chip select for devices that require
+// the CS asserted during the whole transaction that contains reads.
+//
+// A Conn is not safe for concurrent use but different Conns can be used
+// concurrently by multiple goroutines.
+type Conn struct {
+	d    *Master
+	cmd  TCR
+	cs   gpio.Bit
+	wsz  int
+	fill uint32
+	open bool
+	cont bool // continuous transfer in progress (hardware PCS)
+}
+
+// NewConn returns a connection to the slave device. The mode parameter
+// specifies the SPI mode (CPOL, CPHA), the bit order (LSBF), the byte swap
+// (BYSW) and the hardware chip select (TPCSx). Other bits in mode are ignored.
+// The SCK prescaler is calculated so that the SCK frequency does not exceed
+// maxFreqHz (see also Master.BaseFreqHz). The wordSize specifies the number of
+// bits transfered for every element of the data buffer (from 8 to 32, the
+// Write and Read methods require wordSize <= 8, the Write16 and Read16
+// methods require wordSize <= 16). If cs is valid it is configured as the
+// output and used as the software controlled, active low chip select.
+func (d *Master) NewConn(mode TCR, maxFreqHz, wordSize int, cs gpio.Bit) *Conn {
+	if wordSize < 8 || wordSize > 32 {
+		panic("lpspi: bad word size")
+	}
+	mode &= CPOL | CPHA | LSBF | BYSW | TPCS
+	if cs.IsValid() {
+		cs.Set()
+		cs.SetDirOut(true)
+	}
+	return &Conn{
+		d:   d,
+		cmd: mode | prescaler(d.BaseFreqHz(), maxFreqHz),
+		cs:  cs,
+		wsz: wordSize,
+	}
+}
+
+// prescaler returns the smallest TCR prescaler that gives the SCK frequency
+// lower than or equal to clk for the base frequency base.
+func prescaler(base, clk int) TCR {
+	var x int
+	switch {
+	case clk < 0:
+		panic("lpspi: clock < 0")
+	case clk == 0:
+		x = 7
+	default:
+		x = (base+clk-1)/clk - 1
+		if x < 0 {
+			x = 0
+		}
+		x = bits.Len(uint(x))
+		if x > 7 {
+			x = 7
+		}
+	}
+	return TCR(x) << PRESCALEn
+}
+
+// Prescaler returns the TCR command with the PRESCALE field set to the
+// smallest prescaler that gives the SCK frequency lower than or equal to
+// maxFreqHz (see also BaseFreqHz).
+func (d *Master) Prescaler(maxFreqHz int) TCR {
+	return prescaler(d.BaseFreqHz(), maxFreqHz)
+}
+
+// Master returns the underlying Master.
+func (c *Conn) Master() *Master {
+	return c.d
+}
+
+// FreqHz returns the SCK frequency used by the connection.
+func (c *Conn) FreqHz() int {
+	return c.d.BaseFreqHz() >> (c.cmd & PRESCALE >> PRESCALEn)
+}
+
+// SetFill sets the word that is sent to the device by the Read* methods.
+// The default is 0.
+func (c *Conn) SetFill(w uint32) {
+	c.fill = w
+}
+
+func connOpen(c *Conn) {
+	if c.open {
+		return
+	}
+	c.open = true
+	c.cont = false
+	c.d.Lock()
+	c.d.Enable()
+	txnStart(c.d)
+	if c.cs.IsValid() {
+		c.cs.Clear()
+	}
+}
+
+// connCmd writes the command for the next transfer.
+func connCmd(c *Conn, write bool) {
+	cmd := c.cmd
+	if c.cont {
+		cmd |= CONTC
+	}
+	c.cont = false
+	if write {
+		cmd |= RXMSK
+		if !c.cs.IsValid() {
+			cmd |= CONT // keep PCS asserted
+			c.cont = true
+		}
+	}
+	c.d.WriteCmd(cmd, c.wsz)
+}
+
+func connErr(c *Conn) error {
+	err := c.d.Err(true)
+	if err != nil {
+		connEnd(c)
+	}
+	return err
+}
+
+func connEnd(c *Conn) {
+	d := c.d
+	if c.cont {
+		// The command with CONT and CONTC cleared ends the continuous
+		// transfer. PCS is deasserted after the last frame.
+		d.WriteCmd(c.cmd|RXMSK, c.wsz)
+	}
+	p := d.p
+	for p.FSR.LoadBits(TXCOUNT) != 0 || p.SR.LoadBits(MBF) != 0 {
+		if !stall(d) {
+			break
+		}
+	}
+	if c.cs.IsValid() {
+		c.cs.Set()
+	} else {
+		d.Disable()
+	}
+	c.open = false
+	c.cont = false
+	txnEnd(d)
+	d.Unlock()
+}
+
+func connWrite[T dataWord](c *Conn, out []T) error {
+	connOpen(c)
+	if len(out) != 0 {
+		connCmd(c, true)
+		write(c.d, out)
+	}
+	return connErr(c)
+}
+
+func connWriteRead[T dataWord](c *Conn, out, in []T) (int, error) {
+	connOpen(c)
+	n := min(len(out), len(in))
+	switch {
+	case n == 0:
+	case n > 1 && !c.cs.IsValid() && 32%c.wsz == 0 && c.cmd&BYSW == 0:
+		writeReadFrames(c, out[:n], in[:n])
+	default:
+		connCmd(c, false)
+		n = writeRead(c.d, out, in)
+	}
+	if err := connErr(c); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// maxFrame is the maximum frame size supported by the LPSPI (bits).
+const maxFrame = 4096
+
+// writeReadFrames performs the bidirectional transfer using the frames of up
+// to maxFrame bits. Up to 32/c.wsz elements are packed into every data word.
+func writeReadFrames[T dataWord](c *Conn, out, in []T) {
+	d := c.d
+	wsz := c.wsz
+	epw := 32 / wsz // elements per word
+	lsbf := c.cmd&LSBF != 0
+	for len(out) != 0 {
+		ne := min(len(out), maxFrame/wsz)
+		cmd := c.cmd
+		if c.cont {
+			cmd |= CONTC // the frame ends the continuous transfer
+		}
+		c.cont = false
+		d.WriteCmd(cmd, ne*wsz)
+		nw := (ne + epw - 1) / epw
+		for wr, rd := 0, 0; rd < nw; {
+			if wr < nw && wr-rd < fifoLen/2 {
+				d.WriteWord(pack(out[wr*epw:min(wr*epw+epw, ne)], wsz, lsbf))
+				wr++
+				continue
+			}
+			unpack(in[rd*epw:min(rd*epw+epw, ne)], d.ReadWord(), wsz, lsbf)
+			rd++
+			if d.err != nil {
+				return
+			}
+		}
+		out, in = out[ne:], in[ne:]
+	}
+}
+
+// pack packs the elements of s into one data word. The data words of the
+// frame are right-justified and shifted out starting from the MSB (LSB if
+// lsbf is true).
+func pack[T dataWord](s []T, wsz int, lsbf bool) (w uint32) {
+	mask := uint32(1)<<uint(wsz) - 1
+	if lsbf {
+		for i, e := range s {
+			w |= uint32(e) & mask << uint(i*wsz)
+		}
+		return
+	}
+	for _, e := range s {
+		w = w<<uint(wsz) | uint32(e)&mask
+	}
+	return
+}
+
+// unpack is the reverse of pack.
+func unpack[T dataWord](s []T, w uint32, wsz int, lsbf bool) {
+	mask := uint32(1)<<uint(wsz) - 1
+	if lsbf {
+		for i := range s {
+			s[i] = T(w & mask)
+			w >>= uint(wsz)
+		}
+		return
+	}
+	for i := len(s) - 1; i >= 0; i-- {
+		s[i] = T(w & mask)
+		w >>= uint(wsz)
+	}
+}
+
+func connRead[T dataWord](c *Conn, in []T) (int, error) {
+	for i := range in {
+		in[i] = T(c.fill)
+	}
+	return connWriteRead(c, in, in)
+}
+
+// Write implements the io.Writer interface.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if err = connWrite(c, p); err == nil {
+		n = len(p)
+	}
+	return
+}
+
+// WriteString implements the io.StringWriter interface.
+func (c *Conn) WriteString(s string) (n int, err error) {
+	return c.Write(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// WriteByte implements the io.ByteWriter interface.
+func (c *Conn) WriteByte(b byte) error {
+	buf := [1]byte{b}
+	return connWrite(c, buf[:])
+}
+
+// Read implements the io.Reader interface. It sends the fill word (see
+// SetFill) for every byte read.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return connRead(c, p)
+}
+
+// ReadByte implements the io.ByteReader interface.
+func (c *Conn) ReadByte() (byte, error) {
+	var buf [1]byte
+	_, err := connRead(c, buf[:])
+	return buf[0], err
+}
+
+// WriteRead writes n = min(len(out), len(in)) bytes from out and at the same
+// time reads n bytes into in.
+func (c *Conn) WriteRead(out, in []byte) (n int, err error) {
+	return connWriteRead(c, out, in)
+}
+
+// Write16 works like Write but for 16-bit words.
+func (c *Conn) Write16(p []uint16) (n int, err error) {
+	if err = connWrite(c, p); err == nil {
+		n = len(p)
+	}
+	return
+}
+
+// Read16 works like Read but for 16-bit words.
+func (c *Conn) Read16(p []uint16) (n int, err error) {
+	return connRead(c, p)
+}
+
+// WriteRead16 works like WriteRead but for 16-bit words.
+func (c *Conn) WriteRead16(out, in []uint16) (n int, err error) {
+	return connWriteRead(c, out, in)
+}
+
+// Write32 works like Write but for 32-bit words.
+func (c *Conn) Write32(p []uint32) (n int, err error) {
+	if err = connWrite(c, p); err == nil {
+		n = len(p)
+	}
+	return
+}
+
+// Read32 works like Read but for 32-bit words.
+func (c *Conn) Read32(p []uint32) (n int, err error) {
+	return connRead(c, p)
+}
+
+// WriteRead32 works like WriteRead but for 32-bit words.
+func (c *Conn) WriteRead32(out, in []uint32) (n int, err error) {
+	return connWriteRead(c, out, in)
+}
+
+// Close implements the io.Closer interface. It ends the current transaction:
+// waits for the end of the last transfer, deasserts the chip select and
+// unlocks the Master. Close returns nil if there is no transaction in
+// progress.
+func (c *Conn) Close() error {
+	if !c.open {
+		return nil
+	}
+	connEnd(c)
+	return c.d.Err(true)
+}
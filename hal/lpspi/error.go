@@ -0,0 +1,39 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi
+
+type DriverError uint8
+
+const (
+	// ErrTimeout is returned by Err if the transfer has been aborted because
+	// of the timeout. You can not determine the number of words transfered.
+	ErrTimeout DriverError = iota + 1
+
+	// ErrCanceled is returned by Err if the transfer has been aborted by the
+	// Cancel method.
+	ErrCanceled
+
+	// ErrOverflow is returned by the Slave's Recv* methods if some received
+	// data has been lost.
+	ErrOverflow
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrTimeout:
+		return "lpspi: timeout"
+	case ErrCanceled:
+		return "lpspi: canceled"
+	case ErrOverflow:
+		return "lpspi: Rx overflow"
+	}
+	return ""
+}
+
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
@@ -20,3 +20,13 @@ func NewMasterDMA(p *lpspi.Periph) *lpspi.Master {
 	dmairq.SetISR(txdma, m.TxDMAISR)
 	return m
 }
+
+func NewSlaveDMA(p *lpspi.Periph) *lpspi.Slave {
+	d := dma.DMA(0)
+	d.EnableClock(true)
+	rxdma := d.AllocChannel(false)
+	txdma := d.AllocChannel(false)
+	s := lpspi.NewSlave(p, rxdma, txdma)
+	dmairq.SetISR(rxdma, s.RxDMAISR)
+	return s
+}
@@ -2,6 +2,9 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package lpspi1dma provides the LPSPI1 drivers that use DMA. It can not
+// be imported together with the lpspi1 package because both define the
+// LPSPI1 interrupt handler.
 package lpspi1dma
 
 import (
@@ -0,0 +1,29 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi1dma
+
+import (
+	"embedded/rtos"
+	_ "unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/irq"
+	"github.com/embeddedgo/imxrt/hal/lpspi"
+	"github.com/embeddedgo/imxrt/hal/lpspi/internal"
+)
+
+var slave *lpspi.Slave
+
+func Slave() *lpspi.Slave {
+	if slave == nil {
+		slave = internal.NewSlaveDMA(lpspi.LPSPI(1))
+		irq.LPSPI1.Enable(rtos.IntPrioLow, 0)
+	}
+	return slave
+}
+
+//go:interrupthandler
+func _LPSPI1_Handler() { slave.ISR() }
+
+//go:linkname _LPSPI1_Handler IRQ32_Handler
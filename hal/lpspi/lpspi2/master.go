@@ -2,6 +2,9 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package lpspi2 provides the LPSPI2 drivers that don't use DMA. It can
+// not be imported together with the lpspi2dma package because both define
+// the LPSPI2 interrupt handler.
 package lpspi2
 
 import (
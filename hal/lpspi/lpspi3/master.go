@@ -2,6 +2,9 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package lpspi3 provides the LPSPI3 drivers that don't use DMA. It can
+// not be imported together with the lpspi3dma package because both define
+// the LPSPI3 interrupt handler.
 package lpspi3
 
 import (
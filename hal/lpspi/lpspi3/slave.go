@@ -0,0 +1,29 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi3
+
+import (
+	"embedded/rtos"
+	_ "unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/irq"
+	"github.com/embeddedgo/imxrt/hal/lpspi"
+)
+
+var slave *lpspi.Slave
+
+func Slave() *lpspi.Slave {
+	if slave == nil {
+		slave = lpspi.NewSlave(lpspi.LPSPI(3), dma.Channel{}, dma.Channel{})
+		irq.LPSPI3.Enable(rtos.IntPrioLow, 0)
+	}
+	return slave
+}
+
+//go:interrupthandler
+func _LPSPI3_Handler() { slave.ISR() }
+
+//go:linkname _LPSPI3_Handler IRQ34_Handler
@@ -2,6 +2,9 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// Package lpspi4dma provides the LPSPI4 drivers that use DMA. It can not
+// be imported together with the lpspi4 package because both define the
+// LPSPI4 interrupt handler.
 package lpspi4dma
 
 import (
@@ -7,25 +7,48 @@ package lpspi
 import (
 	"embedded/rtos"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/internal/ccm"
 )
 
 // A Master is a driver to the LPSPI peripheral used in master mode.
+//
+// The transfer methods don't return errors (except the ones required to
+// implement the io.Reader and io.Writer interfaces). A transfer can be
+// aborted because of the timeout (see SetTimeout) or by calling Cancel from
+// another goroutine. In such case the driver resets the FIFOs and ignores all
+// subsequent transfers until the error is cleared using the Err method.
+//
+// The Master can be used directly or by the device connections (see NewConn).
+// Both interfaces may be used concurently by multiple goroutines but in such a
+// case users of the low-level interface must gain an exclusive access to the
+// driver using the embedded mutex.
 type Master struct {
-	p      *Periph
-	rxdma  dma.Channel
-	txdma  dma.Channel
-	done   rtos.Note
-	sckdiv uint16
-	slow   bool
+	sync.Mutex
+
+	p        *Periph
+	rxdma    dma.Channel
+	txdma    dma.Channel
+	done     rtos.Note
+	clk      int // LPSPI clock root frequency
+	sckdiv   uint16
+	slow     bool
+	cancel   uint32
+	err      error
+	timeout  time.Duration
+	deadline time.Time
+	txn      bool // multi-transfer transaction in progress, deadline set
 }
 
 // NewMaster returns a new master-mode driver for p. If valid DMA channels are
 // given, the DMA will be used for bigger data transfers.
 func NewMaster(p *Periph, rxdma, txdma dma.Channel) *Master {
-	return &Master{p: p, rxdma: rxdma, txdma: txdma}
+	return &Master{p: p, rxdma: rxdma, txdma: txdma, timeout: -1}
 }
 
 // Periph returns the underlying LPSPI peripheral.
@@ -62,15 +85,16 @@ func (d *Master) Disable() {
 }
 
 const (
-	clkRoot   = 133e6 // 480e6 * 18 / 13 / 5,  TODO: calculate from CCM?
-	fifoLen   = 16    // TODO: calculate from PARAM?
-	dmaBurst  = fifoLen * 3 / 4
-	slowPresc = clkRoot / 100e3
+	fifoLen  = 16 // TODO: calculate from PARAM?
+	dmaBurst = fifoLen * 3 / 4
+	slowFreq = 100e3 // SCK frequency below which busy waiting yields
 )
 
 // Setup enables the SPI clock, resets the peripheral and sets the base SCK
-// clock frequency to baseFreqHz rounded down to 133/n MHz, where n is an
-// integer number from 2 to 257. The LPSPI controller is configured as master
+// clock frequency to baseFreqHz rounded down to clkRoot/n, where clkRoot is
+// the current frequency of the LPSPI clock root (LPSPI_CLK_ROOT, read from
+// CCM) and n is an integer number from 2 to 257. It returns the achieved base
+// frequency (see also BaseFreqHz). The LPSPI controller is configured as master
 // (CFGR1=MASTER). Other configuration registers have their default values. For
 // custom configuration use the Periph method to access configuration registers.
 // Different slave devices on the bust may require different SPI mode (CPOL,
@@ -78,11 +102,13 @@ const (
 // transaction (see WriteCmd). The resulting SPI clock frequency should not
 // exceed 30 MHz (33 MHz seems to work as well and there are reports that even
 // 60 MHz is achievable).
-func (d *Master) Setup(baseFreqHz int) {
+func (d *Master) Setup(baseFreqHz int) int {
 	p := d.p
 	p.EnableClock(true)
 	p.Reset()
 	p.CFGR1.Store(MASTER)
+	clkRoot := int(ccm.LPSPIClkRoot())
+	d.clk = clkRoot
 	switch {
 	case baseFreqHz > clkRoot/2:
 		baseFreqHz = clkRoot / 2
@@ -110,12 +136,149 @@ func (d *Master) Setup(baseFreqHz int) {
 		rxdma.SetMux(dma.Mux(rxDMASlots[num(d.p)]) | dma.En)
 		p.DER.SetBits(RDDE)
 	}
+	return d.BaseFreqHz()
 }
 
 // BaseFreqHz returns the base frequency configured by the Setup method.
 func (d *Master) BaseFreqHz() int {
 	div := int(d.sckdiv)
-	return (clkRoot + div - 1) / div
+	return d.clk / div
+}
+
+// SetTimeout sets the timeout for every subsequent call of a transfer method.
+// The transfer method that does not complete before the timeout is aborted.
+// The Conn, Queue and Wide* transactions are timed as a whole. Use timeout < 0
+// to wait forever (default).
+func (d *Master) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// Cancel aborts the transfer method currently in progress. It is intended to
+// be called by another goroutine. It has no effect if there is no transfer in
+// progress.
+func (d *Master) Cancel() {
+	atomic.StoreUint32(&d.cancel, 1)
+	d.done.Wakeup()
+}
+
+// Err returns the error (ErrTimeout or ErrCanceled) that caused the abort of
+// the last transfer or nil if there was no error. If clear is true Err clears
+// the error so the driver can be used again.
+func (d *Master) Err(clear bool) error {
+	err := d.err
+	if clear {
+		d.err = nil
+	}
+	return err
+}
+
+// begin prepares the driver to a new transfer. It returns false if the driver
+// is in the error state.
+func begin(d *Master) bool {
+	if d.err != nil {
+		return false
+	}
+	if !d.txn {
+		setDeadline(d)
+	}
+	return true
+}
+
+// setDeadline sets the deadline of the transfer or transaction that starts now.
+// It also forgets Cancel called when there was nothing in progress.
+func setDeadline(d *Master) {
+	atomic.StoreUint32(&d.cancel, 0)
+	if d.timeout >= 0 {
+		d.deadline = time.Now().Add(d.timeout)
+	} else {
+		d.deadline = time.Time{}
+	}
+}
+
+// txnStart starts the transaction that consists of multiple transfers. The
+// deadline is set once for the whole transaction.
+func txnStart(d *Master) {
+	setDeadline(d)
+	d.txn = true
+}
+
+// txnEnd ends the transaction started by txnStart.
+func txnEnd(d *Master) {
+	d.txn = false
+}
+
+// stall is called by the busy waiting loops. It returns false if the current
+// transfer has been aborted.
+func stall(d *Master) bool {
+	if d.err != nil {
+		return false
+	}
+	if atomic.SwapUint32(&d.cancel, 0) != 0 {
+		abort(d, ErrCanceled)
+		return false
+	}
+	if !d.deadline.IsZero() && time.Now().After(d.deadline) {
+		abort(d, ErrTimeout)
+		return false
+	}
+	if d.slow {
+		runtime.Gosched()
+	}
+	return true
+}
+
+// waitDone waits for the end of the DMA transfer. It returns false if the
+// transfer has been aborted.
+func waitDone(d *Master) bool {
+	if atomic.LoadUint32(&d.cancel) == 0 {
+		timeout := time.Duration(-1)
+		if !d.deadline.IsZero() {
+			if timeout = time.Until(d.deadline); timeout < 0 {
+				timeout = 0
+			}
+		}
+		if d.done.Sleep(timeout) && atomic.LoadUint32(&d.cancel) == 0 {
+			return true
+		}
+	}
+	err := ErrTimeout
+	if atomic.SwapUint32(&d.cancel, 0) != 0 {
+		err = ErrCanceled
+	}
+	abort(d, err)
+	return false
+}
+
+// abort stops the DMA and resets the peripheral preserving its configuration.
+// The reset empties the FIFOs and ends the continuous transfer (if any).
+func abort(d *Master, err error) {
+	for _, c := range [2]dma.Channel{d.rxdma, d.txdma} {
+		if c.IsValid() {
+			c.DisableReq()
+			for c.TCD().CSR.LoadBits(dma.ACTIVE) != 0 {
+			}
+			c.ClearInt()
+		}
+	}
+	p := d.p
+	cr := p.CR.Load() &^ (RRF | RTF | RST)
+	ier := p.IER.Load()
+	der := p.DER.Load()
+	cfgr0 := p.CFGR0.Load()
+	cfgr1 := p.CFGR1.Load()
+	ccr := p.CCR.Load()
+	fcr := p.FCR.Load()
+	tcr := p.TCR.Load() &^ (CONT | CONTC)
+	p.Reset()
+	p.IER.Store(ier)
+	p.DER.Store(der)
+	p.CFGR0.Store(cfgr0)
+	p.CFGR1.Store(cfgr1)
+	p.CCR.Store(ccr)
+	p.FCR.Store(fcr)
+	p.CR.Store(cr)
+	p.TCR.Store(tcr)
+	d.err = err
 }
 
 // RxDMAISR should be configured as an Rx DMA interrupt handler if DMA is used
@@ -164,10 +327,13 @@ func (d *Master) TxDMAISR() {
 // error flag is set. If you next will read 1 word from the FIFO the LPSPI will
 // read next 2 words from the BUS (one of them is lost).
 func (d *Master) WriteCmd(cmd TCR, frameSize int) {
-	p, slow := d.p, d.slow
+	if !begin(d) {
+		return
+	}
+	p := d.p
 	for p.FSR.LoadBits(TXCOUNT) == fifoLen<<TXCOUNTn {
-		if slow {
-			runtime.Gosched()
+		if !stall(d) {
+			return
 		}
 	}
 	p.TCR.Store(cmd | TCR(frameSize-1)&FRAMESZ)
@@ -175,28 +341,34 @@ func (d *Master) WriteCmd(cmd TCR, frameSize int) {
 	// Calculate speed to decide whether use runtime.Gosched when busy waiting.
 	presc := cmd & PRESCALE >> PRESCALEn
 	width := cmd & WIDTH >> WIDTHn
-	d.slow = uint16(d.sckdiv)<<(presc+2-width) >= slowPresc<<2
+	d.slow = int(d.sckdiv)<<(presc+2-width) >= d.clk/slowFreq<<2
 }
 
 // WriteWord writes a 32-bit data word to the transmit FIFO, waiting for a free
 // FIFO slot if not available.
 func (d *Master) WriteWord(word uint32) {
-	p, slow := d.p, d.slow
+	if !begin(d) {
+		return
+	}
+	p := d.p
 	for p.FSR.LoadBits(TXCOUNT) == fifoLen<<TXCOUNTn {
-		if slow {
-			runtime.Gosched()
+		if !stall(d) {
+			return
 		}
 	}
 	p.TDR.Store(word)
 }
 
 // ReadWord reads a 32-bit data word from the receive FIFO, waiting for data if
-// not available.
+// not available. It returns 0 if the transfer has been aborted.
 func (d *Master) ReadWord() uint32 {
-	p, slow := d.p, d.slow
+	if !begin(d) {
+		return 0
+	}
+	p := d.p
 	for p.FSR.LoadBits(RXCOUNT) == 0 {
-		if slow {
-			runtime.Gosched()
+		if !stall(d) {
+			return 0
 		}
 	}
 	return p.RDR.Load()
@@ -214,7 +386,10 @@ type dataWord interface {
 // pointers instead of slices to speed things up (smaller code size, no bound
 // checking, only one increment operation in the loop).
 func writeReadCPU[T dataWord](d *Master, po, pi unsafe.Pointer, n int) {
-	p, slow := d.p, d.slow
+	if d.err != nil {
+		return
+	}
+	p := d.p
 	sz := int(unsafe.Sizeof(T(0)))
 	nr, nw := n, n
 	nf := fifoLen // how many words can be written to TDR to don't overflow RDR
@@ -246,20 +421,23 @@ func writeReadCPU[T dataWord](d *Master, po, pi unsafe.Pointer, n int) {
 				*(*T)(pi) = T(p.RDR.Load())
 			}
 		}
-		if mw+mr == 0 && slow {
-			runtime.Gosched()
+		if mw+mr == 0 && !stall(d) {
+			return
 		}
 	}
 	return
 }
 
 func writeCPU[T dataWord](d *Master, po unsafe.Pointer, n int) (end unsafe.Pointer) {
-	p, slow := d.p, d.slow
+	if d.err != nil {
+		return
+	}
+	p := d.p
 	sz := int(unsafe.Sizeof(T(0)))
 	for end = unsafe.Add(po, n*sz); po != end; po = unsafe.Add(po, sz) {
 		for p.FSR.LoadBits(TXCOUNT) == fifoLen<<TXCOUNTn {
-			if slow {
-				runtime.Gosched()
+			if !stall(d) {
+				return
 			}
 		}
 		p.TDR.Store(uint32(*(*T)(po)))
@@ -268,12 +446,15 @@ func writeCPU[T dataWord](d *Master, po unsafe.Pointer, n int) (end unsafe.Point
 }
 
 func readCPU[T dataWord](d *Master, pi unsafe.Pointer, n int) (end unsafe.Pointer) {
-	p, slow := d.p, d.slow
+	if d.err != nil {
+		return
+	}
+	p := d.p
 	sz := int(unsafe.Sizeof(T(0)))
 	for end = unsafe.Add(pi, n*sz); pi != end; pi = unsafe.Add(pi, sz) {
 		for p.FSR.LoadBits(RXCOUNT) == 0 {
-			if slow {
-				runtime.Gosched()
+			if !stall(d) {
+				return
 			}
 		}
 		*(*T)(pi) = T(p.RDR.Load())
@@ -313,6 +494,9 @@ func bidirSizes(po, pi unsafe.Pointer, n int, lsz uint) (ho, hi, dn, to, ti int)
 }
 
 func writeReadDMA(d *Master, po, pi unsafe.Pointer, n int, lsz uint) (npo, npi unsafe.Pointer) {
+	if d.err != nil {
+		return
+	}
 	burstBytes := dmaBurst << lsz
 	rtos.CacheMaint(rtos.DCacheFlush, po, n*burstBytes)
 	rtos.CacheMaint(rtos.DCacheFlushInval, pi, n*burstBytes)
@@ -372,7 +556,9 @@ func writeReadDMA(d *Master, po, pi unsafe.Pointer, n int, lsz uint) (npo, npi u
 		}
 		d.done.Clear()
 		rxdma.EnableReq() // accept DMA requests from Rx FIFO
-		d.done.Sleep(-1)  // wait until the Rx DMA major loop complete
+		if !waitDone(d) { // wait until the Rx DMA major loop complete
+			break
+		}
 	}
 
 	return
@@ -380,8 +566,8 @@ func writeReadDMA(d *Master, po, pi unsafe.Pointer, n int, lsz uint) (npo, npi u
 
 func writeRead[T dataWord](d *Master, out, in []T) (n int) {
 	n = min(len(out), len(in))
-	if n == 0 {
-		return
+	if n == 0 || !begin(d) {
+		return 0
 	}
 	po := unsafe.Pointer(unsafe.SliceData(out))
 	pi := unsafe.Pointer(unsafe.SliceData(in))
@@ -391,6 +577,9 @@ func writeRead[T dataWord](d *Master, out, in []T) (n int) {
 	// Use DMA only for long transfers. Short ones are handled by CPU.
 	if n <= 3*dma.MemAlign/sz || !d.rxdma.IsValid() || !d.txdma.IsValid() {
 		writeReadCPU[T](d, po, pi, n)
+		if d.err != nil {
+			n = 0
+		}
 		return
 	}
 
@@ -409,13 +598,17 @@ func writeRead[T dataWord](d *Master, out, in []T) (n int) {
 	pi = readCPU[T](d, pi, ti-to)
 	writeReadCPU[T](d, po, pi, to)
 
+	if d.err != nil {
+		n = 0
+	}
 	return
 }
 
 // WriteRead writes n = min(len(out), len(in)) bytes to the transmit FIFO,
 // zero-extending any byte to the full 32-bit FIFO word. At the same time it
 // reads the same number of bytes from the receive FIFO, using only the low
-// significant bytes from the available 32-bit FIFO words.
+// significant bytes from the available 32-bit FIFO words. It returns 0 if the
+// transfer has been aborted.
 func (d *Master) WriteRead(out, in []byte) (n int) {
 	return writeRead(d, out, in)
 }
@@ -451,6 +644,9 @@ func unidirSizes(ptr unsafe.Pointer, n int, lsz uint) (hn, dn, tn int) {
 }
 
 func writeDMA(d *Master, p unsafe.Pointer, n int, lsz uint) (np unsafe.Pointer) {
+	if d.err != nil {
+		return
+	}
 	burstBytes := dmaBurst << lsz
 	rtos.CacheMaint(rtos.DCacheFlush, p, n*burstBytes)
 
@@ -487,14 +683,16 @@ func writeDMA(d *Master, p unsafe.Pointer, n int, lsz uint) (np unsafe.Pointer)
 		}
 		d.done.Clear()
 		txdma.EnableReq() // accept DMA requests from Tx FIFO
-		d.done.Sleep(-1)  // wait until the major loop complete
+		if !waitDone(d) { // wait until the major loop complete
+			break
+		}
 	}
 
 	return
 }
 
 func write[T dataWord](d *Master, out []T) {
-	if len(out) == 0 {
+	if len(out) == 0 || !begin(d) {
 		return
 	}
 	po := unsafe.Pointer(unsafe.SliceData(out))
@@ -520,9 +718,13 @@ func write[T dataWord](d *Master, out []T) {
 }
 
 // Write implements the io.Writer interface. It works like Write32 but for 8-bit
-// words.
+// words. If the transfer has been aborted Write returns 0 and the error
+// returned by Err.
 func (d *Master) Write(p []byte) (int, error) {
 	write(d, p)
+	if d.err != nil {
+		return 0, d.err
+	}
 	return len(p), nil
 }
 
@@ -530,6 +732,9 @@ func (d *Master) Write(p []byte) (int, error) {
 // information.
 func (d *Master) WriteString(s string) (int, error) {
 	write(d, unsafe.Slice(unsafe.StringData(s), len(s)))
+	if d.err != nil {
+		return 0, d.err
+	}
 	return len(s), nil
 }
 
@@ -548,6 +753,9 @@ func (d *Master) Write32(p []uint32) {
 }
 
 func readDMA(d *Master, p unsafe.Pointer, n int, lsz uint) (np unsafe.Pointer) {
+	if d.err != nil {
+		return
+	}
 	burstBytes := dmaBurst << lsz
 	rtos.CacheMaint(rtos.DCacheFlushInval, p, n*burstBytes)
 
@@ -566,7 +774,7 @@ func readDMA(d *Master, p unsafe.Pointer, n int, lsz uint) (np unsafe.Pointer) {
 		ELINK_BITER: maxMajorIter,
 		CSR:         dma.DREQ | dma.INTMAJOR,
 	}
-	p = unsafe.Add(p, n*burstBytes)
+	np = unsafe.Add(p, n*burstBytes)
 	rxdma.WriteTCD(&tcd)
 
 	tcdio := rxdma.TCD()
@@ -582,14 +790,16 @@ func readDMA(d *Master, p unsafe.Pointer, n int, lsz uint) (np unsafe.Pointer) {
 		}
 		d.done.Clear()
 		rxdma.EnableReq() // accept DMA requests from Rx FIFO
-		d.done.Sleep(-1)  // wait until the major loop complete
+		if !waitDone(d) { // wait until the major loop complete
+			break
+		}
 	}
 
 	return
 }
 
 func read[T dataWord](d *Master, in []T) {
-	if len(in) == 0 {
+	if len(in) == 0 || !begin(d) {
 		return
 	}
 	pi := unsafe.Pointer(unsafe.SliceData(in))
@@ -622,6 +832,9 @@ func read[T dataWord](d *Master, in []T) {
 // configuration unusable (see WriteCmd for more information).
 func (d *Master) Read(p []byte) (int, error) {
 	read(d, p)
+	if d.err != nil {
+		return 0, d.err
+	}
 	return len(p), nil
 }
 
@@ -0,0 +1,356 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi
+
+import (
+	"embedded/rtos"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+)
+
+// An Xfer describes one SPI transaction executed by a Queue.
+//
+// The Cmd field specifies the command written to the TCR at the beginning of
+// the transaction: SPI mode, prescaler, chip select (TPCSx), frame size and
+// the CONT bit. If CONT is set the PCS stays asserted during the whole
+// transaction, otherwise it's deasserted after every frame. The CONTC, TXMSK
+// and RXMSK bits are ignored. The FRAMESZ field defaults to 8-bit frames if
+// zero.
+//
+// The Tx and Rx buffers contain words in the memory layout of the uint8,
+// uint16 or uint32 type, selected according to the frame size (up to 8, up to
+// 16 and more than 16 bits respectively). If Tx is nil the zero words are sent
+// and if Rx is nil the received data are discarded (RXMSK). If both are
+// provided they must be of the same length.
+type Xfer struct {
+	Cmd    TCR    // command
+	Tx     []byte // data to send
+	Rx     []byte // buffer for the received data
+	Notify bool   // generate an interrupt at the end of this transaction
+}
+
+// A Queue is a list of SPI transactions executed by DMA without the CPU
+// intervention. The DMA feeds the TCR with the prepared commands and the TDR
+// with the data using the chain of transfer control descriptors
+// (scatter/gather) so multiple devices on the bus can be serviced
+// back-to-back while the CPU is free to do other things.
+//
+// A Queue requires the Master with valid Rx and Tx DMA channels and their
+// interrupt handlers configured (see RxDMAISR, TxDMAISR). The Rx buffers
+// should be allocated using dma.MakeSlice and their length should be a
+// multiple of dma.MemAlign, otherwise the cache maintenance may corrupt the
+// memory that shares the cache lines with them.
+//
+// A Queue can be started multiple times. The transactions are prepared once
+// (see Add) so the queue of periodically executed transactions (e.g. sensor
+// polling) is cheap to restart.
+type Queue struct {
+	d       *Master
+	xfers   []Xfer
+	cmds    []uint32  // command words read by DMA
+	txc     []dma.TCD // Tx chain
+	rxc     []dma.TCD // Rx chain
+	ends    []int16   // completion TCD of every transaction: rxc[i] or txc[^i]
+	zero    *uint32   // source of the zero words for Rx-only transactions
+	fcr     FCR
+	ndone   int
+	running bool
+}
+
+// NewQueue returns a new empty queue for up to maxXfers transactions.
+func (d *Master) NewQueue(maxXfers int) *Queue {
+	if !d.rxdma.IsValid() || !d.txdma.IsValid() {
+		panic("lpspi: queue requires DMA")
+	}
+	return &Queue{
+		d:     d,
+		xfers: make([]Xfer, 0, maxXfers),
+		cmds:  dma.MakeSlice[uint32](0, 2*maxXfers),
+		txc:   dma.MakeSlice[dma.TCD](0, 3*maxXfers),
+		rxc:   dma.MakeSlice[dma.TCD](0, maxXfers),
+		ends:  make([]int16, 0, maxXfers),
+		zero:  dma.New[uint32](),
+	}
+}
+
+// Master returns the underlying Master.
+func (q *Queue) Master() *Master {
+	return q.d
+}
+
+// Len returns the number of transactions in the queue.
+func (q *Queue) Len() int {
+	return len(q.xfers)
+}
+
+// Reset removes all transactions from the queue.
+func (q *Queue) Reset() {
+	if q.running {
+		panic("lpspi: queue running")
+	}
+	q.xfers = q.xfers[:0]
+	q.cmds = q.cmds[:0]
+	q.txc = q.txc[:0]
+	q.rxc = q.rxc[:0]
+	q.ends = q.ends[:0]
+	q.ndone = 0
+}
+
+// Add adds the transaction x at the end of the queue. It panics if the queue
+// is full or running.
+func (q *Queue) Add(x Xfer) {
+	if q.running {
+		panic("lpspi: queue running")
+	}
+	if len(q.xfers) == cap(q.xfers) {
+		panic("lpspi: queue full")
+	}
+	cmd := x.Cmd &^ (CONTC | TXMSK | RXMSK)
+	if cmd&FRAMESZ == 0 {
+		cmd |= 8 - 1
+	}
+	lsz := uint(2)
+	switch fsz := cmd&FRAMESZ>>FRAMESZn + 1; {
+	case fsz <= 8:
+		lsz = 0
+	case fsz <= 16:
+		lsz = 1
+	}
+	n := len(x.Tx)
+	if x.Rx != nil {
+		if x.Tx != nil && len(x.Rx) != n {
+			panic("lpspi: Tx and Rx of different length")
+		}
+		n = len(x.Rx)
+	} else {
+		cmd |= RXMSK
+	}
+	if n == 0 || n&(1<<lsz-1) != 0 || n>>lsz > 1<<dma.ELINKn-1 {
+		panic("lpspi: bad transaction length")
+	}
+	n >>= lsz
+	size := dma.ATTR(lsz)
+
+	// Tx chain: the command, the data and the end of the continuous transfer.
+	q.cmds = append(q.cmds, uint32(cmd))
+	cmdTCD := dma.TCD{
+		SADDR:       unsafe.Pointer(&q.cmds[len(q.cmds)-1]),
+		ATTR:        dma.S32b | dma.D32b,
+		ML_NBYTES:   4,
+		DADDR:       unsafe.Pointer(q.d.p.TCR.Addr()),
+		ELINK_CITER: 1,
+		ELINK_BITER: 1,
+	}
+	q.txc = append(q.txc, cmdTCD)
+	src, soff := unsafe.Pointer(q.zero), int16(0)
+	if x.Tx != nil {
+		src, soff = unsafe.Pointer(&x.Tx[0]), 1<<lsz
+	}
+	q.txc = append(q.txc, dma.TCD{
+		SADDR:       src,
+		SOFF:        soff,
+		ATTR:        size<<dma.SSIZEn | size<<dma.DSIZEn,
+		ML_NBYTES:   1 << lsz,
+		DADDR:       unsafe.Pointer(q.d.p.TDR.Addr()),
+		ELINK_CITER: int16(n),
+		ELINK_BITER: int16(n),
+	})
+	if cmd&CONT != 0 {
+		// Clearing CONT deasserts PCS and releases the last received word
+		// (see the LPSPI BUGS in WriteCmd).
+		q.cmds = append(q.cmds, uint32(cmd&^CONT))
+		cmdTCD.SADDR = unsafe.Pointer(&q.cmds[len(q.cmds)-1])
+		q.txc = append(q.txc, cmdTCD)
+	}
+	end := ^int16(len(q.txc) - 1)
+	if x.Rx != nil {
+		q.rxc = append(q.rxc, dma.TCD{
+			SADDR:       unsafe.Pointer(q.d.p.RDR.Addr()),
+			ATTR:        size<<dma.SSIZEn | size<<dma.DSIZEn,
+			ML_NBYTES:   1 << lsz,
+			DADDR:       unsafe.Pointer(&x.Rx[0]),
+			DOFF:        1 << lsz,
+			ELINK_CITER: int16(n),
+			ELINK_BITER: int16(n),
+		})
+		end = int16(len(q.rxc) - 1)
+	}
+	q.ends = append(q.ends, end)
+	q.xfers = append(q.xfers, x)
+}
+
+// link links the TCDs of the chain c using scatter/gather and returns its
+// first TCD.
+func link(c []dma.TCD) *dma.TCD {
+	if len(c) == 0 {
+		return nil
+	}
+	last := len(c) - 1
+	for i := range c[:last] {
+		c[i].DLAST_SGA = int32(uintptr(unsafe.Pointer(&c[i+1])))
+		c[i].CSR = dma.ESG
+	}
+	c[last].DLAST_SGA = 0
+	c[last].CSR = dma.DREQ
+	return &c[0]
+}
+
+// Start starts executing the queued transactions. It locks the Master until
+// all transactions are completed or aborted (see Wait). The timeout set by
+// Master.SetTimeout applies to the whole queue.
+func (q *Queue) Start() {
+	if q.running {
+		panic("lpspi: queue running")
+	}
+	if len(q.xfers) == 0 {
+		return
+	}
+	d := q.d
+	d.Lock()
+	q.ndone = 0
+	if !begin(d) {
+		d.Unlock()
+		return
+	}
+	txnStart(d)
+	q.running = true
+	for _, x := range q.xfers {
+		if x.Tx != nil {
+			rtos.CacheMaint(rtos.DCacheFlush, unsafe.Pointer(&x.Tx[0]), len(x.Tx))
+		}
+		if x.Rx != nil {
+			rtos.CacheMaint(rtos.DCacheFlushInval, unsafe.Pointer(&x.Rx[0]), len(x.Rx))
+		}
+	}
+	rxtcd := link(q.rxc)
+	txtcd := link(q.txc)
+	last := len(q.xfers) - 1
+	for i, x := range q.xfers {
+		if x.Notify || i == last {
+			if e := q.ends[i]; e >= 0 {
+				q.rxc[e].CSR |= dma.INTMAJOR
+			} else {
+				q.txc[^e].CSR |= dma.INTMAJOR
+			}
+		}
+	}
+	cacheFlush(q.cmds)
+	cacheFlush(q.txc)
+	cacheFlush(q.rxc)
+
+	// Generate the Rx DMA request for every received word.
+	p := d.p
+	q.fcr = p.FCR.Load()
+	p.FCR.Store(q.fcr &^ RXWATER)
+	d.Enable()
+	d.done.Clear()
+	if rxtcd != nil {
+		d.rxdma.WriteTCD(rxtcd)
+		d.rxdma.EnableReq()
+	}
+	d.txdma.WriteTCD(txtcd)
+	d.txdma.EnableReq()
+}
+
+func cacheFlush[T any](s []T) {
+	if len(s) != 0 {
+		size := len(s) * int(unsafe.Sizeof(s[0]))
+		rtos.CacheMaint(rtos.DCacheFlush, unsafe.Pointer(&s[0]), size)
+	}
+}
+
+// chainPos returns the number of the completed TCDs of the chain c loaded into
+// the channel ch.
+func chainPos(ch dma.Channel, c []dma.TCD) int {
+	if len(c) == 0 {
+		return 0
+	}
+	tcd := ch.TCD()
+	sga := uintptr(uint32(tcd.DLAST_SGA.Load()))
+	if sga == 0 {
+		// The last TCD (all others have the next TCD address in DLAST_SGA).
+		n := len(c) - 1
+		if tcd.CSR.LoadBits(dma.DONE) != 0 {
+			n++
+		}
+		return n
+	}
+	return int((sga-uintptr(unsafe.Pointer(&c[0])))/unsafe.Sizeof(c[0])) - 1
+}
+
+// Done returns the number of the completed transactions. The completion of
+// the transaction without the Rx buffer means that all its data has been
+// written to the transmit FIFO.
+func (q *Queue) Done() int {
+	if !q.running {
+		return q.ndone
+	}
+	rxn := chainPos(q.d.rxdma, q.rxc)
+	txn := chainPos(q.d.txdma, q.txc)
+	n := q.ndone
+	for _, e := range q.ends[n:] {
+		if e >= 0 && int(e) >= rxn || e < 0 && int(^e) >= txn {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Wait waits until at least n transactions are completed. Use n = q.Len() to
+// wait for the whole queue. In such case Wait also waits for the end of the
+// last SPI transfer and unlocks the Master. The waiting goroutine is woken up
+// only by the transactions with the Notify field set (and by the last one) so
+// n should refer to such a transaction.
+//
+// Wait returns false if the queue has been aborted because of the timeout or
+// Master.Cancel. In such case the Master is unlocked and the Master.Err method
+// returns the cause of the abort.
+func (q *Queue) Wait(n int) bool {
+	d := q.d
+	n = min(n, len(q.xfers))
+	if !q.running {
+		return q.ndone >= n && d.err == nil
+	}
+	ok := true
+	for {
+		d.done.Clear()
+		if m := q.Done(); m >= n {
+			queueInval(q, m)
+			break
+		}
+		if !waitDone(d) {
+			ok = false
+			break
+		}
+	}
+	if ok && q.ndone == len(q.xfers) {
+		p := d.p
+		for p.FSR.LoadBits(TXCOUNT) != 0 || p.SR.LoadBits(MBF) != 0 {
+			if !stall(d) {
+				ok = false
+				break
+			}
+		}
+	}
+	if !ok || q.ndone == len(q.xfers) {
+		d.p.FCR.Store(q.fcr)
+		q.running = false
+		txnEnd(d)
+		d.Unlock()
+	}
+	return ok
+}
+
+// queueInval invalidates the Rx buffers of the newly completed transactions.
+func queueInval(q *Queue, n int) {
+	for _, x := range q.xfers[q.ndone:n] {
+		if x.Rx != nil {
+			rtos.CacheMaint(rtos.DCacheInval, unsafe.Pointer(&x.Rx[0]), len(x.Rx))
+		}
+	}
+	q.ndone = n
+}
@@ -0,0 +1,486 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi
+
+import (
+	"embedded/rtos"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+)
+
+// A Slave is a driver to the LPSPI peripheral used in slave mode.
+//
+// The receiver continuously writes the received words to the internal ring
+// buffer (using DMA if the Rx DMA channel is provided). The transactions are
+// delimited by the PCS deassertion (the FCF flag) so the Recv* methods return
+// the data of one transaction at a time together with its length.
+//
+// The data sent to the master in every transaction is pre-loaded using the
+// SetResponse method. The response is reloaded from the beginning at the end
+// of every transaction. If the master clocks more words than the response
+// contains the slave sends undefined data (the transmit FIFO underruns).
+//
+// The PCS must be deasserted long enough (a few microseconds) between the
+// subsequent transactions to allow the ISR to record the end of the previous
+// transaction and to reload the response.
+type Slave struct {
+	p       *Periph
+	rxdma   dma.Channel
+	txdma   dma.Channel
+	rxready rtos.Note
+	rxbuf   []uint32   // Rx ring buffer, len(rxbuf) is a power of 2
+	rxr     uint32     // number of words consumed by the reader
+	rxw     uint32     // number of received words (no-DMA mode)
+	rxdmast uint32     // number of received words seen by RxDMAISR (DMA mode)
+	rxwait  uint32     // reader waits for a transaction
+	rxovf   uint32     // number of Rx FIFO overflows
+	rxovfr  uint32     // number of Rx FIFO overflows reported to the reader
+	ends    [16]uint32 // ends of the last transactions (number of words)
+	nends   uint32     // number of recorded transactions (written by ISR)
+	rends   uint32     // number of transactions read
+	txresp  [2][]uint32
+	txsel   uint32 // txresp index that will be used at the next reload
+	txcur   uint32 // txresp index currently used
+	txi     int    // index of the next word of txresp[txcur] (no-DMA mode)
+	cancel  uint32
+	timeout time.Duration
+}
+
+// NewSlave returns a new slave-mode driver for p. If valid DMA channels are
+// given, the DMA will be used to receive data and send the response.
+func NewSlave(p *Periph, rxdma, txdma dma.Channel) *Slave {
+	return &Slave{p: p, rxdma: rxdma, txdma: txdma, timeout: -1}
+}
+
+// Periph returns the underlying LPSPI peripheral.
+func (d *Slave) Periph() *Periph {
+	return d.p
+}
+
+// Setup enables the SPI clock, resets the peripheral and configures it as
+// slave (CFGR1=0). The cmd parameter specifies the transfer configuration
+// written to the TCR register (CPOL, CPHA, LSBF, BYSW, PCS). The frameSize
+// parameter specifies the word size in bits (from 8 to 32). For custom
+// configuration (e.g. PCS polarity) use the Periph method to access the
+// configuration registers before calling Enable.
+func (d *Slave) Setup(cmd TCR, frameSize int) {
+	p := d.p
+	p.EnableClock(true)
+	p.Reset()
+	p.CFGR1.Store(0)
+	p.FCR.Store(0<<RXWATERn | (fifoLen-2)<<TXWATERn)
+	p.TCR.Store(cmd&^(FRAMESZ|PRESCALE|TXMSK|RXMSK|CONT|CONTC) |
+		TCR(frameSize-1)&FRAMESZ)
+	if txdma := d.txdma; txdma.IsValid() {
+		txdma.DisableReq()
+		txdma.DisableErrInt()
+		txdma.ClearInt()
+		txdma.SetMux(dma.Mux(txDMASlots[num(d.p)]) | dma.En)
+		p.DER.SetBits(TDDE)
+	}
+	if rxdma := d.rxdma; rxdma.IsValid() {
+		rxdma.DisableReq()
+		rxdma.DisableErrInt()
+		rxdma.ClearInt()
+		rxdma.SetMux(dma.Mux(rxDMASlots[num(d.p)]) | dma.En)
+	}
+	p.IER.Store(FCIE | REIE)
+}
+
+// EnableRx enables receiving data into the internal ring buffer of size at
+// least bufLen words (rounded up to the power of 2). The maximum size of the
+// buffer in DMA mode is 16384 words. EnableRx must be called before Enable.
+func (d *Slave) EnableRx(bufLen int) {
+	if d.rxbuf != nil {
+		panic("enabled before")
+	}
+	n := 4
+	for n < bufLen {
+		n <<= 1
+	}
+	d.rxr = 0
+	d.rxw = 0
+	d.rxdmast = 0
+	d.nends = 0
+	d.rends = 0
+	d.rxovfr = d.rxovf
+	rxdma := d.rxdma
+	if !rxdma.IsValid() {
+		d.rxbuf = make([]uint32, n)
+		d.p.IER.SetBits(RDIE)
+		return
+	}
+	if n > 16384 {
+		n = 16384
+	}
+	d.rxbuf = dma.MakeSlice[uint32](n, n)
+	ptr, size := unsafe.Pointer(&d.rxbuf[0]), n*4
+	rtos.CacheMaint(rtos.DCacheFlushInval, ptr, size)
+	tcd := dma.TCD{
+		SADDR:       unsafe.Pointer(d.p.RDR.Addr()),
+		ATTR:        dma.S32b | dma.D32b,
+		ML_NBYTES:   4,
+		DADDR:       ptr,
+		DOFF:        4,
+		ELINK_CITER: int16(n),
+		DLAST_SGA:   int32(-size),
+		CSR:         dma.INTHALF | dma.INTMAJOR,
+		ELINK_BITER: int16(n),
+	}
+	rxdma.WriteTCD(&tcd)
+	rxdma.EnableReq()
+	d.p.DER.SetBits(RDDE)
+}
+
+// Enable loads the response (see SetResponse) and enables the LPSPI
+// peripheral.
+func (d *Slave) Enable() {
+	p := d.p
+	ier := p.IER.Load()
+	p.IER.Store(0)
+	d.txcur = d.txsel
+	if txReload(d) {
+		ier |= TDIE
+	}
+	p.CR.Store(DBGEN | MEN)
+	p.IER.Store(ier)
+}
+
+// Disable disables the LPSPI peripheral and the receiver. All unread data is
+// lost. Disable resets the peripheral so you have to call Setup before enabling
+// it again.
+func (d *Slave) Disable() {
+	p := d.p
+	p.IER.Store(0)
+	p.CR.Store(0)
+	for _, c := range [2]dma.Channel{d.rxdma, d.txdma} {
+		if c.IsValid() {
+			c.DisableReq()
+			for c.TCD().CSR.LoadBits(dma.ACTIVE) != 0 {
+			}
+			c.ClearInt()
+		}
+	}
+	p.DER.Store(0)
+	p.Reset()
+	d.rxbuf = nil
+}
+
+// SetResponse sets the words that will be sent to the master in the
+// subsequent transactions. If the slave is enabled the new response is used
+// starting from the next transaction. The words in out are sent using the
+// frame size configured by Setup (the low significant bits are used).
+// SetResponse keeps the reference to out so you must not modify it until the
+// next call of SetResponse takes effect. The maximum length of out in DMA mode
+// is 32767.
+func (d *Slave) SetResponse(out []uint32) {
+	if d.txdma.IsValid() && len(out) != 0 {
+		if len(out) > 32767 {
+			out = out[:32767]
+		}
+		rtos.CacheMaint(rtos.DCacheFlush, unsafe.Pointer(&out[0]), len(out)*4)
+	}
+	// Block the ISR to safely choose the unused txresp slot.
+	p := d.p
+	ier := p.IER.Load()
+	p.IER.Store(0)
+	n := d.txcur ^ 1
+	d.txresp[n] = out
+	d.txsel = n
+	p.IER.Store(ier)
+}
+
+// SetTimeout sets the timeout for every subsequent call of a Recv* method. Use
+// timeout < 0 to wait forever (default).
+func (d *Slave) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// Cancel aborts the Recv* method currently in progress. It is intended to be
+// called by another goroutine. If there is no Recv* in progress the next one
+// is aborted.
+func (d *Slave) Cancel() {
+	atomic.StoreUint32(&d.cancel, 1)
+	d.rxready.Wakeup()
+}
+
+// txReload flushes the transmit FIFO and starts sending the current response
+// from the beginning. It returns true if the TDIE interrupt should be enabled.
+//
+//go:nosplit
+func txReload(d *Slave) bool {
+	p := d.p
+	txdma := d.txdma
+	if txdma.IsValid() {
+		txdma.DisableReq()
+		for txdma.TCD().CSR.LoadBits(dma.ACTIVE) != 0 {
+		}
+	}
+	p.CR.SetBits(RTF)
+	p.SR.Store(TEF)
+	resp := d.txresp[d.txcur]
+	if len(resp) == 0 {
+		return false
+	}
+	if !txdma.IsValid() {
+		d.txi = 0
+		return true
+	}
+	tcd := dma.TCD{
+		SADDR:       unsafe.Pointer(&resp[0]),
+		SOFF:        4,
+		ATTR:        dma.S32b | dma.D32b,
+		ML_NBYTES:   4,
+		DADDR:       unsafe.Pointer(p.TDR.Addr()),
+		ELINK_CITER: int16(len(resp)),
+		CSR:         dma.DREQ,
+		ELINK_BITER: int16(len(resp)),
+	}
+	txdma.WriteTCD(&tcd)
+	txdma.EnableReq()
+	return false
+}
+
+// txCPU fills the transmit FIFO with the response words. It returns true if
+// there are still words to send.
+//
+//go:nosplit
+func txCPU(d *Slave) bool {
+	p := d.p
+	resp := d.txresp[d.txcur]
+	i := d.txi
+	for i < len(resp) && p.FSR.LoadBits(TXCOUNT) < fifoLen<<TXCOUNTn {
+		p.TDR.Store(resp[i])
+		i++
+	}
+	d.txi = i
+	return i < len(resp)
+}
+
+// rxCPU moves the received words from the receive FIFO to the ring buffer.
+//
+//go:nosplit
+func rxCPU(d *Slave) {
+	p := d.p
+	w := d.rxw
+	mask := uint32(len(d.rxbuf) - 1)
+	for p.FSR.LoadBits(RXCOUNT) != 0 {
+		d.rxbuf[w&mask] = p.RDR.Load()
+		w++
+	}
+	atomic.StoreUint32(&d.rxw, w)
+}
+
+//go:nosplit
+func rxDMAPos(d *Slave) uint32 {
+	citer := int(d.rxdma.TCD().ELINK_CITER.Load())
+	if citer >= len(d.rxbuf) {
+		return 0
+	}
+	return uint32(len(d.rxbuf) - citer)
+}
+
+// rxWritten returns the number of words written to the Rx buffer.
+//
+//go:nosplit
+func rxWritten(d *Slave) uint32 {
+	if !d.rxdma.IsValid() {
+		return atomic.LoadUint32(&d.rxw)
+	}
+	mask := uint32(len(d.rxbuf) - 1)
+	st := atomic.LoadUint32(&d.rxdmast)
+	pos := rxDMAPos(d)
+	if pos < st&mask {
+		st += uint32(len(d.rxbuf)) // wrapped around, the ISR has not run yet
+	}
+	return st&^mask | pos
+}
+
+// ISR handles the LPSPI interrupts. It must be configured as the LPSPI
+// interrupt handler.
+//
+//go:nosplit
+//go:nowritebarrierrec
+func (d *Slave) ISR() {
+	p := d.p
+	ier := p.IER.Load()
+	p.IER.Store(0) // disable all IRQs and fix it later
+	if ier == 0 {
+		return // blocked by the thread mode code
+	}
+	sr := p.SR.Load()
+	if ier&RDIE != 0 {
+		rxCPU(d)
+	}
+	if sr&REF != 0 {
+		p.SR.Store(REF)
+		atomic.StoreUint32(&d.rxovf, d.rxovf+1)
+	}
+	if sr&FCF != 0 {
+		p.SR.Store(FCF | TCF)
+		if d.rxbuf != nil {
+			if d.rxdma.IsValid() {
+				for p.FSR.LoadBits(RXCOUNT) != 0 {
+					// wait for DMA to read the rest of the transaction
+				}
+			} else {
+				rxCPU(d)
+			}
+			n := d.nends
+			d.ends[n%uint32(len(d.ends))] = rxWritten(d)
+			atomic.StoreUint32(&d.nends, n+1)
+			if atomic.LoadUint32(&d.rxwait) != 0 {
+				atomic.StoreUint32(&d.rxwait, 0)
+				d.rxready.Wakeup()
+			}
+		}
+		d.txcur = d.txsel
+		ier &^= TDIE
+		if txReload(d) {
+			ier |= TDIE
+		}
+	}
+	if ier&TDIE != 0 && !txCPU(d) {
+		ier &^= TDIE
+	}
+	p.IER.Store(ier)
+}
+
+// RxDMAISR must be configured as the Rx DMA interrupt handler if the DMA is
+// used.
+//
+//go:nosplit
+func (d *Slave) RxDMAISR() {
+	d.rxdma.ClearInt()
+	// The interrupts occur at half and at the end of the buffer so there is
+	// no way to miss the wrap around if the ISR latency is lower than the time
+	// of receiving the half of the buffer.
+	mask := uint32(len(d.rxbuf) - 1)
+	st := d.rxdmast
+	pos := rxDMAPos(d)
+	if pos < st&mask {
+		st += uint32(len(d.rxbuf))
+	}
+	atomic.StoreUint32(&d.rxdmast, st&^mask|pos)
+}
+
+// waitTrans waits for the end of the next transaction.
+func waitTrans(d *Slave) error {
+	timeout := d.timeout
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for atomic.LoadUint32(&d.nends) == d.rends {
+		d.rxready.Clear()
+		atomic.StoreUint32(&d.rxwait, 1)
+		if atomic.LoadUint32(&d.nends) != d.rends {
+			atomic.StoreUint32(&d.rxwait, 0)
+			break
+		}
+		if atomic.SwapUint32(&d.cancel, 0) != 0 {
+			atomic.StoreUint32(&d.rxwait, 0)
+			return ErrCanceled
+		}
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout < 0 {
+				timeout = 0
+			}
+		}
+		if !d.rxready.Sleep(timeout) {
+			atomic.StoreUint32(&d.rxwait, 0)
+			if atomic.LoadUint32(&d.nends) == d.rends {
+				return ErrTimeout
+			}
+		}
+	}
+	return nil
+}
+
+// rxInval invalidates the cache lines that contain n words of the Rx ring
+// buffer starting from the i-th word.
+func rxInval(d *Slave, i, n int) {
+	if n == 0 || !d.rxdma.IsValid() {
+		return
+	}
+	const align = dma.MemAlign - 1
+	start := uintptr(unsafe.Pointer(&d.rxbuf[i])) &^ align
+	end := (uintptr(unsafe.Pointer(&d.rxbuf[i])) + uintptr(n)*4 + align) &^ align
+	rtos.CacheMaint(rtos.DCacheInval, unsafe.Pointer(start), int(end-start))
+}
+
+func recv[T dataWord](d *Slave, buf []T) (n int, err error) {
+	if d.rxbuf == nil {
+		panic("lpspi: Rx disabled")
+	}
+	if err = waitTrans(d); err != nil {
+		return 0, err
+	}
+	const nslots = uint32(len(d.ends))
+	if ne := atomic.LoadUint32(&d.nends); ne-d.rends > nslots {
+		// Lost transaction records. The slots contain the ends of the last
+		// nslots transactions. Skip to the oldest available one, starting
+		// at the end of the oldest recorded one.
+		for {
+			end := d.ends[ne%nslots]
+			ne1 := atomic.LoadUint32(&d.nends)
+			if ne1 == ne {
+				d.rxr = end
+				break
+			}
+			ne = ne1 // the ISR has overwritten the slot in the meantime
+		}
+		d.rends = ne - nslots + 1
+		return 0, ErrOverflow
+	}
+	start := d.rxr
+	end := d.ends[d.rends%nslots]
+	d.rxr = end
+	d.rends++
+	n = max(int(int32(end-start)), 0)
+	if int(rxWritten(d)-start) > len(d.rxbuf) {
+		return 0, ErrOverflow // overwritten by the subsequent transactions
+	}
+	m := min(n, len(buf))
+	mask := len(d.rxbuf) - 1
+	i := int(start) & mask
+	k := min(m, len(d.rxbuf)-i)
+	rxInval(d, i, k)
+	rxInval(d, 0, m-k)
+	for j := range buf[:m] {
+		buf[j] = T(d.rxbuf[(i+j)&mask])
+	}
+	if int(rxWritten(d)-start) > len(d.rxbuf) {
+		return 0, ErrOverflow // overwritten while copying
+	}
+	if ovf := atomic.LoadUint32(&d.rxovf); ovf != d.rxovfr {
+		d.rxovfr = ovf
+		err = ErrOverflow
+	}
+	return n, err
+}
+
+// Recv waits for the end of the next transaction and copies the received data
+// to buf. It returns the length of the transaction in words which may be
+// greater than len(buf) (the excess words are discarded). Recv returns
+// ErrOverflow if some data or transactions were lost because the reader was
+// too slow or the receive FIFO overflowed. The Recv* methods use the
+// low significant bits of the received words.
+func (d *Slave) Recv(buf []byte) (n int, err error) {
+	return recv(d, buf)
+}
+
+// Recv16 works like Recv but for 16-bit words.
+func (d *Slave) Recv16(buf []uint16) (n int, err error) {
+	return recv(d, buf)
+}
+
+// Recv32 works like Recv but for 32-bit words.
+func (d *Slave) Recv32(buf []uint32) (n int, err error) {
+	return recv(d, buf)
+}
@@ -27,6 +27,14 @@ const (
 	SDO                // MOSI / MISO / data 0
 )
 
+// Signal aliases for the dual (DATA0, DATA1) and quad (DATA0 to DATA3) mode.
+const (
+	DATA0 = SDO
+	DATA1 = SDI
+	DATA2 = PCS2
+	DATA3 = PCS3
+)
+
 // Pins return IO pins that can be used for singal sig.
 func (p *Periph) Pins(sig Signal) []iomux.Pin {
 	return periph.Pins(pins[:], alts[:], num(p)*7+int(sig))
@@ -37,17 +45,23 @@ func (p *Periph) Pins(sig Signal) []iomux.Pin {
 // returns true on succes or false if it isn't possible to use a pin as a sig.
 // See also Periph.Pins.
 func (d *Master) UsePin(pin iomux.Pin, sig Signal) bool {
-	af, sel, daisy := periph.AltFunc(pins[:], alts[:], num(d.p)*7+int(sig), pin)
+	return usePin(d.p, pin, sig)
+}
+
+// UsePin works like Master.UsePin.
+func (d *Slave) UsePin(pin iomux.Pin, sig Signal) bool {
+	return usePin(d.p, pin, sig)
+}
+
+func usePin(p *Periph, pin iomux.Pin, sig Signal) bool {
+	af, sel, daisy := periph.AltFunc(pins[:], alts[:], num(p)*7+int(sig), pin)
 	if af < 0 {
 		return false
 	}
-	var cfg iomux.Config
-	if sig != SDI {
-		// TODO: support half duplex mode
-		cfg = iomux.Drive2 // 75Ω @ 3.3V, 130Ω @ 1.8V
-	}
+	// All signals can be outputs (SDI in half-duplex, dual and quad mode, PCS2
+	// and PCS3 in quad mode).
 	pin.SetAltFunc(af)
-	pin.Setup(cfg)
+	pin.Setup(iomux.Drive2) // 75Ω @ 3.3V, 130Ω @ 1.8V
 	if sel >= 0 {
 		iosel := (*[16]mmio.R32[int32])(unsafe.Pointer(daisyBase))
 		iosel[sel].Store(int32(daisy))
@@ -0,0 +1,185 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpspi
+
+// SetQuad enables or disables the use of the PCS2 and PCS3 signals as the DATA2
+// and DATA3 data lines (CFGR1[PCSCFG]) required by the 4-bit transfers. The
+// dual (2-bit) transfers use only SDO (DATA0) and SDI (DATA1) so they don't
+// require SetQuad. Use UsePin to configure the additional data pins (see
+// DATA0, DATA1, DATA2, DATA3). SetQuad temporarily disables the peripheral so
+// it must not be called during a transfer.
+func (d *Master) SetQuad(on bool) {
+	p := d.p
+	cr := p.CR.Load()
+	p.CR.Store(cr &^ MEN)
+	if on {
+		p.CFGR1.SetBits(PCSDATA)
+	} else {
+		p.CFGR1.ClearBits(PCSDATA)
+	}
+	p.CR.Store(cr)
+}
+
+// A WideCmd describes the command, address and dummy phases of the typical
+// instruction of the dual/quad SPI devices (e.g. SPI NOR flash) and the width
+// of its data phase. The widths are specified using the TCR.WIDTH values:
+// WIDTH0 (1-bit), WIDTH1 (2-bit) and WIDTH2 (4-bit).
+//
+// Examples (the comments use the command-address-data width notation):
+//
+//	fastRead := WideCmd{Cmd: 0x0b, AddrLen: 3, Dummy: 8} // 1-1-1
+//	quadOut := WideCmd{Cmd: 0x6b, AddrLen: 3, Dummy: 8, DataW: WIDTH2} // 1-1-4
+//	quadIO := WideCmd{ // 1-4-4
+//		Cmd: 0xeb, AddrLen: 3, AddrW: WIDTH2, Dummy: 6, DataW: WIDTH2,
+//	}
+type WideCmd struct {
+	Cmd     uint8  // command (instruction) code
+	CmdW    TCR    // width of the command phase
+	NoCmd   bool   // skip the command phase (e.g. continuous read mode)
+	Addr    uint32 // address
+	AddrLen int    // address length in bytes (0 to 4), 0 means no address
+	AddrW   TCR    // width of the address phase
+	Dummy   int    // number of dummy cycles, 0 means no dummy phase
+	DataW   TCR    // width of the dummy and data phases
+}
+
+// widthBits returns the number of data lines for the TCR.WIDTH value w.
+func widthBits(w TCR) int {
+	return 1 << (w & WIDTH >> WIDTHn)
+}
+
+// wideHeader writes the commands and data for the command, address and dummy
+// phases of c. All phases are sent as the continuous transfer. If end is true
+// the last phase ends the transfer (PCS is deasserted after it), otherwise the
+// PCS stays asserted. It returns false if there are no phases to send.
+func wideHeader(d *Master, base TCR, c *WideCmd, addr uint32, end bool) bool {
+	type phase struct {
+		w    TCR
+		bits int
+		data uint32
+	}
+	var (
+		ph [3]phase
+		n  int
+	)
+	if !c.NoCmd {
+		ph[n] = phase{c.CmdW, 8, uint32(c.Cmd)}
+		n++
+	}
+	if c.AddrLen != 0 {
+		if c.AddrLen < 1 || c.AddrLen > 4 {
+			panic("lpspi: bad address length")
+		}
+		ph[n] = phase{c.AddrW, c.AddrLen * 8, addr}
+		n++
+	}
+	if c.Dummy != 0 {
+		// The dummy cycles are sent using the data phase width. The data
+		// lines are driven low.
+		bits := c.Dummy * widthBits(c.DataW)
+		if bits < 8 || bits > 4096 || bits > 32 && bits&31 == 1 {
+			panic("lpspi: unsupported number of dummy cycles")
+		}
+		ph[n] = phase{c.DataW, bits, 0}
+		n++
+	}
+	for i, f := range ph[:n] {
+		cmd := base | CONT | RXMSK | f.w&WIDTH
+		if i != 0 {
+			cmd |= CONTC
+		}
+		if end && i == n-1 {
+			cmd &^= CONT
+		}
+		d.WriteCmd(cmd, f.bits)
+		for k := 0; k < (f.bits+31)/32; k++ {
+			d.WriteWord(f.data)
+		}
+	}
+	return n != 0
+}
+
+// wideBase returns the part of the mode used by the wide transfers.
+func wideBase(mode TCR) TCR {
+	return mode & (CPOL | CPHA | PRESCALE | TPCS)
+}
+
+// WideWrite performs one SPI transaction that consists of the command,
+// address and dummy phases described by c followed by the data phase that
+// writes p. The mode parameter specifies the SPI mode (CPOL, CPHA), the
+// prescaler and the chip select (TPCSx), other bits are ignored. WideWrite
+// can be used for the instructions without the data phase (len(p) == 0). The
+// data lines are driven by the master in all phases.
+func (d *Master) WideWrite(mode TCR, c *WideCmd, p []byte) {
+	txnStart(d)
+	defer txnEnd(d)
+	base := wideBase(mode)
+	n := len(p)
+	cont := TCR(0)
+	if wideHeader(d, base, c, c.Addr, n == 0) {
+		cont = CONTC
+	}
+	if n == 0 {
+		return
+	}
+	cmd := base | RXMSK | c.DataW&WIDTH
+	if n > 1 {
+		d.WriteCmd(cmd|CONT|cont, 8)
+		d.Write(p[:n-1])
+		cont = CONTC
+	}
+	// Send the last byte without CONT to deassert PCS at the end of the
+	// transaction.
+	d.WriteCmd(cmd|cont, 8)
+	d.WriteWord(uint32(p[n-1]))
+}
+
+// WideMaxRead is the maximum number of bytes that can be read by WideRead in
+// one SPI transaction.
+const WideMaxRead = 4096 / 8
+
+// WideRead performs the SPI transaction that consists of the command, address
+// and dummy phases described by c followed by the data phase that reads len(p)
+// bytes into p. See WideWrite for the description of the mode parameter.
+//
+// Because of the LPSPI bug in the Rx-only mode (see WriteCmd) the data phase
+// is limited to WideMaxRead bytes. WideRead splits longer reads into multiple
+// transactions, incrementing the address by WideMaxRead for each subsequent
+// one, so the command described by c must contain the address phase in such
+// case.
+func (d *Master) WideRead(mode TCR, c *WideCmd, p []byte) {
+	if len(p) > WideMaxRead && c.AddrLen == 0 {
+		panic("lpspi: WideRead too long")
+	}
+	txnStart(d)
+	defer txnEnd(d)
+	base := wideBase(mode)
+	addr := c.Addr
+	for len(p) != 0 {
+		n := min(len(p), WideMaxRead)
+		cont := TCR(0)
+		if wideHeader(d, base, c, addr, false) {
+			cont = CONTC
+		}
+		// The frame size > 32 bits gives the 32-bit words except the last
+		// one. The frame ends the continuous transfer so the PCS is
+		// deasserted after the last word.
+		d.WriteCmd(base|cont|TXMSK|c.DataW&WIDTH, n*8)
+		q := p[:n]
+		for len(q) != 0 {
+			m := min(len(q), 4)
+			w := d.ReadWord()
+			for i := range q[:m] {
+				q[i] = byte(w >> uint(8*(m-1-i))) // MSB first
+			}
+			q = q[m:]
+		}
+		if d.err != nil {
+			return
+		}
+		p = p[n:]
+		addr += uint32(n)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpuart
+
+import "time"
+
+// StdBaudrates contains the standard baudrates used by AutoBaud to find the
+// nearest match for the measured one. You can modify it before calling
+// AutoBaud.
+var StdBaudrates = []int{
+	300, 600, 1200, 2400, 4800, 9600, 14400, 19200, 28800, 38400, 57600,
+	76800, 115200, 230400, 250000, 460800, 500000, 921600, 1000000,
+}
+
+// AutoBaud measures the baudrate of the incoming data using the RXD pin edge
+// detection (RXEDGIF) and a known reference pattern sent by the remote party.
+//
+// If sync >= 0 the reference pattern is the character sync (use 0x55 or 0x7f
+// for the best results). If sync < 0 the reference pattern is a break
+// condition of -sync bit periods long (e.g. -13 for the LIN break). The
+// measured rate is compared with the nearest rate from the StdBaudrates table.
+//
+// AutoBaud returns the measured baudrate, the nearest standard one and the
+// deviation between them in ppm (parts per million). If the deviation is
+// greater than maxDev it returns ErrBaudMismatch, otherwise it configures the
+// peripheral to use std baudrate (see SetBaudrate for possible errors). It
+// returns ErrTimeout if it could not detect the reference pattern before the
+// timeout expired (use timeout < 0 to wait forever).
+//
+// The edges are timestamped by the CPU so the accuracy depends on the system
+// timer resolution and the current system load. AutoBaud is intended for the
+// baudrates up to 115200 sym/s. The receiver must be disabled (see DisableRx,
+// EnableRx) before calling AutoBaud.
+func (d *Driver) AutoBaud(sync int, maxDev int, timeout time.Duration) (baud, std, dev int, err error) {
+	// The levels of the reference pattern, one bit per bit period, start bit
+	// first.
+	var (
+		levels uint32
+		nbits  int
+	)
+	if sync >= 0 {
+		levels = uint32(sync&0xff)<<1 | 1<<9 // start bit, 8 data bits, stop bit
+		nbits = 10
+	} else {
+		nbits = -sync + 1 // break and the following mark
+		if nbits > 32 {
+			panic("lpuart: break too long")
+		}
+		levels = 1 << (nbits - 1)
+	}
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	p := d.p
+	// Keep the user RXINV setting. The edges below are relative to it.
+	rxinv := p.STAT.LoadBits(RXINV)
+	defer setEdge(p, rxinv)
+	for {
+		// Wait for the first falling edge (the start bit or break).
+		setEdge(p, rxinv)
+		t0, ok := waitEdge(p, deadline)
+		if !ok {
+			return 0, 0, 0, ErrTimeout
+		}
+		// Timestamp all edges of the pattern. The last edge gives the best
+		// resolution.
+		var (
+			span time.Duration
+			last int
+		)
+		level, inv := uint32(0), STAT(0)
+		for i := 1; i < nbits; i++ {
+			b := levels >> uint(i) & 1
+			if b == level {
+				continue
+			}
+			level = b
+			inv ^= RXINV // detect the opposite edge
+			setEdge(p, rxinv^inv)
+			t, ok := waitEdge(p, t0.Add(edgeTimeout(i)))
+			if !ok {
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return 0, 0, 0, ErrTimeout
+				}
+				last = 0
+				break
+			}
+			if last != 0 {
+				// Check the consistency of the measured timing to reject
+				// the random data that do not match the reference pattern.
+				bt := span / time.Duration(last)
+				if e := t.Sub(t0) - bt*time.Duration(i); e > bt/2 || e < -bt/2 {
+					last = 0
+					break
+				}
+			}
+			span = t.Sub(t0)
+			last = i
+		}
+		if last == 0 || span <= 0 {
+			continue // pattern not recognized, try again
+		}
+		baud = int((time.Duration(last)*time.Second + span/2) / span)
+		break
+	}
+	std = nearestBaudrate(baud)
+	dev = int((int64(baud) - int64(std)) * 1e6 / int64(std))
+	if dev > maxDev || -dev > maxDev {
+		return baud, std, dev, ErrBaudMismatch
+	}
+	err = p.SetBaudrate(std)
+	return baud, std, dev, err
+}
+
+// edgeTimeout returns the timeout for the i-th edge of the reference pattern
+// assuming the lowest supported baudrate.
+func edgeTimeout(i int) time.Duration {
+	return time.Duration(i+1) * time.Second / 300
+}
+
+// setEdge selects the active edge of the RXD pin (falling for inv == 0, rising
+// for inv == RXINV) and clears RXEDGIF. It does not touch the other w1c flags.
+func setEdge(p *Periph, inv STAT) {
+	const w1c = LBKDIF | RXEDGIF | IDLE | OR | NF | FE | PF | MA1F | MA2F
+	p.STAT.Store(p.STAT.Load()&^(w1c|RXINV) | inv | RXEDGIF)
+}
+
+func waitEdge(p *Periph, deadline time.Time) (t time.Time, ok bool) {
+	for n := 0; ; n++ {
+		if p.STAT.LoadBits(RXEDGIF) != 0 {
+			return time.Now(), true
+		}
+		if n&255 == 255 && !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+func nearestBaudrate(baud int) (std int) {
+	lowestE := 1<<31 - 1
+	for _, b := range StdBaudrates {
+		e := b - baud
+		if e < 0 {
+			e = -e
+		}
+		if e < lowestE {
+			lowestE = e
+			std = b
+		}
+	}
+	return std
+}
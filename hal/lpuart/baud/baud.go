@@ -0,0 +1,56 @@
+// Copyright 2022 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package baud calculates the LPUART baudrate dividers. It does not depend on
+// any hardware specific package so it can be used (and tested) on any
+// platform.
+package baud
+
+// Dividers describes the LPUART baudrate generator configuration.
+type Dividers struct {
+	OSR   int     // oversampling ratio (4 to 32)
+	SBR   int     // baudrate modulo divisor (1 to 8191)
+	Baud  int     // actual baudrate [sym/s] (rounded to the nearest integer)
+	Error float64 // relative error of the actual baudrate in percent
+}
+
+// Solve finds the OSR and SBR values that give the baudrate closest to baud
+// for the LPUART functional clock clk [Hz]. If there are several equally good
+// solutions it prefers the one with the higher oversampling ratio. The caller
+// should check the Error field because the requested baudrate may be out of
+// the achievable range. Solve returns zero Dividers if clk <= 0 or baud <= 0.
+func Solve(clk, baud int) (d Dividers) {
+	if clk <= 0 || baud <= 0 {
+		return
+	}
+	// The actual baudrate is clk/(osr*sbr) so the error is proportional to
+	// |clk - baud*osr*sbr|/(osr*sbr). Compare the candidates using the cross
+	// multiplication to avoid the floating point arithmetic.
+	var bestE, bestD int64 = -1, 1
+	c, b := int64(clk), int64(baud)
+	for osr := int64(32); osr >= 4; osr-- {
+		bo := b * osr
+		sbr0 := c / bo
+		if sbr0 < 1 {
+			sbr0 = 1
+		} else if sbr0 > 8190 {
+			sbr0 = 8190
+		}
+		for sbr := sbr0; sbr <= sbr0+1; sbr++ {
+			div := osr * sbr
+			e := c - b*div
+			if e < 0 {
+				e = -e
+			}
+			if bestE < 0 || e*bestD < bestE*div {
+				bestE, bestD = e, div
+				d.OSR, d.SBR = int(osr), int(sbr)
+			}
+		}
+	}
+	div := int64(d.OSR * d.SBR)
+	d.Baud = int((c + div/2) / div)
+	d.Error = (float64(c)/float64(div) - float64(baud)) * 100 / float64(baud)
+	return
+}
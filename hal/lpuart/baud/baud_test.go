@@ -0,0 +1,116 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package baud
+
+import (
+	"math"
+	"testing"
+)
+
+// bestError returns the smallest achievable relative error (without sign) by
+// checking all OSR, SBR combinations.
+func bestError(clk, baud int) float64 {
+	best := math.Inf(1)
+	for osr := 4; osr <= 32; osr++ {
+		for sbr := 1; sbr <= 8191; sbr++ {
+			e := math.Abs(float64(clk)/float64(osr*sbr) - float64(baud))
+			best = min(best, e*100/float64(baud))
+		}
+	}
+	return best
+}
+
+func checkDividers(t *testing.T, clk, baud int, d Dividers) {
+	t.Helper()
+	if d.OSR < 4 || d.OSR > 32 {
+		t.Errorf("clk=%d baud=%d: OSR=%d out of range", clk, baud, d.OSR)
+	}
+	if d.SBR < 1 || d.SBR > 8191 {
+		t.Errorf("clk=%d baud=%d: SBR=%d out of range", clk, baud, d.SBR)
+	}
+	div := d.OSR * d.SBR
+	if want := (clk + div/2) / div; d.Baud != want {
+		t.Errorf("clk=%d baud=%d: Baud=%d, want %d", clk, baud, d.Baud, want)
+	}
+	want := (float64(clk)/float64(div) - float64(baud)) * 100 / float64(baud)
+	if math.Abs(d.Error-want) > 1e-9 {
+		t.Errorf("clk=%d baud=%d: Error=%g, want %g", clk, baud, d.Error, want)
+	}
+}
+
+func TestSolve(t *testing.T) {
+	clks := []int{
+		24e6,     // OSC
+		80e6,     // PLL3/6
+		66666667, // non-round clock
+		100e6,
+		4e6, // slow clock
+	}
+	bauds := []int{
+		300, 1200, 2400, 4800, 9600, 19200, 38400, 57600, 115200, 230400,
+		250000, 460800, 500000, 921600, 1000000, 3000000,
+	}
+	for _, clk := range clks {
+		for _, baud := range bauds {
+			if baud*4 > clk {
+				continue
+			}
+			d := Solve(clk, baud)
+			checkDividers(t, clk, baud, d)
+			if best := bestError(clk, baud); math.Abs(d.Error) > best+1e-9 {
+				t.Errorf(
+					"clk=%d baud=%d: |Error|=%g, best possible %g",
+					clk, baud, math.Abs(d.Error), best,
+				)
+			}
+		}
+	}
+}
+
+func TestSolveExact(t *testing.T) {
+	tests := []struct {
+		clk, baud int
+		osr, sbr  int
+	}{
+		{24e6, 1500000, 16, 1}, // the highest OSR preferred
+		{24e6, 3000000, 8, 1},  // only low OSR possible
+		{80e6, 2500000, 32, 1},
+		{24e6, 1000000, 24, 1},
+		{24e6, 100000, 30, 8}, // many candidates
+	}
+	for _, tc := range tests {
+		d := Solve(tc.clk, tc.baud)
+		if d.OSR != tc.osr || d.SBR != tc.sbr || d.Error != 0 {
+			t.Errorf(
+				"clk=%d baud=%d: OSR=%d SBR=%d Error=%g, want %d %d 0",
+				tc.clk, tc.baud, d.OSR, d.SBR, d.Error, tc.osr, tc.sbr,
+			)
+		}
+		if d.Baud != tc.baud {
+			t.Errorf("clk=%d baud=%d: Baud=%d", tc.clk, tc.baud, d.Baud)
+		}
+	}
+}
+
+func TestSolveErrors(t *testing.T) {
+	for _, tc := range []struct{ clk, baud int }{
+		{0, 115200}, {-1, 115200}, {24e6, 0}, {24e6, -9600}, {0, 0},
+	} {
+		if d := Solve(tc.clk, tc.baud); d != (Dividers{}) {
+			t.Errorf("Solve(%d, %d) = %+v, want zero", tc.clk, tc.baud, d)
+		}
+	}
+	// Out of the achievable range: too fast and too slow baudrates.
+	d := Solve(24e6, 12e6)
+	checkDividers(t, 24e6, 12e6, d)
+	if d.OSR != 4 || d.SBR != 1 || d.Error > -49 {
+		t.Errorf("Solve(24e6, 12e6) = %+v, want OSR=4 SBR=1, Error=-50", d)
+	}
+	d = Solve(80e6, 50)
+	checkDividers(t, 80e6, 50, d)
+	if d.OSR != 32 || d.SBR < 8190 || d.Error < 400 {
+		t.Errorf("Solve(80e6, 50) = %+v, want OSR=32 SBR>=8190, Error>400", d)
+	}
+}
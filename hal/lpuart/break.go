@@ -0,0 +1,71 @@
+// Copyright 2022 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lpuart
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/internal"
+)
+
+// SendBreak waits for the end of the current transmission and sends a break
+// condition (continuous logic 0 on the TXD line) that lasts at least duration.
+// Because the break is generated using break characters (see CTRL[SBK],
+// STAT[BRK13]) its actual length is rounded up to the multiple of the break
+// character length. SendBreak returns after the break has been completely sent
+// so the line is in the idle (mark) state. If duration <= 0 SendBreak only
+// queues one break character and returns without waiting for its end. It uses
+// the write timeout (see SetWriteTimeout) and can be aborted by CancelWrite.
+func (d *Driver) SendBreak(duration time.Duration) error {
+	txBegin(d)
+	if err := waitTC(d); err != nil {
+		return err
+	}
+	p := d.p
+	internal.ExclusiveStoreBits(&p.CTRL, SBK, SBK)
+	if duration > 0 {
+		if !d.txdl.IsZero() {
+			d.txdl = d.txdl.Add(duration) // the timeout excludes the break
+		}
+		end := time.Now().Add(duration)
+		for time.Now().Before(end) {
+			if atomic.LoadUint32(&d.txcancel) != 0 {
+				break
+			}
+			runtime.Gosched()
+		}
+	}
+	internal.ExclusiveStoreBits(&p.CTRL, SBK, 0)
+	if atomic.SwapUint32(&d.txcancel, 0) != 0 {
+		return ErrCanceled
+	}
+	if duration <= 0 {
+		return nil
+	}
+	return waitTC(d)
+}
+
+// waitTC waits for the transmission complete flag.
+func waitTC(d *Driver) error {
+	for d.p.STAT.LoadBits(TC) == 0 {
+		if atomic.SwapUint32(&d.txcancel, 0) != 0 {
+			return ErrCanceled
+		}
+		if expired(d.txdl) {
+			return ErrTimeout
+		}
+		runtime.Gosched()
+	}
+	return nil
+}
+
+// IsBreak reports whether the 16-bit word w returned by Read16 or ReadWord16
+// is the break marker, that is the received break character (all data bits
+// zero and the framing error flag set).
+func IsBreak(w uint16) bool {
+	return w&FRETSC != 0 && w&0x3ff == 0
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dmx512 provides DMX512 (ANSI E1.11) transmitter and receiver helpers
+// built on top of the lpuart.Driver break support.
+//
+// The DMX512 packet consists of the break, the mark after break (MAB), the
+// start code (0 for the dimmer data) and up to 512 slots. All characters are
+// sent at 250 kb/s using 8 data bits, no parity and 2 stop bits.
+package dmx512
+
+import (
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/lpuart"
+)
+
+const (
+	Baudrate = 250000
+	MaxSlots = 512
+
+	// Conf is the character format used by DMX512.
+	Conf = lpuart.Word8b | lpuart.Stop2b
+)
+
+// The timing used by Send. The values are the typical ones used by the
+// transmitters, well above the minimums required by the receivers
+// (break >= 88 µs, MAB >= 8 µs).
+var (
+	BreakTime = 176 * time.Microsecond
+	MABTime   = 12 * time.Microsecond
+)
+
+// Setup configures d for DMX512. You still have to enable the transmitter
+// and/or the receiver.
+func Setup(d *lpuart.Driver) error {
+	return d.Setup(Conf, Baudrate)
+}
+
+// Send sends one DMX512 packet. The packet[0] is the start code, the
+// remaining bytes are the slots. The length of packet must be in the range
+// 1 to MaxSlots+1. Send returns after the last slot has been written to the
+// Tx FIFO.
+func Send(d *lpuart.Driver, packet []byte) error {
+	if len(packet) == 0 || len(packet) > MaxSlots+1 {
+		panic("dmx512: bad packet length")
+	}
+	if err := d.SendBreak(BreakTime); err != nil {
+		return err
+	}
+	// SendBreak returned after the end of break so the line is in the mark
+	// state now.
+	end := time.Now().Add(MABTime)
+	for time.Now().Before(end) {
+	}
+	_, err := d.Write(packet)
+	return err
+}
+
+// A Receiver receives DMX512 packets using the lpuart.Driver. The driver's
+// read timeout and CancelRead method apply to the Receive method.
+type Receiver struct {
+	d      *lpuart.Driver
+	synced bool
+}
+
+// NewReceiver returns a new receiver that uses d to receive packets.
+func NewReceiver(d *lpuart.Driver) *Receiver {
+	return &Receiver{d: d}
+}
+
+// Receive receives the next DMX512 packet into buf (start code in buf[0]) and
+// returns its length. It returns when the break that starts the next packet
+// is received or buf is full. Any bytes that don't fit into buf are skipped.
+//
+// If the data stream contains errors or lost data Receive returns the already
+// received part of the packet with the error and the next call skips the rest
+// of the damaged packet.
+func (r *Receiver) Receive(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	d := r.d
+	if !r.synced {
+		// Wait for break.
+		var b [1]byte
+		for {
+			_, err = d.Read(b[:])
+			if err == nil {
+				continue
+			}
+			if e, ok := err.(lpuart.Error); ok && e&lpuart.EBREAK != 0 {
+				break
+			}
+			if _, ok := err.(lpuart.Error); !ok && err != lpuart.ErrBufOverflow {
+				return 0, err // timeout, canceled
+			}
+		}
+		r.synced = true
+	}
+	for n < len(buf) {
+		var m int
+		m, err = d.Read(buf[n:])
+		n += m
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(lpuart.Error); ok && e&lpuart.EBREAK != 0 {
+			n-- // remove the break character
+			if n == 0 {
+				continue // long break received as multiple break characters
+			}
+			return n, nil // r.synced remains true
+		}
+		r.synced = false
+		return n, err
+	}
+	r.synced = false
+	return n, nil
+}
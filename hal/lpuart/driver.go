@@ -7,6 +7,7 @@ package lpuart
 import (
 	"embedded/rtos"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -20,11 +21,12 @@ const (
 	EFRAMING = Error(FE)
 	ENOISE   = Error(NF)
 	EOVERRUN = Error(OR)
+	EBREAK   = Error(LBKDIF) // break character received (see IsBreak)
 )
 
 func (e Error) Error() string {
 	var (
-		a [4]string
+		a [5]string
 		n int
 	)
 	if e&EPARITY != 0 {
@@ -43,6 +45,10 @@ func (e Error) Error() string {
 		a[n] = "overrun"
 		n++
 	}
+	if e&EBREAK != 0 {
+		a[n] = "break"
+		n++
+	}
 	return "lpurat: " + strings.Join(a[:n], ",")
 }
 
@@ -57,6 +63,20 @@ const (
 	// operation has been interrupted. In case of write you can not determine
 	// the exact number of bytes sent to the remote party.
 	ErrTimeout
+
+	// ErrBaudMismatch is returned by AutoBaud if the measured baudrate
+	// deviates too much from the nearest standard baudrate.
+	ErrBaudMismatch
+
+	// ErrCanceled is returned if the read/write operation has been aborted by
+	// the CancelRead/CancelWrite method. In case of write you can not determine the exact
+	// number of bytes sent to the remote party.
+	ErrCanceled
+
+	// ErrBaudrate is returned by SetBaudrate and Setup if the requested
+	// baudrate can not be achieved with the current UART clock root
+	// frequency within BaudTolerance.
+	ErrBaudrate
 )
 
 // Error implements error interface.
@@ -66,10 +86,21 @@ func (e DriverError) Error() string {
 		return "lpuart: Rx buffer overflow"
 	case ErrTimeout:
 		return "lpuart: timeout"
+	case ErrBaudMismatch:
+		return "lpuart: baudrate mismatch"
+	case ErrCanceled:
+		return "lpuart: canceled"
+	case ErrBaudrate:
+		return "lpuart: baudrate out of tolerance"
 	}
 	return ""
 }
 
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
+
 // A Driver is a driver to the LPUART peripheral. It provides standard io.Reader
 // and io.Writer interface that can be used to read/write stream of 8-bit
 // characters. It also provides couple of methods to configure and manage the
@@ -79,10 +110,12 @@ func (e DriverError) Error() string {
 //
 // The receiver, if enabled, continuously writes received data to the internal
 // ring buffer which minimizes the risk of data loss. All provided reading
-// methods read from this buffer. The detection of a buffer overflow is based on
-// a best-effort strategy. You cannot rely on it, nor can you rely on error
-// detection provided by hardware. Both provide qualitative, not quantitative,
-// information.
+// methods read from this buffer. Every received character is stored together
+// with its error flags. Any data loss (buffer overflow or hardware overrun) is
+// reported by the reading methods at the position in the data stream where it
+// occured and the number of lost characters is available using RxStats. In
+// no-DMA mode the newest characters are dropped if the buffer is full. In DMA
+// mode the oldest ones are overwritten.
 //
 // The sending and receiving subsystems of the driver are completly independent.
 // Each of them can be independently turned on, off, and used by different
@@ -92,17 +125,29 @@ type Driver struct {
 
 	// Rx fields
 	rxtimeout time.Duration
+	rxcancel  uint32
 	rxdma     dma.Channel
 	rxready   rtos.Note
 	rxbuf     []uint16 // Rx ring buffer
-	nextr     uint32   // 30 LSBits: index in rxbuf, 2 MSBits: loop count
-	nextw     uint32   // 30 LSBits: index in rxbuf, 2 MSBits: loop count
-	rxwake    uint32
-	rxdman    uint32
-	rxfirst   uint16
+	rxr       uint32   // read position, see nshift
+	rxw       uint32   // write position (no-DMA mode), see nshift
+	rxwait    uint32   // reader waits for data
+	rxdman    uint32   // number of DMA major loops (DMA mode)
+	rxdmast   uint32   // write position seen by the last RxDMAISR (DMA mode)
+	rxframes  uint32   // number of received characters (no-DMA mode)
+	rxdrop    uint32   // number of dropped characters (no-DMA mode)
+	rxovr     uint32   // number of overrun events
+	rxlossn   uint32   // number of recorded losses (written by ISR)
+	rxlossa   uint32   // number of reported losses (written by reader)
+	rxlossp   uint32   // position of the first unreported loss
+	rxlossk   uint32   // kind of the first unreported loss
+	rxstats   RxStats  // statistics updated by reader
+	rxbase    RxStats  // statistics at the time of ResetRxStats
 
 	// Tx fields
 	txtimeout time.Duration
+	txcancel  uint32
+	txdl      time.Time // deadline of the current Write*/SendBreak call
 	txdma     dma.Channel
 	txd       unsafe.Pointer
 	txi       int
@@ -117,7 +162,6 @@ func NewDriver(p *Periph, rxdma, txdma dma.Channel) *Driver {
 		p:         p,
 		rxtimeout: -1,
 		rxdma:     rxdma,
-		rxfirst:   RXEMPT,
 		txtimeout: -1,
 		txdma:     txdma,
 	}
@@ -153,8 +197,9 @@ func (d *Driver) SetConfig(conf Config) {
 }
 
 // Setup enables clock source, resets, and configures the LPUART peripheral. You
-// still have to enable Tx and/or Rx before use it.
-func (d *Driver) Setup(conf Config, baudrate int) {
+// still have to enable Tx and/or Rx before use it. It returns ErrBaudrate if
+// the requested baudrate can not be set (see SetBaudrate).
+func (d *Driver) Setup(conf Config, baudrate int) error {
 	p := d.p
 	p.EnableClock(true)
 	p.GLOBAL.Store(RST) // reset
@@ -178,9 +223,10 @@ func (d *Driver) Setup(conf Config, baudrate int) {
 		// Enable DMA requests. Gates IRQ (undocumented?).
 		p.BAUD.StoreBits(TDMAE|RDMAE, dmae)
 	}
-	p.SetBaudrate(baudrate)
+	err := p.SetBaudrate(baudrate)
 	d.SetConfig(conf)
 	d.txlog2max = uint(d.p.PARAM.LoadBits(TXFIFO) >> TXFIFOn)
+	return err
 }
 
 // SetReadTimeout sets the read timeout used by Read* functions.
@@ -193,14 +239,54 @@ func (d *Driver) SetWriteTimeout(timeout time.Duration) {
 	d.txtimeout = timeout
 }
 
+// CancelRead aborts the Read* method currently in progress. The aborted method
+// returns ErrCanceled. CancelRead is intended to be called by another
+// goroutine. It has no effect if there is no read in progress.
+func (d *Driver) CancelRead() {
+	atomic.StoreUint32(&d.rxcancel, 1)
+	d.rxready.Wakeup()
+}
+
+// CancelWrite works like CancelRead but aborts the Write* or SendBreak method
+// currently in progress. The aborted write flushes the Tx FIFO.
+func (d *Driver) CancelWrite() {
+	atomic.StoreUint32(&d.txcancel, 1)
+	d.txdone.Wakeup()
+}
+
+// deadline returns the deadline of the operation that starts now and should
+// not last longer than timeout. It returns zero Time for timeout < 0.
+func deadline(timeout time.Duration) time.Time {
+	if timeout < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// until returns the time remaining to the deadline dl or -1 if dl is zero.
+func until(dl time.Time) time.Duration {
+	if dl.IsZero() {
+		return -1
+	}
+	if t := time.Until(dl); t > 0 {
+		return t
+	}
+	return 0
+}
+
+// expired reports whether the deadline dl has passed.
+func expired(dl time.Time) bool {
+	return !dl.IsZero() && time.Now().After(dl)
+}
+
 //go:nosplit
 //go:nowritebarrierrec
 func (d *Driver) ISR() {
 	p := d.p
 	ctrl := p.CTRL.Load()
 	stat := p.STAT.Load()
-	if ctrl&RIE != 0 && stat&RDRF != 0 {
-		rxISR(d)
+	if ctrl&(RIE|ILIE|ORIE) != 0 && stat&(RDRF|IDLE|OR) != 0 {
+		rxISR(d, stat)
 	}
 	if ctrl&TIE != 0 && stat&TDRE != 0 {
 		txISR(d)
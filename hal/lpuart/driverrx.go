@@ -13,16 +13,20 @@ import (
 	"github.com/embeddedgo/imxrt/hal/internal"
 )
 
-// TODO(md): The Rx code is too tangled and unclear. Simplify it and avoid using
-// atomics for MMIO registers because it's unclear does they work as intended.
-// See lpi2c for example of well written code that doesn't use atomics.
-
+// The positions in the Rx ring buffer are stored as uint32 values. 24 LSBits
+// contain the index in rxbuf, 8 MSBits contain the wrap counter.
 const (
 	nshift = 24
 	imask  = uint32(0xffff_ffff) >> (32 - nshift)
 	nmask  = int(uint32(0xffff_ffff) >> nshift)
 )
 
+// Rx loss kinds recorded in Driver.rxlossk.
+const (
+	lossOverflow = 1 << iota // Rx buffer overflow
+	lossOverrun              // hardware overrun (STAT[OR])
+)
+
 // All dma.Mux slot constants are less than 128 so we can easily group them in
 // constant array.
 const rxDMASlots = "" +
@@ -45,6 +49,19 @@ func (d *Driver) EnableRx(bufLen int) {
 	if bufLen < 2 {
 		panic("lpuart: bufLen < 2")
 	}
+	d.rxr = 0
+	d.rxw = 0
+	d.rxdman = 0
+	d.rxdmast = 0
+	d.rxframes = 0
+	d.rxdrop = 0
+	d.rxovr = 0
+	d.rxlossn = 0
+	d.rxlossa = 0
+	d.rxwait = 0
+	d.rxstats = RxStats{}
+	d.rxbase = RxStats{}
+	ie := RIE | ORIE
 	if rxdma := d.rxdma; rxdma.IsValid() {
 		const align = dma.MemAlign - 1
 		bufLen = (bufLen + align) &^ align
@@ -62,421 +79,489 @@ func (d *Driver) EnableRx(bufLen int) {
 			DOFF:        2,
 			ELINK_CITER: int16(len(d.rxbuf)),
 			DLAST_SGA:   int32(-size),
-			CSR:         dma.INTMAJOR,
+			CSR:         dma.INTHALF | dma.INTMAJOR,
 			ELINK_BITER: int16(len(d.rxbuf)),
 		}
 		rxdma.WriteTCD(&tcd)
 		rxdma.SetMux(dma.Mux(rxDMASlots[num(d.p)]) | dma.En)
 		rxdma.EnableReq()
+		// The DMA requests gate the RDRF interrupt. The waiting reader is
+		// woken up by the DMA interrupts (half and full buffer) or by the
+		// idle line interrupt.
+		ie = ILIE | ORIE
 	} else {
 		if bufLen > 1<<nshift {
 			bufLen = 1 << nshift
 		}
 		d.rxbuf = make([]uint16, bufLen)
 	}
-	internal.ExclusiveStoreBits(&d.p.CTRL, RE|RIE, RE|RIE)
+	internal.ExclusiveStoreBits(&d.p.CTRL, RE|RIE|ILIE|ORIE, RE|ie)
 }
 
 // DisableRx disables receiver and discards all data in Rx buffer. Disabled
 // driver cannot be used to read data.
 func (d *Driver) DisableRx() {
 	p := d.p
-	internal.ExclusiveStoreBits(&p.CTRL, RE|RIE, 0)
+	internal.ExclusiveStoreBits(&p.CTRL, RE|RIE|ILIE|ORIE, 0)
 	for p.CTRL.LoadBits(RE) != 0 {
 		// wait for receiver to finish receiving the last character
 	}
-	for p.DATA.Load()&RXEMPT == 0 {
-		// empty the FIFO to ensure the Rx ISR will no longer use the buffer
-	}
 	if rxdma := d.rxdma; rxdma.IsValid() {
 		rxdma.DisableReq()
 		for rxdma.IsReq() {
 		}
-		d.rxdman = 0
 	}
-	d.nextr = 0
-	d.nextw = 0
-	d.rxfirst = RXEMPT
+	for p.DATA.Load()&RXEMPT == 0 {
+		// empty the FIFO
+	}
+	clearStat(p, OR|IDLE)
 	d.rxbuf = nil
 }
 
-// DiscardRx discards all rceived data.
+// DiscardRx discards all rceived data. The discarded characters are not
+// counted as dropped ones.
 func (d *Driver) DiscardRx() {
-	rxbuf := d.rxbuf
-	d.DisableRx()
-	d.rxbuf = rxbuf
-	if d.rxdma.IsValid() {
-		d.nextr = uint32(len(d.rxbuf) - int(d.rxdma.TCD().ELINK_CITER.Load()))
-	}
-	internal.ExclusiveStoreBits(&d.p.CTRL, RE|RIE, RE|RIE)
+	w := rxWritten(d)
+	atomic.StoreUint32(&d.rxlossa, atomic.LoadUint32(&d.rxlossn))
+	atomic.StoreUint32(&d.rxr, w)
 }
 
-// Len returns the number of buffered characters in the Rx ring buffre or -1
-// if it detected the overflow condition.
+// Len returns the number of buffered characters in the Rx ring buffer.
 func (d *Driver) Len() int {
-	ir, nr := int(d.nextr&imask), int(d.nextr>>nshift)
-	nextw := getNextwDMA(d)
-	iw, nw := int(nextw&imask), int(nextw>>nshift)
-	n := (nw-nr)&nmask*len(d.rxbuf) + (iw - ir)
-	if uint(n) > uint(len(d.rxbuf)) {
-		n = -1
+	w := rxWritten(d)
+	n := rxdist(d, d.rxr, w)
+	if n > len(d.rxbuf) {
+		n = len(d.rxbuf) // overflow detected, will be reported by the reader
 	}
 	return n
 }
 
-//go:nosplit
-func rxISR(d *Driver) {
-	wake := atomic.CompareAndSwapUint32(&d.rxwake, 1, 0)
-	if rxdma := d.rxdma; rxdma.IsValid() {
-		if wake {
-			// Complete the DMA disabling sequence (see IMXRT1060RM_rev3 6.4.8).
-			// Skip RDMAE check because it should be 0 if Rx IRQ is taken.
-			for rxdma.IsReq() {
+// RxStats contains the receiver statistics. All counters wrap around modulo
+// 2^32.
+//
+// The Frames, Dropped and Overruns counters are exact. The Parity, Framing,
+// Noise and Breaks counters are updated when the characters are read from the
+// Rx buffer so they don't include the dropped characters.
+type RxStats struct {
+	Frames   uint32 // characters received by the driver (including dropped)
+	Dropped  uint32 // characters lost because of the Rx buffer overflow
+	Overruns uint32 // hardware overrun events (the number of lost chars unknown)
+	Parity   uint32 // characters received with the parity error
+	Framing  uint32 // characters received with the framing error (not breaks)
+	Noise    uint32 // characters received with the noise flag set
+	Breaks   uint32 // received break characters
+}
+
+// RxStats returns the receiver statistics collected since the last call of
+// ResetRxStats or EnableRx. RxStats should be called by the same goroutine
+// that reads the received data.
+func (d *Driver) RxStats() RxStats {
+	s := d.rxstats
+	if d.rxdma.IsValid() {
+		for {
+			dman := atomic.LoadUint32(&d.rxdman)
+			st := atomic.LoadUint32(&d.rxdmast)
+			pos := rxDMAPos(d)
+			if dman != atomic.LoadUint32(&d.rxdman) {
+				continue
 			}
-			// If rxbuf is still empty make the first character available to the
-			// waiting goroutine before enabling DMA. Required because there is
-			// no guarantee that the DMA will read anything on time.
-			if getNextwDMA(d) == d.nextr {
-				d.rxfirst = d.p.DATA.Load()
+			if pos < st&imask {
+				dman++
 			}
-			d.p.BAUD.StoreBits(RDMAE, RDMAE) // enable DMA and gate IRQ
-			d.rxready.Wakeup()
+			s.Frames = dman*uint32(len(d.rxbuf)) + pos
+			break
 		}
+	} else {
+		s.Frames = atomic.LoadUint32(&d.rxframes)
+		s.Dropped = atomic.LoadUint32(&d.rxdrop)
+	}
+	s.Overruns = atomic.LoadUint32(&d.rxovr)
+	b := &d.rxbase
+	s.Frames -= b.Frames
+	s.Dropped -= b.Dropped
+	s.Overruns -= b.Overruns
+	s.Parity -= b.Parity
+	s.Framing -= b.Framing
+	s.Noise -= b.Noise
+	s.Breaks -= b.Breaks
+	return s
+}
+
+// ResetRxStats resets all receiver statistics counters.
+func (d *Driver) ResetRxStats() {
+	d.rxbase = RxStats{}
+	d.rxbase = d.RxStats()
+}
+
+// clearStat clears the w1c flags in the STAT register without touching other
+// ones.
+//
+//go:nosplit
+func clearStat(p *Periph, flags STAT) {
+	const w1c = LBKDIF | RXEDGIF | IDLE | OR | NF | FE | PF | MA1F | MA2F
+	p.STAT.Store(p.STAT.Load()&^w1c | flags)
+}
+
+// rxdist returns the distance between two positions in the Rx buffer.
+//
+//go:nosplit
+func rxdist(d *Driver, from, to uint32) int {
+	if_, nf := int(from&imask), int(from>>nshift)
+	it, nt := int(to&imask), int(to>>nshift)
+	return (nt-nf)&nmask*len(d.rxbuf) + (it - if_)
+}
+
+// rxadd returns the position n characters after pos.
+//
+//go:nosplit
+func rxadd(d *Driver, pos uint32, n int) uint32 {
+	i, nw := int(pos&imask)+n, pos>>nshift
+	for i >= len(d.rxbuf) {
+		i -= len(d.rxbuf)
+		nw++
+	}
+	return nw<<nshift | uint32(i)
+}
+
+// rxloss records the loss of received data at the position pos.
+//
+//go:nosplit
+func rxloss(d *Driver, pos, kind uint32) {
+	n := d.rxlossn
+	if n != atomic.LoadUint32(&d.rxlossa) {
+		// The previous loss has not been reported yet. Merge both of them.
+		atomic.StoreUint32(&d.rxlossk, d.rxlossk|kind)
 		return
 	}
-	if wake {
-		// Use d.rxfirst also in no-DMA mode (works well, preserves symmetry).
-		d.rxfirst = d.p.DATA.Load()
+	atomic.StoreUint32(&d.rxlossp, pos)
+	atomic.StoreUint32(&d.rxlossk, kind)
+	atomic.StoreUint32(&d.rxlossn, n+1) // must be the last one
+}
+
+//go:nosplit
+func rxwakeup(d *Driver) {
+	if atomic.LoadUint32(&d.rxwait) != 0 {
+		atomic.StoreUint32(&d.rxwait, 0)
 		d.rxready.Wakeup()
 	}
-	// Empty the FIFO quickly. Goal is speed so d.nextw is updated at the end
-	// and there is no overflow checking (same as in DMA mode).
-	iw := int(d.nextw & imask)
-	nw := int(d.nextw >> nshift)
+}
+
+//go:nosplit
+func rxISR(d *Driver, stat STAT) {
+	p := d.p
+	if d.rxdma.IsValid() {
+		if stat&OR != 0 {
+			for p.WATER.LoadBits(RXCOUNT) != 0 {
+				// wait for DMA to read the characters received before overrun
+			}
+			w := rxWritten(d)
+			rxloss(d, w, lossOverrun)
+			atomic.StoreUint32(&d.rxovr, d.rxovr+1)
+		}
+		clearStat(p, stat&(OR|IDLE))
+		rxwakeup(d)
+		return
+	}
+	r := atomic.LoadUint32(&d.rxr)
+	w := d.rxw
+	iw, nw := int(w&imask), w>>nshift
+	frames, drop := d.rxframes, d.rxdrop
 	rxbuf := d.rxbuf
-	dr := &d.p.DATA
+	dr := &p.DATA
+	var lossk uint32
 	for {
 		data := dr.Load()
 		if data&RXEMPT != 0 {
 			break
 		}
+		frames++
+		if rxdist(d, r, nw<<nshift|uint32(iw)) >= len(rxbuf) {
+			// Drop the new character. The buffered ones remain intact.
+			lossk = lossOverflow
+			drop++
+			continue
+		}
 		rxbuf[iw] = data
 		if iw++; iw == len(rxbuf) {
 			iw = 0
 			nw++
 		}
 	}
-	atomic.StoreUint32(&d.nextw, uint32(nw<<nshift|iw))
-}
-
-func waitRxData(d *Driver) (uint32, error) {
-	nextr := d.nextr
-	nextw := atomic.LoadUint32(&d.nextw)
-	if nextw != nextr {
-		goto dataInBuffer
-	}
-	if stat := &d.p.STAT; stat.Load()&OR != 0 {
-		stat.Store(OR)
-		return 0, Error(OR)
-	}
-	d.rxready.Clear()
-	atomic.StoreUint32(&d.rxwake, 1)
-	nextw = atomic.LoadUint32(&d.nextw)
-	if nextw != nextr {
-		if !atomic.CompareAndSwapUint32(&d.rxwake, 1, 0) {
-			d.rxready.Sleep(-1) // wait for the upcoming wake-up
-		}
-		goto dataInBuffer
-	}
-	if !d.rxready.Sleep(d.rxtimeout) {
-		if atomic.CompareAndSwapUint32(&d.rxwake, 1, 0) {
-			return 0, ErrTimeout
-		}
-		d.rxready.Sleep(-1) // wait for the upcoming wake-up
-	}
-	nextw = atomic.LoadUint32(&d.nextw)
-dataInBuffer:
-	iw, nw := int(nextw&imask), int(nextw>>nshift)
-	ir, nr := int(nextr&imask), int(nextr>>nshift)
-	n := (nw-nr)&nmask*len(d.rxbuf) + (iw - ir) // number of buffered words
-	if uint(n) > uint(len(d.rxbuf)) {
-		// Discard buffered data. Does it make sense to salvage something?
-		d.nextr = nextw
-		return 0, ErrBufOverflow
-	}
-	return nextw, nil
+	if stat&OR != 0 {
+		// The FIFO has been emptied so the lost characters are just after the
+		// already buffered ones.
+		lossk |= lossOverrun
+		atomic.StoreUint32(&d.rxovr, d.rxovr+1)
+		clearStat(p, OR)
+	}
+	atomic.StoreUint32(&d.rxframes, frames)
+	atomic.StoreUint32(&d.rxdrop, drop)
+	w = nw<<nshift | uint32(iw)
+	atomic.StoreUint32(&d.rxw, w)
+	if lossk != 0 {
+		// All characters were lost at the current write position. Record the
+		// loss after publishing rxw so the reader never sees a loss position
+		// beyond the written data.
+		rxloss(d, w, lossk)
+	}
+	rxwakeup(d)
 }
 
+// RxDMAISR must be called by the Rx DMA channel interrupt handler if the
+// driver uses DMA for receiving data.
+//
+//go:nosplit
 func (d *Driver) RxDMAISR() {
-	atomic.StoreUint32(&d.rxdman, d.rxdman+1) // must be before ClearInt
 	d.rxdma.ClearInt()
+	// The interrupts occur at half and at the end of the buffer so there is
+	// no way to miss the wrap around if the ISR latency is lower than the time
+	// of receiving the half of the buffer.
+	st := d.rxdmast
+	pos := rxDMAPos(d)
+	if pos < st&imask {
+		st += 1 << nshift
+		atomic.StoreUint32(&d.rxdman, d.rxdman+1)
+	}
+	atomic.StoreUint32(&d.rxdmast, st&^imask|pos)
+	rxwakeup(d)
 }
 
-func getNextwDMA(d *Driver) uint32 {
-	var citer int
-	rxdma := d.rxdma
-	tcd := rxdma.TCD()
-	irq := rxdma.IsInt()
-	rxdman := atomic.LoadUint32(&d.rxdman) // must be after IsInt
-	for {
-		citer = int(tcd.ELINK_CITER.Load())
-		irq1 := rxdma.IsInt()
-		rxdman1 := atomic.LoadUint32(&d.rxdman) // must be after IsInt
-		if !irq && !irq1 && rxdman == rxdman1 {
-			break
-		}
-		irq = irq1
-		rxdman = rxdman1
+//go:nosplit
+func rxDMAPos(d *Driver) uint32 {
+	citer := int(d.rxdma.TCD().ELINK_CITER.Load())
+	if citer >= len(d.rxbuf) {
+		return 0
 	}
-	return uint32(len(d.rxbuf)-citer) | rxdman<<nshift
+	return uint32(len(d.rxbuf) - citer)
 }
 
-func disableIRQenableDMAifnoISR(d *Driver) (noisr bool) {
-	internal.ExclusiveStoreBits(&d.p.CTRL, RIE, 0) // ensure valid noisr below
-	noisr = atomic.CompareAndSwapUint32(&d.rxwake, 1, 0)
-	if noisr {
-		d.p.BAUD.StoreBits(RDMAE, RDMAE) // enable DMA and gate IRQ
+// rxWritten returns the position of the next character to be written to the
+// Rx buffer.
+//
+//go:nosplit
+func rxWritten(d *Driver) uint32 {
+	if !d.rxdma.IsValid() {
+		return atomic.LoadUint32(&d.rxw)
 	}
-	internal.ExclusiveStoreBits(&d.p.CTRL, RIE, RIE) // reanable gated IRQ
-	return
+	st := atomic.LoadUint32(&d.rxdmast)
+	pos := rxDMAPos(d)
+	if pos < st&imask {
+		st += 1 << nshift // wrapped around, the ISR has not run yet
+	}
+	return st&^imask | pos
 }
 
-func waitRxDataDMA(d *Driver, m int) (uint32, error) {
-	nextr := d.nextr
-	nextw := getNextwDMA(d)
-	if nextw != nextr {
-		goto dataInBuffer
-	}
-	if stat := &d.p.STAT; stat.Load()&OR != 0 {
-		stat.Store(OR)
-		return 0, Error(OR)
-	}
-	d.rxwake = 1
-	d.rxready.Clear()
-	d.p.BAUD.StoreBits(RDMAE, 0) // disable DMA and ungate IRQ
-	nextw = getNextwDMA(d)
-	if nextw != nextr {
-		if !disableIRQenableDMAifnoISR(d) {
-			d.rxready.Sleep(-1) // wait for the upcoming wake-up
-		}
-		goto dataInBuffer
-	}
-	if !d.rxready.Sleep(d.rxtimeout) {
-		if disableIRQenableDMAifnoISR(d) {
-			return 0, ErrTimeout
-		}
-		d.rxready.Sleep(-1) // wait for the upcoming wake-up
-	}
-	nextw = getNextwDMA(d)
-dataInBuffer:
-	iw, nw := int(nextw&imask), int(nextw>>nshift)
-	ir, nr := int(nextr&imask), int(nextr>>nshift)
-	n := (nw-nr)&nmask*len(d.rxbuf) + (iw - ir) // number of buffered words
-	if uint(n) > uint(len(d.rxbuf)) {
-		// Discard buffered data. Does it make sense to salvage something?
-		d.nextr = nextw
-		d.nextw = nextw // reset the cache maintanence pointer
+// rxAvail returns the number of characters that can be read in one chunk
+// from the Rx buffer without waiting. It returns an error if the reader
+// reached the position of a lost data.
+func rxAvail(d *Driver) (n int, err error) {
+	r := d.rxr
+	w := rxWritten(d)
+	n = rxdist(d, r, w)
+	if n > len(d.rxbuf) {
+		// The DMA overwrote the oldest characters.
+		lost := n - len(d.rxbuf)
+		d.rxstats.Dropped += uint32(lost)
+		atomic.StoreUint32(&d.rxr, rxadd(d, r, lost))
 		return 0, ErrBufOverflow
 	}
-	if m > n {
-		m = n
-	}
-	// To avoid unnecessary cache maintenance operations check if the reading
-	// applies to the buffer area for which the cache may be invalid.
-	if ir += m; ir >= len(d.rxbuf) {
-		ir -= len(d.rxbuf)
-		nr = (nr + 1) & nmask
-	}
-	im, nm := int(d.nextw&imask), int(d.nextw>>nshift)
-	if uint((nm-nr)&nmask*len(d.rxbuf)+(im-ir)) > uint(len(d.rxbuf)) {
-		d.nextw = nextw
-		n := iw - im
-		switch {
-		case n > 0:
-			ptr := unsafe.Pointer(&d.rxbuf[im])
-			rtos.CacheMaint(rtos.DCacheInval, ptr, n*2)
-		case n < 0:
-			ptr := unsafe.Pointer(&d.rxbuf[0])
-			if n > -64*dma.MemAlign/2 {
-				n = len(d.rxbuf) // invalidate the entire buffer at once
-			} else {
-				n = iw // first, invalidate the bottom part of the buffer
-			}
-			rtos.CacheMaint(rtos.DCacheInval, ptr, n*2)
-			if n == len(d.rxbuf) {
-				break
+	if ln := atomic.LoadUint32(&d.rxlossn); ln != d.rxlossa {
+		if m := rxdist(d, r, atomic.LoadUint32(&d.rxlossp)); m <= 0 || m > n {
+			// The reader reached the lost data or has already skipped them
+			// because of the DMA buffer overflow (m < 0).
+			atomic.StoreUint32(&d.rxlossa, ln)
+			if atomic.LoadUint32(&d.rxlossk)&lossOverrun != 0 {
+				return 0, EOVERRUN
 			}
-			ptr = unsafe.Pointer(&d.rxbuf[im]) // then, the top part
-			n = len(d.rxbuf) - im
-			rtos.CacheMaint(rtos.DCacheInval, ptr, n*2)
-		default: // n == 0
-			// iw points to new data, cannot be equal im, undetected overflow
 			return 0, ErrBufOverflow
+		} else if m < n {
+			n = m // read up to the lost data
 		}
-
-		// TODO: Why such complicated D-cache invalidation pattern. Isn't
-		// better to invalidate the whole circular buffer after reaching it's
-		// end and wrapping to the beggining?
 	}
-	return nextw, nil
+	if m := len(d.rxbuf) - int(r&imask); n > m {
+		n = m
+	}
+	return n, nil
 }
 
-const dataErrMask = FRETSC | PARITYE | NOISY
-
-func dataError(w uint16) error {
-	return Error(w&FRETSC)<<(FEn-FRETSCn) | Error(w&PARITYE)<<(PFn-PARITYEn) |
-		Error(w&NOISY)<<(NFn-NOISYn)
+// rxWait waits for data in the Rx buffer. It returns the number of characters
+// that can be read in one chunk.
+func rxWait(d *Driver) (n int, err error) {
+	atomic.StoreUint32(&d.rxcancel, 0) // forget CancelRead called before
+	dl := deadline(d.rxtimeout)
+	for {
+		if n, err = rxAvail(d); n != 0 || err != nil {
+			return
+		}
+		d.rxready.Clear()
+		atomic.StoreUint32(&d.rxwait, 1)
+		if n, err = rxAvail(d); n != 0 || err != nil {
+			atomic.StoreUint32(&d.rxwait, 0)
+			return
+		}
+		if atomic.SwapUint32(&d.rxcancel, 0) != 0 {
+			atomic.StoreUint32(&d.rxwait, 0)
+			return 0, ErrCanceled
+		}
+		if !d.rxready.Sleep(until(dl)) {
+			atomic.StoreUint32(&d.rxwait, 0)
+			if n, err = rxAvail(d); n == 0 && err == nil {
+				err = ErrTimeout
+			}
+			return
+		}
+	}
 }
 
-// ReadByte implements the io.ByteReader interface.
-func (d *Driver) ReadByte() (byte, error) {
-	var err error
+// rxData returns n characters from the Rx buffer starting from the current
+// read position. n must be less than or equal to the value returned by rxWait.
+func rxData(d *Driver, n int) []uint16 {
+	ir := int(d.rxr & imask)
+	data := d.rxbuf[ir : ir+n]
 	if d.rxdma.IsValid() {
-		_, err = waitRxDataDMA(d, 1)
-	} else {
-		_, err = waitRxData(d)
+		// CPU never writes to rxbuf so there are no dirty cache lines in it.
+		// Invalidate the cache lines that contain the data to be read.
+		const align = dma.MemAlign - 1
+		start := uintptr(unsafe.Pointer(&data[0])) &^ align
+		end := (uintptr(unsafe.Pointer(&data[0])) + uintptr(n)*2 + align) &^ align
+		rtos.CacheMaint(rtos.DCacheInval, unsafe.Pointer(start), int(end-start))
 	}
-	if err != nil {
-		return 0, err
+	return data
+}
+
+// rxCommit moves the read position by n characters. In DMA mode it checks
+// that the read characters were not overwritten while they were being read.
+// All characters that were not passed to the user are counted as dropped.
+func rxCommit(d *Driver, n int) error {
+	r := d.rxr
+	if d.rxdma.IsValid() {
+		w := rxWritten(d)
+		if over := rxdist(d, r, w) - len(d.rxbuf); over > 0 {
+			if over < n {
+				over = n
+			}
+			d.rxstats.Dropped += uint32(over)
+			d.rxr = rxadd(d, r, over)
+			return ErrBufOverflow
+		}
 	}
-	w := d.rxfirst
-	if w&RXEMPT == 0 {
-		d.rxfirst = RXEMPT
-	} else {
-		ir, nr := int(d.nextr&imask), int(d.nextr>>nshift)
-		w = d.rxbuf[ir]
-		if ir++; ir == len(d.rxbuf) {
-			ir = 0
-			nr++
+	atomic.StoreUint32(&d.rxr, rxadd(d, r, n))
+	return nil
+}
+
+const dataErrMask = FRETSC | PARITYE | NOISY
+
+// rxCount updates the error statistics for the data passed to the user.
+func rxCount(d *Driver, data []uint16) {
+	s := &d.rxstats
+	for _, w := range data {
+		if w&dataErrMask == 0 {
+			continue
+		}
+		if w&PARITYE != 0 {
+			s.Parity++
+		}
+		if w&NOISY != 0 {
+			s.Noise++
+		}
+		if w&FRETSC != 0 {
+			if IsBreak(w) {
+				s.Breaks++
+			} else {
+				s.Framing++
+			}
 		}
-		d.nextr = uint32(nr<<nshift | ir)
 	}
-	if w&dataErrMask != 0 {
-		err = dataError(w)
+}
+
+func dataError(w uint16) error {
+	e := Error(w&FRETSC)<<(FEn-FRETSCn) | Error(w&PARITYE)<<(PFn-PARITYEn) |
+		Error(w&NOISY)<<(NFn-NOISYn)
+	if IsBreak(w) {
+		// The break is a frame delimiter in many protocols (DMX512, LIN,
+		// SDI-12) so report it separately from the framing errors.
+		e = e&^EFRAMING | EBREAK
 	}
-	return byte(w), err
+	return e
 }
 
 // ReadWord16 works like ReadByte but returns all bits that can be read from
 // DATA register (up to 10 data bits and 4 status/error flags). Because of this
 // the error flags are not returned in error.
 func (d *Driver) ReadWord16() (uint16, error) {
-	var err error
-	if d.rxdma.IsValid() {
-		_, err = waitRxDataDMA(d, 1)
-	} else {
-		_, err = waitRxData(d)
-	}
-	if err != nil {
+	if _, err := rxWait(d); err != nil {
 		return 0, err
 	}
-	w := d.rxfirst
-	if w&RXEMPT == 0 {
-		d.rxfirst = RXEMPT
-	} else {
-		ir, nr := int(d.nextr&imask), int(d.nextr>>nshift)
-		w = d.rxbuf[ir]
-		if ir++; ir == len(d.rxbuf) {
-			ir = 0
-			nr++
-		}
-		d.nextr = uint32(nr<<nshift | ir)
+	data := rxData(d, 1)
+	w := data[0]
+	if err := rxCommit(d, 1); err != nil {
+		return 0, err
 	}
+	rxCount(d, data)
 	return w, nil
 }
 
-// Read implements the io.Reader interface.
+// ReadByte implements the io.ByteReader interface.
+func (d *Driver) ReadByte() (byte, error) {
+	w, err := d.ReadWord16()
+	if err == nil && w&dataErrMask != 0 {
+		err = dataError(w)
+	}
+	return byte(w), err
+}
+
+// Read implements the io.Reader interface. Read stops at the first character
+// received with an error flag set and returns it with the corresponding error.
+// The received break is returned as a zero byte with the EBREAK error. If some
+// data was lost Read returns the characters received before the loss and
+// reports it by the next call (ErrBufOverflow or EOVERRUN).
 func (d *Driver) Read(buf []byte) (n int, err error) {
 	if len(buf) == 0 {
 		return
 	}
-	var nextw uint32
-	if d.rxdma.IsValid() {
-		nextw, err = waitRxDataDMA(d, len(buf))
-	} else {
-		nextw, err = waitRxData(d)
-	}
-	if err != nil {
+	if n, err = rxWait(d); err != nil {
 		return
 	}
-	if w := d.rxfirst; w&RXEMPT == 0 {
-		d.rxfirst = RXEMPT
-		buf[n] = byte(w)
-		n++
-		if w&dataErrMask != 0 {
-			err = dataError(w)
-			return n, err
-		}
-		if d.nextr == nextw || n == len(buf) {
-			return
-		}
+	if n > len(buf) {
+		n = len(buf)
 	}
-	iw := int(nextw & imask)
-	ir, nr := int(d.nextr&imask), int(d.nextr>>nshift)
-	for {
-		w := d.rxbuf[ir]
-		buf[n] = byte(w)
-		n++
-		if ir++; ir == len(d.rxbuf) {
-			ir = 0
-			nr++
-		}
+	data := rxData(d, n)
+	for i, w := range data {
+		buf[i] = byte(w)
 		if w&dataErrMask != 0 {
 			err = dataError(w)
+			n = i + 1
+			data = data[:n]
 			break
 		}
-		if ir == iw || n == len(buf) {
-			break
-		}
 	}
-	d.nextr = uint32(nr<<nshift | ir)
+	if e := rxCommit(d, n); e != nil {
+		return 0, e
+	}
+	rxCount(d, data)
 	return n, err
 }
 
 // Read16 works like Read but transfers 16-bit words that contain all bits
 // read from DATA register (up to 10 data bits and 4 status/error flags per
 // word). Because of this Read16 does not stop on the detected error flag like
-// Read does and these flags are not returned in err.
+// Read does and these flags are not returned in err. Use IsBreak to find the
+// received break characters in buf.
 func (d *Driver) Read16(buf []uint16) (n int, err error) {
 	if len(buf) == 0 {
 		return
 	}
-	var nextw uint32
-	if d.rxdma.IsValid() {
-		nextw, err = waitRxDataDMA(d, len(buf))
-	} else {
-		nextw, err = waitRxData(d)
-	}
-	if err != nil {
+	if n, err = rxWait(d); err != nil {
 		return
 	}
-	if w := d.rxfirst; w&RXEMPT == 0 {
-		d.rxfirst = RXEMPT
-		buf[n] = w
-		n++
-		if d.nextr == nextw || n == len(buf) {
-			return
-		}
+	if n > len(buf) {
+		n = len(buf)
 	}
-	iw := int(nextw & imask)
-	ir, nr := int(d.nextr&imask), int(d.nextr>>nshift)
-	switch {
-	case ir < iw:
-		m := copy(buf[n:], d.rxbuf[ir:iw])
-		n += m
-		ir += m
-	default:
-		m := copy(buf[n:], d.rxbuf[ir:])
-		n += m
-		ir += m
-		if n == len(buf) || iw == 0 {
-			break
-		}
-		m = copy(buf[n:], d.rxbuf[:iw])
-		n += m
-		ir = m
-		nr++
+	data := rxData(d, n)
+	copy(buf, data)
+	if err = rxCommit(d, n); err != nil {
+		return 0, err
 	}
-	d.nextr = uint32(nr<<nshift | ir)
+	rxCount(d, data)
 	return n, nil
 }
@@ -7,7 +7,7 @@ package lpuart
 import (
 	"embedded/rtos"
 	"runtime"
-	"time"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/embeddedgo/imxrt/hal/dma"
@@ -84,24 +84,34 @@ func (d *Driver) TxDMAISR() {
 }
 
 func write(d *Driver, s string, s16 []uint16) (err error) {
-	if len(s) != 0 {
-		if len(s) == 1 {
-			return d.WriteWord16(uint16(s[0]))
+	n := len(s)
+	if n != 0 {
+		if n == 1 {
+			return writeWord16(d, uint16(s[0]))
 		}
 		d.txd = *(*unsafe.Pointer)(unsafe.Pointer(&s))
 		d.txn = len(s)
 	} else {
-		if len(s16) == 1 {
-			return d.WriteWord16(s16[0])
+		if n = len(s16); n == 1 {
+			return writeWord16(d, s16[0])
 		}
 		d.txd = unsafe.Pointer(&s16[0])
 		d.txn = -len(s16)
 	}
 	d.txdone.Clear()
 	internal.ExclusiveStoreBits(&d.p.CTRL, TIE, TIE)
-	if !d.txdone.Sleep(d.txtimeout) {
-		internal.ExclusiveStoreBits(&d.p.CTRL, TIE, 0)
+	if atomic.SwapUint32(&d.txcancel, 0) != 0 {
+		err = ErrCanceled
+	} else if !d.txdone.Sleep(until(d.txdl)) {
 		err = ErrTimeout
+	} else if d.txi != n && atomic.SwapUint32(&d.txcancel, 0) != 0 {
+		err = ErrCanceled
+	}
+	if err != nil {
+		internal.ExclusiveStoreBits(&d.p.CTRL, TIE, 0)
+		if err == ErrCanceled {
+			d.p.FIFO.SetBits(TXFLUSH)
+		}
 	}
 	d.txd = nil
 	d.txi = 0
@@ -146,12 +156,23 @@ func writeDMA(d *Driver, s string, s16 []uint16) error {
 	for {
 		d.txdone.Clear()
 		txdma.EnableReq()
-		if !d.txdone.Sleep(d.txtimeout) {
+		var err error
+		if atomic.SwapUint32(&d.txcancel, 0) != 0 {
+			err = ErrCanceled
+		} else if !d.txdone.Sleep(until(d.txdl)) {
+			err = ErrTimeout
+		} else if txdma.ReqEnabled() && atomic.SwapUint32(&d.txcancel, 0) != 0 {
+			err = ErrCanceled // DREQ clears ERQ at the end of the major loop
+		}
+		if err != nil {
 			txdma.DisableReq()
 			for tcdio.CSR.LoadBits(dma.ACTIVE) != 0 {
 				runtime.Gosched()
 			}
-			return ErrTimeout
+			if err == ErrCanceled {
+				d.p.FIFO.SetBits(TXFLUSH)
+			}
+			return err
 		}
 		if n -= m; n == 0 {
 			break
@@ -177,6 +198,13 @@ func dmaOffsets(p unsafe.Pointer, size int) (start, end uintptr) {
 	return
 }
 
+// txBegin prepares the driver to a new write operation. It sets the deadline
+// and forgets CancelWrite called before.
+func txBegin(d *Driver) {
+	atomic.StoreUint32(&d.txcancel, 0)
+	d.txdl = deadline(d.txtimeout)
+}
+
 // WriteString implements the io.StringWriter interface.
 //
 //go:nosplit
@@ -186,6 +214,9 @@ func (d *Driver) WriteString(s string) (n int, err error) {
 		return
 	case rtos.HandlerMode():
 		return sysWrite(d, s)
+	}
+	txBegin(d)
+	switch {
 	case len(s) >= 32 && d.txdma.IsValid():
 		// DMA can handle only cache-aligned transfers, because of the required
 		// cache maintenance operations that must don't overlap accidentally.
@@ -225,9 +256,11 @@ func (d *Driver) Write(p []byte) (int, error) {
 
 // Write16 works like Write but writes 16-bit words to the DATA register.
 func (d *Driver) Write16(s []uint16) (n int, err error) {
-	switch {
-	case len(s) == 0:
+	if len(s) == 0 {
 		return
+	}
+	txBegin(d)
+	switch {
 	case len(s) >= 16 && d.txdma.IsValid():
 		// DMA can handle only cache-aligned transfers, because of the required
 		// cache maintenance operations that must don't overlap accidentally.
@@ -262,17 +295,17 @@ func (d *Driver) Write16(s []uint16) (n int, err error) {
 
 // WriteWord16 works like WriteByte but writes 16-bit word to the DATA register.
 func (d *Driver) WriteWord16(w uint16) error {
-	var start time.Time
+	txBegin(d)
+	return writeWord16(d, w)
+}
+
+func writeWord16(d *Driver, w uint16) error {
 	for int(d.p.WATER.LoadBits(TXCOUNT)>>TXCOUNTn) == 1<<d.txlog2max {
-		if d.txtimeout >= 0 {
-			t := time.Now()
-			if start.IsZero() {
-				start = t
-				continue
-			}
-			if t.Sub(start) >= d.txtimeout {
-				return ErrTimeout
-			}
+		if atomic.SwapUint32(&d.txcancel, 0) != 0 {
+			return ErrCanceled
+		}
+		if expired(d.txdl) {
+			return ErrTimeout
 		}
 		runtime.Gosched()
 	}
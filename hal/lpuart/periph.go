@@ -10,6 +10,7 @@ import (
 
 	"github.com/embeddedgo/imxrt/hal/internal"
 	"github.com/embeddedgo/imxrt/hal/internal/ccm"
+	"github.com/embeddedgo/imxrt/hal/lpuart/baud"
 	"github.com/embeddedgo/imxrt/p/mmap"
 )
 
@@ -78,41 +79,30 @@ func (p *Periph) DisableClock() {
 	}
 }
 
-func dividers(clk, baud int) (osr, sbr int) {
-	lowestE := 1<<31 - 1
-	for o := 32; o >= 4; o-- {
-		bo := baud * o
-		minS := clk / bo
-		// check s = minS and s = minS + 1
-		for s := minS; ; s++ {
-			e := clk - bo*s
-			if e < 0 {
-				e = -e
-			}
-			if e < lowestE {
-				lowestE = e
-				osr = o
-				sbr = s
-				if e == 0 {
-					return
-				}
-			}
-			if s != minS {
-				break
-			}
-		}
-	}
-	return
+// BaudTolerance is the maximum acceptable deviation of the actual baudrate
+// from the requested one [%].
+const BaudTolerance = 2.0
+
+// Dividers returns the baudrate generator configuration that gives the
+// baudrate closest to the requested one based on the current UART clock root
+// frequency.
+func (p *Periph) Dividers(baudrate int) baud.Dividers {
+	return baud.Solve(int(ccm.UARTClkRoot()), baudrate)
 }
 
-// SetBaudrate sets the UART speed [sym/s].
-func (p *Periph) SetBaudrate(baud int) {
-	const uartClkRoot = 80e6 // TODO: calculate from CCM settings
-	osr, sbr := dividers(uartClkRoot, baud)
+// SetBaudrate sets the UART speed [sym/s]. It returns ErrBaudrate and leaves
+// the current configuration unchanged if the achievable baudrate differs from
+// the requested one by more than BaudTolerance.
+func (p *Periph) SetBaudrate(baudrate int) error {
+	d := p.Dividers(baudrate)
+	if d.OSR == 0 || d.Error > BaudTolerance || d.Error < -BaudTolerance {
+		return ErrBaudrate
+	}
 	var baudBits BAUD
-	if osr < 8 {
+	if d.OSR < 8 {
 		baudBits = BOTHEDGE
 	}
-	baudBits |= BAUD((osr-1)<<OSRn | sbr)
+	baudBits |= BAUD((d.OSR-1)<<OSRn | d.SBR)
 	p.BAUD.StoreBits(BOTHEDGE|OSR|SBR, baudBits)
+	return nil
 }
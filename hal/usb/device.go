@@ -33,6 +33,8 @@ func (nn *noteNext) uintptr() uintptr {
 	return uintptr(unsafe.Pointer(nn))
 }
 
+const maxInterfaces = 16 // supporting alternate settings
+
 const maxCtrlData = 256 // BUG: may be too small for the config descriptors
 
 // Control transfer data structures.
@@ -66,11 +68,18 @@ type Device struct {
 	cwl   atomic.Uintptr // *wait
 	cwlmu sync.Mutex
 
+	// Alternate settings of interfaces.
+	alts [maxInterfaces]atomic.Uint32
+
 	// For control request in the thread mode.
 	crno rtos.Note
 	crst uint32
 	crsa [leNum][2]uint32
 	crhm map[uint32]func(cr *ControlRequest) int
+
+	// For the OUT data stage of control transfers.
+	dsno   rtos.Note
+	setups atomic.Uint32 // incremented by ISR on every setup and bus reset
 }
 
 /*
@@ -221,6 +230,13 @@ func handleControRequests(d *Device) {
 			handler := d.crhm[key]
 			n = parseSetup(&cr, crsa)
 			cr.Data = d.dtcm.thr.data[:n]
+			if handler == nil && cr.LE == 0 && crsa[0]&0x7f <= 2 {
+				// Standard request with the OUT data stage.
+				handler = d.controlHandlerISR
+			}
+			if cr.Request>>7&1 == 0 && n != 0 && !recvDataStage(d, &cr) {
+				continue
+			}
 			if handler == nil {
 				badControlRequest(d, &cr)
 				continue
@@ -230,19 +246,87 @@ func handleControRequests(d *Device) {
 	}
 }
 
+// Maximum duration of the control OUT data stage (USB 2.0 9.2.6.4).
+const dataStageTimeout = 5 * time.Second
+
+// recvDataStage receives the OUT data stage of the cr control transfer into
+// cr.Data. It reports whether the data stage has completed successfully. If
+// not, the endpoint is stalled unless the transfer has been aborted by a new
+// setup packet or the bus reset.
+func recvDataStage(d *Device, cr *ControlRequest) bool {
+	setups := d.setups.Load()
+	td := &d.dtcm.thr.dtd
+	td.token = tokIOC // UI interrupt on completion wakes up d.dsno
+	td.SetupTransfer(unsafe.Pointer(&cr.Data[0]), len(cr.Data))
+	d.prime(uint8(cr.LE)*2, td)
+	deadline := time.Now().Add(dataStageTimeout)
+	for {
+		d.dsno.Clear()
+		mmio.MB()
+		if td.token&Active == 0 {
+			break
+		}
+		if d.setups.Load() != setups {
+			return false
+		}
+		timeout := time.Until(deadline)
+		if timeout <= 0 || !d.dsno.Sleep(timeout) {
+			protocolStall(d, cr.LE)
+			return false
+		}
+	}
+	if _, status := td.Status(); status != 0 {
+		protocolStall(d, cr.LE)
+		return false
+	}
+	return true
+}
+
 // Config returns the configuration number selected during the USB enumeration
 // process or zero if the device is not in the configured state.
 func (d *Device) Config() int {
 	return int(d.config.Load())
 }
 
+// Speed returns the current bus speed. It is valid after the bus reset, in
+// the configured state.
+func (d *Device) Speed() Speed {
+	return Speed(d.u.PORTSC1.LoadBits(usb.PSPD) >> usb.PSPDn)
+}
+
 // WaitConfig waits for the selection of the cn configuration number during the
 // USB enumeration process. Use cn=0 to wait for the configured state (any
 // configuration number).
 func (d *Device) WaitConfig(cn int) {
-	for {
+	d.wait(func() bool {
 		cnf := d.config.Load()
-		if cnf != 0 && (cnf == uint32(cn) || cn == 0) {
+		return cnf != 0 && (cnf == uint32(cn) || cn == 0)
+	})
+}
+
+// Interface returns the alternate setting of the intf interface selected by
+// the host (SET_INTERFACE request).
+func (d *Device) Interface(intf int) int {
+	if uint(intf) >= uint(len(d.alts)) {
+		return 0
+	}
+	return int(d.alts[intf].Load())
+}
+
+// WaitInterface waits for the configured state and the selection of the alt
+// alternate setting of the intf interface. Only the first 16 interfaces
+// support alternate settings.
+func (d *Device) WaitInterface(intf, alt int) {
+	d.wait(func() bool {
+		return d.config.Load() != 0 && d.Interface(intf) == alt
+	})
+}
+
+// wait waits for the cond to be true. The cond is checked after every
+// SET_CONFIGURATION and SET_INTERFACE request.
+func (d *Device) wait(cond func() bool) {
+	for {
+		if cond() {
 			return
 		}
 		d.cwlmu.Lock()
@@ -251,24 +335,42 @@ func (d *Device) WaitConfig(cn int) {
 			cw  noteNext
 		)
 		for {
-			cwl := d.cwl.Load()
+			cwl = d.cwl.Load()
 			cw.next = cwl
 			if d.cwl.CompareAndSwap(cwl, cw.uintptr()) {
 				break
 			}
 		}
-		cnf = d.config.Load()
-		if cnf != 0 && !d.cwl.CompareAndSwap(cw.uintptr(), cwl) {
+		ok := cond()
+		if ok && !d.cwl.CompareAndSwap(cw.uintptr(), cwl) {
 			// ISR removed cw, must keep reference to cw until recieving a note
-			cnf = 0
+			ok = false
 		}
 		d.cwlmu.Unlock()
-		if cnf == 0 {
+		if !ok {
 			cw.note.Sleep(-1)
 		}
 	}
 }
 
+// Stall sets or clears the stall condition of the he hardware endpoint.
+// Clearing the stall condition also resets the endpoint data toggle. Class
+// drivers can use it to signal errors on the data endpoints (the host clears
+// the stall condition using the CLEAR_FEATURE(ENDPOINT_HALT) request).
+func (d *Device) Stall(he uint8, stall bool) {
+	le, dir := LE(he)
+	mask, reset := usb.RXS, usb.RXR
+	if dir == IN {
+		mask, reset = usb.TXS, usb.TXR
+	}
+	epctl := &d.u.ENDPTCTRL[le]
+	if stall {
+		epctl.SetBits(mask)
+	} else {
+		epctl.Store(epctl.Load()&^mask | reset)
+	}
+}
+
 // Endpoint direction.
 const (
 	OUT uint8 = 0 // output endpoint (Rx for device, Tx for host)
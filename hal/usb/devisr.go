@@ -58,9 +58,10 @@ func (d *Device) ISR() {
 				u.ENDPTFLUSH.Store(flush)
 				for u.ENDPTFLUSH.LoadBits(flush) != 0 {
 				}
-				if le == 0 && setup[0]&0x7f <= 2 {
-					// Standard device/interface/endpoint requests are handled
-					// directly in the ISR.
+				d.setups.Add(1) // abort the data stage in progress, if any
+				if le == 0 && setup[0]&0x7f <= 2 && (setup[0]&0x80 != 0 || setup[1]>>16 == 0) {
+					// Standard device/interface/endpoint requests without the
+					// OUT data stage are handled directly in the ISR.
 					n := parseSetup(&d.cr, setup)
 					d.cr.Data = d.cr.Data[:n:maxCtrlData] // avoid write barrier
 					execContorHandler(d, &d.dtcm.isr, &d.cr, d.controlHandlerISR)
@@ -91,6 +92,8 @@ func (d *Device) ISR() {
 				removeAndWakeup(&d.dtcm.qhs[he], Active)
 			}
 		}
+		// The control OUT data stage may have been completed.
+		d.dsno.Wakeup()
 	}
 
 	if status&usb.URI != 0 {
@@ -114,6 +117,8 @@ func (d *Device) ISR() {
 			}
 			qh.next = dtdEnd
 		}
+		d.setups.Add(1)
+		d.dsno.Wakeup()
 	}
 
 	if status&usb.SRI != 0 {
@@ -209,6 +214,134 @@ func removeAndWakeup(qh *dQH, active uint32) {
 	}
 }
 
+// configDesc returns the configuration descriptors for the current speed.
+//
+//go:nosplit
+func (d *Device) configDesc() string {
+	if d.u.PORTSC1.LoadBits(usb.PSPD)>>usb.PSPDn < 2 {
+		return d.des[0x0700_0000]
+	}
+	return d.des[0x0200_0000]
+}
+
+// initEndpoint configures the endpoint described by the endpoint descriptor
+// ed.
+//
+//go:nosplit
+func (d *Device) initEndpoint(ed string) {
+	if uint(ed[2]&0x0f)-1 >= uint(leNum)-1 {
+		return
+	}
+	u := d.u
+	le := int(ed[2] & 0x0f)
+	dir := ed[2] >> 7 // 0: Rx (OUT),  1: Tx (IN)
+	shift := uint(dir) * 16
+	he := le*2 + int(dir)
+	typ := ed[3] & 3
+	maxPkt := int(ed[4]) | int(ed[5])<<8
+
+	// 42.5.6.3.1 Endpoint Initialization
+	flags := dqhDisableZLT & (uint32(dir) - 1)
+	if typ == epIsochr {
+		// The number of transactions per microframe (high-bandwidth HS
+		// isochronous endpoints).
+		flags = dqhDisableZLT | uint32(maxPkt>>11&3+1)<<dqhMultShift
+	}
+	d.dtcm.qhs[he].setConf(maxPkt&0x7ff, flags)
+	mask := usb.ENDPTCTRL(0xffff) << shift
+	other := u.ENDPTCTRL[le].LoadBits(^mask)
+	if typ != 0 && other == 0 {
+		other = 2 << usb.TXTn >> shift
+	}
+	cfg := usb.ENDPTCTRL(typ)<<usb.RXTn | usb.RXR | usb.RXE
+	mmio.MB()
+	u.ENDPTCTRL[le].Store(other | cfg<<shift)
+}
+
+// disableEndpoint disables the endpoint described by the endpoint descriptor
+// ed and terminates its pending transfers (the goroutines waiting for them are
+// woken up and see the Active status).
+//
+//go:nosplit
+func (d *Device) disableEndpoint(ed string) {
+	if uint(ed[2]&0x0f)-1 >= uint(leNum)-1 {
+		return
+	}
+	u := d.u
+	le := int(ed[2] & 0x0f)
+	dir := ed[2] >> 7
+	he := le*2 + int(dir)
+	u.ENDPTCTRL[le].ClearBits(usb.RXE << (uint(dir) * 16))
+	flush := uint32(1) << (uint(dir) * 16) << uint(le)
+	u.ENDPTFLUSH.Store(flush)
+	for u.ENDPTFLUSH.LoadBits(flush) != 0 {
+	}
+	qh := &d.dtcm.qhs[he]
+	removeAndWakeup(qh, 0)
+	qh.next = dtdEnd
+}
+
+// setInterface selects the alternate setting alt of the intf interface. The
+// endpoints of the previous alternate setting are disabled and the endpoints
+// of the new one are configured. It reports false if there is no such
+// alternate setting.
+//
+//go:nosplit
+func (d *Device) setInterface(intf, alt uint8) bool {
+	cfd := d.configDesc()
+	found := false
+	for pass := 0; pass < 3; pass++ {
+		cur := -1 // alternate setting of the current interface descriptor
+		for des := cfd; len(des) > 2; {
+			n := int(des[0])
+			if n < 2 || len(des) < n {
+				break
+			}
+			switch {
+			case des[1] == 4 && n >= 9:
+				cur = -1
+				if des[2] == intf {
+					cur = int(des[3])
+					if cur == int(alt) {
+						found = true
+					}
+				}
+			case des[1] == 5 && n >= 7 && cur >= 0:
+				switch pass {
+				case 1:
+					d.disableEndpoint(des[:n])
+				case 2:
+					if cur == int(alt) {
+						d.initEndpoint(des[:n])
+					}
+				}
+			}
+			des = des[n:]
+		}
+		if !found {
+			return false
+		}
+	}
+	d.alts[intf].Store(uint32(alt))
+	return true
+}
+
+// wakeWaiters wakes up all goroutines waiting in WaitConfig and WaitInterface.
+//
+//go:nosplit
+func (d *Device) wakeWaiters() {
+	for {
+		p := d.cwl.Load()
+		if p == 0 {
+			break
+		}
+		nn := (*noteNext)(unsafe.Pointer(p))
+		if d.cwl.CompareAndSwap(p, nn.next) {
+			nn.note.Wakeup() // succesfully removed w so send the note
+		}
+	}
+}
+
 // Prime performs simplified prime algorithm. Intended for control endpoints.
 // Can be used in ISR.
 //
@@ -236,21 +369,28 @@ func badControlRequest(d *Device, cr *ControlRequest) {
 	print(" Value:   ", cr.Value, "\r\n")
 	print(" Index:   ", cr.Index, "\r\n")
 	print(" DataLen: ", len(cr.Data), "\r\n")
+	protocolStall(d, cr.LE)
+}
+
+// protocolStall stalls the le control endpoint. The stall is cleared by the
+// hardware when the next setup packet is received.
+//
+//go:nosplit
+func protocolStall(d *Device, le int8) {
 	// 42.5.6.3.2 Protocol stall
-	d.u.ENDPTCTRL[cr.LE].Store(usb.RXS | usb.TXS)
+	d.u.ENDPTCTRL[le].Store(usb.RXS | usb.TXS)
 }
 
+// execContorHandler calls h to handle the control request cr and performs the
+// IN data stage, if any, and the status stage. In case of the OUT direction the
+// data stage must be already completed (see recvDataStage).
+//
 //go:nosplit
 func execContorHandler(d *Device, ctds *ctds, cr *ControlRequest, h func(r *ControlRequest) int) {
 	he := uint8(cr.LE) * 2
 	she := he // status he
 	if cr.Request>>7&1 == 0 {
 		she++
-		// Receive data
-		if len(cr.Data) != 0 {
-			ctds.dtd.SetupTransfer(unsafe.Pointer(&cr.Data[0]), len(cr.Data))
-			d.prime(he, &ctds.dtd)
-		}
 	}
 	n := h(cr)
 	if n < 0 {
@@ -294,7 +434,7 @@ const (
 	reqGetConfiguration = 0x08<<1 | 1
 	reqSetConfiguration = 0x09<<1 | 0
 	reqGetInterface     = 0x0a<<1 | 1
-	reqSetInterface     = 0x11<<1 | 0
+	reqSetInterface     = 0x0b<<1 | 0
 )
 
 //go:nosplit
@@ -342,55 +482,33 @@ func (d *Device) controlHandlerISR(cr *ControlRequest) int {
 			for i := 1; i < leNum; i++ {
 				u.ENDPTCTRL[i].Store(0)
 			}
+			for i := range d.alts {
+				d.alts[i].Store(0)
+			}
 			cnf := uint32(cr.Value) & 0xff
 			if cnf != 0 {
-				// Select the appropriate configuration descriptors.
-				cfd := d.des[0x0200_0000]
-				if u.PORTSC1.LoadBits(usb.PSPD)>>usb.PSPDn < 2 {
-					cfd = d.des[0x0700_0000]
-				}
-				// Configure endpoints according to the endpoint descriptors.
+				// Configure endpoints according to the endpoint descriptors
+				// of the default alternate settings. The endpoints of the
+				// other ones are configured by SET_INTERFACE.
+				cfd := d.configDesc()
+				alt := 0 // alternate setting of the current interface
 				for len(cfd) > 2 {
 					n := int(cfd[0])
-					if len(cfd) < n {
+					if n < 2 || len(cfd) < n {
 						break
 					}
-					if n == 7 && cfd[1] == 5 && uint(cfd[2]&0x0f)-1 < uint(leNum)-1 {
-						le := int(cfd[2] & 0x0f)
-						dir := cfd[2] >> 7 // 0: Rx (OUT),  1: Tx (IN)
-						shift := uint(dir) * 16
-						he := le*2 + int(dir)
-						typ := cfd[3] & 3
-						maxPkt := int(cfd[4]) | int(cfd[5])<<8
-
-						// 42.5.6.3.1 Endpoint Initialization
-						flags := dqhDisableZLT & (uint32(dir) - 1)
-						d.dtcm.qhs[he].setConf(maxPkt, flags)
-						mask := usb.ENDPTCTRL(0xffff) << shift
-						other := u.ENDPTCTRL[le].LoadBits(^mask)
-						if typ != 0 && other == 0 {
-							other = 2 << usb.TXTn >> shift
-						}
-						cfg := usb.ENDPTCTRL(typ)<<usb.RXTn | usb.RXR | usb.RXE
-						mmio.MB()
-						u.ENDPTCTRL[le].Store(other | cfg<<shift)
+					switch {
+					case cfd[1] == 4 && n >= 9:
+						alt = int(cfd[3])
+					case cfd[1] == 5 && n >= 7 && alt == 0:
+						d.initEndpoint(cfd[:n])
 					}
 					cfd = cfd[n:]
 				}
 			}
 			d.config.Store(cnf)
-			if cnf == 0 {
-				return 0
-			}
-			for {
-				p := d.cwl.Load()
-				if p == 0 {
-					break
-				}
-				nn := (*noteNext)(unsafe.Pointer(p))
-				if d.cwl.CompareAndSwap(p, nn.next) {
-					nn.note.Wakeup() // succesfully removed w so send the note
-				}
+			if cnf != 0 {
+				d.wakeWaiters()
 			}
 			return 0
 		}
@@ -404,13 +522,28 @@ func (d *Device) controlHandlerISR(cr *ControlRequest) int {
 			cr.Data[1] = 0
 			return 2
 		case reqGetInterface:
-			if len(cr.Data) < 1 {
+			if len(cr.Data) < 1 || uint(cr.Index) >= uint(len(d.alts)) {
 				break
 			}
-			cr.Data[0] = 0
+			cr.Data[0] = uint8(d.alts[cr.Index].Load())
 			return 1
 		case reqSetInterface:
-			// TODO: support alternate interface settings
+			if d.config.Load() == 0 || uint(cr.Index) >= uint(len(d.alts)) {
+				break
+			}
+			if !d.setInterface(uint8(cr.Index), uint8(cr.Value)) {
+				break
+			}
+			d.wakeWaiters()
+			return 0
+		case reqGetDescriptor:
+			// Class descriptors addressed to the interface (e.g. HID report
+			// descriptor) are stored with the interface number as index.
+			desc, ok := d.des[uint32(cr.Value)<<16|uint32(cr.Index)]
+			if !ok {
+				break
+			}
+			return copy(cr.Data, desc)
 		}
 
 	case 0x02: // Standard Endpoint Request
@@ -419,9 +552,9 @@ func (d *Device) controlHandlerISR(cr *ControlRequest) int {
 			return -1
 		}
 		epctl := &d.u.ENDPTCTRL[le]
-		mask := usb.RXS
+		mask, reset := usb.RXS, usb.RXR
 		if cr.Index&0x80 != 0 {
-			mask = usb.TXS
+			mask, reset = usb.TXS, usb.TXR
 		}
 		switch req {
 		case reqGetStatus:
@@ -433,7 +566,7 @@ func (d *Device) controlHandlerISR(cr *ControlRequest) int {
 			cr.Data[1] = 0
 			return 2
 		case reqClearFeature:
-			epctl.ClearBits(mask)
+			epctl.Store(epctl.Load()&^mask | reset) // also reset data toggle
 			return 0
 		case reqSetFeature:
 			epctl.SetBits(mask)
@@ -76,4 +76,31 @@
 //	func USB_OTG1_Handler() {
 //		usbd.ISR()
 //	}
+//
+// # Host Controller Driver (HCD)
+//
+// The USB controllers can also work in the EHCI compatible host mode. The Host
+// type handles the root port, enumerates the connected devices (hubs are
+// supported by the built-in hub class driver) and offers the interfaces of
+// every configured device to the registered class drivers (see HostDriver).
+// The class drivers use the HostDevice.Control method and the pipes opened
+// by HostDevice.OpenPipe to communicate with the device.
+//
+//	var host *usb.Host
+//
+//	func main() {
+//		host = usb.NewHost(2, nil)
+//		host.Register(myClassDriver)
+//		host.Init(rtos.IntPrioLow)
+//		// ...
+//	}
+//
+//	//go:interrupthandler
+//	func USB_OTG2_Handler() {
+//		host.ISR()
+//	}
+//
+// The HCD supports control, bulk and interrupt transfers. All interrupt
+// endpoints are polled every frame regardless of their bInterval.
+// Isochronous transfers are not supported.
 package usb
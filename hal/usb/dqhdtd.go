@@ -17,6 +17,7 @@ const (
 	dqhDisableZLT = 1 << 29 // zero length termination
 
 	dqhMaxPktLenShift = 16
+	dqhMultShift      = 30 // isochronous endpoints only
 )
 
 type dQH struct {
@@ -113,6 +114,14 @@ func (td *DTD) Next() *DTD {
 	return (*DTD)(unsafe.Pointer(td.next))
 }
 
+// SetMultO sets the Multiplier Override field of td. It can be used for the
+// isochronous IN endpoints to send less than the number of packets per
+// microframe declared in the endpoint descriptor (0 means no override). The
+// MultO field must be zero for other kinds of endpoints.
+func (td *DTD) SetMultO(mult int) {
+	td.token = td.token&^tokMultO | uint32(mult&3)<<10
+}
+
 // SetNote sets the Interrupt On Complete bit (IOC) in the td.token field and
 // a note that will be used by an interrupt handler to communicate the
 // completion of a transfer. As the Go GC may have no access to the td.note
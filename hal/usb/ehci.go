@@ -0,0 +1,114 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usb
+
+// EHCI data structures used by the Host Controller Driver. All of them are
+// accessed by the controller so they are allocated in the non-cacheable DTCM.
+
+// Link pointer bits.
+const (
+	linkT  = 1 << 0 // terminate
+	linkQH = 1 << 1 // type: queue head
+)
+
+// qTD token bits. The status bits TransErr, DataBufErr, Halted and Active are
+// the same as in the DTD token.
+const (
+	qtdPing     = 1 << 0
+	qtdSplitX   = 1 << 1
+	qtdMissedMF = 1 << 2
+	Babble      = 1 << 4 // babble detected (host only)
+
+	qtdPIDOut   = 0 << 8
+	qtdPIDIn    = 1 << 8
+	qtdPIDSetup = 2 << 8
+	qtdCerr     = 3 << 10 // three retries
+	qtdIOC      = 1 << 15
+	qtdDT       = 1 << 31
+
+	qtdLenShift = 16
+	qtdMaxLen   = 0x4000 // 16 KiB, always fits in five pages
+)
+
+// QH endpoint characteristics.
+const (
+	qhEPSShift   = 12      // endpoint speed, the same encoding as Speed
+	qhDTC        = 1 << 14 // data toggle from qTD
+	qhH          = 1 << 15 // head of reclamation list
+	qhMaxPktSh   = 16
+	qhCtrl       = 1 << 27 // control endpoint (FS/LS only)
+	qhNAKReload  = 15 << 28
+	qhEPShift    = 8
+	qhMultShift  = 30 // epCap
+	qhHubShift   = 16 // epCap
+	qhPortShift  = 23 // epCap
+	qhSMaskShift = 0  // epCap
+	qhCMaskShift = 8  // epCap
+)
+
+// A qTD is an EHCI Queue Element Transfer Descriptor (32 bytes, 32 byte
+// aligned).
+type qTD struct {
+	next    uint32
+	altNext uint32
+	token   uint32
+	buf     [5]uint32
+}
+
+// An eQH is an EHCI Queue Head (48 bytes, padded to 64, 32 byte aligned).
+type eQH struct {
+	link    uint32
+	epChar  uint32
+	epCap   uint32
+	current uint32
+
+	// Transfer overlay.
+	next    uint32
+	altNext uint32
+	token   uint32
+	buf     [5]uint32
+
+	_ [4]uint32
+}
+
+// setup configures td to transfer size bytes starting from addr. It returns
+// the number of bytes that will be transferred which is limited to qtdMaxLen.
+//
+//go:nosplit
+func (td *qTD) setup(addr uintptr, size int, token uint32) int {
+	if size > qtdMaxLen {
+		size = qtdMaxLen
+	}
+	td.buf[0] = uint32(addr)
+	pa := uint32(addr)&^0x0fff + 0x1000
+	for i := 1; i < len(td.buf); i++ {
+		td.buf[i] = pa
+		pa += 0x1000
+	}
+	td.next = linkT
+	td.altNext = linkT
+	td.token = token | uint32(size)<<qtdLenShift | qtdCerr | Active
+	return size
+}
+
+// Frame list size. The interrupt QHs are linked to every frame list entry so
+// the frame list length doesn't affect the polling rate. USBCMD.FS_2 with
+// FS_1=1 selects 32 elements.
+const frameListLen = 32
+
+// hostmem contains the schedule heads.
+type hostmem struct {
+	flist [frameListLen]uint32 // periodic frame list, 128 B, requires 4096 alignment
+	async eQH                  // head of the asynchronous schedule (never executed)
+	intr  eQH                  // head of the periodic schedule (never executed)
+}
+
+// pipemem contains the controller data structures of a single pipe.
+type pipemem struct {
+	qh    eQH    // 64 B, requires 32 alignment
+	td    [3]qTD // setup, data, status (only td[0] is used by non-control pipes)
+	setup [8]byte
+	_     [24]byte
+}
@@ -4,7 +4,10 @@
 
 package usb
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // An Error may be used by a higher-level driver to inform about unsuccessfull
 // transfer with the additional information provided by the device driver or the
@@ -30,3 +33,37 @@ func (e *Error) Error() string {
 		e.Controller, e.Function, e.HE>>1, "inout"[dir*2:dir*3+2], e.HE, e.Status,
 	)
 }
+
+// Errors returned by the host controller driver.
+var (
+	ErrDetached    = errors.New("usb: device detached")
+	ErrNoResources = errors.New("usb: no free pipes or addresses")
+	ErrDescriptor  = errors.New("usb: bad descriptor")
+)
+
+// A HostError is returned by the host controller driver in case of
+// unsuccessful transfer.
+type HostError struct {
+	Controller int   // controler number
+	Addr       uint8 // device address
+	EP         uint8 // endpoint address (direction in the most significant bit)
+	Status     uint8 // qTD status field
+}
+
+// Stalled reports whether the endpoint returned the STALL handshake.
+func (e *HostError) Stalled() bool {
+	return e.Status&(Halted|Babble|DataBufErr|TransErr|Active) == Halted
+}
+
+// Timeout reports whether the transfer has not been finished in the specified
+// time.
+func (e *HostError) Timeout() bool {
+	return e.Status&Active != 0
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf(
+		"USB controler: %d, device: %d, endpoint: %#02x: status: %#08b",
+		e.Controller, e.Addr, e.EP, e.Status,
+	)
+}
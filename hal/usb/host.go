@@ -0,0 +1,521 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usb
+
+import (
+	"embedded/mmio"
+	"embedded/rtos"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/irq"
+	"github.com/embeddedgo/imxrt/hal/mem/dtcm"
+
+	"github.com/embeddedgo/imxrt/p/ccm"
+	"github.com/embeddedgo/imxrt/p/ccm_analog"
+	"github.com/embeddedgo/imxrt/p/usb"
+	"github.com/embeddedgo/imxrt/p/usbphy"
+)
+
+// Speed represents the USB device speed.
+type Speed uint8
+
+const (
+	FullSpeed Speed = 0
+	LowSpeed  Speed = 1
+	HighSpeed Speed = 2
+)
+
+func (s Speed) String() string {
+	switch s {
+	case FullSpeed:
+		return "full-speed"
+	case LowSpeed:
+		return "low-speed"
+	case HighSpeed:
+		return "high-speed"
+	}
+	return "unknown-speed"
+}
+
+// Standard descriptor types.
+const (
+	DescDevice    = 1
+	DescConfig    = 2
+	DescString    = 3
+	DescInterface = 4
+	DescEndpoint  = 5
+)
+
+// Standard requests in the form used by ControlRequest.Request and
+// HostDevice.Control: bRequest<<8 | bmRequestType.
+const (
+	hreqClearFeatureEP = 0x01<<8 | 0x02
+	hreqSetAddress     = 0x05<<8 | 0x00
+	hreqGetDescriptor  = 0x06<<8 | 0x80
+	hreqSetConfig      = 0x09<<8 | 0x00
+)
+
+const (
+	maxPipes    = 32              // maximum number of open pipes
+	ctrlTimeout = 5 * time.Second // USB 2.0 9.2.6.4
+)
+
+// A HostDriver is a class driver that can be attached to an interface of the
+// device connected to the host.
+type HostDriver interface {
+	// Attach is called by the enumeration goroutine for every interface of
+	// a newly configured device. The intf contains the interface descriptor
+	// followed by all class-specific and endpoint descriptors of this
+	// interface, including its alternate settings. Attach reports whether the
+	// driver has taken the interface. It should not block for a long time.
+	Attach(d *HostDevice, intf []byte) bool
+
+	// Detach is called after the device d has been disconnected. All pipes
+	// open to d are closed at this point.
+	Detach(d *HostDevice)
+}
+
+// A Host represents an USB Host Controller Driver (HCD). It uses the EHCI
+// compatible host mode of the i.MX RT USB controller.
+//
+// Host handles the root port, enumerates the connected devices (also these
+// connected through hubs) and attaches the registered class drivers to their
+// interfaces.
+type Host struct {
+	u    *usb.Periph
+	phy  *usbphy.Periph
+	m    *hostmem
+	vbus func(on bool)
+
+	mu      sync.Mutex      // protects the fields below and the schedules
+	pipes   [maxPipes]*Pipe // open pipes, checked by ISR
+	free    []*pipemem
+	addrs   [128 / 32]uint32
+	drivers []HostDriver
+
+	enum sync.Mutex // serializes enumeration (the default address)
+	pcn  rtos.Note  // port change
+	iaan rtos.Note  // async advance
+	root atomic.Pointer[HostDevice]
+}
+
+var hostmemCache [2]*hostmem // cache the allocated DTCM for both controllers
+
+// NewHost returns a new host controller driver for USB controller 1 or 2. The
+// optional vbus function is used to control the VBUS power switch if it isn't
+// controlled by the USB_OTGn_PWR signal. The hub class driver is registered
+// by default.
+func NewHost(controller int, vbus func(on bool)) *Host {
+	h := new(Host)
+	switch controller {
+	case 1:
+		h.u = usb.USB1()
+		h.phy = usbphy.USBPHY1()
+	case 2:
+		h.u = usb.USB2()
+		h.phy = usbphy.USBPHY2()
+	default:
+		return nil
+	}
+	controller--
+	m := hostmemCache[controller]
+	if m == nil {
+		m = dtcm.New[hostmem](4096)
+		hostmemCache[controller] = m
+	}
+	h.m = m
+	h.vbus = vbus
+	h.drivers = []HostDriver{hubDriver{}}
+	return h
+}
+
+// Controller returns the controller number used by this host driver.
+func (h *Host) Controller() int {
+	switch h.u {
+	case usb.USB1():
+		return 1
+	case usb.USB2():
+		return 2
+	}
+	return -1
+}
+
+// Register registers the class driver drv. The drivers are checked in the
+// registration order.
+func (h *Host) Register(drv HostDriver) {
+	h.mu.Lock()
+	h.drivers = append(h.drivers, drv)
+	h.mu.Unlock()
+}
+
+// Root returns the device connected to the root port or nil if there is no
+// enumerated device.
+func (h *Host) Root() *HostDevice {
+	return h.root.Load()
+}
+
+func qhaddr(qh *eQH) uint32 {
+	return uint32(uintptr(unsafe.Pointer(qh)))
+}
+
+func tdaddr(td *qTD) uint32 {
+	return uint32(uintptr(unsafe.Pointer(td)))
+}
+
+// Init initializes the USB controller in the host mode, turns on the VBUS and
+// starts the root port handling goroutine.
+func (h *Host) Init(intPrio int) {
+	// Ungate all necessary clocks.
+	ccm.CCM().CCGR6.SetBits(ccm.CG6_0 | ccm.CG6_11) // usboh3 | anadig (CCMA)
+	ca := ccm_analog.CCM_ANALOG()
+	if h.u == usb.USB1() {
+		ca.PLL_USB1_SET.Store(ccm_analog.PLL_USB_EN_USB_CLKS)
+	} else {
+		ca.PLL_USB2_SET.Store(ccm_analog.PLL_USB_POWER | ccm_analog.PLL_USB_ENABLE | ccm_analog.PLL_USB_EN_USB_CLKS)
+		ca.PLL_USB2_CLR.Store(ccm_analog.PLL_USB_BYPASS)
+		for ca.PLL_USB2.LoadBits(ccm_analog.PLL_USB_LOCK) == 0 {
+		}
+	}
+
+	u, phy := h.u, h.phy
+
+	// Reset
+	phy.CTRL_SET.Store(usbphy.SFTRST)
+	u.USBCMD.SetBits(usb.RST)
+	for u.USBCMD.LoadBits(usb.RST) != 0 {
+	}
+	phy.CTRL_CLR.Store(usbphy.SFTRST | usbphy.CLKGATE)
+
+	// Enable power to PHY, enable the LS/FS support and select host mode.
+	phy.PWD.Store(0)
+	phy.CTRL_SET.Store(usbphy.ENUTMILEVEL2 | usbphy.ENUTMILEVEL3)
+	u.USBMODE.Store(usb.CM_3)
+
+	// Setup the schedules. Both heads are never executed by the controller.
+	m := h.m
+	m.async = eQH{
+		link:   qhaddr(&m.async) | linkQH,
+		epChar: qhH | uint32(HighSpeed)<<qhEPSShift,
+		next:   linkT,
+		token:  Halted,
+	}
+	m.intr = eQH{link: linkT, next: linkT, token: Halted}
+	for i := range m.flist {
+		m.flist[i] = qhaddr(&m.intr) | linkQH
+	}
+	mmio.MB()
+	u.DEVADDR_PLISTBASE.Store(uint32(uintptr(unsafe.Pointer(&m.flist[0]))))
+	u.ASYNC_ENDPTLISTADDR.Store(qhaddr(&m.async))
+
+	// Enable interrupts
+	ui := irq.USB_OTG1
+	if u == usb.USB2() {
+		ui = irq.USB_OTG2
+	}
+	ui.Enable(intPrio, 0)
+	u.USBINTR.Store(usb.UE | usb.UEE | usb.PCE | usb.AAE)
+
+	// Run with the 32 element frame list and the minimum interrupt threshold.
+	u.USBCMD.Store(usb.RS | usb.ASE | usb.PSE | usb.FS_2 | 1<<usb.FS_1n | 1<<usb.ITCn)
+
+	// Power the port.
+	u.PORTSC1.Store(portsc(u.PORTSC1.Load()) | usb.PP)
+	if h.vbus != nil {
+		h.vbus(true)
+	}
+
+	go rootPort(h)
+}
+
+// portsc returns the PORTSC1 value that can be written back without any side
+// effects.
+func portsc(ps usb.PORTSC1) usb.PORTSC1 {
+	return ps &^ (usb.CSC | usb.PEC | usb.OCC | usb.FPR | usb.SUSP | usb.PR)
+}
+
+func rootPort(h *Host) {
+	u := h.u
+	for {
+		h.pcn.Clear()
+		ps := u.PORTSC1.Load()
+		if ps&usb.CSC == 0 {
+			h.pcn.Sleep(-1)
+			continue
+		}
+		u.PORTSC1.Store(portsc(ps) | usb.CSC)
+		if d := h.root.Swap(nil); d != nil {
+			h.phy.CTRL_CLR.Store(usbphy.ENHOSTDISCONDETECT)
+			h.detach(d)
+		}
+		if ps&usb.CCS == 0 {
+			continue
+		}
+		time.Sleep(100 * time.Millisecond) // debounce interval
+		if d := h.connect(nil, 0, func() (Speed, bool) { return resetRootPort(h) }); d != nil {
+			h.root.Store(d)
+		}
+	}
+}
+
+func resetRootPort(h *Host) (speed Speed, ok bool) {
+	u := h.u
+	u.PORTSC1.Store(portsc(u.PORTSC1.Load())&^usb.PE | usb.PR)
+	// The controller terminates the reset itself.
+	for i := 0; u.PORTSC1.LoadBits(usb.PR) != 0; i++ {
+		if i == 100 {
+			return 0, false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // reset recovery time
+	ps := u.PORTSC1.Load()
+	if ps&(usb.CCS|usb.PE) != usb.CCS|usb.PE {
+		return 0, false
+	}
+	speed = Speed(ps >> usb.PSPDn & 3)
+	if speed == HighSpeed {
+		h.phy.CTRL_SET.Store(usbphy.ENHOSTDISCONDETECT)
+	}
+	return speed, true
+}
+
+func (h *Host) allocAddr() uint8 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for a := 1; a < 128; a++ {
+		if h.addrs[a>>5]&(1<<uint(a&31)) == 0 {
+			h.addrs[a>>5] |= 1 << uint(a&31)
+			return uint8(a)
+		}
+	}
+	return 0
+}
+
+func (h *Host) freeAddr(a uint8) {
+	h.mu.Lock()
+	h.addrs[a>>5] &^= 1 << uint(a&31)
+	h.mu.Unlock()
+}
+
+// connect resets the port of the parent hub (nil means the root port) using
+// the reset function, enumerates the connected device and attaches the class
+// drivers to its interfaces. Only one device at a time can be reset and
+// enumerated because it responds to the default address until SET_ADDRESS.
+func (h *Host) connect(parent *HostDevice, port uint8, reset func() (Speed, bool)) *HostDevice {
+	h.enum.Lock()
+	speed, ok := reset()
+	var (
+		d   *HostDevice
+		err error
+	)
+	if ok {
+		d, err = h.enumerate(parent, port, speed)
+	}
+	h.enum.Unlock()
+	if !ok || err != nil {
+		return nil
+	}
+	h.attach(d)
+	return d
+}
+
+func (h *Host) enumerate(parent *HostDevice, port uint8, speed Speed) (d *HostDevice, err error) {
+	d = &HostDevice{h: h, parent: parent, port: port, speed: speed}
+	if speed != HighSpeed && parent != nil {
+		// FS/LS device behind a hub uses the nearest HS hub transaction
+		// translator (the root port has the embedded one).
+		if parent.speed == HighSpeed {
+			d.ttHub, d.ttPort = parent.addr, port
+		} else {
+			d.ttHub, d.ttPort = parent.ttHub, parent.ttPort
+		}
+	}
+	defer func() {
+		if err != nil {
+			h.detach(d)
+		}
+	}()
+	maxPkt := 64
+	if speed == LowSpeed {
+		maxPkt = 8
+	}
+	if d.ep0, err = d.openPipe(0, epControl, maxPkt); err != nil {
+		return
+	}
+	buf := dma.MakeSlice[byte](64, 64)
+	n, err := d.Control(hreqGetDescriptor, DescDevice<<8, 0, buf[:8])
+	if err != nil {
+		return
+	}
+	if n != 8 || buf[7] == 0 {
+		err = ErrDescriptor
+		return
+	}
+	maxPkt = int(buf[7])
+	addr := h.allocAddr()
+	if addr == 0 {
+		err = ErrNoResources
+		return
+	}
+	if _, err = d.Control(hreqSetAddress, uint16(addr), 0, nil); err != nil {
+		h.freeAddr(addr)
+		return
+	}
+	d.addr = addr
+	time.Sleep(2 * time.Millisecond) // SET_ADDRESS recovery time
+	d.ep0.Close()
+	if d.ep0, err = d.openPipe(0, epControl, maxPkt); err != nil {
+		return
+	}
+	if _, err = d.Control(hreqGetDescriptor, DescDevice<<8, 0, buf[:18]); err != nil {
+		return
+	}
+	copy(d.Desc[:], buf)
+	if n, err = d.Control(hreqGetDescriptor, DescConfig<<8, 0, buf[:9]); err != nil {
+		return
+	}
+	if n != 9 {
+		err = ErrDescriptor
+		return
+	}
+	n = int(buf[2]) | int(buf[3])<<8
+	if n < 9 {
+		err = ErrDescriptor
+		return
+	}
+	d.Config = dma.MakeSlice[byte](n, n)
+	if n, err = d.Control(hreqGetDescriptor, DescConfig<<8, 0, d.Config); err != nil {
+		return
+	}
+	d.Config = d.Config[:n]
+	_, err = d.Control(hreqSetConfig, uint16(d.Config[5]), 0, nil)
+	return
+}
+
+// attach offers all interfaces of d to the registered class drivers.
+func (h *Host) attach(d *HostDevice) {
+	h.mu.Lock()
+	drivers := h.drivers
+	h.mu.Unlock()
+	rest := d.Config
+	for {
+		var intf []byte
+		if intf, rest = nextInterface(rest); intf == nil {
+			break
+		}
+		for _, drv := range drivers {
+			if drv.Attach(d, intf) {
+				d.addDriver(drv)
+				break
+			}
+		}
+	}
+}
+
+// detach closes all pipes of d, informs the attached drivers and releases the
+// device address.
+func (h *Host) detach(d *HostDevice) {
+	if d.gone.Swap(true) {
+		return
+	}
+	h.mu.Lock()
+	pipes := d.pipes
+	d.pipes = nil
+	h.mu.Unlock()
+	for _, p := range pipes {
+		p.Close()
+	}
+	for _, drv := range d.drivers {
+		drv.Detach(d)
+	}
+	if d.addr != 0 {
+		h.freeAddr(d.addr)
+	}
+}
+
+// link inserts qh just after the head of the selected schedule.
+func (h *Host) link(qh *eQH, periodic bool) {
+	head := &h.m.async
+	if periodic {
+		head = &h.m.intr
+	}
+	qh.link = head.link
+	mmio.MB()
+	head.link = qhaddr(qh) | linkQH
+	mmio.MB()
+}
+
+// unlink removes qh from the selected schedule and waits until the controller
+// no longer uses it.
+func (h *Host) unlink(qh *eQH, periodic bool) {
+	a := qhaddr(qh) | linkQH
+	prev := &h.m.async
+	if periodic {
+		prev = &h.m.intr
+	}
+	if prev.link != a {
+		for _, p := range &h.pipes {
+			if p != nil && p.m.qh.link == a {
+				prev = &p.m.qh
+				break
+			}
+		}
+	}
+	if prev.link != a {
+		return // not linked
+	}
+	prev.link = qh.link
+	mmio.MB()
+	if periodic {
+		// The periodic schedule is traversed once per frame.
+		time.Sleep(2 * time.Millisecond)
+		return
+	}
+	h.iaan.Clear()
+	h.u.USBCMD.SetBits(usb.IAA)
+	h.iaan.Sleep(10 * time.Millisecond)
+}
+
+// NextDescriptor returns the first descriptor in b of the type typ (of any type
+// if typ is zero) and the part of b that follows it. It returns nil if there is
+// no such descriptor.
+func NextDescriptor(b []byte, typ uint8) (desc, rest []byte) {
+	for len(b) >= 2 {
+		n := int(b[0])
+		if n < 2 || n > len(b) {
+			break
+		}
+		desc, b = b[:n], b[n:]
+		if typ == 0 || desc[1] == typ {
+			return desc, b
+		}
+	}
+	return nil, nil
+}
+
+// nextInterface returns the first interface in b (all descriptors that belong
+// to the interface, including its alternate settings) and the rest of b.
+func nextInterface(b []byte) (intf, rest []byte) {
+	desc, rest := NextDescriptor(b, DescInterface)
+	if desc == nil {
+		return nil, nil
+	}
+	start := len(b) - len(rest) - len(desc)
+	for {
+		next, r := NextDescriptor(rest, DescInterface)
+		if next == nil {
+			return b[start:], nil
+		}
+		if next[2] != desc[2] {
+			end := len(b) - len(r) - len(next)
+			return b[start:end], b[end:]
+		}
+		rest = r
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usb
+
+import (
+	"sync/atomic"
+
+	"github.com/embeddedgo/imxrt/p/usb"
+)
+
+// All functions/methods of the host controller driver that may run in the
+// interrupt context should be placed in this file.
+//
+// All functions in this file must have the go:nosplit directive.
+
+// ISR handles USB interrupts in the host mode.
+//
+//go:nosplit
+//go:nowritebarrierrec
+func (h *Host) ISR() {
+	u := h.u
+	status := u.USBSTS.Load()
+	u.USBSTS.Store(status)
+
+	if status&(usb.UI|usb.UEI) != 0 {
+		// Find the finished transfers.
+		for _, p := range &h.pipes {
+			if p == nil || atomic.LoadUint32(&p.busy) == 0 {
+				continue
+			}
+			m := p.m
+			if m.td[p.last].token&Active == 0 || m.qh.token&Halted != 0 {
+				atomic.StoreUint32(&p.busy, 0)
+				p.done.Wakeup()
+			}
+		}
+	}
+	if status&usb.PCI != 0 {
+		h.pcn.Wakeup()
+	}
+	if status&usb.AAI != 0 {
+		h.iaan.Wakeup()
+	}
+}
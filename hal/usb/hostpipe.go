@@ -0,0 +1,380 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usb
+
+import (
+	"embedded/mmio"
+	"embedded/rtos"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/mem/dtcm"
+)
+
+// A HostDevice represents an USB device connected to the host.
+type HostDevice struct {
+	h       *Host
+	parent  *HostDevice
+	ep0     *Pipe
+	pipes   []*Pipe
+	drivers []HostDriver
+	gone    atomic.Bool
+	port    uint8
+	addr    uint8
+	speed   Speed
+	ttHub   uint8
+	ttPort  uint8
+
+	// Desc contains the device descriptor.
+	Desc [18]byte
+
+	// Config contains the complete configuration descriptor (including all
+	// interface, endpoint and class-specific descriptors) of the active
+	// configuration.
+	Config []byte
+}
+
+// Host returns the host controller driver the device is connected to.
+func (d *HostDevice) Host() *Host { return d.h }
+
+// Parent returns the hub the device is connected to or nil if the device is
+// connected to the root port.
+func (d *HostDevice) Parent() *HostDevice { return d.parent }
+
+// Port returns the hub port number the device is connected to (0 means the
+// root port).
+func (d *HostDevice) Port() int { return int(d.port) }
+
+// Addr returns the device address.
+func (d *HostDevice) Addr() uint8 { return d.addr }
+
+// Speed returns the device speed.
+func (d *HostDevice) Speed() Speed { return d.speed }
+
+// VendorID returns the idVendor field of the device descriptor.
+func (d *HostDevice) VendorID() uint16 {
+	return uint16(d.Desc[8]) | uint16(d.Desc[9])<<8
+}
+
+// ProductID returns the idProduct field of the device descriptor.
+func (d *HostDevice) ProductID() uint16 {
+	return uint16(d.Desc[10]) | uint16(d.Desc[11])<<8
+}
+
+// Detached reports whether the device has been disconnected.
+func (d *HostDevice) Detached() bool {
+	return d.gone.Load()
+}
+
+func (d *HostDevice) addDriver(drv HostDriver) {
+	for _, a := range d.drivers {
+		if a == drv {
+			return
+		}
+	}
+	d.drivers = append(d.drivers, drv)
+}
+
+// Control performs the control transfer using the default control pipe. The
+// request is bRequest<<8 | bmRequestType (see ControlRequest) and the length
+// of data determines wLength (at most 16 KiB). The direction of the data stage
+// is determined by the most significant bit of bmRequestType. Control returns
+// the number of bytes transferred in the data stage.
+//
+// The data must be a DMA capable buffer (see dma.MakeSlice).
+func (d *HostDevice) Control(request, value, index uint16, data []byte) (n int, err error) {
+	p := d.ep0
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.Load() {
+		return 0, ErrDetached
+	}
+	if len(data) > qtdMaxLen {
+		data = data[:qtdMaxLen]
+	}
+	m := p.m
+	s := &m.setup
+	s[0] = byte(request)
+	s[1] = byte(request >> 8)
+	s[2] = byte(value)
+	s[3] = byte(value >> 8)
+	s[4] = byte(index)
+	s[5] = byte(index >> 8)
+	s[6] = byte(len(data))
+	s[7] = byte(len(data) >> 8)
+	m.td[0].setup(uintptr(unsafe.Pointer(s)), len(s), qtdPIDSetup)
+	last := &m.td[0]
+	in := request&0x80 != 0
+	spid := uint32(qtdPIDIn) // status stage
+	if len(data) != 0 {
+		pid := uint32(qtdPIDOut)
+		if in {
+			pid, spid = qtdPIDIn, qtdPIDOut
+		}
+		ptr := unsafe.Pointer(&data[0])
+		rtos.CacheMaint(rtos.DCacheFlushInval, ptr, len(data))
+		m.td[1].setup(uintptr(ptr), len(data), pid|qtdDT)
+		last.next = tdaddr(&m.td[1])
+		last = &m.td[1]
+	}
+	m.td[2].setup(0, 0, spid|qtdDT)
+	last.next = tdaddr(&m.td[2])
+	st := p.run(2, ctrlTimeout)
+	if len(data) != 0 {
+		n = len(data) - int(m.td[1].token>>qtdLenShift&0x7fff)
+	}
+	return n, p.err(st)
+}
+
+// Endpoint transfer types.
+const (
+	epControl   = 0
+	epIsochr    = 1
+	epBulk      = 2
+	epInterrupt = 3
+)
+
+// A Pipe represents a communication channel between the host and an endpoint
+// of the device.
+type Pipe struct {
+	d      *HostDevice
+	m      *pipemem
+	done   rtos.Note
+	busy   uint32 // accessed atomically
+	last   uint32 // the last qTD of the current transfer
+	idx    int
+	mu     sync.Mutex
+	closed atomic.Bool
+	ep     uint8
+	typ    uint8
+}
+
+// OpenPipe opens the pipe to the bulk or interrupt endpoint described by the
+// endpoint descriptor ed. Isochronous endpoints are not supported.
+//
+// The interrupt endpoints are polled every frame (every microframe 0 in case
+// of HS devices) regardless of the bInterval field.
+func (d *HostDevice) OpenPipe(ed []byte) (*Pipe, error) {
+	if len(ed) < 7 || ed[1] != DescEndpoint {
+		return nil, ErrDescriptor
+	}
+	typ := ed[3] & 3
+	if typ != epBulk && typ != epInterrupt {
+		return nil, ErrDescriptor
+	}
+	return d.openPipe(ed[2], typ, int(ed[4])|int(ed[5])<<8)
+}
+
+func (d *HostDevice) openPipe(ep, typ uint8, maxPkt int) (*Pipe, error) {
+	h := d.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if d.gone.Load() {
+		return nil, ErrDetached
+	}
+	idx := -1
+	for i, p := range &h.pipes {
+		if p == nil {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, ErrNoResources
+	}
+	var m *pipemem
+	if n := len(h.free); n != 0 {
+		m = h.free[n-1]
+		h.free = h.free[:n-1]
+		*m = pipemem{}
+	} else {
+		m = dtcm.New[pipemem](64)
+	}
+	for i := range m.td {
+		m.td[i].next = linkT
+		m.td[i].altNext = linkT
+	}
+	qh := &m.qh
+	qh.epChar = uint32(d.addr) | uint32(ep&0xf)<<qhEPShift |
+		uint32(d.speed)<<qhEPSShift | uint32(maxPkt&0x7ff)<<qhMaxPktSh
+	qh.epCap = uint32(maxPkt>>11&3+1)<<qhMultShift |
+		uint32(d.ttHub)<<qhHubShift | uint32(d.ttPort)<<qhPortShift
+	switch {
+	case typ == epControl:
+		qh.epChar |= qhDTC
+		if d.speed != HighSpeed {
+			qh.epChar |= qhCtrl
+		}
+	case typ == epInterrupt:
+		qh.epCap |= 0x01 << qhSMaskShift // microframe 0
+		if d.speed != HighSpeed {
+			qh.epCap |= 0x1c << qhCMaskShift // complete-splits in 2, 3, 4
+		}
+	}
+	if d.speed == HighSpeed && typ != epInterrupt {
+		qh.epChar |= qhNAKReload
+	}
+	qh.next = linkT
+	qh.altNext = linkT
+	p := &Pipe{d: d, m: m, idx: idx, ep: ep, typ: typ}
+	h.link(qh, typ == epInterrupt)
+	h.pipes[idx] = p
+	d.pipes = append(d.pipes, p)
+	return p, nil
+}
+
+// Device returns the device the pipe is connected to.
+func (p *Pipe) Device() *HostDevice { return p.d }
+
+// Endpoint returns the endpoint address (the direction in the most significant
+// bit).
+func (p *Pipe) Endpoint() uint8 { return p.ep }
+
+// run starts the transfer described by the qTDs linked starting from p.m.td[0]
+// and ending at p.m.td[last]. It waits for the end of the transfer and returns
+// the status.
+func (p *Pipe) run(last int, timeout time.Duration) uint8 {
+	m := p.m
+	qh := &m.qh
+	m.td[last].token |= qtdIOC
+	p.done.Clear()
+	if p.closed.Load() {
+		return Active
+	}
+	p.last = uint32(last)
+	qh.altNext = linkT
+	qh.token &= qtdDT // clear the status, preserve the data toggle
+	mmio.MB()
+	atomic.StoreUint32(&p.busy, 1)
+	qh.next = tdaddr(&m.td[0])
+	mmio.MB()
+	if !p.done.Sleep(timeout) {
+		p.cancel()
+		return Active
+	}
+	if p.closed.Load() {
+		return Active
+	}
+	st := uint8(qh.token) & (Halted | Babble | DataBufErr | TransErr)
+	if st == 0 && m.td[last].token&Active != 0 {
+		st = Active
+	}
+	return st
+}
+
+// cancel removes the unfinished transfer from the pipe.
+func (p *Pipe) cancel() {
+	h := p.d.h
+	h.mu.Lock()
+	if !p.closed.Load() {
+		periodic := p.typ == epInterrupt
+		h.unlink(&p.m.qh, periodic)
+		atomic.StoreUint32(&p.busy, 0)
+		qh := &p.m.qh
+		qh.current = 0
+		qh.next = linkT
+		qh.altNext = linkT
+		qh.token &= qtdDT
+		h.link(qh, periodic)
+	}
+	h.mu.Unlock()
+}
+
+func (p *Pipe) err(status uint8) error {
+	if status == 0 {
+		return nil
+	}
+	if p.closed.Load() {
+		return ErrDetached
+	}
+	return &HostError{
+		Controller: p.d.h.Controller(),
+		Addr:       p.d.addr,
+		EP:         p.ep,
+		Status:     status,
+	}
+}
+
+// Transfer performs the bulk or interrupt transfer. The direction is
+// determined by the endpoint address. Transfer returns the number of bytes
+// transferred which may be less than len(buf) in case of the IN transfer ended
+// with a short packet. An empty buf can be used to send a zero-length packet.
+// A negative timeout means no timeout (useful for interrupt endpoints that
+// NAK until they have something to report).
+//
+// The buf must be a DMA capable buffer (see dma.MakeSlice).
+func (p *Pipe) Transfer(buf []byte, timeout time.Duration) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed.Load() {
+		return 0, ErrDetached
+	}
+	pid := uint32(qtdPIDOut)
+	if p.ep&0x80 != 0 {
+		pid = qtdPIDIn
+	}
+	td := &p.m.td[0]
+	for {
+		var ptr unsafe.Pointer
+		if n < len(buf) {
+			ptr = unsafe.Pointer(&buf[n])
+		}
+		size := td.setup(uintptr(ptr), len(buf)-n, pid)
+		if size != 0 {
+			rtos.CacheMaint(rtos.DCacheFlushInval, ptr, size)
+		}
+		st := p.run(0, timeout)
+		m := size - int(td.token>>qtdLenShift&0x7fff)
+		n += m
+		if st != 0 {
+			return n, p.err(st)
+		}
+		if m < size || n == len(buf) {
+			return n, nil
+		}
+	}
+}
+
+// ClearHalt clears the halt condition of the endpoint (sends the CLEAR_FEATURE
+// (ENDPOINT_HALT) request) and resets the data toggle of the pipe.
+func (p *Pipe) ClearHalt() error {
+	_, err := p.d.Control(hreqClearFeatureEP, 0, uint16(p.ep), nil)
+	p.mu.Lock()
+	if !p.closed.Load() {
+		p.m.qh.token &^= qtdDT
+	}
+	p.mu.Unlock()
+	return err
+}
+
+// Close closes the pipe. The pending transfer is terminated with ErrDetached.
+func (p *Pipe) Close() {
+	h := p.d.h
+	h.mu.Lock()
+	if p.closed.Load() {
+		h.mu.Unlock()
+		return
+	}
+	p.closed.Store(true)
+	h.unlink(&p.m.qh, p.typ == epInterrupt)
+	h.pipes[p.idx] = nil
+	d := p.d
+	for i, a := range d.pipes {
+		if a == p {
+			d.pipes = append(d.pipes[:i], d.pipes[i+1:]...)
+			break
+		}
+	}
+	h.mu.Unlock()
+	atomic.StoreUint32(&p.busy, 0)
+	p.done.Wakeup()
+	p.mu.Lock() // wait for the end of the pending transfer
+	h.mu.Lock()
+	h.free = append(h.free, p.m)
+	h.mu.Unlock()
+	p.mu.Unlock()
+}
@@ -0,0 +1,164 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usb
+
+import (
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+)
+
+// Hub class definitions (USB 2.0 11.23, 11.24).
+const (
+	hubClass = 9
+	descHub  = 0x29
+
+	hreqGetHubDesc       = 0x06<<8 | 0xa0
+	hreqGetPortStatus    = 0x00<<8 | 0xa3
+	hreqSetPortFeature   = 0x03<<8 | 0x23
+	hreqClearPortFeature = 0x01<<8 | 0x23
+
+	portReset       = 4
+	portPower       = 8
+	cPortConnection = 16 // followed by C_PORT_ENABLE .. C_PORT_OVER_CURRENT
+	cPortReset      = 20
+
+	psConnection = 1 << 0
+	psEnable     = 1 << 1
+	psLowSpeed   = 1 << 9
+	psHighSpeed  = 1 << 10
+)
+
+// hubDriver is the hub class driver. It is registered by NewHost.
+type hubDriver struct{}
+
+func (hubDriver) Attach(d *HostDevice, intf []byte) bool {
+	if intf[5] != hubClass {
+		return false
+	}
+	ed, _ := NextDescriptor(intf, DescEndpoint)
+	if ed == nil {
+		return false
+	}
+	p, err := d.OpenPipe(ed)
+	if err != nil {
+		return false
+	}
+	go runHub(d, p)
+	return true
+}
+
+// Detach does nothing. The goroutine started by Attach detaches the devices
+// connected to the hub after its status change pipe has been closed.
+func (hubDriver) Detach(d *HostDevice) {}
+
+func runHub(d *HostDevice, p *Pipe) {
+	buf := dma.MakeSlice[byte](64, 64)
+	n, err := d.Control(hreqGetHubDesc, descHub<<8, 0, buf[:9])
+	if err != nil || n < 7 {
+		p.Close()
+		return
+	}
+	nport := int(buf[2])
+	pgood := time.Duration(buf[5]) * 2 * time.Millisecond
+	for port := 1; port <= nport; port++ {
+		d.Control(hreqSetPortFeature, portPower, uint16(port), nil)
+	}
+	time.Sleep(pgood)
+
+	children := make([]*HostDevice, nport+1)
+	sbuf := dma.MakeSlice[byte](32, 32)[:nport/8+1] // status change bitmap
+	for {
+		if _, err = p.Transfer(sbuf, -1); err != nil {
+			if d.Detached() || err == ErrDetached {
+				break
+			}
+			if e, ok := err.(*HostError); ok && e.Stalled() {
+				p.ClearHalt()
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		for port := 1; port <= nport; port++ {
+			if sbuf[port>>3]&(1<<uint(port&7)) != 0 {
+				hubPortChange(d, children, port, buf)
+			}
+		}
+	}
+	for _, c := range children {
+		if c != nil {
+			d.h.detach(c)
+		}
+	}
+}
+
+func hubPortStatus(d *HostDevice, port int, buf []byte) (status, change uint16, ok bool) {
+	if n, err := d.Control(hreqGetPortStatus, 0, uint16(port), buf[:4]); err != nil || n != 4 {
+		return 0, 0, false
+	}
+	status = uint16(buf[0]) | uint16(buf[1])<<8
+	change = uint16(buf[2]) | uint16(buf[3])<<8
+	return status, change, true
+}
+
+func hubPortChange(d *HostDevice, children []*HostDevice, port int, buf []byte) {
+	status, change, ok := hubPortStatus(d, port, buf)
+	if !ok {
+		return
+	}
+	for f := 0; f <= cPortReset-cPortConnection; f++ {
+		if change&(1<<uint(f)) != 0 {
+			d.Control(hreqClearPortFeature, uint16(cPortConnection+f), uint16(port), nil)
+		}
+	}
+	if change&psConnection == 0 {
+		return
+	}
+	if c := children[port]; c != nil {
+		children[port] = nil
+		d.h.detach(c)
+	}
+	if status&psConnection == 0 {
+		return
+	}
+	time.Sleep(100 * time.Millisecond) // debounce interval
+	children[port] = d.h.connect(d, uint8(port), func() (Speed, bool) {
+		return resetHubPort(d, port, buf)
+	})
+}
+
+func resetHubPort(d *HostDevice, port int, buf []byte) (speed Speed, ok bool) {
+	if _, err := d.Control(hreqSetPortFeature, portReset, uint16(port), nil); err != nil {
+		return 0, false
+	}
+	for i := 0; ; i++ {
+		if i == 50 {
+			return 0, false
+		}
+		time.Sleep(10 * time.Millisecond)
+		status, change, ok := hubPortStatus(d, port, buf)
+		if !ok {
+			return 0, false
+		}
+		if change&(1<<(cPortReset-cPortConnection)) == 0 {
+			continue
+		}
+		d.Control(hreqClearPortFeature, cPortReset, uint16(port), nil)
+		if status&(psConnection|psEnable) != psConnection|psEnable {
+			return 0, false
+		}
+		switch {
+		case status&psLowSpeed != 0:
+			speed = LowSpeed
+		case status&psHighSpeed != 0:
+			speed = HighSpeed
+		default:
+			speed = FullSpeed
+		}
+		break
+	}
+	time.Sleep(10 * time.Millisecond) // reset recovery time
+	return speed, true
+}
@@ -0,0 +1,420 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usbaudio provides the USB Audio Class 1.0 device driver with the
+// isochronous playback (host OUT) and capture (host IN) streams.
+//
+// The playback stream uses the asynchronous synchronization: the device
+// clock (e.g. SAI/I2S master clock) determines the sample rate and the host
+// adjusts the amount of data sent based on the values read from the feedback
+// endpoint. The capture stream is asynchronous too: the number of samples sent
+// in every (micro)frame depends on the amount of data in the capture FIFO.
+//
+// In the FS mode the data endpoints are serviced every frame (1 ms), in the HS
+// mode every microframe (125 µs).
+//
+// The audio function uses the Audio Control interface (Config.Interf) followed
+// by the Audio Streaming interfaces (first the playback one, if enabled). The
+// streaming interfaces have two alternate settings: the zero-bandwidth setting
+// 0 and the operational setting 1. The descriptors returned by Descriptors
+// must be included in the configuration descriptors passed to usb.Device.Init.
+// Example:
+//
+//	cfg := &usbaudio.Config{
+//		Interf:     interf,
+//		Out:        usbaudio.StreamConfig{Rate: 48000, Channels: 2, Bytes: 2, EP: 2},
+//		FeedbackEP: 3,
+//	}
+//	...
+//	ad := usbaudio.NewDriver(usbd, cfg)
+//	usbd.Enable()
+//	out := ad.Out()
+//	for {
+//		n := out.FIFO().Read(buf) // in the SAI DMA handler or goroutine
+//		...
+//	}
+//
+// The volume and mute controls are implemented by the Feature Units. The
+// driver doesn't modify the samples. Use Stream.Gain to apply them.
+package usbaudio
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/embeddedgo/imxrt/hal/usb"
+)
+
+// A StreamConfig describes the audio stream. The default FIFO size and the
+// default volume range (from -60 dB to 0 dB with 1 dB resolution) are used if
+// the corresponding fields are zero.
+type StreamConfig struct {
+	Rate     int  // sampling frequency (Hz)
+	Channels int  // number of channels, 0 means no stream
+	Bytes    int  // bytes per sample (2, 3 or 4)
+	EP       int8 // isochronous data endpoint
+	FIFOSize int  // FIFO size in bytes (power of two, default about 16 ms)
+
+	// Volume range in 1/256 dB units.
+	VolMin, VolMax, VolRes int16
+}
+
+// A Config describes the audio function.
+type Config struct {
+	Interf     uint8        // Audio Control interface number
+	Out        StreamConfig // playback stream (host to device)
+	In         StreamConfig // capture stream (device to host)
+	FeedbackEP int8         // isochronous feedback IN endpoint for playback
+}
+
+func (c *Config) outIntf() uint8 { return c.Interf + 1 }
+
+func (c *Config) inIntf() uint8 {
+	if c.Out.Channels != 0 {
+		return c.Interf + 2
+	}
+	return c.Interf + 1
+}
+
+// Entity IDs.
+const (
+	idOutIT = 1 // USB streaming input terminal
+	idOutFU = 2
+	idOutOT = 3 // speaker
+	idInIT  = 4 // microphone
+	idInFU  = 5
+	idInOT  = 6 // USB streaming output terminal
+)
+
+// Audio class specific requests: bRequest<<8 | bmRequestType.
+const (
+	reqSetCur = 0x0121
+	reqGetCur = 0x81a1
+	reqGetMin = 0x82a1
+	reqGetMax = 0x83a1
+	reqGetRes = 0x84a1
+)
+
+// Feature Unit control selectors.
+const (
+	csMute   = 0x01
+	csVolume = 0x02
+)
+
+// volSilence is the special volume value that means -∞ dB.
+const volSilence = -0x8000
+
+// A Driver is an USB Audio Class driver.
+type Driver struct {
+	out, in *Stream
+}
+
+var interfaces = make(map[uint8]*Driver)
+
+// NewDriver returns a new audio driver configured according to cfg.
+func NewDriver(d *usb.Device, cfg *Config) *Driver {
+	a := new(Driver)
+	if c := &cfg.Out; c.Channels != 0 {
+		a.out = newStream(d, c, cfg.outIntf(), idOutFU, usb.HE(c.EP, usb.OUT))
+		a.out.fbe = usb.HE(cfg.FeedbackEP, usb.IN)
+		go receiver(a.out)
+		go feedback(a.out)
+	}
+	if c := &cfg.In; c.Channels != 0 {
+		a.in = newStream(d, c, cfg.inIntf(), idInFU, usb.HE(c.EP, usb.IN))
+		go sender(a.in)
+	}
+	interfaces[cfg.Interf] = a
+	d.Handle(0, reqSetCur, control)
+	d.Handle(0, reqGetCur, control)
+	d.Handle(0, reqGetMin, control)
+	d.Handle(0, reqGetMax, control)
+	d.Handle(0, reqGetRes, control)
+	return a
+}
+
+// Out returns the playback stream or nil if there is no playback stream.
+func (a *Driver) Out() *Stream { return a.out }
+
+// In returns the capture stream or nil if there is no capture stream.
+func (a *Driver) In() *Stream { return a.in }
+
+// A Stream represents the audio stream.
+type Stream struct {
+	d       *usb.Device
+	fifo    *FIFO
+	cfg     StreamConfig
+	frame   int // audio frame size in bytes (all channels)
+	intf    uint8
+	fu      uint8
+	he, fbe uint8
+	active  atomic.Bool
+	mute    atomic.Bool
+	vol     atomic.Int32
+	changed chan struct{}
+
+	volMin, volMax, volRes int16
+}
+
+func newStream(d *usb.Device, c *StreamConfig, intf, fu, he uint8) *Stream {
+	s := &Stream{
+		d:       d,
+		cfg:     *c,
+		frame:   c.Channels * c.Bytes,
+		intf:    intf,
+		fu:      fu,
+		he:      he,
+		changed: make(chan struct{}, 1),
+		volMin:  c.VolMin,
+		volMax:  c.VolMax,
+		volRes:  c.VolRes,
+	}
+	if s.volMin == 0 && s.volMax == 0 && s.volRes == 0 {
+		s.volMin, s.volMax, s.volRes = -60*256, 0, 256
+	}
+	size := c.FIFOSize
+	if size == 0 {
+		size = 1
+		for size < c.Rate*s.frame*16/1000 {
+			size <<= 1
+		}
+	}
+	s.fifo = NewFIFO(size)
+	s.vol.Store(int32(s.volMax))
+	return s
+}
+
+// FIFO returns the FIFO of the stream. In case of the playback stream the
+// driver writes the received samples to the FIFO and the application reads
+// them. In case of the capture stream the application writes the samples and
+// the driver reads them.
+func (s *Stream) FIFO() *FIFO { return s.fifo }
+
+// Active reports whether the host selected the operational alternate setting
+// of the streaming interface (the stream is open on the host side).
+func (s *Stream) Active() bool { return s.active.Load() }
+
+// Muted reports the state of the Mute control.
+func (s *Stream) Muted() bool { return s.mute.Load() }
+
+// Volume returns the value of the Volume control in 1/256 dB units.
+func (s *Stream) Volume() int { return int(s.vol.Load()) }
+
+// Gain returns the linear gain that corresponds to the current Volume and Mute
+// controls.
+func (s *Stream) Gain() float32 {
+	v := s.vol.Load()
+	if s.mute.Load() || v == volSilence {
+		return 0
+	}
+	return float32(math.Pow(10, float64(v)/(256*20)))
+}
+
+// Changed returns the channel that receives a value when the host changes the
+// Volume or Mute control or opens/closes the stream.
+func (s *Stream) Changed() <-chan struct{} { return s.changed }
+
+func (s *Stream) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) setActive(active bool) {
+	s.active.Store(active)
+	s.notify()
+}
+
+// Descriptors returns the Audio Control interface descriptors followed by the
+// Audio Streaming interface descriptors. Use hs to obtain the descriptors for
+// the HS configuration.
+func Descriptors(cfg *Config, hs bool) string {
+	out, in := &cfg.Out, &cfg.In
+	var ac []byte
+	nintf := byte(0)
+	if out.Channels != 0 {
+		nintf++
+		ac = append(ac,
+			12, 0x24, 0x02, idOutIT, 0x01, 0x01, 0, byte(out.Channels),
+			byte(chanConfig(out)), byte(chanConfig(out)>>8), 0, 0,
+		)
+		ac = appendFU(ac, idOutFU, idOutIT, out.Channels)
+		ac = append(ac, 9, 0x24, 0x03, idOutOT, 0x01, 0x03, 0, idOutFU, 0)
+	}
+	if in.Channels != 0 {
+		nintf++
+		ac = append(ac,
+			12, 0x24, 0x02, idInIT, 0x01, 0x02, 0, byte(in.Channels),
+			byte(chanConfig(in)), byte(chanConfig(in)>>8), 0, 0,
+		)
+		ac = appendFU(ac, idInFU, idInIT, in.Channels)
+		ac = append(ac, 9, 0x24, 0x03, idInOT, 0x01, 0x01, 0, idInFU, 0)
+	}
+	total := 8 + int(nintf) + len(ac)
+	b := []byte{
+		9, 4, cfg.Interf, 0, 0, 0x01, 0x01, 0, 0,
+		8 + nintf, 0x24, 0x01, 0x00, 0x01, byte(total), byte(total >> 8), nintf,
+	}
+	if out.Channels != 0 {
+		b = append(b, cfg.outIntf())
+	}
+	if in.Channels != 0 {
+		b = append(b, cfg.inIntf())
+	}
+	b = append(b, ac...)
+
+	interval := byte(1) // every frame (FS) or every microframe (HS)
+	if out.Channels != 0 {
+		intf := cfg.outIntf()
+		fbSize, fbInterval, fbRefresh := byte(3), byte(1), byte(3) // 8 ms
+		if hs {
+			fbSize, fbInterval, fbRefresh = 4, 4, 0 // 1 ms
+		}
+		wmax, _ := packetSize(out, hs)
+		b = append(b,
+			9, 4, intf, 0, 0, 0x01, 0x02, 0, 0,
+			9, 4, intf, 1, 2, 0x01, 0x02, 0, 0,
+			7, 0x24, 0x01, idOutIT, 1, 0x01, 0x00,
+		)
+		b = appendFormat(b, out)
+		b = append(b,
+			9, 5, byte(out.EP), 0x05, byte(wmax), byte(wmax>>8), interval, 0,
+			0x80|byte(cfg.FeedbackEP),
+			7, 0x25, 0x01, 0, 0, 0, 0,
+			9, 5, 0x80|byte(cfg.FeedbackEP), 0x11, fbSize, 0, fbInterval,
+			fbRefresh, 0,
+		)
+	}
+	if in.Channels != 0 {
+		intf := cfg.inIntf()
+		wmax, _ := packetSize(in, hs)
+		b = append(b,
+			9, 4, intf, 0, 0, 0x01, 0x02, 0, 0,
+			9, 4, intf, 1, 1, 0x01, 0x02, 0, 0,
+			7, 0x24, 0x01, idInOT, 1, 0x01, 0x00,
+		)
+		b = appendFormat(b, in)
+		b = append(b,
+			9, 5, 0x80|byte(in.EP), 0x05, byte(wmax), byte(wmax>>8), interval,
+			0, 0,
+			7, 0x25, 0x01, 0, 0, 0, 0,
+		)
+	}
+	return string(b)
+}
+
+func chanConfig(c *StreamConfig) uint16 {
+	if c.Channels == 2 {
+		return 0x0003 // left front, right front
+	}
+	return 0
+}
+
+func appendFU(b []byte, id, src byte, channels int) []byte {
+	b = append(b, byte(7+channels+1), 0x24, 0x06, id, src, 1, 0x03) // master: mute, volume
+	for i := 0; i < channels; i++ {
+		b = append(b, 0)
+	}
+	return append(b, 0)
+}
+
+func appendFormat(b []byte, c *StreamConfig) []byte {
+	return append(b,
+		11, 0x24, 0x02, 0x01, byte(c.Channels), byte(c.Bytes), byte(c.Bytes*8),
+		1, byte(c.Rate), byte(c.Rate>>8), byte(c.Rate>>16),
+	)
+}
+
+// servicesPerSec returns the number of (micro)frames per second.
+func servicesPerSec(hs bool) int {
+	if hs {
+		return 8000
+	}
+	return 1000
+}
+
+// packetSize returns the wMaxPacketSize field of the data endpoint descriptor
+// and the maximum number of bytes transferred in one (micro)frame. The
+// packets can carry one more audio frame than the nominal rate requires.
+func packetSize(c *StreamConfig, hs bool) (wmax, size int) {
+	ps := servicesPerSec(hs)
+	frames := (c.Rate+ps-1)/ps + 1
+	size = frames * c.Channels * c.Bytes
+	if !hs {
+		return size, size
+	}
+	mult := (size + 1023) / 1024
+	if mult > 3 {
+		panic("usbaudio: too high bandwidth")
+	}
+	pkt := (size + mult - 1) / mult
+	return pkt | (mult-1)<<11, size
+}
+
+func control(cr *usb.ControlRequest) int {
+	a := interfaces[uint8(cr.Index)]
+	if a == nil {
+		return -1
+	}
+	var s *Stream
+	switch fu := uint8(cr.Index >> 8); {
+	case a.out != nil && fu == a.out.fu:
+		s = a.out
+	case a.in != nil && fu == a.in.fu:
+		s = a.in
+	default:
+		return -1
+	}
+	if uint8(cr.Value) != 0 {
+		return -1 // only the master channel controls are implemented
+	}
+	switch cr.Value >> 8 {
+	case csMute:
+		if len(cr.Data) < 1 {
+			return -1
+		}
+		switch cr.Request {
+		case reqSetCur:
+			s.mute.Store(cr.Data[0] != 0)
+			s.notify()
+			return 0
+		case reqGetCur:
+			cr.Data[0] = 0
+			if s.mute.Load() {
+				cr.Data[0] = 1
+			}
+			return 1
+		}
+	case csVolume:
+		if len(cr.Data) < 2 {
+			return -1
+		}
+		var v int16
+		switch cr.Request {
+		case reqSetCur:
+			v = int16(cr.Data[0]) | int16(cr.Data[1])<<8
+			if v != volSilence {
+				v = max(s.volMin, min(s.volMax, v))
+			}
+			s.vol.Store(int32(v))
+			s.notify()
+			return 0
+		case reqGetCur:
+			v = int16(s.vol.Load())
+		case reqGetMin:
+			v = s.volMin
+		case reqGetMax:
+			v = s.volMax
+		case reqGetRes:
+			v = s.volRes
+		default:
+			return -1
+		}
+		cr.Data[0] = byte(v)
+		cr.Data[1] = byte(v >> 8)
+		return 2
+	}
+	return -1
+}
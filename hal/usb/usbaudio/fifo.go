@@ -0,0 +1,58 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usbaudio
+
+import "sync/atomic"
+
+// A FIFO is a byte ring buffer that connects the USB audio stream with the
+// audio hardware (e.g. SAI/I2S DMA handler). It can be used concurrently by
+// one writer and one reader without any additional synchronization.
+type FIFO struct {
+	buf []byte
+	r   atomic.Uint32 // free-running read index
+	w   atomic.Uint32 // free-running write index
+}
+
+// NewFIFO returns a new FIFO of the given size which must be a power of two.
+func NewFIFO(size int) *FIFO {
+	if size <= 0 || size&(size-1) != 0 {
+		panic("usbaudio: FIFO size must be power of two")
+	}
+	return &FIFO{buf: make([]byte, size)}
+}
+
+// Cap returns the capacity of the FIFO.
+func (f *FIFO) Cap() int {
+	return len(f.buf)
+}
+
+// Len returns the number of bytes available for reading.
+func (f *FIFO) Len() int {
+	return int(f.w.Load() - f.r.Load())
+}
+
+// Write writes as much of p as fits in the FIFO and returns the number of
+// bytes written.
+func (f *FIFO) Write(p []byte) int {
+	w := f.w.Load()
+	n := min(len(p), len(f.buf)-int(w-f.r.Load()))
+	i := int(w) & (len(f.buf) - 1)
+	m := copy(f.buf[i:], p[:n])
+	copy(f.buf, p[m:n])
+	f.w.Store(w + uint32(n))
+	return n
+}
+
+// Read reads at most len(p) bytes from the FIFO and returns the number of
+// bytes read.
+func (f *FIFO) Read(p []byte) int {
+	r := f.r.Load()
+	n := min(len(p), int(f.w.Load()-r))
+	i := int(r) & (len(f.buf) - 1)
+	m := copy(p[:n], f.buf[i:])
+	copy(p[m:n], f.buf)
+	f.r.Store(r + uint32(n))
+	return n
+}
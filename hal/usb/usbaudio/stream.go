@@ -0,0 +1,215 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usbaudio
+
+import (
+	"embedded/rtos"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/usb"
+)
+
+// ringLen is the number of DTDs queued on the isochronous data endpoint (one
+// DTD per (micro)frame).
+const ringLen = 8
+
+// An isoRing is a ring of DTDs used to keep the isochronous endpoint primed.
+type isoRing struct {
+	tda   []usb.DTD
+	notes []rtos.Note
+	bufs  [][]byte
+}
+
+func newRing(n, size int) *isoRing {
+	stride := (size + dma.MemAlign - 1) &^ (dma.MemAlign - 1)
+	mem := dma.MakeSlice[byte](n*stride, n*stride)
+	r := &isoRing{
+		tda:   usb.MakeSliceDTD(n, n),
+		notes: make([]rtos.Note, n),
+		bufs:  make([][]byte, n),
+	}
+	for i := range r.tda {
+		r.tda[i].SetNote(&r.notes[i])
+		r.bufs[i] = mem[i*stride : i*stride+size : i*stride+stride]
+	}
+	return r
+}
+
+// prime appends the i-th DTD that describes the first n bytes of the i-th
+// buffer to the he endpoint queue.
+func (r *isoRing) prime(d *usb.Device, he uint8, i, n int) bool {
+	buf := r.bufs[i]
+	ptr := unsafe.Pointer(&buf[0])
+	if he&1 == usb.IN {
+		rtos.CacheMaint(rtos.DCacheFlush, ptr, cap(buf))
+	} else {
+		rtos.CacheMaint(rtos.DCacheInval, ptr, cap(buf))
+	}
+	td := &r.tda[i]
+	td.SetupTransfer(ptr, n)
+	r.notes[i].Clear()
+	return d.Prime(he, td, td)
+}
+
+// wait waits for the end of the i-th transfer. It reports false if the
+// transfer has been terminated (the host selected the zero-bandwidth setting,
+// bus reset). The n is the number of bytes transferred.
+func (r *isoRing) wait(i, size int) (n int, ok bool) {
+	r.notes[i].Sleep(-1)
+	rem, status := r.tda[i].Status()
+	if status&usb.Active != 0 {
+		return 0, false
+	}
+	if status != 0 {
+		return 0, true // transfer error, ignore the data
+	}
+	return size - rem, true
+}
+
+// receiver receives the playback stream and writes it to the FIFO.
+func receiver(s *Stream) {
+	_, maxSize := packetSize(&s.cfg, false)
+	r := newRing(ringLen, maxSize)
+	for {
+		s.d.WaitInterface(int(s.intf), 1)
+		_, size := packetSize(&s.cfg, s.d.Speed() == usb.HighSpeed)
+		s.setActive(true)
+		for i := 0; i < ringLen; i++ {
+			if !r.prime(s.d, s.he, i, size) {
+				goto stop
+			}
+		}
+		for i := 0; ; i = (i + 1) % ringLen {
+			n, ok := r.wait(i, size)
+			if !ok {
+				break
+			}
+			n -= n % s.frame
+			s.fifo.Write(r.bufs[i][:n]) // drop the overflowing samples
+			if !r.prime(s.d, s.he, i, size) {
+				break
+			}
+		}
+	stop:
+		s.setActive(false)
+	}
+}
+
+// feedbackValue returns the number of audio frames per (micro)frame the host
+// should send to keep the playback FIFO half full. FS uses the 10.14 format,
+// HS uses the 16.16 format.
+func (s *Stream) feedbackValue(hs bool) uint32 {
+	shift := 14
+	if hs {
+		shift = 16
+	}
+	// Correct the rate to compensate the FIFO level error in about 0.5 s but
+	// don't deviate from the nominal rate more than 0.5%.
+	level := s.fifo.Len() / s.frame
+	target := s.fifo.Cap() / s.frame / 2
+	rate := int64(s.cfg.Rate)
+	lim := rate / 200
+	adj := max(-lim, min(lim, int64(target-level)*2))
+	return uint32((rate + adj) << shift / int64(servicesPerSec(hs)))
+}
+
+// feedback provides the feedback endpoint with the current rate value.
+func feedback(s *Stream) {
+	r := newRing(2, 4)
+	for {
+		s.d.WaitInterface(int(s.intf), 1)
+		hs := s.d.Speed() == usb.HighSpeed
+		size := 3
+		if hs {
+			size = 4
+		}
+		for i := range r.tda {
+			putLE32(r.bufs[i], s.feedbackValue(hs))
+			if !r.prime(s.d, s.fbe, i, size) {
+				goto stop
+			}
+		}
+		for i := 0; ; i ^= 1 {
+			if _, ok := r.wait(i, size); !ok {
+				break
+			}
+			putLE32(r.bufs[i], s.feedbackValue(hs))
+			if !r.prime(s.d, s.fbe, i, size) {
+				break
+			}
+		}
+	stop:
+	}
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
+// fill fills buf with the samples read from the FIFO that should be sent in
+// the next (micro)frame and returns their length in bytes. The acc accumulates
+// the fractional part of the nominal number of audio frames.
+func (s *Stream) fill(buf []byte, acc *int, ps int) int {
+	*acc += s.cfg.Rate
+	n := *acc / ps
+	*acc -= n * ps
+	// Keep the FIFO half full (the device clock determines the rate).
+	level := s.fifo.Len() / s.frame
+	target := s.fifo.Cap() / s.frame / 2
+	switch {
+	case level > target+2*(n+1):
+		n++
+	case level < target-2*(n+1) && n > 0:
+		n--
+	}
+	m := n * s.frame
+	k := s.fifo.Read(buf[:m])
+	clear(buf[k:m]) // silence in case of underrun
+	return m
+}
+
+// sender reads the capture stream from the FIFO and sends it to the host.
+func sender(s *Stream) {
+	_, maxSize := packetSize(&s.cfg, false)
+	r := newRing(ringLen, maxSize)
+	for {
+		s.d.WaitInterface(int(s.intf), 1)
+		hs := s.d.Speed() == usb.HighSpeed
+		wmax, _ := packetSize(&s.cfg, hs)
+		pkt := wmax & 0x7ff
+		mult := wmax>>11 != 0
+		ps := servicesPerSec(hs)
+		acc := 0
+		sizes := [ringLen]int{}
+		s.setActive(true)
+		for i := 0; i < ringLen; i++ {
+			sizes[i] = s.fill(r.bufs[i], &acc, ps)
+			if mult {
+				r.tda[i].SetMultO(max(1, (sizes[i]+pkt-1)/pkt))
+			}
+			if !r.prime(s.d, s.he, i, sizes[i]) {
+				goto stop
+			}
+		}
+		for i := 0; ; i = (i + 1) % ringLen {
+			if _, ok := r.wait(i, sizes[i]); !ok {
+				break
+			}
+			sizes[i] = s.fill(r.bufs[i], &acc, ps)
+			if mult {
+				r.tda[i].SetMultO(max(1, (sizes[i]+pkt-1)/pkt))
+			}
+			if !r.prime(s.d, s.he, i, sizes[i]) {
+				break
+			}
+		}
+	stop:
+		s.setActive(false)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usbhid provides the USB Human Interface Device class driver and the
+// ready-made keyboard and mouse reports.
+//
+// The report descriptor must be added to the descriptor map passed to the
+// usb.Device.Init with the ReportDescKey key. The interface, HID and endpoint
+// descriptors returned by Descriptors must be included in the configuration
+// descriptors. Example:
+//
+//	descriptors[usbhid.ReportDescKey(interf)] = usbhid.KeyboardReportDesc
+//	...
+//	hid := usbhid.NewDriver(usbd, interf, in, out, 64)
+//	usbd.Enable()
+//	kbd := usbhid.NewKeyboard(hid)
+//	kbd.Type("Hello, World!\n")
+package usbhid
+
+import (
+	"embedded/rtos"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/usb"
+)
+
+// Report types.
+const (
+	Input   = 1
+	Output  = 2
+	Feature = 3
+)
+
+// Protocols (see Driver.Protocol).
+const (
+	BootProtocol   = 0
+	ReportProtocol = 1
+)
+
+// Class-specific requests: bRequest<<8 | bmRequestType.
+const (
+	reqGetReport   = 0x01a1
+	reqGetIdle     = 0x02a1
+	reqGetProtocol = 0x03a1
+	reqSetReport   = 0x0921
+	reqSetIdle     = 0x0a21
+	reqSetProtocol = 0x0b21
+)
+
+const queueLen = 8
+
+// A Driver is an USB HID class driver.
+type Driver struct {
+	d        *usb.Device
+	tda      *[2]usb.DTD // tda[0] is for Tx, tda[1] is for Rx
+	donea    [2]rtos.Note
+	tx       chan []byte
+	rx       chan []byte
+	txbuf    []byte
+	rxbuf    []byte
+	mu       sync.Mutex
+	last     map[byte][]byte // the last input reports by report ID
+	getRep   func(typ, id byte, p []byte) int
+	setRep   func(typ, id byte, p []byte)
+	idle     atomic.Uint32 // in ms
+	protocol atomic.Uint32
+	ids      bool
+	interf   uint8
+	txe, rxe uint8
+}
+
+var interfaces = make(map[uint8]*Driver)
+
+// NewDriver returns a new HID driver that uses the txe interrupt IN endpoint
+// and the optional rxe interrupt OUT endpoint (rxe <= 0 means no OUT
+// endpoint) to exchange reports with the host. MaxPkt is the maximum packet
+// size of both endpoints and limits the report length.
+func NewDriver(d *usb.Device, interf uint8, txe, rxe int8, maxPkt int) *Driver {
+	s := &Driver{
+		d:      d,
+		tda:    (*[2]usb.DTD)(usb.MakeSliceDTD(2, 2)),
+		tx:     make(chan []byte, queueLen),
+		rx:     make(chan []byte, queueLen),
+		txbuf:  dma.MakeSlice[byte](maxPkt, maxPkt),
+		rxbuf:  dma.MakeSlice[byte](maxPkt, maxPkt),
+		last:   make(map[byte][]byte),
+		interf: interf,
+		txe:    usb.HE(txe, usb.IN),
+	}
+	s.tda[0].SetNote(&s.donea[0])
+	s.tda[1].SetNote(&s.donea[1])
+	s.protocol.Store(ReportProtocol)
+	interfaces[interf] = s
+	d.Handle(0, reqGetReport, getReport)
+	d.Handle(0, reqSetReport, setReport)
+	d.Handle(0, reqGetIdle, getIdle)
+	d.Handle(0, reqSetIdle, setIdle)
+	d.Handle(0, reqGetProtocol, getProtocol)
+	d.Handle(0, reqSetProtocol, setProtocol)
+	go sender(s)
+	if rxe > 0 {
+		s.rxe = usb.HE(rxe, usb.OUT)
+		go receiver(s)
+	}
+	return s
+}
+
+// ReportDescKey returns the key of the report descriptor in the descriptor map
+// passed to the usb.Device.Init method.
+func ReportDescKey(interf uint8) uint32 {
+	return 0x2200_0000 | uint32(interf)
+}
+
+// Descriptors returns the interface descriptor followed by the HID descriptor
+// and the endpoint descriptors of the HID interface. Use rxe <= 0 if there is
+// no OUT endpoint. The interval is the endpoint polling interval (in frames
+// for FS, 2^(interval-1) microframes for HS). The boot keyboard and mouse use
+// subclass 1 and protocol 1 and 2 respectively.
+func Descriptors(interf uint8, txe, rxe int8, maxPkt int, interval, subclass, protocol byte, reportDesc string) string {
+	nep := byte(1)
+	if rxe > 0 {
+		nep = 2
+	}
+	rlen := len(reportDesc)
+	b := []byte{
+		9, 4, interf, 0, nep, 0x03, subclass, protocol, 0,
+		9, 0x21, 0x11, 0x01, 0, 1, 0x22, byte(rlen), byte(rlen >> 8),
+		7, 5, 0x80 | byte(txe), 3, byte(maxPkt), byte(maxPkt >> 8), interval,
+	}
+	if rxe > 0 {
+		b = append(b, 7, 5, byte(rxe), 3, byte(maxPkt), byte(maxPkt>>8), interval)
+	}
+	return string(b)
+}
+
+// SetReportIDs informs the driver that the reports are prefixed with the
+// report ID (the report descriptor contains the Report ID items).
+func (s *Driver) SetReportIDs(ids bool) {
+	s.ids = ids
+}
+
+// HandleFeature registers the functions that handle the GET_REPORT and
+// SET_REPORT requests for Feature reports (and for the Input reports that
+// have not been sent yet). The get function returns the number of bytes
+// written to p or -1 to stall the request. Both functions are called by the
+// control request handling goroutine.
+func (s *Driver) HandleFeature(get func(typ, id byte, p []byte) int, set func(typ, id byte, p []byte)) {
+	s.mu.Lock()
+	s.getRep = get
+	s.setRep = set
+	s.mu.Unlock()
+}
+
+// Protocol returns the current protocol selected by the host (BootProtocol or
+// ReportProtocol).
+func (s *Driver) Protocol() int {
+	return int(s.protocol.Load())
+}
+
+// Idle returns the current idle rate. Zero means that the report is sent only
+// when its content changes, otherwise the last report is repeated at least
+// every Idle period.
+func (s *Driver) Idle() time.Duration {
+	return time.Duration(s.idle.Load()) * time.Millisecond
+}
+
+func (s *Driver) reportID(p []byte) byte {
+	if s.ids && len(p) != 0 {
+		return p[0]
+	}
+	return 0
+}
+
+// Send queues the input report p to be sent to the host. It blocks if the
+// queue is full. Send copies p so it can be modified immediately after return.
+func (s *Driver) Send(p []byte) {
+	if len(p) > len(s.txbuf) {
+		p = p[:len(s.txbuf)]
+	}
+	r := append([]byte(nil), p...)
+	s.mu.Lock()
+	s.last[s.reportID(r)] = r
+	s.mu.Unlock()
+	s.tx <- r
+}
+
+// Recv waits for the output report received from the host, either from the
+// interrupt OUT endpoint or by the SET_REPORT(Output) request. It returns the
+// number of bytes copied to p. Reports are dropped if the receive queue is
+// full.
+func (s *Driver) Recv(p []byte) int {
+	return copy(p, <-s.rx)
+}
+
+// RecvChan returns the channel of received output reports.
+func (s *Driver) RecvChan() <-chan []byte {
+	return s.rx
+}
+
+func (s *Driver) deliver(p []byte) {
+	select {
+	case s.rx <- append([]byte(nil), p...):
+	default:
+	}
+}
+
+func sender(s *Driver) {
+	td, done := &s.tda[0], &s.donea[0]
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var last []byte
+	for {
+		var p []byte
+		if idle := s.Idle(); idle == 0 || last == nil {
+			p = <-s.tx
+		} else {
+			timer.Reset(idle)
+			select {
+			case p = <-s.tx:
+				timer.Stop()
+			case <-timer.C:
+				p = last
+			}
+		}
+		last = p
+		n := copy(s.txbuf, p)
+		ptr := unsafe.Pointer(&s.txbuf[0])
+		rtos.CacheMaint(rtos.DCacheFlush, ptr, len(s.txbuf))
+		td.SetupTransfer(ptr, n)
+		done.Clear()
+		if !s.d.Prime(s.txe, td, td) {
+			// Not configured. Drop the report.
+			last = nil
+			continue
+		}
+		done.Sleep(-1)
+	}
+}
+
+func receiver(s *Driver) {
+	td, done := &s.tda[1], &s.donea[1]
+	ptr := unsafe.Pointer(&s.rxbuf[0])
+usbNotReady:
+	s.d.WaitConfig(0)
+	for {
+		rtos.CacheMaint(rtos.DCacheInval, ptr, len(s.rxbuf))
+		n := td.SetupTransfer(ptr, len(s.rxbuf))
+		done.Clear()
+		if !s.d.Prime(s.rxe, td, td) {
+			goto usbNotReady
+		}
+		done.Sleep(-1)
+		m, status := td.Status()
+		if status != 0 {
+			if status&usb.Active != 0 {
+				goto usbNotReady
+			}
+			continue
+		}
+		s.deliver(s.rxbuf[:n-m])
+	}
+}
+
+func getReport(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	typ, id := byte(cr.Value>>8), byte(cr.Value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if typ == Input {
+		if r := s.last[id]; r != nil {
+			return copy(cr.Data, r)
+		}
+	}
+	if s.getRep == nil {
+		return -1
+	}
+	return s.getRep(typ, id, cr.Data)
+}
+
+func setReport(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	typ, id := byte(cr.Value>>8), byte(cr.Value)
+	if typ == Output {
+		s.deliver(cr.Data)
+		return 0
+	}
+	s.mu.Lock()
+	set := s.setRep
+	s.mu.Unlock()
+	if set == nil {
+		return -1
+	}
+	set(typ, id, cr.Data)
+	return 0
+}
+
+func getIdle(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 1 {
+		return -1
+	}
+	cr.Data[0] = byte(s.idle.Load() / 4)
+	return 1
+}
+
+func setIdle(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	// The duration is in 4 ms units. Only the global idle rate is supported
+	// (the report ID in the lower byte is ignored).
+	s.idle.Store(uint32(cr.Value>>8) * 4)
+	return 0
+}
+
+func getProtocol(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 1 {
+		return -1
+	}
+	cr.Data[0] = byte(s.protocol.Load())
+	return 1
+}
+
+func setProtocol(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	s.protocol.Store(uint32(cr.Value & 1))
+	return 0
+}
@@ -0,0 +1,304 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usbhid
+
+import "sync/atomic"
+
+// KeyboardReportDesc is the report descriptor of the boot protocol compatible
+// keyboard with five LEDs (HID 1.11, Appendix B.1).
+const KeyboardReportDesc = "" +
+	"\x05\x01" + // Usage Page (Generic Desktop)
+	"\x09\x06" + // Usage (Keyboard)
+	"\xa1\x01" + // Collection (Application)
+	"\x05\x07" + //   Usage Page (Key Codes)
+	"\x19\xe0" + //   Usage Minimum (224)
+	"\x29\xe7" + //   Usage Maximum (231)
+	"\x15\x00" + //   Logical Minimum (0)
+	"\x25\x01" + //   Logical Maximum (1)
+	"\x75\x01" + //   Report Size (1)
+	"\x95\x08" + //   Report Count (8)
+	"\x81\x02" + //   Input (Data, Variable, Absolute): modifier byte
+	"\x95\x01" + //   Report Count (1)
+	"\x75\x08" + //   Report Size (8)
+	"\x81\x01" + //   Input (Constant): reserved byte
+	"\x95\x05" + //   Report Count (5)
+	"\x75\x01" + //   Report Size (1)
+	"\x05\x08" + //   Usage Page (LEDs)
+	"\x19\x01" + //   Usage Minimum (1)
+	"\x29\x05" + //   Usage Maximum (5)
+	"\x91\x02" + //   Output (Data, Variable, Absolute): LED report
+	"\x95\x01" + //   Report Count (1)
+	"\x75\x03" + //   Report Size (3)
+	"\x91\x01" + //   Output (Constant): LED report padding
+	"\x95\x06" + //   Report Count (6)
+	"\x75\x08" + //   Report Size (8)
+	"\x15\x00" + //   Logical Minimum (0)
+	"\x25\x65" + //   Logical Maximum (101)
+	"\x05\x07" + //   Usage Page (Key Codes)
+	"\x19\x00" + //   Usage Minimum (0)
+	"\x29\x65" + //   Usage Maximum (101)
+	"\x81\x00" + //   Input (Data, Array): key arrays (6 bytes)
+	"\xc0" //      End Collection
+
+// Modifier bits (the first byte of the keyboard report).
+const (
+	ModLeftCtrl   = 1 << 0
+	ModLeftShift  = 1 << 1
+	ModLeftAlt    = 1 << 2
+	ModLeftGUI    = 1 << 3
+	ModRightCtrl  = 1 << 4
+	ModRightShift = 1 << 5
+	ModRightAlt   = 1 << 6
+	ModRightGUI   = 1 << 7
+)
+
+// LED bits (the keyboard output report).
+const (
+	LEDNumLock    = 1 << 0
+	LEDCapsLock   = 1 << 1
+	LEDScrollLock = 1 << 2
+	LEDCompose    = 1 << 3
+	LEDKana       = 1 << 4
+)
+
+// Keyboard usage IDs (HID Usage Tables, Keyboard/Keypad Page).
+const (
+	KeyA = 0x04 + iota
+	KeyB
+	KeyC
+	KeyD
+	KeyE
+	KeyF
+	KeyG
+	KeyH
+	KeyI
+	KeyJ
+	KeyK
+	KeyL
+	KeyM
+	KeyN
+	KeyO
+	KeyP
+	KeyQ
+	KeyR
+	KeyS
+	KeyT
+	KeyU
+	KeyV
+	KeyW
+	KeyX
+	KeyY
+	KeyZ
+	Key1
+	Key2
+	Key3
+	Key4
+	Key5
+	Key6
+	Key7
+	Key8
+	Key9
+	Key0
+	KeyEnter
+	KeyEsc
+	KeyBackspace
+	KeyTab
+	KeySpace
+	KeyMinus
+	KeyEqual
+	KeyLeftBrace
+	KeyRightBrace
+	KeyBackslash
+	KeyNonUSHash
+	KeySemicolon
+	KeyApostrophe
+	KeyGrave
+	KeyComma
+	KeyDot
+	KeySlash
+	KeyCapsLock
+	KeyF1
+	KeyF2
+	KeyF3
+	KeyF4
+	KeyF5
+	KeyF6
+	KeyF7
+	KeyF8
+	KeyF9
+	KeyF10
+	KeyF11
+	KeyF12
+	KeyPrintScreen
+	KeyScrollLock
+	KeyPause
+	KeyInsert
+	KeyHome
+	KeyPageUp
+	KeyDelete
+	KeyEnd
+	KeyPageDown
+	KeyRight
+	KeyLeft
+	KeyDown
+	KeyUp
+	KeyNumLock
+)
+
+// Modifier keys. Press and Release handle them by setting/clearing the
+// corresponding modifier bits.
+const (
+	KeyLeftCtrl = 0xe0 + iota
+	KeyLeftShift
+	KeyLeftAlt
+	KeyLeftGUI
+	KeyRightCtrl
+	KeyRightShift
+	KeyRightAlt
+	KeyRightGUI
+)
+
+// A KeyboardReport is the boot protocol keyboard input report: the modifier
+// byte, the reserved byte and up to six pressed keys.
+type KeyboardReport [8]byte
+
+// Press adds key to the report. It reports false if there is no room for the
+// key (ErrorRollOver should be reported in this case).
+func (r *KeyboardReport) Press(key byte) bool {
+	if key >= KeyLeftCtrl && key <= KeyRightGUI {
+		r[0] |= 1 << (key - KeyLeftCtrl)
+		return true
+	}
+	free := -1
+	for i := 2; i < len(r); i++ {
+		switch r[i] {
+		case key:
+			return true
+		case 0:
+			if free < 0 {
+				free = i
+			}
+		}
+	}
+	if free < 0 {
+		return false
+	}
+	r[free] = key
+	return true
+}
+
+// Release removes key from the report.
+func (r *KeyboardReport) Release(key byte) {
+	if key >= KeyLeftCtrl && key <= KeyRightGUI {
+		r[0] &^= 1 << (key - KeyLeftCtrl)
+		return
+	}
+	for i := 2; i < len(r); i++ {
+		if r[i] == key {
+			r[i] = 0
+		}
+	}
+}
+
+// Clear releases all keys including modifiers.
+func (r *KeyboardReport) Clear() {
+	*r = KeyboardReport{}
+}
+
+// usASCII maps the printable ASCII characters (starting from space) to the
+// key codes of the US keyboard layout. The most significant bit means Shift.
+const usASCII = "" +
+	"\x2c\x9e\xb4\xa0\xa1\xa2\xa4\x34\xa6\xa7\xa5\xae\x36\x2d\x37\x38" + //  !"#$%&'()*+,-./
+	"\x27\x1e\x1f\x20\x21\x22\x23\x24\x25\x26\xb3\x33\xb6\x2e\xb7\xb8" + // 0123456789:;<=>?
+	"\x9f\x84\x85\x86\x87\x88\x89\x8a\x8b\x8c\x8d\x8e\x8f\x90\x91\x92" + // @ABCDEFGHIJKLMNO
+	"\x93\x94\x95\x96\x97\x98\x99\x9a\x9b\x9c\x9d\x2f\x31\x30\xa3\xad" + // PQRSTUVWXYZ[\]^_
+	"\x35\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12" + // `abcdefghijklmno
+	"\x13\x14\x15\x16\x17\x18\x19\x1a\x1b\x1c\x1d\xaf\xb1\xb0\xb5" //     pqrstuvwxyz{|}~
+
+// KeyFromRune returns the key code and the modifiers required to type the r
+// character using the US keyboard layout. It reports false if r cannot be
+// typed.
+func KeyFromRune(r rune) (key, mod byte, ok bool) {
+	switch {
+	case r == '\n':
+		return KeyEnter, 0, true
+	case r == '\t':
+		return KeyTab, 0, true
+	case r == '\b':
+		return KeyBackspace, 0, true
+	case r >= ' ' && r <= '~':
+		k := usASCII[r-' ']
+		if k&0x80 != 0 {
+			mod = ModLeftShift
+		}
+		return k & 0x7f, mod, true
+	}
+	return 0, 0, false
+}
+
+// A Keyboard is a simple keyboard that uses the Driver to send the boot
+// protocol reports (KeyboardReportDesc).
+type Keyboard struct {
+	d    *Driver
+	r    KeyboardReport
+	leds atomic.Uint32
+}
+
+// NewKeyboard returns a new keyboard that uses d to communicate with the host.
+// It starts a goroutine that receives the LED output reports.
+func NewKeyboard(d *Driver) *Keyboard {
+	k := &Keyboard{d: d}
+	go func() {
+		for r := range d.RecvChan() {
+			if d.ids && len(r) > 1 {
+				r = r[1:]
+			}
+			if len(r) > 0 {
+				k.leds.Store(uint32(r[0]))
+			}
+		}
+	}()
+	return k
+}
+
+// LEDs returns the LED state set by the host (see LEDNumLock, LEDCapsLock,
+// etc.).
+func (k *Keyboard) LEDs() uint8 {
+	return uint8(k.leds.Load())
+}
+
+// Press presses key and sends the report.
+func (k *Keyboard) Press(key byte) {
+	k.r.Press(key)
+	k.d.Send(k.r[:])
+}
+
+// Release releases key and sends the report.
+func (k *Keyboard) Release(key byte) {
+	k.r.Release(key)
+	k.d.Send(k.r[:])
+}
+
+// ReleaseAll releases all keys and sends the report.
+func (k *Keyboard) ReleaseAll() {
+	k.r.Clear()
+	k.d.Send(k.r[:])
+}
+
+// Type types s using the US keyboard layout. The characters that cannot be
+// typed are skipped.
+func (k *Keyboard) Type(s string) {
+	for _, c := range s {
+		key, mod, ok := KeyFromRune(c)
+		if !ok {
+			continue
+		}
+		r := k.r
+		r[0] |= mod
+		r.Press(key)
+		k.d.Send(r[:])
+		k.d.Send(k.r[:])
+	}
+}
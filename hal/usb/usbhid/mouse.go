@@ -0,0 +1,115 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package usbhid
+
+// MouseReportDesc is the report descriptor of the boot protocol compatible
+// mouse with three buttons and a wheel.
+const MouseReportDesc = "" +
+	"\x05\x01" + // Usage Page (Generic Desktop)
+	"\x09\x02" + // Usage (Mouse)
+	"\xa1\x01" + // Collection (Application)
+	"\x09\x01" + //   Usage (Pointer)
+	"\xa1\x00" + //   Collection (Physical)
+	"\x05\x09" + //     Usage Page (Buttons)
+	"\x19\x01" + //     Usage Minimum (1)
+	"\x29\x03" + //     Usage Maximum (3)
+	"\x15\x00" + //     Logical Minimum (0)
+	"\x25\x01" + //     Logical Maximum (1)
+	"\x95\x03" + //     Report Count (3)
+	"\x75\x01" + //     Report Size (1)
+	"\x81\x02" + //     Input (Data, Variable, Absolute): buttons
+	"\x95\x01" + //     Report Count (1)
+	"\x75\x05" + //     Report Size (5)
+	"\x81\x01" + //     Input (Constant): padding
+	"\x05\x01" + //     Usage Page (Generic Desktop)
+	"\x09\x30" + //     Usage (X)
+	"\x09\x31" + //     Usage (Y)
+	"\x09\x38" + //     Usage (Wheel)
+	"\x15\x81" + //     Logical Minimum (-127)
+	"\x25\x7f" + //     Logical Maximum (127)
+	"\x75\x08" + //     Report Size (8)
+	"\x95\x03" + //     Report Count (3)
+	"\x81\x06" + //     Input (Data, Variable, Relative): X, Y, wheel
+	"\xc0" + //     End Collection
+	"\xc0" //     End Collection
+
+// Mouse buttons.
+const (
+	ButtonLeft   = 1 << 0
+	ButtonRight  = 1 << 1
+	ButtonMiddle = 1 << 2
+)
+
+// A MouseReport is the mouse input report: buttons, X, Y and wheel. The boot
+// protocol uses only the first three bytes.
+type MouseReport [4]byte
+
+func clamp(v int) byte {
+	return byte(int8(max(-127, min(127, v))))
+}
+
+// Set sets the report fields. The relative movements are clamped to the
+// -127..127 range.
+func (r *MouseReport) Set(buttons uint8, dx, dy, wheel int) {
+	r[0] = buttons & 7
+	r[1] = clamp(dx)
+	r[2] = clamp(dy)
+	r[3] = clamp(wheel)
+}
+
+// A Mouse is a simple mouse that uses the Driver to send the reports described
+// by MouseReportDesc.
+type Mouse struct {
+	d       *Driver
+	buttons uint8
+}
+
+// NewMouse returns a new mouse that uses d to communicate with the host.
+func NewMouse(d *Driver) *Mouse {
+	return &Mouse{d: d}
+}
+
+func (m *Mouse) send(dx, dy, wheel int) {
+	for {
+		var r MouseReport
+		r.Set(m.buttons, dx, dy, wheel)
+		m.d.Send(r[:])
+		dx -= int(int8(r[1]))
+		dy -= int(int8(r[2]))
+		wheel -= int(int8(r[3]))
+		if dx == 0 && dy == 0 && wheel == 0 {
+			return
+		}
+	}
+}
+
+// Move moves the pointer by dx, dy. Large movements are split into several
+// reports.
+func (m *Mouse) Move(dx, dy int) {
+	m.send(dx, dy, 0)
+}
+
+// Scroll rotates the wheel by n detents.
+func (m *Mouse) Scroll(n int) {
+	m.send(0, 0, n)
+}
+
+// Press presses the buttons.
+func (m *Mouse) Press(buttons uint8) {
+	m.buttons |= buttons
+	m.send(0, 0, 0)
+}
+
+// Release releases the buttons.
+func (m *Mouse) Release(buttons uint8) {
+	m.buttons &^= buttons
+	m.send(0, 0, 0)
+}
+
+// Click presses and releases the buttons.
+func (m *Mouse) Click(buttons uint8) {
+	m.Press(buttons)
+	m.Release(buttons)
+}
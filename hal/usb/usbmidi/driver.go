@@ -0,0 +1,223 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usbmidi provides the class compliant USB MIDI 1.0 device driver with
+// up to 16 virtual cables. The USB-MIDI event packets are encoded and decoded
+// by the midi package.
+//
+// The MIDI function uses two interfaces: the Audio Control interface (interf)
+// and the MIDI Streaming interface (interf+1). Both are described by the
+// descriptors returned by Descriptors which must be included in the
+// configuration descriptors passed to usb.Device.Init. Example:
+//
+//	md := usbmidi.NewDriver(usbd, interf, out, in, 512, 2)
+//	usbd.Enable()
+//	md.Send(0, midi.NoteOn(0, 60, 100))
+//	for m := range md.RecvChan() {
+//		fmt.Printf("cable %d: % x\n", m.Cable, m.Data)
+//	}
+package usbmidi
+
+import (
+	"embedded/rtos"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/usb"
+	"github.com/embeddedgo/imxrt/hal/usb/usbmidi/midi"
+)
+
+const (
+	queueLen = 32
+	maxSysEx = 1024 // longer SysEx messages received from the host are dropped
+)
+
+// A Message is a complete MIDI message sent or received using the virtual
+// cable.
+type Message struct {
+	Cable int
+	Data  []byte
+}
+
+// A Driver is an USB MIDI class driver.
+type Driver struct {
+	d        *usb.Device
+	tda      *[2]usb.DTD // tda[0] is for Tx, tda[1] is for Rx
+	donea    [2]rtos.Note
+	tx       chan []midi.Packet
+	rx       chan Message
+	txbuf    []byte
+	rxbuf    []byte
+	cables   int
+	rxe, txe uint8
+}
+
+// NewDriver returns a new MIDI driver that uses the rxe (host OUT) and txe
+// (host IN) bulk endpoints to exchange the USB-MIDI event packets with the
+// host. MaxPkt must be the maximum packet size of both endpoints (512 for HS,
+// 64 for FS). The number of virtual cables must be in the range from 1 to 16
+// and must match the one passed to Descriptors.
+func NewDriver(d *usb.Device, interf uint8, rxe, txe int8, maxPkt, cables int) *Driver {
+	if cables < 1 || cables > midi.MaxCables {
+		panic("usbmidi: bad number of cables")
+	}
+	s := &Driver{
+		d:      d,
+		tda:    (*[2]usb.DTD)(usb.MakeSliceDTD(2, 2)),
+		tx:     make(chan []midi.Packet, queueLen),
+		rx:     make(chan Message, queueLen),
+		txbuf:  dma.MakeSlice[byte](maxPkt, maxPkt),
+		rxbuf:  dma.MakeSlice[byte](maxPkt, maxPkt),
+		cables: cables,
+		rxe:    usb.HE(rxe, usb.OUT),
+		txe:    usb.HE(txe, usb.IN),
+	}
+	s.tda[0].SetNote(&s.donea[0])
+	s.tda[1].SetNote(&s.donea[1])
+	go sender(s)
+	go receiver(s)
+	return s
+}
+
+// Descriptors returns the Audio Control interface descriptors followed by the
+// MIDI Streaming interface descriptors. Every virtual cable is described by
+// a pair of embedded MIDI jacks (connected to the endpoints) and a pair of
+// external MIDI jacks.
+func Descriptors(interf uint8, rxe, txe int8, maxPkt, cables int) string {
+	msLen := 7 + cables*(6+6+9+9) + 2*(9+4+cables)
+	b := []byte{
+		// Audio Control interface
+		9, 4, interf, 0, 0, 0x01, 0x01, 0, 0,
+		9, 0x24, 0x01, 0x00, 0x01, 9, 0, 1, interf + 1,
+		// MIDI Streaming interface
+		9, 4, interf + 1, 0, 2, 0x01, 0x03, 0, 0,
+		7, 0x24, 0x01, 0x00, 0x01, byte(msLen), byte(msLen >> 8),
+	}
+	for i := 0; i < cables; i++ {
+		embIn, extIn, embOut, extOut := jacks(i)
+		b = append(b,
+			6, 0x24, 0x02, 0x01, embIn, 0,
+			6, 0x24, 0x02, 0x02, extIn, 0,
+			9, 0x24, 0x03, 0x01, embOut, 1, extIn, 1, 0,
+			9, 0x24, 0x03, 0x02, extOut, 1, embIn, 1, 0,
+		)
+	}
+	b = append(b,
+		9, 5, byte(rxe), 2, byte(maxPkt), byte(maxPkt>>8), 0, 0, 0,
+		byte(4+cables), 0x25, 0x01, byte(cables),
+	)
+	for i := 0; i < cables; i++ {
+		embIn, _, _, _ := jacks(i)
+		b = append(b, embIn)
+	}
+	b = append(b,
+		9, 5, 0x80|byte(txe), 2, byte(maxPkt), byte(maxPkt>>8), 0, 0, 0,
+		byte(4+cables), 0x25, 0x01, byte(cables),
+	)
+	for i := 0; i < cables; i++ {
+		_, _, embOut, _ := jacks(i)
+		b = append(b, embOut)
+	}
+	return string(b)
+}
+
+func jacks(cable int) (embIn, extIn, embOut, extOut byte) {
+	id := byte(cable*4 + 1)
+	return id, id + 1, id + 2, id + 3
+}
+
+// Send encodes msg and queues it to be sent to the host using the virtual
+// cable. The msg may contain any number of complete MIDI messages (see
+// midi.AppendPackets). Send blocks if the queue is full. The messages sent
+// while the device is not in the configured state are dropped.
+func (s *Driver) Send(cable int, msg []byte) error {
+	if uint(cable) >= uint(s.cables) {
+		return midi.ErrInvalid
+	}
+	ps, err := midi.AppendPackets(nil, cable, msg)
+	if err != nil {
+		return err
+	}
+	if len(ps) != 0 {
+		s.tx <- ps
+	}
+	return nil
+}
+
+// Recv waits for the next MIDI message received from the host. The SysEx
+// messages are reassembled before delivery (messages longer than 1024 bytes
+// are dropped). The host is flow controlled (NAKed) if the received messages
+// aren't read.
+func (s *Driver) Recv() Message {
+	return <-s.rx
+}
+
+// RecvChan returns the channel of the received messages.
+func (s *Driver) RecvChan() <-chan Message {
+	return s.rx
+}
+
+func sender(s *Driver) {
+	td, done := &s.tda[0], &s.donea[0]
+	ptr := unsafe.Pointer(&s.txbuf[0])
+	var pending []midi.Packet
+	for {
+		if len(pending) == 0 {
+			pending = <-s.tx
+		}
+		// Pack as many queued packets as possible into the single transfer.
+		n := 0
+	fill:
+		for n < len(s.txbuf) {
+			if len(pending) == 0 {
+				select {
+				case pending = <-s.tx:
+				default:
+					break fill
+				}
+			}
+			n += copy(s.txbuf[n:], pending[0][:])
+			pending = pending[1:]
+		}
+		rtos.CacheMaint(rtos.DCacheFlush, ptr, len(s.txbuf))
+		td.SetupTransfer(ptr, n)
+		done.Clear()
+		if !s.d.Prime(s.txe, td, td) {
+			// Not configured. Drop the messages.
+			pending = nil
+			continue
+		}
+		done.Sleep(-1)
+	}
+}
+
+func receiver(s *Driver) {
+	td, done := &s.tda[1], &s.donea[1]
+	ptr := unsafe.Pointer(&s.rxbuf[0])
+	dec := midi.NewDecoder(maxSysEx)
+usbNotReady:
+	s.d.WaitConfig(0)
+	for {
+		rtos.CacheMaint(rtos.DCacheInval, ptr, len(s.rxbuf))
+		n := td.SetupTransfer(ptr, len(s.rxbuf))
+		done.Clear()
+		if !s.d.Prime(s.rxe, td, td) {
+			goto usbNotReady
+		}
+		done.Sleep(-1)
+		m, status := td.Status()
+		if status != 0 {
+			if status&usb.Active != 0 {
+				goto usbNotReady
+			}
+			continue
+		}
+		for buf := s.rxbuf[:n-m]; len(buf) >= 4; buf = buf[4:] {
+			cable, msg := dec.Decode(midi.Packet(buf[:4]))
+			if msg != nil && cable < s.cables {
+				s.rx <- Message{cable, append([]byte(nil), msg...)}
+			}
+		}
+	}
+}
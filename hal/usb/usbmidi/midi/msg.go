@@ -0,0 +1,45 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package midi
+
+// The following functions return the channel voice messages. The channel
+// number is 0-based (0 to 15). The data bytes are masked to 7 bits.
+
+// NoteOff returns the Note Off message.
+func NoteOff(ch int, key, velocity byte) []byte {
+	return []byte{0x80 | byte(ch&15), key & 0x7f, velocity & 0x7f}
+}
+
+// NoteOn returns the Note On message.
+func NoteOn(ch int, key, velocity byte) []byte {
+	return []byte{0x90 | byte(ch&15), key & 0x7f, velocity & 0x7f}
+}
+
+// PolyKeyPressure returns the Polyphonic Key Pressure message.
+func PolyKeyPressure(ch int, key, pressure byte) []byte {
+	return []byte{0xa0 | byte(ch&15), key & 0x7f, pressure & 0x7f}
+}
+
+// ControlChange returns the Control Change message.
+func ControlChange(ch int, control, value byte) []byte {
+	return []byte{0xb0 | byte(ch&15), control & 0x7f, value & 0x7f}
+}
+
+// ProgramChange returns the Program Change message.
+func ProgramChange(ch int, program byte) []byte {
+	return []byte{0xc0 | byte(ch&15), program & 0x7f}
+}
+
+// ChannelPressure returns the Channel Pressure message.
+func ChannelPressure(ch int, pressure byte) []byte {
+	return []byte{0xd0 | byte(ch&15), pressure & 0x7f}
+}
+
+// PitchBend returns the Pitch Bend message. The value is in the range from
+// -8192 to 8191 (0 means the center position).
+func PitchBend(ch int, value int) []byte {
+	v := max(-8192, min(8191, value)) + 8192
+	return []byte{0xe0 | byte(ch&15), byte(v & 0x7f), byte(v >> 7)}
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package midi implements the USB-MIDI 1.0 event packet encoding and decoding
+// (see Universal Serial Bus Device Class Definition for MIDI Devices, 4.).
+// It has no hardware dependencies.
+package midi
+
+import "errors"
+
+// Code Index Numbers (the lower nibble of the first byte of the packet).
+const (
+	CINMisc            = 0x0 // reserved
+	CINCableEvent      = 0x1 // reserved
+	CINSysCommon2      = 0x2 // two-byte System Common message
+	CINSysCommon3      = 0x3 // three-byte System Common message
+	CINSysExStart      = 0x4 // SysEx starts or continues
+	CINSysExEnd1       = 0x5 // single-byte System Common or SysEx ends
+	CINSysExEnd2       = 0x6 // SysEx ends with the following two bytes
+	CINSysExEnd3       = 0x7 // SysEx ends with the following three bytes
+	CINNoteOff         = 0x8
+	CINNoteOn          = 0x9
+	CINPolyKeyPress    = 0xa
+	CINControlChange   = 0xb
+	CINProgramChange   = 0xc
+	CINChannelPressure = 0xd
+	CINPitchBend       = 0xe
+	CINSingleByte      = 0xf
+)
+
+// MaxCables is the maximum number of virtual cables.
+const MaxCables = 16
+
+var (
+	ErrInvalid    = errors.New("midi: invalid message")
+	ErrIncomplete = errors.New("midi: incomplete message")
+)
+
+// A Packet is the 32-bit USB-MIDI event packet.
+type Packet [4]byte
+
+// cinLen contains the number of the MIDI bytes in the packet by CIN.
+var cinLen = [16]int8{0, 0, 2, 3, 3, 1, 2, 3, 3, 3, 3, 3, 2, 2, 3, 1}
+
+// MakePacket returns the packet with the given cable number, code index number
+// and up to three MIDI bytes.
+func MakePacket(cable, cin int, data ...byte) (p Packet) {
+	p[0] = byte(cable&15)<<4 | byte(cin&15)
+	copy(p[1:], data)
+	return
+}
+
+// Cable returns the virtual cable number.
+func (p *Packet) Cable() int { return int(p[0] >> 4) }
+
+// CIN returns the Code Index Number.
+func (p *Packet) CIN() int { return int(p[0] & 15) }
+
+// Data returns the MIDI bytes carried by the packet.
+func (p *Packet) Data() []byte { return p[1 : 1+cinLen[p[0]&15]] }
+
+// MsgLen returns the length of the MIDI message that starts with the status
+// byte. It returns 0 for the SysEx start byte (variable length) and -1 for the
+// data bytes and the SysEx end byte.
+func MsgLen(status byte) int {
+	switch {
+	case status < 0x80 || status == 0xf7:
+		return -1
+	case status < 0xf0:
+		return int(cinLen[status>>4])
+	case status == 0xf0:
+		return 0
+	case status == 0xf1 || status == 0xf3:
+		return 2
+	case status == 0xf2:
+		return 3
+	}
+	return 1 // 0xf4, 0xf5 (undefined), 0xf6, real-time messages
+}
+
+// AppendPackets encodes msg into the USB-MIDI event packets and appends them
+// to dst. The msg may contain any number of complete MIDI messages, including
+// SysEx messages of any length. The running status is supported within msg.
+// The real-time messages cannot be interleaved with the SysEx data.
+func AppendPackets(dst []Packet, cable int, msg []byte) ([]Packet, error) {
+	var rs byte // running status
+	for len(msg) != 0 {
+		s := msg[0]
+		switch {
+		case s == 0xf0:
+			end := 1
+			for end < len(msg) && msg[end] < 0x80 {
+				end++
+			}
+			if end == len(msg) {
+				return dst, ErrIncomplete
+			}
+			if msg[end] != 0xf7 {
+				return dst, ErrInvalid
+			}
+			sysex := msg[:end+1]
+			for len(sysex) > 3 {
+				dst = append(dst, MakePacket(cable, CINSysExStart, sysex[:3]...))
+				sysex = sysex[3:]
+			}
+			dst = append(dst, MakePacket(cable, CINSysExEnd1-1+len(sysex), sysex...))
+			msg = msg[end+1:]
+			rs = 0
+		case s >= 0xf8:
+			// Real-time messages don't affect the running status.
+			dst = append(dst, MakePacket(cable, CINSingleByte, s))
+			msg = msg[1:]
+		case s >= 0xf1:
+			n := MsgLen(s)
+			if n > len(msg) {
+				return dst, ErrIncomplete
+			}
+			if s == 0xf7 || !dataBytes(msg[1:n]) {
+				return dst, ErrInvalid
+			}
+			cin := CINSysCommon2 - 2 + n
+			if n == 1 {
+				cin = CINSysExEnd1
+			}
+			dst = append(dst, MakePacket(cable, cin, msg[:n]...))
+			msg = msg[n:]
+			rs = 0
+		default:
+			if s >= 0x80 {
+				rs = s
+				msg = msg[1:]
+			} else if rs == 0 {
+				return dst, ErrInvalid
+			}
+			n := MsgLen(rs) - 1
+			if n > len(msg) {
+				return dst, ErrIncomplete
+			}
+			if !dataBytes(msg[:n]) {
+				return dst, ErrInvalid
+			}
+			p := MakePacket(cable, int(rs>>4), rs)
+			copy(p[2:], msg[:n])
+			dst = append(dst, p)
+			msg = msg[n:]
+		}
+	}
+	return dst, nil
+}
+
+func dataBytes(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+type sysexState struct {
+	buf      []byte
+	active   bool
+	overflow bool
+}
+
+// A Decoder decodes the USB-MIDI event packets into MIDI messages. It
+// reassembles the SysEx messages separately for every virtual cable.
+type Decoder struct {
+	sysex    [MaxCables]sysexState
+	maxSysEx int
+	msg      [3]byte
+}
+
+// NewDecoder returns a new decoder that drops the SysEx messages longer than
+// maxSysEx bytes.
+func NewDecoder(maxSysEx int) *Decoder {
+	return &Decoder{maxSysEx: maxSysEx}
+}
+
+func (s *sysexState) add(b []byte, max int) {
+	if s.overflow {
+		return
+	}
+	if len(s.buf)+len(b) > max {
+		s.overflow = true
+		return
+	}
+	s.buf = append(s.buf, b...)
+}
+
+// Decode decodes the packet p. It returns the cable number and the complete
+// MIDI message. The returned msg is nil if p carries an unfinished part of the
+// SysEx message or is invalid. The msg is valid until the next Decode call.
+func (d *Decoder) Decode(p Packet) (cable int, msg []byte) {
+	cable = p.Cable()
+	cin := p.CIN()
+	data := p.Data()
+	sx := &d.sysex[cable]
+	switch cin {
+	case CINMisc, CINCableEvent:
+		return cable, nil
+	case CINSysExStart:
+		if data[0] == 0xf0 {
+			sx.buf = sx.buf[:0]
+			sx.active = true
+			sx.overflow = false
+		} else if !sx.active {
+			return cable, nil
+		}
+		sx.add(data, d.maxSysEx)
+		return cable, nil
+	case CINSysExEnd1, CINSysExEnd2, CINSysExEnd3:
+		if data[0] == 0xf0 {
+			sx.buf = sx.buf[:0]
+			sx.active = true
+			sx.overflow = false
+		} else if !sx.active {
+			if cin == CINSysExEnd1 && data[0] >= 0xf1 && data[0] != 0xf7 {
+				break // single-byte System Common message
+			}
+			return cable, nil
+		}
+		sx.add(data, d.maxSysEx)
+		sx.active = false
+		if sx.overflow || sx.buf[len(sx.buf)-1] != 0xf7 {
+			return cable, nil
+		}
+		return cable, sx.buf
+	case CINSingleByte:
+		// Unparsed single bytes: also used to transfer SysEx byte by byte.
+		c := data[0]
+		switch {
+		case c >= 0xf8:
+			break
+		case c == 0xf0:
+			sx.buf = sx.buf[:0]
+			sx.active = true
+			sx.overflow = false
+			sx.add(data, d.maxSysEx)
+			return cable, nil
+		case c < 0x80 || c == 0xf7:
+			if !sx.active {
+				return cable, nil
+			}
+			sx.add(data, d.maxSysEx)
+			if c < 0x80 {
+				return cable, nil
+			}
+			sx.active = false
+			if sx.overflow {
+				return cable, nil
+			}
+			return cable, sx.buf
+		default:
+			if MsgLen(c) != 1 {
+				return cable, nil
+			}
+		}
+	default:
+		if MsgLen(data[0]) != len(data) || !dataBytes(data[1:]) {
+			return cable, nil
+		}
+	}
+	n := copy(d.msg[:], data)
+	return cable, d.msg[:n]
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package midi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func sysex(n int) []byte {
+	b := make([]byte, n)
+	b[0] = 0xf0
+	for i := 1; i < n-1; i++ {
+		b[i] = byte(i)
+	}
+	b[n-1] = 0xf7
+	return b
+}
+
+func TestAppendPacketsSysEx(t *testing.T) {
+	for n := 2; n <= 10; n++ {
+		msg := sysex(n)
+		ps, err := AppendPackets(nil, 3, msg)
+		if err != nil {
+			t.Fatalf("len %d: %v", n, err)
+		}
+		if want := (n + 2) / 3; len(ps) != want {
+			t.Fatalf("len %d: %d packets, want %d", n, len(ps), want)
+		}
+		var data []byte
+		for i, p := range ps {
+			cin := CINSysExStart
+			if i == len(ps)-1 {
+				// n%3 == 1: F7 alone, 2: two bytes, 0: three bytes.
+				cin = CINSysExEnd1 + (n+2)%3
+			}
+			if p.Cable() != 3 || p.CIN() != cin {
+				t.Errorf("len %d: packet %d: cable=%d CIN=%d, want 3 %d",
+					n, i, p.Cable(), p.CIN(), cin)
+			}
+			data = append(data, p.Data()...)
+			if pad := p[1+len(p.Data()):]; !bytes.Equal(pad, make([]byte, len(pad))) {
+				t.Errorf("len %d: packet %d: not zero padded: % x", n, i, p)
+			}
+		}
+		if !bytes.Equal(data, msg) {
+			t.Errorf("len %d: data % x, want % x", n, data, msg)
+		}
+	}
+}
+
+func TestAppendPacketsRunningStatus(t *testing.T) {
+	msg := []byte{
+		0x90, 60, 100, 62, 101, // Note On with running status
+		0xf8,    // real-time doesn't cancel the running status
+		64, 102, // Note On (running status)
+		0xc1, 5, 6, // Program Change with running status
+		0xf6,       // Tune Request cancels the running status
+		0xf2, 1, 2, // Song Position Pointer
+	}
+	ps, err := AppendPackets(nil, 0, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Packet{
+		{0x09, 0x90, 60, 100},
+		{0x09, 0x90, 62, 101},
+		{0x0f, 0xf8, 0, 0},
+		{0x09, 0x90, 64, 102},
+		{0x0c, 0xc1, 5, 0},
+		{0x0c, 0xc1, 6, 0},
+		{0x05, 0xf6, 0, 0},
+		{0x03, 0xf2, 1, 2},
+	}
+	if len(ps) != len(want) {
+		t.Fatalf("%d packets, want %d: % x", len(ps), len(want), ps)
+	}
+	for i := range want {
+		if ps[i] != want[i] {
+			t.Errorf("packet %d: % x, want % x", i, ps[i], want[i])
+		}
+	}
+	// Data bytes after the System Common message have no running status.
+	if _, err := AppendPackets(nil, 0, []byte{0x90, 1, 2, 0xf6, 3, 4}); err != ErrInvalid {
+		t.Errorf("data after 0xf6: %v, want ErrInvalid", err)
+	}
+}
+
+func TestAppendPacketsRealTime(t *testing.T) {
+	for _, b := range []byte{0xf8, 0xfa, 0xfb, 0xfc, 0xfe, 0xff} {
+		ps, err := AppendPackets(nil, 15, []byte{b})
+		if err != nil {
+			t.Fatalf("%#x: %v", b, err)
+		}
+		if len(ps) != 1 || ps[0] != (Packet{0xff, b, 0, 0}) {
+			t.Errorf("%#x: % x", b, ps)
+		}
+	}
+}
+
+func TestAppendPacketsErrors(t *testing.T) {
+	tests := []struct {
+		msg []byte
+		err error
+	}{
+		{[]byte{1, 2}, ErrInvalid},                // no status
+		{[]byte{0x90, 60}, ErrIncomplete},         // missing data byte
+		{[]byte{0x90, 60, 0x80}, ErrInvalid},      // status instead of data
+		{[]byte{0xf0, 1, 2}, ErrIncomplete},       // unterminated SysEx
+		{[]byte{0xf0, 1, 0xf8, 0xf7}, ErrInvalid}, // real-time inside SysEx
+		{[]byte{0xf7}, ErrInvalid},                // SysEx end alone
+		{[]byte{0xf2, 1}, ErrIncomplete},
+	}
+	for _, tc := range tests {
+		if _, err := AppendPackets(nil, 0, tc.msg); err != tc.err {
+			t.Errorf("% x: %v, want %v", tc.msg, err, tc.err)
+		}
+	}
+}
+
+func TestDecoderRoundTrip(t *testing.T) {
+	msgs := [][]byte{
+		NoteOn(1, 60, 100),
+		NoteOff(2, 60, 0),
+		ControlChange(3, 7, 127),
+		ProgramChange(4, 5),
+		PitchBend(5, 0x1234),
+		{0xf8},
+		{0xf6},
+		{0xf1, 0x12},
+		{0xf2, 1, 2},
+		sysex(2), sysex(3), sysex(4), sysex(5), sysex(100),
+	}
+	d := NewDecoder(1024)
+	for _, msg := range msgs {
+		ps, err := AppendPackets(nil, 7, msg)
+		if err != nil {
+			t.Fatalf("% x: %v", msg, err)
+		}
+		var got []byte
+		for i, p := range ps {
+			cable, m := d.Decode(p)
+			if cable != 7 {
+				t.Errorf("% x: cable %d", msg, cable)
+			}
+			if i != len(ps)-1 && m != nil {
+				t.Errorf("% x: message returned before the last packet", msg)
+			}
+			got = m
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("decoded % x, want % x", got, msg)
+		}
+	}
+}
+
+func TestDecoderSysExCables(t *testing.T) {
+	m0, m1 := sysex(10), sysex(8)
+	for i := range m1[1 : len(m1)-1] {
+		m1[i+1] = 0x70 + byte(i)
+	}
+	p0, _ := AppendPackets(nil, 0, m0)
+	p1, _ := AppendPackets(nil, 1, m1)
+	p2, _ := AppendPackets(nil, 2, NoteOn(0, 1, 2))
+
+	// Interleave the packets of both SysEx messages and a channel message.
+	var ps []Packet
+	for i := 0; i < max(len(p0), len(p1)); i++ {
+		if i < len(p1) {
+			ps = append(ps, p1[i])
+		}
+		if i == 1 {
+			ps = append(ps, p2...)
+		}
+		if i < len(p0) {
+			ps = append(ps, p0[i])
+		}
+	}
+	d := NewDecoder(64)
+	got := make(map[int][]byte)
+	for _, p := range ps {
+		if cable, msg := d.Decode(p); msg != nil {
+			if got[cable] != nil {
+				t.Errorf("cable %d: second message % x", cable, msg)
+			}
+			got[cable] = append([]byte(nil), msg...)
+		}
+	}
+	if !bytes.Equal(got[0], m0) {
+		t.Errorf("cable 0: % x, want % x", got[0], m0)
+	}
+	if !bytes.Equal(got[1], m1) {
+		t.Errorf("cable 1: % x, want % x", got[1], m1)
+	}
+	if !bytes.Equal(got[2], NoteOn(0, 1, 2)) {
+		t.Errorf("cable 2: % x", got[2])
+	}
+}
+
+func TestDecoderSysExOverflow(t *testing.T) {
+	d := NewDecoder(8)
+	ps, _ := AppendPackets(nil, 0, sysex(9))
+	for _, p := range ps {
+		if _, msg := d.Decode(p); msg != nil {
+			t.Errorf("too long SysEx not dropped: % x", msg)
+		}
+	}
+	// The decoder recovers after the dropped message.
+	ps, _ = AppendPackets(nil, 0, sysex(8))
+	var msg []byte
+	for _, p := range ps {
+		_, msg = d.Decode(p)
+	}
+	if !bytes.Equal(msg, sysex(8)) {
+		t.Errorf("got % x, want % x", msg, sysex(8))
+	}
+}
+
+func TestDecoderSingleByteSysEx(t *testing.T) {
+	// SysEx transferred byte by byte (CIN 0xf) with the real-time message
+	// inside.
+	d := NewDecoder(16)
+	msg := sysex(5)
+	var got []byte
+	for i, b := range msg {
+		if i == 2 {
+			if _, m := d.Decode(MakePacket(4, CINSingleByte, 0xf8)); !bytes.Equal(m, []byte{0xf8}) {
+				t.Errorf("real-time inside SysEx: % x", m)
+			}
+		}
+		_, got = d.Decode(MakePacket(4, CINSingleByte, b))
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got % x, want % x", got, msg)
+	}
+}
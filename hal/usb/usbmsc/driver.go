@@ -0,0 +1,261 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usbmsc provides the USB Mass Storage Class driver that uses the
+// Bulk-Only Transport. The SCSI commands are handled by the scsi package so
+// any block device (SD card, flash memory, RAM disk) can be exposed to the
+// host as an USB drive.
+//
+// Example:
+//
+//	disk := scsi.NewRAMDisk(dma.MakeSlice[byte](256*512, 256*512), 512)
+//	lun := scsi.NewTarget(disk)
+//	msc := usbmsc.NewDriver(usbd, interf, out, in, lun)
+//	usbd.Enable()
+//	go msc.Serve()
+//
+// The interface and endpoint descriptors returned by Descriptors must be
+// included in the configuration descriptors passed to usb.Device.Init.
+package usbmsc
+
+import (
+	"embedded/rtos"
+	"time"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/usb"
+	"github.com/embeddedgo/imxrt/hal/usb/usbmsc/scsi"
+)
+
+// Bulk-Only Transport definitions.
+const (
+	cbwLen = 31
+	cswLen = 13
+	cbwSig = 0x43425355 // USBC
+	cswSig = 0x53425355 // USBS
+
+	cswPassed     = 0
+	cswFailed     = 1
+	cswPhaseError = 2
+
+	// Class-specific requests: bRequest<<8 | bmRequestType.
+	reqReset     = 0xff21
+	reqGetMaxLUN = 0xfea1
+
+	bufSize = 16 * 1024 // fits in a single DTD
+)
+
+// A Driver is a Bulk-Only Transport Mass Storage driver.
+type Driver struct {
+	d        *usb.Device
+	luns     []*scsi.Target
+	td       *usb.DTD
+	buf      []byte
+	done     rtos.Note
+	rst      rtos.Note
+	interf   uint8
+	rxe, txe uint8
+}
+
+var interfaces = make(map[uint8]*Driver)
+
+// NewDriver returns a new MSC driver that uses rxe (host OUT) and txe (host
+// IN) bulk endpoints to communicate with the host. The logical units are
+// numbered in the order of the luns arguments (at most 16).
+func NewDriver(d *usb.Device, interf uint8, rxe, txe int8, luns ...*scsi.Target) *Driver {
+	if len(luns) == 0 || len(luns) > 16 {
+		panic("usbmsc: bad number of LUNs")
+	}
+	s := &Driver{
+		d:      d,
+		luns:   luns,
+		td:     usb.NewDTD(),
+		buf:    dma.MakeSlice[byte](bufSize, bufSize),
+		interf: interf,
+		rxe:    usb.HE(rxe, usb.OUT),
+		txe:    usb.HE(txe, usb.IN),
+	}
+	s.td.SetNote(&s.done)
+	interfaces[interf] = s
+	d.Handle(0, reqReset, reset)
+	d.Handle(0, reqGetMaxLUN, getMaxLUN)
+	return s
+}
+
+// Descriptors returns the interface descriptor followed by the two bulk
+// endpoint descriptors of the MSC interface. MaxPkt must be 512 for HS and 64
+// for FS configuration.
+func Descriptors(interf uint8, rxe, txe int8, maxPkt int) string {
+	return string([]byte{
+		9, 4, interf, 0, 2, 0x08, 0x06, 0x50, 0, // MSC, SCSI transparent, BOT
+		7, 5, byte(rxe), 2, byte(maxPkt), byte(maxPkt >> 8), 0,
+		7, 5, 0x80 | byte(txe), 2, byte(maxPkt), byte(maxPkt >> 8), 0,
+	})
+}
+
+func reset(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	s.rst.Wakeup()
+	return 0
+}
+
+func getMaxLUN(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 1 {
+		return -1
+	}
+	cr.Data[0] = byte(len(s.luns) - 1)
+	return 1
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
+// xfer transfers p using the he endpoint. It reports false if the device is
+// not in the configured state or the transfer failed.
+func (s *Driver) xfer(he uint8, p []byte) (n int, ok bool) {
+	ptr := unsafe.Pointer(&p[0])
+	cn := (len(p) + dma.MemAlign - 1) &^ (dma.MemAlign - 1)
+	if he&1 == usb.IN {
+		rtos.CacheMaint(rtos.DCacheFlush, ptr, cn)
+	} else {
+		rtos.CacheMaint(rtos.DCacheInval, ptr, cn)
+	}
+	n = s.td.SetupTransfer(ptr, len(p))
+	s.done.Clear()
+	if !s.d.Prime(he, s.td, s.td) {
+		return 0, false
+	}
+	s.done.Sleep(-1)
+	rem, status := s.td.Status()
+	if status != 0 {
+		return 0, false
+	}
+	return n - rem, true
+}
+
+// Serve handles the MSC Bulk-Only Transport. It never returns so it should be
+// run in a separate goroutine.
+func (s *Driver) Serve() {
+	var cdb [16]byte
+usbNotReady:
+	s.d.WaitConfig(0)
+	for {
+		n, ok := s.xfer(s.rxe, s.buf[:512])
+		if !ok {
+			goto usbNotReady
+		}
+		cbw := s.buf[:n]
+		if n != cbwLen || le32(cbw[0:4]) != cbwSig || int(cbw[13]) >= len(s.luns) ||
+			cbw[14]-1 >= 16 {
+			// Invalid CBW. Stall both endpoints and wait for the reset
+			// recovery performed by the host.
+			s.rst.Clear()
+			s.d.Stall(s.txe, true)
+			s.d.Stall(s.rxe, true)
+			s.rst.Sleep(time.Second)
+			continue
+		}
+		tag := le32(cbw[4:8])
+		hn := int(le32(cbw[8:12]))
+		hin := cbw[12]&0x80 != 0
+		t := s.luns[cbw[13]]
+		cb := cdb[:cbw[14]]
+		copy(cb, cbw[15:])
+
+		dir, dn := t.Begin(cb)
+		status, residue, ok := s.dataPhase(t, dir, dn, hn, hin)
+		if !ok {
+			t.End()
+			goto usbNotReady
+		}
+		if t.End() != scsi.Good && status == cswPassed {
+			status = cswFailed
+		}
+
+		csw := s.buf[:cswLen]
+		putLE32(csw[0:4], cswSig)
+		putLE32(csw[4:8], tag)
+		putLE32(csw[8:12], uint32(residue))
+		csw[12] = status
+		if _, ok = s.xfer(s.txe, csw); !ok {
+			goto usbNotReady
+		}
+	}
+}
+
+// dataPhase performs the data phase according to the host (hn, hin) and the
+// target (dir, dn) expectations. See the thirteen cases in the USB Mass
+// Storage Class Bulk-Only Transport specification, 6.7.
+func (s *Driver) dataPhase(t *scsi.Target, dir scsi.Dir, dn, hn int, hin bool) (status byte, residue int, ok bool) {
+	if hn == 0 {
+		if dn != 0 {
+			return cswPhaseError, 0, true // cases 2, 3
+		}
+		return cswPassed, 0, true // case 1
+	}
+	if hin && dir == scsi.Out || !hin && dir == scsi.In {
+		// Cases 8, 10
+		if hin {
+			s.d.Stall(s.txe, true)
+		} else {
+			s.d.Stall(s.rxe, true)
+		}
+		return cswPhaseError, hn, true
+	}
+	n := min(dn, hn)
+	var done int
+	if hin {
+		for done < n {
+			k, _ := t.Read(s.buf[:min(len(s.buf), n-done)])
+			if k == 0 {
+				break
+			}
+			if _, ok = s.xfer(s.txe, s.buf[:k]); !ok {
+				return
+			}
+			done += k
+		}
+		if done < hn {
+			s.d.Stall(s.txe, true) // cases 4, 5
+		}
+	} else {
+		for done < n {
+			k := min(len(s.buf), n-done)
+			m, ok := s.xfer(s.rxe, s.buf[:k])
+			if !ok {
+				return 0, 0, false
+			}
+			if m != 0 {
+				if _, err := t.Write(s.buf[:m]); err != nil {
+					done += m
+					break
+				}
+			}
+			done += m
+			if m < k {
+				break // short packet
+			}
+		}
+		if done < hn {
+			s.d.Stall(s.rxe, true) // cases 9, 11
+		}
+	}
+	if dn > hn {
+		status = cswPhaseError // cases 7, 13
+	}
+	return status, hn - done, true
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scsi
+
+import "errors"
+
+// ErrRange is returned by RAMDisk if the accessed blocks are out of the disk.
+var ErrRange = errors.New("scsi: block out of range")
+
+// A RAMDisk is a storage.BlockDevice that stores data in memory.
+type RAMDisk struct {
+	data []byte
+	bs   int
+}
+
+// NewRAMDisk returns a RAM disk that uses data as the storage. The length of
+// data is rounded down to the multiple of the block size bs.
+func NewRAMDisk(data []byte, bs int) *RAMDisk {
+	return &RAMDisk{data: data[:len(data)/bs*bs], bs: bs}
+}
+
+// Bytes returns the content of the disk.
+func (d *RAMDisk) Bytes() []byte { return d.data }
+
+// BlockSize implements the storage.BlockDevice interface.
+func (d *RAMDisk) BlockSize() int { return d.bs }
+
+// NumBlocks implements the storage.BlockDevice interface.
+func (d *RAMDisk) NumBlocks() int64 { return int64(len(d.data) / d.bs) }
+
+// blocks returns the part of the disk that corresponds to p and blk.
+func (d *RAMDisk) blocks(p []byte, blk int64) ([]byte, error) {
+	n := int64(len(p) / d.bs)
+	if len(p)%d.bs != 0 || blk < 0 || blk+n > d.NumBlocks() {
+		return nil, ErrRange
+	}
+	off := blk * int64(d.bs)
+	return d.data[off : off+int64(len(p))], nil
+}
+
+// ReadBlocks implements the storage.BlockDevice interface.
+func (d *RAMDisk) ReadBlocks(p []byte, blk int64) error {
+	b, err := d.blocks(p, blk)
+	copy(p, b)
+	return err
+}
+
+// WriteBlocks implements the storage.BlockDevice interface.
+func (d *RAMDisk) WriteBlocks(p []byte, blk int64) error {
+	b, err := d.blocks(p, blk)
+	copy(b, p)
+	return err
+}
+
+// Sync implements the storage.BlockDevice interface. It does nothing.
+func (d *RAMDisk) Sync() error { return nil }
@@ -0,0 +1,479 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package scsi implements the subset of the SCSI Block Commands required by
+// the USB Mass Storage Class devices. It doesn't depend on any hardware so it
+// can be also used (and tested) on a host computer, e.g. with a RAM disk.
+//
+// The command is executed in three steps that correspond to the three phases
+// of the USB Bulk-Only Transport: Begin decodes the command block and returns
+// the direction and the length of the data phase, Read/Write perform the data
+// phase and End returns the status.
+package scsi
+
+import (
+	"errors"
+	"io"
+
+	"github.com/embeddedgo/imxrt/storage"
+)
+
+// Operation codes.
+const (
+	TestUnitReady       = 0x00
+	RequestSense        = 0x03
+	Inquiry             = 0x12
+	ModeSelect6         = 0x15
+	ModeSense6          = 0x1a
+	StartStopUnit       = 0x1b
+	PreventAllowRemoval = 0x1e
+	ReadFormatCapacity  = 0x23
+	ReadCapacity10      = 0x25
+	Read10              = 0x28
+	Write10             = 0x2a
+	Verify10            = 0x2f
+	SyncCache10         = 0x35
+	ModeSense10         = 0x5a
+)
+
+// Status codes.
+const (
+	Good           = 0x00
+	CheckCondition = 0x02
+)
+
+// Sense keys.
+const (
+	NoSense        = 0x0
+	NotReady       = 0x2
+	MediumError    = 0x3
+	IllegalRequest = 0x5
+	UnitAttention  = 0x6
+	DataProtect    = 0x7
+	Miscompare     = 0xe
+)
+
+// Additional sense codes (ASC<<8 | ASCQ).
+const (
+	ascNone              = 0x0000
+	ascWriteError        = 0x0c00
+	ascReadError         = 0x1100
+	ascInvalidCommand    = 0x2000
+	ascLBAOutOfRange     = 0x2100
+	ascInvalidField      = 0x2400
+	ascWriteProtected    = 0x2700
+	ascMediumChanged     = 0x2800
+	ascMediumNotPresent  = 0x3a00
+	ascMiscompare        = 0x1d00
+	ascParamListLenError = 0x1a00
+)
+
+// Dir describes the direction of the data phase from the host perspective.
+type Dir int8
+
+const (
+	None Dir = 0  // no data phase
+	In   Dir = 1  // data from device to host
+	Out  Dir = -1 // data from host to device
+)
+
+// A Target represents a logical unit backed by a block device. The device Sync
+// method is called by the SYNCHRONIZE CACHE command and when the medium is
+// stopped or ejected.
+type Target struct {
+	dev storage.BlockDevice
+	bs  int
+
+	// Inquiry data. Set them before the first command.
+	Vendor   string // T10 vendor identification, at most 8 characters
+	Product  string // at most 16 characters
+	Revision string // at most 4 characters
+
+	readOnly  bool
+	removable bool
+	ejected   bool
+	changed   bool
+
+	// current command
+	op     byte
+	dir    Dir
+	lba    int64
+	n      int // remaining data phase length
+	resp   []byte
+	key    byte
+	asc    uint16
+	info   uint32
+	buf    [36]byte
+	sense  [18]byte
+	status byte
+}
+
+// NewTarget returns a new logical unit that uses dev as the medium.
+func NewTarget(dev storage.BlockDevice) *Target {
+	return &Target{
+		dev:      dev,
+		bs:       dev.BlockSize(),
+		Vendor:   "EmbedGo",
+		Product:  "Mass Storage",
+		Revision: "1.0",
+	}
+}
+
+// Device returns the underlying block device.
+func (t *Target) Device() storage.BlockDevice { return t.dev }
+
+// SetReadOnly makes the medium write protected.
+func (t *Target) SetReadOnly(ro bool) { t.readOnly = ro }
+
+// SetRemovable sets the RMB bit in the inquiry data. Removable media can be
+// ejected by the host and replaced by calling SetDevice.
+func (t *Target) SetRemovable(rmb bool) { t.removable = rmb }
+
+// Ejected reports whether the host has ejected the medium (START STOP UNIT
+// with the LOEJ bit set) or dev == nil has been set by SetDevice.
+func (t *Target) Ejected() bool { return t.ejected }
+
+// SetDevice replaces the medium. Use nil to report that there is no medium.
+// The new medium is reported to the host with the UNIT ATTENTION condition.
+// SetDevice must not be called concurrently with the command execution.
+func (t *Target) SetDevice(dev storage.BlockDevice) {
+	t.dev = dev
+	t.ejected = dev == nil
+	if dev != nil {
+		t.bs = dev.BlockSize()
+		t.changed = true
+	}
+}
+
+func (t *Target) fail(key byte, asc uint16) {
+	t.status = CheckCondition
+	t.key = key
+	t.asc = asc
+	t.dir = None
+	t.n = 0
+}
+
+func be16(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func putBE32(b []byte, v uint32) {
+	b[0] = byte(v >> 24)
+	b[1] = byte(v >> 16)
+	b[2] = byte(v >> 8)
+	b[3] = byte(v)
+}
+
+func putString(b []byte, s string) {
+	for i := range b {
+		if i < len(s) {
+			b[i] = s[i]
+		} else {
+			b[i] = ' '
+		}
+	}
+}
+
+// reply sets r as the response of the In command truncated to the allocation
+// length alen.
+func (t *Target) reply(r []byte, alen int) {
+	if len(r) > alen {
+		r = r[:alen]
+	}
+	t.resp = r
+	t.dir = In
+	t.n = len(r)
+}
+
+// Begin starts the execution of the command described by the command
+// descriptor block cdb. It returns the direction and the length of the data
+// phase expected by the target. The length is zero if the command failed
+// (see End).
+func (t *Target) Begin(cdb []byte) (dir Dir, n int) {
+	t.status = Good
+	t.dir = None
+	t.n = 0
+	t.resp = nil
+	if len(cdb) == 0 {
+		t.fail(IllegalRequest, ascInvalidCommand)
+		return None, 0
+	}
+	t.op = cdb[0]
+	if t.op != RequestSense {
+		t.key, t.asc, t.info = NoSense, ascNone, 0
+	}
+	switch t.op {
+	case Inquiry, RequestSense:
+		// Allowed without medium and in the UNIT ATTENTION state.
+	default:
+		if t.ejected || t.dev == nil {
+			t.fail(NotReady, ascMediumNotPresent)
+			return None, 0
+		}
+		if t.changed {
+			t.changed = false
+			t.fail(UnitAttention, ascMediumChanged)
+			return None, 0
+		}
+	}
+	switch t.op {
+	case TestUnitReady, PreventAllowRemoval:
+		// Nothing to do.
+
+	case RequestSense:
+		if len(cdb) < 6 {
+			break
+		}
+		s := t.sense[:]
+		clear(s)
+		s[0] = 0x70 // current errors, fixed format
+		s[2] = t.key
+		putBE32(s[3:7], t.info)
+		s[7] = 10 // additional sense length
+		s[12] = byte(t.asc >> 8)
+		s[13] = byte(t.asc)
+		t.key, t.asc, t.info = NoSense, ascNone, 0
+		t.reply(s, int(cdb[4]))
+
+	case Inquiry:
+		if len(cdb) < 6 {
+			break
+		}
+		if cdb[1]&1 != 0 {
+			// Vital product data pages are not supported.
+			t.fail(IllegalRequest, ascInvalidField)
+			break
+		}
+		r := t.buf[:36]
+		clear(r)
+		r[0] = 0x00 // direct access block device
+		if t.removable {
+			r[1] = 0x80
+		}
+		r[2] = 0x04 // SPC-2
+		r[3] = 0x02 // response data format
+		r[4] = 36 - 5
+		putString(r[8:16], t.Vendor)
+		putString(r[16:32], t.Product)
+		putString(r[32:36], t.Revision)
+		t.reply(r, be16(cdb[3:5]))
+
+	case ModeSense6, ModeSense10:
+		// Only the header (no block descriptors, no pages) with the WP bit.
+		r := t.buf[:8]
+		clear(r)
+		wp := byte(0)
+		if t.readOnly {
+			wp = 0x80
+		}
+		if t.op == ModeSense6 {
+			if len(cdb) < 6 {
+				break
+			}
+			r = r[:4]
+			r[0] = 3 // mode data length
+			r[2] = wp
+			t.reply(r, int(cdb[4]))
+		} else {
+			if len(cdb) < 10 {
+				break
+			}
+			r[1] = 6
+			r[3] = wp
+			t.reply(r, be16(cdb[7:9]))
+		}
+
+	case StartStopUnit:
+		if len(cdb) < 6 {
+			break
+		}
+		if cdb[4]&1 == 0 || cdb[4]&2 != 0 {
+			// Stop or eject.
+			if err := t.sync(); err != nil {
+				t.fail(MediumError, ascWriteError)
+				break
+			}
+		}
+		if cdb[4]&2 != 0 && cdb[4]&1 == 0 {
+			t.ejected = true
+		}
+
+	case ReadCapacity10:
+		r := t.buf[:8]
+		last := t.dev.NumBlocks() - 1
+		if last > 0xffff_ffff {
+			last = 0xffff_ffff
+		}
+		putBE32(r[0:4], uint32(last))
+		putBE32(r[4:8], uint32(t.bs))
+		t.reply(r, 8)
+
+	case ReadFormatCapacity:
+		if len(cdb) < 9 {
+			break
+		}
+		r := t.buf[:12]
+		clear(r)
+		r[3] = 8 // capacity list length
+		putBE32(r[4:8], uint32(t.dev.NumBlocks()))
+		putBE32(r[8:12], uint32(t.bs))
+		r[8] = 0x02 // formatted media
+		t.reply(r, be16(cdb[7:9]))
+
+	case Read10, Write10, Verify10:
+		if len(cdb) < 10 {
+			break
+		}
+		t.lba = int64(be32(cdb[2:6]))
+		cnt := int64(be16(cdb[7:9]))
+		if t.lba+cnt > t.dev.NumBlocks() {
+			t.fail(IllegalRequest, ascLBAOutOfRange)
+			break
+		}
+		switch {
+		case t.op == Read10:
+			t.dir = In
+		case t.readOnly:
+			t.fail(DataProtect, ascWriteProtected)
+			return None, 0
+		case t.op == Write10:
+			t.dir = Out
+		case cdb[1]&0x02 == 0:
+			// Verify without data comparison (BYTCHK=0).
+			return None, 0
+		default:
+			t.dir = Out
+		}
+		t.n = int(cnt) * t.bs
+
+	case SyncCache10:
+		if err := t.sync(); err != nil {
+			t.fail(MediumError, ascWriteError)
+		}
+
+	case ModeSelect6:
+		// Mode parameters cannot be changed.
+		if len(cdb) >= 6 && cdb[4] != 0 {
+			t.fail(IllegalRequest, ascParamListLenError)
+		}
+
+	default:
+		t.fail(IllegalRequest, ascInvalidCommand)
+	}
+	return t.dir, t.n
+}
+
+func (t *Target) sync() error {
+	return t.dev.Sync()
+}
+
+// Read performs the In data phase. It returns io.EOF after the whole data has
+// been read. Read reads whole blocks so len(p) must be at least BlockSize long
+// in case of READ(10).
+func (t *Target) Read(p []byte) (n int, err error) {
+	if t.dir != In || t.n == 0 {
+		return 0, io.EOF
+	}
+	if t.resp != nil {
+		n = copy(p, t.resp)
+		t.resp = t.resp[n:]
+		t.n -= n
+		return n, nil
+	}
+	if len(p) > t.n {
+		p = p[:t.n]
+	}
+	nb := len(p) / t.bs
+	if nb == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	if err = t.dev.ReadBlocks(p[:nb*t.bs], t.lba); err != nil {
+		t.fail(MediumError, ascReadError)
+		t.info = uint32(t.lba)
+		return 0, err
+	}
+	n = nb * t.bs
+	t.lba += int64(nb)
+	t.n -= n
+	return n, nil
+}
+
+// Write performs the Out data phase. Write writes whole blocks so len(p) must
+// be a multiple of BlockSize.
+func (t *Target) Write(p []byte) (n int, err error) {
+	if t.dir != Out || t.n == 0 {
+		return 0, io.ErrShortWrite
+	}
+	if len(p) > t.n {
+		p = p[:t.n]
+	}
+	nb := len(p) / t.bs
+	if nb == 0 || len(p) != nb*t.bs {
+		return 0, io.ErrShortWrite
+	}
+	if t.op == Verify10 {
+		// BYTCHK=1: compare with the medium content.
+		n, err = t.verify(p)
+	} else if err = t.dev.WriteBlocks(p, t.lba); err == nil {
+		n = len(p)
+	}
+	t.lba += int64(n / t.bs)
+	t.n -= n
+	if err != nil {
+		switch {
+		case err == ErrMiscompare:
+			t.fail(Miscompare, ascMiscompare)
+		case t.op == Verify10:
+			t.fail(MediumError, ascReadError)
+		default:
+			t.fail(MediumError, ascWriteError)
+		}
+		t.info = uint32(t.lba)
+	}
+	return n, err
+}
+
+// ErrMiscompare is returned by Write if the data sent by VERIFY(10) doesn't
+// match the medium content.
+var ErrMiscompare = errors.New("scsi: miscompare")
+
+func (t *Target) verify(p []byte) (n int, err error) {
+	blk := make([]byte, t.bs)
+	for n < len(p) {
+		if err = t.dev.ReadBlocks(blk, t.lba+int64(n/t.bs)); err != nil {
+			return
+		}
+		for i, b := range blk {
+			if p[n+i] != b {
+				return n, ErrMiscompare
+			}
+		}
+		n += t.bs
+	}
+	return
+}
+
+// Residue returns the number of bytes of the data phase that remain to be
+// transferred.
+func (t *Target) Residue() int { return t.n }
+
+// End finishes the command execution and returns its status (Good or
+// CheckCondition). If the data phase has not been completed the command ends
+// with the CHECK CONDITION status. Use the REQUEST SENSE command to obtain the
+// detailed information about the failure.
+func (t *Target) End() (status byte) {
+	if t.status == Good && t.n != 0 {
+		t.fail(IllegalRequest, ascInvalidField)
+	}
+	t.dir = None
+	t.resp = nil
+	return t.status
+}
+
+// Sense returns the current sense key and the additional sense code.
+func (t *Target) Sense() (key byte, asc, ascq byte) {
+	return t.key, byte(t.asc >> 8), byte(t.asc)
+}
@@ -0,0 +1,227 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scsi
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+const (
+	testBS   = 512
+	testBlks = 64
+)
+
+func newTestTarget() (*Target, *RAMDisk) {
+	disk := NewRAMDisk(make([]byte, testBS*testBlks), testBS)
+	return NewTarget(disk), disk
+}
+
+// exec executes the command described by cdb. The out data is sent to the
+// target in the Out data phase. The data received in the In data phase is
+// returned in in.
+func exec(t *testing.T, tg *Target, cdb []byte, out []byte) (status byte, in []byte) {
+	t.Helper()
+	dir, n := tg.Begin(cdb)
+	switch dir {
+	case In:
+		buf := make([]byte, testBS)
+		for {
+			m, err := tg.Read(buf)
+			in = append(in, buf[:m]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Logf("Read: %v", err)
+				break
+			}
+		}
+		if len(in) != n {
+			t.Errorf("cdb % x: %d bytes read, want %d", cdb, len(in), n)
+		}
+	case Out:
+		if len(out) != n {
+			t.Fatalf("cdb % x: %d bytes to write, want %d", cdb, len(out), n)
+		}
+		for len(out) != 0 {
+			m, err := tg.Write(out)
+			if err != nil {
+				t.Logf("Write: %v", err)
+				break
+			}
+			out = out[m:]
+		}
+	}
+	return tg.End(), in
+}
+
+func cdb10(op byte, lba uint32, cnt int) []byte {
+	c := make([]byte, 10)
+	c[0] = op
+	putBE32(c[2:6], lba)
+	c[7] = byte(cnt >> 8)
+	c[8] = byte(cnt)
+	return c
+}
+
+// checkSense issues REQUEST SENSE and checks the returned sense data.
+func checkSense(t *testing.T, tg *Target, key byte, asc uint16) {
+	t.Helper()
+	status, s := exec(t, tg, []byte{RequestSense, 0, 0, 0, 18, 0}, nil)
+	if status != Good {
+		t.Fatalf("REQUEST SENSE status: %d", status)
+	}
+	if len(s) != 18 || s[0] != 0x70 || s[7] != 10 {
+		t.Fatalf("bad sense data: % x", s)
+	}
+	if s[2] != key || uint16(s[12])<<8|uint16(s[13]) != asc {
+		t.Errorf(
+			"sense: key=%#x asc=%#02x%02x, want key=%#x asc=%#04x",
+			s[2], s[12], s[13], key, asc,
+		)
+	}
+}
+
+func TestInquiry(t *testing.T) {
+	tg, _ := newTestTarget()
+	tg.Vendor = "Vendor"
+	tg.Product = "Product"
+	tg.Revision = "0.1"
+	tg.SetRemovable(true)
+	status, r := exec(t, tg, []byte{Inquiry, 0, 0, 0, 36, 0}, nil)
+	if status != Good || len(r) != 36 {
+		t.Fatalf("INQUIRY: status=%d len=%d", status, len(r))
+	}
+	if r[0] != 0 || r[1] != 0x80 || r[4] != 31 {
+		t.Errorf("INQUIRY header: % x", r[:8])
+	}
+	if s := string(r[8:36]); s != "Vendor  Product         0.1 " {
+		t.Errorf("INQUIRY strings: %q", s)
+	}
+	// Allocation length truncates the response.
+	if status, r = exec(t, tg, []byte{Inquiry, 0, 0, 0, 5, 0}, nil); status != Good || len(r) != 5 {
+		t.Errorf("INQUIRY(5): status=%d len=%d", status, len(r))
+	}
+	// VPD pages aren't supported.
+	if status, _ = exec(t, tg, []byte{Inquiry, 1, 0x80, 0, 36, 0}, nil); status != CheckCondition {
+		t.Errorf("INQUIRY(EVPD): status=%d", status)
+	}
+	checkSense(t, tg, IllegalRequest, ascInvalidField)
+}
+
+func TestReadCapacity(t *testing.T) {
+	tg, _ := newTestTarget()
+	status, r := exec(t, tg, cdb10(ReadCapacity10, 0, 0), nil)
+	if status != Good || len(r) != 8 {
+		t.Fatalf("READ CAPACITY: status=%d len=%d", status, len(r))
+	}
+	if last, bs := be32(r[0:4]), be32(r[4:8]); last != testBlks-1 || bs != testBS {
+		t.Errorf("READ CAPACITY: last=%d bs=%d", last, bs)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	tg, disk := newTestTarget()
+	data := make([]byte, 3*testBS)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if status, _ := exec(t, tg, cdb10(Write10, 10, 3), data); status != Good {
+		t.Fatalf("WRITE(10) status: %d", status)
+	}
+	if !bytes.Equal(disk.Bytes()[10*testBS:13*testBS], data) {
+		t.Errorf("WRITE(10) data mismatch")
+	}
+	status, r := exec(t, tg, cdb10(Read10, 10, 3), nil)
+	if status != Good || !bytes.Equal(r, data) {
+		t.Errorf("READ(10): status=%d, data mismatch", status)
+	}
+}
+
+func TestReadWriteOutOfRange(t *testing.T) {
+	tg, disk := newTestTarget()
+	for _, tc := range []struct {
+		op  byte
+		lba uint32
+		cnt int
+	}{
+		{Read10, testBlks, 1},
+		{Read10, testBlks - 1, 2},
+		{Read10, 0xffff_ffff, 1},
+		{Write10, testBlks, 1},
+		{Write10, testBlks - 2, 3},
+	} {
+		dir, n := tg.Begin(cdb10(tc.op, tc.lba, tc.cnt))
+		if dir != None || n != 0 {
+			t.Errorf("op=%#x lba=%d cnt=%d: dir=%d n=%d", tc.op, tc.lba, tc.cnt, dir, n)
+		}
+		if status := tg.End(); status != CheckCondition {
+			t.Errorf("op=%#x lba=%d cnt=%d: status=%d", tc.op, tc.lba, tc.cnt, status)
+		}
+		checkSense(t, tg, IllegalRequest, ascLBAOutOfRange)
+	}
+	for _, b := range disk.Bytes() {
+		if b != 0 {
+			t.Fatal("disk modified by the failed WRITE(10)")
+		}
+	}
+	// The last block is accessible.
+	if status, _ := exec(t, tg, cdb10(Read10, testBlks-1, 1), nil); status != Good {
+		t.Errorf("READ(10) of the last block: status=%d", status)
+	}
+}
+
+func TestRequestSense(t *testing.T) {
+	tg, _ := newTestTarget()
+
+	// No error.
+	checkSense(t, tg, NoSense, ascNone)
+
+	// Unsupported command.
+	if status, _ := exec(t, tg, []byte{0xff, 0, 0, 0, 0, 0}, nil); status != CheckCondition {
+		t.Fatalf("unknown command: status=%d", status)
+	}
+	key, asc, ascq := tg.Sense()
+	if key != IllegalRequest || asc != 0x20 || ascq != 0 {
+		t.Errorf("Sense() = %#x %#x %#x", key, asc, ascq)
+	}
+	checkSense(t, tg, IllegalRequest, ascInvalidCommand)
+	// The sense data are cleared after REQUEST SENSE.
+	checkSense(t, tg, NoSense, ascNone)
+
+	// The next command clears the sense data.
+	exec(t, tg, []byte{0xff, 0, 0, 0, 0, 0}, nil)
+	if status, _ := exec(t, tg, []byte{TestUnitReady, 0, 0, 0, 0, 0}, nil); status != Good {
+		t.Fatalf("TEST UNIT READY: status=%d", status)
+	}
+	checkSense(t, tg, NoSense, ascNone)
+
+	// Write protected medium.
+	tg.SetReadOnly(true)
+	if status, _ := exec(t, tg, cdb10(Write10, 0, 1), nil); status != CheckCondition {
+		t.Fatalf("WRITE(10) to read-only medium: status=%d", status)
+	}
+	checkSense(t, tg, DataProtect, ascWriteProtected)
+	tg.SetReadOnly(false)
+
+	// Medium change: UNIT ATTENTION once, then the new medium is ready.
+	tg.SetDevice(NewRAMDisk(make([]byte, 8*testBS), testBS))
+	if status, _ := exec(t, tg, []byte{TestUnitReady, 0, 0, 0, 0, 0}, nil); status != CheckCondition {
+		t.Fatalf("TEST UNIT READY after medium change: status=%d", status)
+	}
+	checkSense(t, tg, UnitAttention, ascMediumChanged)
+	if status, _ := exec(t, tg, []byte{TestUnitReady, 0, 0, 0, 0, 0}, nil); status != Good {
+		t.Errorf("TEST UNIT READY: status=%d", status)
+	}
+
+	// No medium.
+	tg.SetDevice(nil)
+	if status, _ := exec(t, tg, []byte{TestUnitReady, 0, 0, 0, 0, 0}, nil); status != CheckCondition {
+		t.Fatalf("TEST UNIT READY without medium: status=%d", status)
+	}
+	checkSense(t, tg, NotReady, ascMediumNotPresent)
+}
@@ -0,0 +1,376 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package usbncm provides the USB CDC Network Control Model (NCM) driver. It
+// exposes an Ethernet interface to the host so a network stack running on the
+// device can communicate with the host over the USB cable. The NCM Transfer
+// Blocks are handled by the ntb package.
+//
+// The NCM function uses the Communication interface (interf) with the
+// notification endpoint and the Data interface (interf+1) with the two bulk
+// endpoints. The descriptors returned by Descriptors must be included in the
+// configuration descriptors and the MAC address string descriptor returned by
+// MACAddrDesc must be added to the descriptor map passed to usb.Device.Init.
+// Example:
+//
+//	descriptors[usbncm.MACAddrKey(iMAC)] = usbncm.MACAddrDesc(hostMAC)
+//	...
+//	ncm := usbncm.NewDriver(usbd, interf, ne, out, in)
+//	usbd.Enable()
+//	for frame := range ncm.RecvChan() {
+//		... // pass the Ethernet frame to the network stack
+//	}
+//
+// The hostMAC is the MAC address of the host side of the link. The device
+// side uses its own MAC address (must be different).
+package usbncm
+
+import (
+	"embedded/rtos"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/embeddedgo/imxrt/hal/dma"
+	"github.com/embeddedgo/imxrt/hal/usb"
+	"github.com/embeddedgo/imxrt/hal/usb/usbncm/ntb"
+)
+
+// MaxFrameSize is the maximum size of the Ethernet frame (without FCS).
+const MaxFrameSize = 1514
+
+const (
+	ntbMaxSize   = 16 * 1024 // fits in a single DTD
+	ntbMinInSize = 2048
+	queueLen     = 16
+
+	// Class-specific requests: bRequest<<8 | bmRequestType.
+	reqSetEthernetPacketFilter = 0x4321
+	reqGetNTBParameters        = 0x80a1
+	reqGetNTBInputSize         = 0x85a1
+	reqSetNTBInputSize         = 0x8621
+
+	// Notifications.
+	ntfNetworkConnection     = 0x00
+	ntfConnectionSpeedChange = 0x2a
+)
+
+// A Driver is an USB CDC NCM driver.
+type Driver struct {
+	d        *usb.Device
+	tda      *[3]usb.DTD // tda[0] is for Tx, tda[1] is for Rx, tda[2] for notifications
+	donea    [3]rtos.Note
+	txbuf    []byte
+	rxbuf    []byte
+	nbuf     []byte
+	tx       chan []byte
+	rx       chan []byte
+	link     chan struct{}
+	ntbInMax atomic.Uint32
+	filter   atomic.Uint32
+	down     atomic.Bool
+	bitRate  atomic.Uint32
+	interf   uint8
+	ne       uint8
+	rxe, txe uint8
+}
+
+var interfaces = make(map[uint8]*Driver)
+
+// NewDriver returns a new NCM driver that uses the ne interrupt IN endpoint
+// for notifications and the rxe (host OUT) and txe (host IN) bulk endpoints
+// for data. The link is reported as up with the bit rate equal to the USB
+// bus speed (see SetLink).
+func NewDriver(d *usb.Device, interf uint8, ne, rxe, txe int8) *Driver {
+	s := &Driver{
+		d:      d,
+		tda:    (*[3]usb.DTD)(usb.MakeSliceDTD(3, 3)),
+		txbuf:  dma.MakeSlice[byte](ntbMaxSize, ntbMaxSize),
+		rxbuf:  dma.MakeSlice[byte](ntbMaxSize, ntbMaxSize),
+		nbuf:   dma.MakeSlice[byte](16, dma.MemAlign),
+		tx:     make(chan []byte, queueLen),
+		rx:     make(chan []byte, queueLen),
+		link:   make(chan struct{}, 1),
+		interf: interf,
+		ne:     usb.HE(ne, usb.IN),
+		rxe:    usb.HE(rxe, usb.OUT),
+		txe:    usb.HE(txe, usb.IN),
+	}
+	for i := range s.tda {
+		s.tda[i].SetNote(&s.donea[i])
+	}
+	s.ntbInMax.Store(ntbMaxSize)
+	interfaces[interf] = s
+	d.Handle(0, reqSetEthernetPacketFilter, setEthernetPacketFilter)
+	d.Handle(0, reqGetNTBParameters, getNTBParameters)
+	d.Handle(0, reqGetNTBInputSize, getNTBInputSize)
+	d.Handle(0, reqSetNTBInputSize, setNTBInputSize)
+	go sender(s)
+	go receiver(s)
+	go notifier(s)
+	return s
+}
+
+// MACAddrKey returns the key of the MAC address string descriptor (US English
+// language ID) in the descriptor map passed to the usb.Device.Init method.
+func MACAddrKey(iMAC uint8) uint32 {
+	return uint32(0x0300|uint16(iMAC))<<16 | 0x0409
+}
+
+// MACAddrDesc returns the string descriptor that contains the MAC address of
+// the host side of the link.
+func MACAddrDesc(mac [6]byte) string {
+	const hex = "0123456789ABCDEF"
+	b := make([]byte, 2+2*12)
+	b[0] = byte(len(b))
+	b[1] = 3
+	for i, c := range mac {
+		b[2+i*4] = hex[c>>4]
+		b[2+i*4+2] = hex[c&15]
+	}
+	return string(b)
+}
+
+// Descriptors returns the interface descriptors, the class-specific functional
+// descriptors and the endpoint descriptors of the NCM function. MaxPkt is the
+// maximum packet size of the bulk endpoints (512 for HS, 64 for FS). The iMAC
+// is the index of the MAC address string descriptor (see MACAddrDesc).
+func Descriptors(interf uint8, ne, rxe, txe int8, maxPkt int, iMAC uint8) string {
+	const mss = MaxFrameSize
+	return string([]byte{
+		// Communication interface
+		9, 4, interf, 0, 1, 0x02, 0x0d, 0x00, 0,
+		5, 0x24, 0x00, 0x10, 0x01, // Header, CDC 1.10
+		5, 0x24, 0x06, interf, interf + 1, // Union
+		13, 0x24, 0x0f, iMAC, 0, 0, 0, 0, mss & 0xff, mss >> 8, 0, 0, 0, // Ethernet
+		6, 0x24, 0x1a, 0x00, 0x01, 0x00, // NCM 1.0, no optional requests
+		7, 5, 0x80 | byte(ne), 3, 16, 0, 9, // 9 ms (FS), 32 ms (HS)
+
+		// Data interface
+		9, 4, interf + 1, 0, 0, 0x0a, 0x00, 0x01, 0,
+		9, 4, interf + 1, 1, 2, 0x0a, 0x00, 0x01, 0,
+		7, 5, byte(rxe), 2, byte(maxPkt), byte(maxPkt >> 8), 0,
+		7, 5, 0x80 | byte(txe), 2, byte(maxPkt), byte(maxPkt >> 8), 0,
+	})
+}
+
+// SetLink sets the link state and the bit rate reported to the host. The zero
+// bitRate means the USB bus speed.
+func (s *Driver) SetLink(up bool, bitRate uint32) {
+	s.down.Store(!up)
+	s.bitRate.Store(bitRate)
+	select {
+	case s.link <- struct{}{}:
+	default:
+	}
+}
+
+// PacketFilter returns the Ethernet packet filter bitmap set by the host
+// (SET_ETHERNET_PACKET_FILTER request). The driver doesn't filter the frames.
+func (s *Driver) PacketFilter() uint16 {
+	return uint16(s.filter.Load())
+}
+
+// Active reports whether the host enabled the data interface.
+func (s *Driver) Active() bool {
+	return s.d.Interface(int(s.interf)+1) == 1
+}
+
+// Send queues the Ethernet frame to be sent to the host. It blocks if the
+// queue is full. Send copies the frame so it can be modified immediately after
+// return. The frames sent while the data interface isn't active are dropped.
+func (s *Driver) Send(frame []byte) {
+	if len(frame) == 0 || len(frame) > MaxFrameSize {
+		return
+	}
+	s.tx <- append([]byte(nil), frame...)
+}
+
+// Recv waits for the Ethernet frame received from the host and returns the
+// number of bytes copied to p. The frames are dropped if the receive queue is
+// full.
+func (s *Driver) Recv(p []byte) int {
+	return copy(p, <-s.rx)
+}
+
+// RecvChan returns the channel of the received Ethernet frames.
+func (s *Driver) RecvChan() <-chan []byte {
+	return s.rx
+}
+
+// xfer transfers p using the he endpoint. It reports false if the device is
+// not in the configured state or the transfer failed.
+func (s *Driver) xfer(i int, he uint8, p []byte) (n int, ok bool) {
+	td, done := &s.tda[i], &s.donea[i]
+	ptr := unsafe.Pointer(&p[0])
+	cn := (len(p) + dma.MemAlign - 1) &^ (dma.MemAlign - 1)
+	if he&1 == usb.IN {
+		rtos.CacheMaint(rtos.DCacheFlush, ptr, cn)
+	} else {
+		rtos.CacheMaint(rtos.DCacheInval, ptr, cn)
+	}
+	n = td.SetupTransfer(ptr, len(p))
+	done.Clear()
+	if !s.d.Prime(he, td, td) {
+		return 0, false
+	}
+	done.Sleep(-1)
+	rem, status := td.Status()
+	if status != 0 {
+		return 0, false
+	}
+	return n - rem, true
+}
+
+func sender(s *Driver) {
+	var (
+		p       ntb.Packer
+		pending []byte
+	)
+	for {
+		if pending == nil {
+			pending = <-s.tx
+		}
+		if !s.Active() {
+			pending = nil
+			continue
+		}
+		// Pack as many queued frames as possible into the single NTB.
+		p.Reset(s.txbuf, int(s.ntbInMax.Load()), 0)
+		for p.Add(pending) {
+			select {
+			case pending = <-s.tx:
+				continue
+			default:
+				pending = nil
+			}
+			break
+		}
+		if p.Len() == 0 {
+			pending = nil // cannot happen, MaxFrameSize < ntbMinInSize
+			continue
+		}
+		s.xfer(0, s.txe, p.Finish())
+	}
+}
+
+func receiver(s *Driver) {
+	data := int(s.interf) + 1
+	deliver := func(frame []byte) {
+		select {
+		case s.rx <- append([]byte(nil), frame...):
+		default:
+		}
+	}
+	for {
+		s.d.WaitInterface(data, 1)
+		s.SetLink(!s.down.Load(), s.bitRate.Load()) // notify the host
+		for {
+			n, ok := s.xfer(1, s.rxe, s.rxbuf)
+			if !ok {
+				break
+			}
+			ntb.Parse(s.rxbuf[:n], deliver)
+		}
+	}
+}
+
+func notifier(s *Driver) {
+	b := s.nbuf
+	for {
+		<-s.link
+		if !s.Active() {
+			continue
+		}
+		up := !s.down.Load()
+		if up {
+			rate := s.bitRate.Load()
+			if rate == 0 {
+				rate = 12e6
+				if s.d.Speed() == usb.HighSpeed {
+					rate = 480e6
+				}
+			}
+			b = b[:16]
+			b[0], b[1] = 0xa1, ntfConnectionSpeedChange
+			b[2], b[3] = 0, 0
+			b[4], b[5] = s.interf, 0
+			b[6], b[7] = 8, 0
+			for i := 0; i < 8; i += 4 {
+				b[8+i] = byte(rate)
+				b[9+i] = byte(rate >> 8)
+				b[10+i] = byte(rate >> 16)
+				b[11+i] = byte(rate >> 24)
+			}
+			if _, ok := s.xfer(2, s.ne, b); !ok {
+				continue
+			}
+		}
+		b = b[:8]
+		b[0], b[1] = 0xa1, ntfNetworkConnection
+		b[2], b[3] = 0, 0
+		if up {
+			b[2] = 1
+		}
+		b[4], b[5] = s.interf, 0
+		b[6], b[7] = 0, 0
+		s.xfer(2, s.ne, b)
+	}
+}
+
+func setEthernetPacketFilter(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil {
+		return -1
+	}
+	s.filter.Store(uint32(cr.Value))
+	return 0
+}
+
+func getNTBParameters(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 28 {
+		return -1
+	}
+	b := cr.Data[:28]
+	clear(b)
+	b[0] = 28                   // wLength
+	b[2] = 0x01                 // bmNtbFormatsSupported: NTB16
+	putLE32(b[4:], ntbMaxSize)  // dwNtbInMaxSize
+	b[8] = ntb.Align            // wNdpInDivisor
+	b[12] = ntb.Align           // wNdpInAlignment
+	putLE32(b[16:], ntbMaxSize) // dwNtbOutMaxSize
+	b[20] = ntb.Align           // wNdpOutDivisor
+	b[24] = ntb.Align           // wNdpOutAlignment
+	return 28
+}
+
+func getNTBInputSize(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 4 {
+		return -1
+	}
+	putLE32(cr.Data, s.ntbInMax.Load())
+	return 4
+}
+
+func setNTBInputSize(cr *usb.ControlRequest) int {
+	s := interfaces[uint8(cr.Index)]
+	if s == nil || len(cr.Data) < 4 {
+		return -1
+	}
+	b := cr.Data
+	size := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	if size < ntbMinInSize || size > ntbMaxSize {
+		return -1
+	}
+	s.ntbInMax.Store(size)
+	return 0
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
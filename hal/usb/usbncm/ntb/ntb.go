@@ -0,0 +1,171 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ntb implements parsing and packing of the NCM Transfer Blocks in the
+// 16-bit format (NTB16, see USB Network Control Model Devices 1.0, 3.2). It
+// has no hardware dependencies.
+package ntb
+
+import "errors"
+
+// ErrFormat is returned by Parse if the NTB is malformed.
+var ErrFormat = errors.New("ntb: bad NTB16 format")
+
+const (
+	nthSig  = 0x484d434e // NCMH
+	ndpSig0 = 0x304d434e // NCM0 (no CRC)
+	ndpSig1 = 0x314d434e // NCM1 (CRC-32 appended to datagrams)
+	nthLen  = 12
+	ndpLen  = 8 // without datagram pointers
+
+	// Align is the alignment of datagrams and NDPs in the NTBs created by the
+	// Packer.
+	Align = 4
+)
+
+func le16(b []byte) int {
+	return int(b[0]) | int(b[1])<<8
+}
+
+func le32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func putLE16(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+}
+
+func putLE32(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+	b[3] = byte(v >> 24)
+}
+
+// Parse calls f for every datagram (Ethernet frame) in the NTB16 p. The
+// datagram slices point into p. The CRC, if present, isn't checked.
+func Parse(p []byte, f func(datagram []byte)) error {
+	if len(p) < nthLen || le32(p) != nthSig || le16(p[4:]) != nthLen {
+		return ErrFormat
+	}
+	blen := le16(p[8:])
+	if blen > len(p) || blen < nthLen {
+		if blen != 0 {
+			return ErrFormat
+		}
+		blen = len(p) // zero means the NTB is terminated by a short packet
+	}
+	p = p[:blen]
+	ndp := le16(p[10:])
+	for n := 0; ndp != 0; n++ {
+		if ndp < nthLen || ndp+ndpLen > len(p) || n > len(p)/ndpLen {
+			return ErrFormat
+		}
+		h := p[ndp:]
+		sig := le32(h)
+		if sig != ndpSig0 && sig != ndpSig1 {
+			return ErrFormat
+		}
+		l := le16(h[4:])
+		if l < ndpLen+4 || l&3 != 0 || ndp+l > len(p) {
+			return ErrFormat
+		}
+		for e := h[ndpLen:l]; len(e) >= 4; e = e[4:] {
+			off, dlen := le16(e), le16(e[2:])
+			if off == 0 || dlen == 0 {
+				break
+			}
+			if off+dlen > len(p) {
+				return ErrFormat
+			}
+			if sig == ndpSig1 {
+				dlen -= 4
+				if dlen <= 0 {
+					continue
+				}
+			}
+			f(p[off : off+dlen])
+		}
+		ndp = le16(h[6:])
+	}
+	return nil
+}
+
+// A Packer creates NTB16 blocks that contain one or more datagrams. The
+// datagrams are placed just after the NTH16 header, the NDP16 is placed at the
+// end of the block.
+type Packer struct {
+	buf  []byte
+	n    int // end of the last datagram
+	dgs  []uint16
+	seq  uint16
+	max  int
+	maxd int
+}
+
+// Reset starts a new NTB in buf. The size of the NTB will not exceed max
+// bytes (if max > 0 and max < len(buf)). The number of datagrams will not
+// exceed maxDatagrams (if maxDatagrams > 0).
+func (p *Packer) Reset(buf []byte, max, maxDatagrams int) {
+	if max <= 0 || max > len(buf) {
+		max = len(buf)
+	}
+	p.buf = buf
+	p.max = max
+	p.maxd = maxDatagrams
+	p.n = nthLen
+	p.dgs = p.dgs[:0]
+}
+
+// Len returns the number of datagrams in the current NTB.
+func (p *Packer) Len() int {
+	return len(p.dgs) / 2
+}
+
+func align(n int) int {
+	return (n + Align - 1) &^ (Align - 1)
+}
+
+// Add adds the datagram to the current NTB. It reports false if the datagram
+// doesn't fit in the NTB.
+func (p *Packer) Add(datagram []byte) bool {
+	if p.maxd > 0 && p.Len() >= p.maxd {
+		return false
+	}
+	off := align(p.n)
+	end := off + len(datagram)
+	if align(end)+ndpLen+4*(p.Len()+2) > p.max || len(datagram) == 0 {
+		return false
+	}
+	copy(p.buf[off:], datagram)
+	p.dgs = append(p.dgs, uint16(off), uint16(len(datagram)))
+	p.n = end
+	return true
+}
+
+// Finish writes the NTH16 header and the NDP16 and returns the complete NTB.
+func (p *Packer) Finish() []byte {
+	b := p.buf
+	ndp := align(p.n)
+	l := ndpLen + 4*(p.Len()+1)
+	blen := ndp + l
+	putLE32(b[0:], nthSig)
+	putLE16(b[4:], nthLen)
+	putLE16(b[6:], int(p.seq))
+	putLE16(b[8:], blen)
+	putLE16(b[10:], ndp)
+	p.seq++
+	clear(b[p.n:ndp])
+	h := b[ndp:blen]
+	putLE32(h, ndpSig0)
+	putLE16(h[4:], l)
+	putLE16(h[6:], 0)
+	e := h[ndpLen:]
+	for i, v := range p.dgs {
+		putLE16(e[2*i:], int(v))
+	}
+	clear(e[2*len(p.dgs):])
+	return b[:blen]
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ntb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func datagram(n int, b byte) []byte {
+	d := make([]byte, n)
+	for i := range d {
+		d[i] = b + byte(i)
+	}
+	return d
+}
+
+func parseAll(t *testing.T, ntb []byte) [][]byte {
+	t.Helper()
+	var dgs [][]byte
+	err := Parse(ntb, func(d []byte) {
+		dgs = append(dgs, append([]byte(nil), d...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dgs
+}
+
+func TestRoundTrip(t *testing.T) {
+	var p Packer
+	buf := make([]byte, 1640)
+	for seq := 0; seq < 3; seq++ {
+		p.Reset(buf, 0, 0)
+		var want [][]byte
+		for i, n := range []int{60, 1, 2, 3, 1514, 7} {
+			d := datagram(n, byte(i*16+seq))
+			if !p.Add(d) {
+				// The 1514 B datagram must fit, the next one doesn't.
+				if n != 7 {
+					t.Fatalf("%d: datagram %d (%d B) doesn't fit", seq, i, n)
+				}
+				break
+			}
+			want = append(want, d)
+		}
+		if len(want) != 5 || p.Len() != len(want) {
+			t.Fatalf("%d: Len=%d, want %d", seq, p.Len(), len(want))
+		}
+		ntb := p.Finish()
+		if s := le16(ntb[6:]); s != seq {
+			t.Errorf("sequence %d, want %d", s, seq)
+		}
+		if ndp := le16(ntb[10:]); ndp%Align != 0 || len(ntb)%4 != 0 {
+			t.Errorf("%d: NDP at %d, NTB length %d", seq, ndp, len(ntb))
+		}
+		got := parseAll(t, ntb)
+		if len(got) != len(want) {
+			t.Fatalf("%d: %d datagrams, want %d", seq, len(got), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("%d: datagram %d: % x, want % x", seq, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestPackerLimits(t *testing.T) {
+	var p Packer
+	buf := make([]byte, 256)
+
+	p.Reset(buf, 0, 2)
+	if !p.Add(datagram(10, 0)) || !p.Add(datagram(10, 1)) || p.Add(datagram(10, 2)) {
+		t.Errorf("maxDatagrams=2: Len=%d", p.Len())
+	}
+
+	p.Reset(buf, 64, 0)
+	// NTH16 (12) + datagram (32) + NDP16 with two entries (16) = 60
+	if !p.Add(datagram(32, 0)) {
+		t.Fatal("32 B datagram doesn't fit in 64 B NTB")
+	}
+	if p.Add(datagram(1, 1)) {
+		t.Error("1 B datagram fits in full 64 B NTB")
+	}
+	if p.Add(nil) {
+		t.Error("empty datagram added")
+	}
+	if ntb := p.Finish(); len(ntb) > 64 {
+		t.Errorf("NTB length %d > 64", len(ntb))
+	}
+}
+
+func TestParseShortPacket(t *testing.T) {
+	var p Packer
+	p.Reset(make([]byte, 128), 0, 0)
+	p.Add(datagram(20, 0))
+	ntb := p.Finish()
+	putLE16(ntb[8:], 0) // wBlockLength=0: NTB terminated by a short packet
+	if got := parseAll(t, ntb); len(got) != 1 || !bytes.Equal(got[0], datagram(20, 0)) {
+		t.Errorf("got % x", got)
+	}
+}
+
+func TestParseCRC(t *testing.T) {
+	var p Packer
+	p.Reset(make([]byte, 128), 0, 0)
+	p.Add(append(datagram(20, 0), 1, 2, 3, 4)) // datagram with CRC-32
+	ntb := p.Finish()
+	putLE32(ntb[le16(ntb[10:]):], ndpSig1)
+	if got := parseAll(t, ntb); len(got) != 1 || !bytes.Equal(got[0], datagram(20, 0)) {
+		t.Errorf("got % x", got)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	var p Packer
+	p.Reset(make([]byte, 128), 0, 0)
+	p.Add(datagram(20, 0))
+	p.Add(datagram(30, 1))
+	valid := append([]byte(nil), p.Finish()...)
+	ndp := le16(valid[10:])
+
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{"short NTH", func(b []byte) []byte { return b[:nthLen-1] }},
+		{"NTH signature", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"NTH length", func(b []byte) []byte { putLE16(b[4:], 16); return b }},
+		{"block length > len", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"block length < NTH", func(b []byte) []byte { putLE16(b[8:], nthLen-1); return b }},
+		{"NDP inside NTH", func(b []byte) []byte { putLE16(b[10:], 4); return b }},
+		{"NDP beyond block", func(b []byte) []byte { putLE16(b[10:], len(b)-4); return b }},
+		{"NDP signature", func(b []byte) []byte { b[ndp+3] = 'X'; return b }},
+		{"NDP length too small", func(b []byte) []byte { putLE16(b[ndp+4:], ndpLen); return b }},
+		{"NDP length unaligned", func(b []byte) []byte { putLE16(b[ndp+4:], ndpLen+6); return b }},
+		{"NDP length beyond block", func(b []byte) []byte { putLE16(b[ndp+4:], len(b)-ndp+4); return b }},
+		{"datagram beyond block", func(b []byte) []byte { putLE16(b[ndp+ndpLen+6:], len(b)); return b }},
+		{"NDP loop", func(b []byte) []byte { putLE16(b[ndp+6:], ndp); return b }},
+	}
+	for _, tc := range tests {
+		b := tc.modify(append([]byte(nil), valid...))
+		if err := Parse(b, func([]byte) {}); err != ErrFormat {
+			t.Errorf("%s: err=%v, want ErrFormat", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regmap
+
+import "io"
+
+// Conn is the Bus implementation that uses a connection to the device (e.g.
+// i2cbus.Conn, *lpspi.Conn). Every register access is performed in a single
+// transaction: the address is written, next the data is written or read,
+// and the connection is closed (I2C Stop, SPI chip select deasserted).
+type Conn struct {
+	c         io.ReadWriteCloser
+	abuf      [4]byte
+	readFlag  byte
+	writeFlag byte
+}
+
+// NewConn returns a new Bus that uses c. The readFlag and writeFlag are ORed
+// with the first address byte of the read and write accesses respectively.
+// They are intended for SPI devices that encode the direction (and often the
+// address auto-increment) in the address byte (e.g. 0x80 for read). Use zero
+// flags for I2C devices.
+func NewConn(c io.ReadWriteCloser, readFlag, writeFlag byte) *Conn {
+	return &Conn{c: c, readFlag: readFlag, writeFlag: writeFlag}
+}
+
+// Conn returns the underlying connection.
+func (b *Conn) Conn() io.ReadWriteCloser {
+	return b.c
+}
+
+func writeAddr(b *Conn, addr []byte, flag byte) error {
+	n := copy(b.abuf[:], addr)
+	b.abuf[0] |= flag
+	_, err := b.c.Write(b.abuf[:n])
+	return err
+}
+
+func end(b *Conn, err error) error {
+	if cerr := b.c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadRegs implements the Bus interface.
+func (b *Conn) ReadRegs(addr, p []byte) error {
+	err := writeAddr(b, addr, b.readFlag)
+	if err == nil {
+		_, err = io.ReadFull(b.c, p)
+	}
+	return end(b, err)
+}
+
+// WriteRegs implements the Bus interface.
+func (b *Conn) WriteRegs(addr, p []byte) error {
+	err := writeAddr(b, addr, b.writeFlag)
+	if err == nil && len(p) != 0 {
+		_, err = b.c.Write(p)
+	}
+	return end(b, err)
+}
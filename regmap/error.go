@@ -0,0 +1,23 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regmap
+
+// DriverError represents the errors returned by the regmap backends.
+type DriverError uint8
+
+const (
+	// ErrRange is returned by Mock if the access is out of the simulated
+	// register space.
+	ErrRange DriverError = iota + 1
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrRange:
+		return "regmap: address out of range"
+	}
+	return ""
+}
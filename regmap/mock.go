@@ -0,0 +1,77 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regmap
+
+// Op describes a single register access recorded by Mock.
+type Op struct {
+	Write bool
+	Addr  uint32
+	Data  []byte
+}
+
+// Mock is the Bus implementation that simulates the device registers in
+// memory. It is intended for host-side unit tests of device drivers.
+//
+// Mem is the register space. The register addr occupies RegSize bytes (1 if
+// RegSize is zero) starting from Mem[addr*RegSize]. The burst accesses work as
+// with the address auto-increment. Every access is recorded in Log. If Err is
+// not nil all accesses fail with Err (and aren't recorded). The OnWrite
+// function, if set, is called after every write so it can simulate the
+// device behavior (e.g. self clearing bits).
+type Mock struct {
+	Mem     []byte
+	RegSize int
+	Log     []Op
+	Err     error
+	OnWrite func(m *Mock, addr uint32)
+}
+
+// NewMock returns a new Mock with n registers, regSize bytes each.
+func NewMock(n, regSize int) *Mock {
+	return &Mock{Mem: make([]byte, n*regSize), RegSize: regSize}
+}
+
+func mockRange(m *Mock, addr []byte, n int) (a uint32, off int, err error) {
+	for _, b := range addr {
+		a = a<<8 | uint32(b)
+	}
+	rs := max(m.RegSize, 1)
+	off = int(a) * rs
+	if off < 0 || off+n > len(m.Mem) {
+		return 0, 0, ErrRange
+	}
+	return a, off, nil
+}
+
+// ReadRegs implements the Bus interface.
+func (m *Mock) ReadRegs(addr, p []byte) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	a, off, err := mockRange(m, addr, len(p))
+	if err != nil {
+		return err
+	}
+	copy(p, m.Mem[off:])
+	m.Log = append(m.Log, Op{false, a, append([]byte(nil), p...)})
+	return nil
+}
+
+// WriteRegs implements the Bus interface.
+func (m *Mock) WriteRegs(addr, p []byte) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	a, off, err := mockRange(m, addr, len(p))
+	if err != nil {
+		return err
+	}
+	copy(m.Mem[off:], p)
+	m.Log = append(m.Log, Op{true, a, append([]byte(nil), p...)})
+	if m.OnWrite != nil {
+		m.OnWrite(m, a)
+	}
+	return nil
+}
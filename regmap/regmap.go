@@ -0,0 +1,150 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package regmap provides typed access to the registers of I2C/SPI devices
+// (sensors, ADCs, I/O expanders, etc.) that use the common "write the register
+// address, then read/write the register data" protocol.
+//
+// The package doesn't depend on any hardware. The Conn backend works with any
+// connection that implements io.ReadWriteCloser (i2cbus.Conn, *lpspi.Conn).
+// The Mock backend allows to test device drivers on the host.
+//
+// Example:
+//
+//	c := lpi2c1.Master().NewConn(0x48)
+//	m := regmap.New(regmap.NewConn(c, 0, 0), 1, binary.BigEndian)
+//	err := m.Write16(ads111x.RegCfg, cfg)
+//	...
+//	v, err := m.Read16(ads111x.RegConv)
+package regmap
+
+import "encoding/binary"
+
+// Bus is the interface to the device registers. The addr contains the encoded
+// (big-endian) register address. The Bus implementation is responsible for
+// the required framing (e.g. the read/write bit in the address byte of SPI
+// devices).
+type Bus interface {
+	ReadRegs(addr, p []byte) error
+	WriteRegs(addr, p []byte) error
+}
+
+// A Map provides access to the device registers using Bus. It isn't safe for
+// concurrent use.
+type Map struct {
+	bus   Bus
+	order binary.ByteOrder
+	aw    int
+	abuf  [4]byte
+	dbuf  [4]byte
+}
+
+// New returns a new register map that uses bus to access the registers. The
+// addrWidth specifies the register address width in bytes (1 to 4), order
+// specifies the byte order of the multi-byte register values.
+func New(bus Bus, addrWidth int, order binary.ByteOrder) *Map {
+	if addrWidth < 1 || addrWidth > 4 {
+		panic("regmap: bad address width")
+	}
+	return &Map{bus: bus, order: order, aw: addrWidth}
+}
+
+// Bus returns the underlying bus.
+func (m *Map) Bus() Bus {
+	return m.bus
+}
+
+func encodeAddr(m *Map, addr uint32) []byte {
+	for i := m.aw - 1; i >= 0; i-- {
+		m.abuf[i] = byte(addr)
+		addr >>= 8
+	}
+	return m.abuf[:m.aw]
+}
+
+// Read reads len(p) bytes starting from the register addr (burst read). The
+// device must support the address auto-increment if p spans more than one
+// register.
+func (m *Map) Read(addr uint32, p []byte) error {
+	return m.bus.ReadRegs(encodeAddr(m, addr), p)
+}
+
+// Write writes p starting from the register addr (burst write).
+func (m *Map) Write(addr uint32, p []byte) error {
+	return m.bus.WriteRegs(encodeAddr(m, addr), p)
+}
+
+// Read8 reads the 8-bit register.
+func (m *Map) Read8(addr uint32) (uint8, error) {
+	err := m.Read(addr, m.dbuf[:1])
+	return m.dbuf[0], err
+}
+
+// Write8 writes the 8-bit register.
+func (m *Map) Write8(addr uint32, v uint8) error {
+	m.dbuf[0] = v
+	return m.Write(addr, m.dbuf[:1])
+}
+
+// Read16 reads the 16-bit register.
+func (m *Map) Read16(addr uint32) (uint16, error) {
+	err := m.Read(addr, m.dbuf[:2])
+	return m.order.Uint16(m.dbuf[:2]), err
+}
+
+// Write16 writes the 16-bit register.
+func (m *Map) Write16(addr uint32, v uint16) error {
+	m.order.PutUint16(m.dbuf[:2], v)
+	return m.Write(addr, m.dbuf[:2])
+}
+
+// Read32 reads the 32-bit register.
+func (m *Map) Read32(addr uint32) (uint32, error) {
+	err := m.Read(addr, m.dbuf[:4])
+	return m.order.Uint32(m.dbuf[:4]), err
+}
+
+// Write32 writes the 32-bit register.
+func (m *Map) Write32(addr uint32, v uint32) error {
+	m.order.PutUint32(m.dbuf[:4], v)
+	return m.Write(addr, m.dbuf[:4])
+}
+
+// Update8 performs the read-modify-write operation on the 8-bit register: the
+// bits selected by mask are replaced by the corresponding bits of v. The
+// register isn't written if its value doesn't change.
+func (m *Map) Update8(addr uint32, mask, v uint8) error {
+	old, err := m.Read8(addr)
+	if err != nil {
+		return err
+	}
+	if nv := old&^mask | v&mask; nv != old {
+		err = m.Write8(addr, nv)
+	}
+	return err
+}
+
+// Update16 works like Update8 but for the 16-bit register.
+func (m *Map) Update16(addr uint32, mask, v uint16) error {
+	old, err := m.Read16(addr)
+	if err != nil {
+		return err
+	}
+	if nv := old&^mask | v&mask; nv != old {
+		err = m.Write16(addr, nv)
+	}
+	return err
+}
+
+// Update32 works like Update8 but for the 32-bit register.
+func (m *Map) Update32(addr uint32, mask, v uint32) error {
+	old, err := m.Read32(addr)
+	if err != nil {
+		return err
+	}
+	if nv := old&^mask | v&mask; nv != old {
+		err = m.Write32(addr, nv)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package regmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestEndianness(t *testing.T) {
+	for _, order := range []binary.ByteOrder{
+		binary.BigEndian, binary.LittleEndian,
+	} {
+		bus := NewMock(4, 4)
+		m := New(bus, 1, order)
+		if err := m.Write16(1, 0x1234); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Write32(2, 0x12345678); err != nil {
+			t.Fatal(err)
+		}
+		var w16, w32 []byte
+		if order == binary.BigEndian {
+			w16, w32 = []byte{0x12, 0x34}, []byte{0x12, 0x34, 0x56, 0x78}
+		} else {
+			w16, w32 = []byte{0x34, 0x12}, []byte{0x78, 0x56, 0x34, 0x12}
+		}
+		if !bytes.Equal(bus.Mem[4:6], w16) {
+			t.Errorf("%v: reg 1 = % x, want % x", order, bus.Mem[4:6], w16)
+		}
+		if !bytes.Equal(bus.Mem[8:12], w32) {
+			t.Errorf("%v: reg 2 = % x, want % x", order, bus.Mem[8:12], w32)
+		}
+		if v, err := m.Read16(1); err != nil || v != 0x1234 {
+			t.Errorf("%v: Read16 = %#x, %v", order, v, err)
+		}
+		if v, err := m.Read32(2); err != nil || v != 0x12345678 {
+			t.Errorf("%v: Read32 = %#x, %v", order, v, err)
+		}
+	}
+}
+
+// addrBus records the encoded addresses.
+type addrBus struct {
+	addrs [][]byte
+}
+
+func (b *addrBus) ReadRegs(addr, p []byte) error {
+	b.addrs = append(b.addrs, append([]byte(nil), addr...))
+	return nil
+}
+
+func (b *addrBus) WriteRegs(addr, p []byte) error {
+	return b.ReadRegs(addr, p)
+}
+
+func TestAddrWidth(t *testing.T) {
+	tests := []struct {
+		aw   int
+		addr uint32
+		want []byte
+	}{
+		{1, 0x12, []byte{0x12}},
+		{1, 0x1234, []byte{0x34}}, // truncated
+		{2, 0x1234, []byte{0x12, 0x34}},
+		{3, 0x123456, []byte{0x12, 0x34, 0x56}},
+		{4, 0x12345678, []byte{0x12, 0x34, 0x56, 0x78}},
+	}
+	for _, tc := range tests {
+		bus := new(addrBus)
+		m := New(bus, tc.aw, binary.BigEndian)
+		m.Read8(tc.addr)
+		m.Write8(tc.addr, 0)
+		for _, a := range bus.addrs {
+			if !bytes.Equal(a, tc.want) {
+				t.Errorf("aw=%d: addr %#x encoded as % x, want % x",
+					tc.aw, tc.addr, a, tc.want)
+			}
+		}
+	}
+	for _, aw := range []int{0, 5} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("New(aw=%d) didn't panic", aw)
+				}
+			}()
+			New(new(addrBus), aw, binary.BigEndian)
+		}()
+	}
+}
+
+func TestAddrWidthMock(t *testing.T) {
+	bus := NewMock(0x102, 1)
+	m := New(bus, 2, binary.BigEndian)
+	if err := m.Write8(0x101, 0xa5); err != nil {
+		t.Fatal(err)
+	}
+	if bus.Mem[0x101] != 0xa5 {
+		t.Errorf("Mem[0x101] = %#x, want 0xa5", bus.Mem[0x101])
+	}
+	if len(bus.Log) != 1 || bus.Log[0].Addr != 0x101 {
+		t.Errorf("Log = %+v", bus.Log)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	bus := NewMock(3, 4)
+	m := New(bus, 1, binary.BigEndian)
+	m.Write8(0, 0x0f)
+	m.Write16(1, 0x00ff)
+	m.Write32(2, 0x0000ffff)
+	bus.Log = nil
+
+	// Unchanged values aren't written.
+	if err := m.Update8(0, 0x03, 0x03); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update16(1, 0xf000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update32(2, 0xffff0000, 0x0000ffff); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range bus.Log {
+		if op.Write {
+			t.Errorf("unexpected write: %+v", op)
+		}
+	}
+	if len(bus.Log) != 3 {
+		t.Errorf("%d ops logged, want 3 reads", len(bus.Log))
+	}
+
+	// Changed values are written.
+	bus.Log = nil
+	if err := m.Update8(0, 0xf0, 0xa5); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update16(1, 0xff00, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update32(2, 0xffff0000, 0x87654321); err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.Log) != 6 {
+		t.Fatalf("%d ops logged, want 3 reads and 3 writes", len(bus.Log))
+	}
+	if v, _ := m.Read8(0); v != 0xaf {
+		t.Errorf("reg 0 = %#x, want 0xaf", v)
+	}
+	if v, _ := m.Read16(1); v != 0x12ff {
+		t.Errorf("reg 1 = %#x, want 0x12ff", v)
+	}
+	if v, _ := m.Read32(2); v != 0x8765ffff {
+		t.Errorf("reg 2 = %#x, want 0x8765ffff", v)
+	}
+}
+
+func TestMockRange(t *testing.T) {
+	bus := NewMock(4, 2)
+	m := New(bus, 1, binary.LittleEndian)
+	if _, err := m.Read16(4); err != ErrRange {
+		t.Errorf("Read16(4): %v, want ErrRange", err)
+	}
+	if err := m.Write32(3, 0); err != ErrRange {
+		t.Errorf("Write32(3): %v, want ErrRange", err)
+	}
+	if err := m.Update8(0xff, 1, 1); err != ErrRange {
+		t.Errorf("Update8(0xff): %v, want ErrRange", err)
+	}
+	if len(bus.Log) != 0 {
+		t.Errorf("failed ops logged: %+v", bus.Log)
+	}
+	// Burst access up to the end of the register space.
+	if err := m.Write(2, []byte{1, 2, 3, 4}); err != nil {
+		t.Errorf("Write(2, 4 bytes): %v", err)
+	}
+	if v, err := m.Read16(3); err != nil || v != 0x0403 {
+		t.Errorf("Read16(3) = %#x, %v, want 0x403", v, err)
+	}
+}
+
+func TestMockErrOnWrite(t *testing.T) {
+	bus := NewMock(2, 1)
+	bus.OnWrite = func(m *Mock, addr uint32) {
+		if addr == 0 {
+			m.Mem[0] &^= 0x80 // self clearing bit
+		}
+	}
+	m := New(bus, 1, binary.BigEndian)
+	m.Write8(0, 0x81)
+	if v, _ := m.Read8(0); v != 0x01 {
+		t.Errorf("reg 0 = %#x, want 0x01", v)
+	}
+	errBus := errors.New("bus error")
+	bus.Err = errBus
+	bus.Log = nil
+	if _, err := m.Read8(0); err != errBus {
+		t.Errorf("Read8: %v, want %v", err, errBus)
+	}
+	if err := m.Update8(1, 1, 1); err != errBus {
+		t.Errorf("Update8: %v, want %v", err, errBus)
+	}
+	if len(bus.Log) != 0 {
+		t.Errorf("failed ops logged: %+v", bus.Log)
+	}
+}
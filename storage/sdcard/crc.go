@@ -0,0 +1,32 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sdcard
+
+// crc7 calculates the CRC7 (x^7 + x^3 + 1) used by the SD commands.
+func crc7(p []byte) byte {
+	var crc byte
+	for _, b := range p {
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if (b^crc)&0x80 != 0 {
+				crc ^= 0x09
+			}
+			b <<= 1
+		}
+	}
+	return crc & 0x7f
+}
+
+// crc16 calculates the CRC16-CCITT (x^16 + x^12 + x^5 + 1) used by the SD data
+// blocks.
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		x := crc>>8 ^ uint16(b)
+		x ^= x >> 4
+		crc = crc<<8 ^ x<<12 ^ x<<5 ^ x
+	}
+	return crc
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sdcard
+
+import "strconv"
+
+type DriverError uint8
+
+const (
+	// ErrTimeout is returned if the card did not respond in time.
+	ErrTimeout DriverError = iota + 1
+
+	// ErrNotSupported is returned by Init if the card (or its operating
+	// voltage) is not supported.
+	ErrNotSupported
+
+	// ErrCRC is returned if the CRC of the received data is invalid or the
+	// card reported a CRC error of the data sent to it.
+	ErrCRC
+
+	// ErrRead is returned if the card responded with the data error token
+	// instead of the data block.
+	ErrRead
+
+	// ErrWrite is returned if the card rejected the written data block.
+	ErrWrite
+
+	// ErrRange is returned if the requested blocks are out of the card
+	// capacity or the buffer length isn't a multiple of the block size.
+	ErrRange
+
+	// ErrNoInit is returned if the card hasn't been initialized by Init.
+	ErrNoInit
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrTimeout:
+		return "sdcard: timeout"
+	case ErrNotSupported:
+		return "sdcard: card not supported"
+	case ErrCRC:
+		return "sdcard: CRC error"
+	case ErrRead:
+		return "sdcard: read error"
+	case ErrWrite:
+		return "sdcard: write error"
+	case ErrRange:
+		return "sdcard: out of range"
+	case ErrNoInit:
+		return "sdcard: not initialized"
+	}
+	return ""
+}
+
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
+
+// A CmdError is returned if the card reported an error in the R1 response to
+// the command.
+type CmdError struct {
+	Cmd uint8 // command index
+	R1  uint8 // R1 response
+}
+
+// Error implements error interface.
+func (e *CmdError) Error() string {
+	return "sdcard: CMD" + strconv.Itoa(int(e.Cmd)) + " error, R1=0x" +
+		strconv.FormatUint(uint64(e.R1), 16)
+}
@@ -0,0 +1,515 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sdcard provides the driver for the SD memory cards (SDSC, SDHC,
+// SDXC) connected to the LPSPI peripheral and used in the SPI mode. The Card
+// type implements the storage.BlockDevice interface so the card can be used
+// by the block based filesystems (e.g. FAT).
+//
+// The chip select must be a GPIO pin because the SD card requires CS asserted
+// during the whole command/response/data sequence (see lpspi.Conn).
+package sdcard
+
+import (
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/gpio"
+	"github.com/embeddedgo/imxrt/hal/lpspi"
+)
+
+// BlockSize is the size of the data block used by Card.
+const BlockSize = 512
+
+// Type describes the type of the SD card.
+type Type uint8
+
+const (
+	NoCard Type = iota // card not initialized
+	SDv1               // Standard Capacity SD Memory Card, version 1.x
+	SDv2               // Standard Capacity SD Memory Card, version 2.0 or later
+	SDHC               // High or Extended Capacity SD Memory Card (SDHC, SDXC)
+)
+
+// SD commands used in the SPI mode.
+const (
+	cmd0  = 0  // GO_IDLE_STATE
+	cmd8  = 8  // SEND_IF_COND
+	cmd9  = 9  // SEND_CSD
+	cmd10 = 10 // SEND_CID
+	cmd12 = 12 // STOP_TRANSMISSION
+	cmd16 = 16 // SET_BLOCKLEN
+	cmd17 = 17 // READ_SINGLE_BLOCK
+	cmd18 = 18 // READ_MULTIPLE_BLOCK
+	cmd24 = 24 // WRITE_BLOCK
+	cmd25 = 25 // WRITE_MULTIPLE_BLOCK
+	cmd55 = 55 // APP_CMD
+	cmd58 = 58 // READ_OCR
+	cmd59 = 59 // CRC_ON_OFF
+
+	acmd41 = 41 // SD_SEND_OP_COND
+)
+
+// R1 response bits.
+const (
+	r1Idle    = 0x01
+	r1Illegal = 0x04
+	r1CRC     = 0x08
+)
+
+// Data tokens.
+const (
+	tokenStart      = 0xfe // start block (single block read/write, multiple block read)
+	tokenStartMulti = 0xfc // start block (multiple block write)
+	tokenStopTran   = 0xfd // stop transmission (multiple block write)
+)
+
+const (
+	initTimeout  = time.Second
+	readTimeout  = 250 * time.Millisecond
+	writeTimeout = 500 * time.Millisecond
+)
+
+// A Card represents an SD memory card connected to the SPI bus.
+type Card struct {
+	d    *lpspi.Master
+	c    *lpspi.Conn
+	cs   gpio.Bit
+	typ  Type
+	ashl uint // block number to card address conversion
+	nblk int64
+	csd  [16]byte
+	cid  [16]byte
+}
+
+// New returns a new driver for the SD card connected to d, that uses cs as the
+// chip select.
+func New(d *lpspi.Master, cs gpio.Bit) *Card {
+	cs.Set()
+	cs.SetDirOut(true)
+	return &Card{d: d, cs: cs}
+}
+
+// sel starts the SPI transaction and asserts CS. The empty write locks the
+// Master so CS is never asserted while another Conn uses the bus.
+func (c *Card) sel() error {
+	if _, err := c.c.Write(nil); err != nil {
+		return err
+	}
+	c.cs.Clear()
+	return nil
+}
+
+// desel deasserts CS, sends 8 clock cycles required by the card to release
+// the data line and ends the SPI transaction.
+func (c *Card) desel() error {
+	c.cs.Set()
+	if err := c.c.WriteByte(0xff); err != nil {
+		return err
+	}
+	return c.c.Close()
+}
+
+// end ends the SPI transaction and returns err or the error that occurred
+// during deselection.
+func end(c *Card, err error) error {
+	if err1 := c.desel(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// waitReady waits until the card releases the busy state (the data line
+// high).
+func waitReady(c *Card, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		b, err := c.c.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == 0xff {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+}
+
+// command sends the command and returns the R1 response.
+func command(c *Card, idx uint8, arg uint32) (r1 byte, err error) {
+	if idx != cmd0 {
+		if err = waitReady(c, writeTimeout); err != nil {
+			return
+		}
+	}
+	buf := [6]byte{
+		0x40 | idx, byte(arg >> 24), byte(arg >> 16), byte(arg >> 8), byte(arg),
+	}
+	buf[5] = crc7(buf[:5])<<1 | 1
+	if _, err = c.c.Write(buf[:]); err != nil {
+		return
+	}
+	if idx == cmd12 {
+		// Skip the stuff byte.
+		if _, err = c.c.ReadByte(); err != nil {
+			return
+		}
+	}
+	// The response comes after 0 to 8 bytes (NCR).
+	for i := 0; i < 9; i++ {
+		if r1, err = c.c.ReadByte(); err != nil || r1&0x80 == 0 {
+			return
+		}
+	}
+	return r1, ErrTimeout
+}
+
+// cmd works like command but returns CmdError if the R1 response reports an
+// error.
+func cmd(c *Card, idx uint8, arg uint32) error {
+	r1, err := command(c, idx, arg)
+	if err == nil && r1&^r1Idle != 0 {
+		if r1&r1CRC != 0 {
+			return ErrCRC
+		}
+		err = &CmdError{idx, r1}
+	}
+	return err
+}
+
+// acmd sends the application specific command.
+func acmd(c *Card, idx uint8, arg uint32) (r1 byte, err error) {
+	if err = cmd(c, cmd55, 0); err != nil {
+		return
+	}
+	return command(c, idx, arg)
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// Init initializes the card and reads its parameters. The SCK frequency used
+// after initialization does not exceed maxFreqHz (limited to 25 MHz).
+func (c *Card) Init(maxFreqHz int) error {
+	c.typ = NoCard
+	c.c = c.d.NewConn(lpspi.CPOL0|lpspi.CPHA0, 400e3, 8, gpio.Bit{})
+	c.c.SetFill(0xff)
+
+	// Send at least 74 clock cycles with CS deasserted.
+	var ff [10]byte
+	for i := range ff {
+		ff[i] = 0xff
+	}
+	if _, err := c.c.Write(ff[:]); err != nil {
+		return err
+	}
+	if err := c.c.Close(); err != nil {
+		return err
+	}
+	if err := c.sel(); err != nil {
+		return err
+	}
+	if err := initCard(c); err != nil {
+		c.typ = NoCard
+		return end(c, err)
+	}
+	if err := c.desel(); err != nil {
+		c.typ = NoCard
+		return err
+	}
+	c.c = c.d.NewConn(lpspi.CPOL0|lpspi.CPHA0, min(maxFreqHz, 25e6), 8, gpio.Bit{})
+	c.c.SetFill(0xff)
+	return nil
+}
+
+func initCard(c *Card) error {
+	// Enter the SPI mode.
+	var (
+		r1  byte
+		err error
+	)
+	for i := 0; ; i++ {
+		if r1, err = command(c, cmd0, 0); err != nil && err != ErrTimeout {
+			return err
+		}
+		if r1 == r1Idle {
+			break
+		}
+		if i == 10 {
+			return ErrTimeout
+		}
+	}
+
+	// Check the supported voltage and the card version.
+	var r7 [4]byte
+	c.typ = SDv2
+	r1, err = command(c, cmd8, 0x1aa)
+	if err != nil {
+		return err
+	}
+	if r1&r1Illegal != 0 {
+		c.typ = SDv1
+	} else {
+		if _, err = c.c.Read(r7[:]); err != nil {
+			return err
+		}
+		if r7[2]&0x0f != 0x01 || r7[3] != 0xaa {
+			return ErrNotSupported
+		}
+	}
+
+	// Enable the CRC checking.
+	if err = cmd(c, cmd59, 1); err != nil {
+		return err
+	}
+
+	// Wait for the end of the card initialization process.
+	var hcs uint32
+	if c.typ == SDv2 {
+		hcs = 1 << 30
+	}
+	deadline := time.Now().Add(initTimeout)
+	for {
+		if r1, err = acmd(c, acmd41, hcs); err != nil {
+			return err
+		}
+		if r1 == 0 {
+			break
+		}
+		if r1&^r1Idle != 0 {
+			return ErrNotSupported // probably MMC
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+
+	// Determine the addressing mode.
+	c.ashl = 9
+	if c.typ == SDv2 {
+		if err = cmd(c, cmd58, 0); err != nil {
+			return err
+		}
+		var ocr [4]byte
+		if _, err = c.c.Read(ocr[:]); err != nil {
+			return err
+		}
+		if be32(ocr[:])&(1<<30) != 0 {
+			c.typ = SDHC
+			c.ashl = 0
+		}
+	}
+	if c.typ != SDHC {
+		if err = cmd(c, cmd16, BlockSize); err != nil {
+			return err
+		}
+	}
+
+	// Read the card registers.
+	if err = cmd(c, cmd9, 0); err != nil {
+		return err
+	}
+	if err = readData(c, c.csd[:]); err != nil {
+		return err
+	}
+	if err = cmd(c, cmd10, 0); err != nil {
+		return err
+	}
+	if err = readData(c, c.cid[:]); err != nil {
+		return err
+	}
+	return parseCSD(c)
+}
+
+// parseCSD calculates the card capacity using the CSD register.
+func parseCSD(c *Card) error {
+	csd := &c.csd
+	switch csd[0] >> 6 {
+	case 0: // CSD Version 1.0
+		size := int64(csd[6]&3)<<10 | int64(csd[7])<<2 | int64(csd[8]>>6)
+		mult := uint(csd[9]&3)<<1 | uint(csd[10]>>7)
+		blen := uint(csd[5] & 15)
+		c.nblk = (size + 1) << (mult + 2) << blen / BlockSize
+	case 1: // CSD Version 2.0
+		size := int64(csd[7]&0x3f)<<16 | int64(csd[8])<<8 | int64(csd[9])
+		c.nblk = (size + 1) * 1024
+	default:
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// readData reads the data block into p.
+func readData(c *Card, p []byte) error {
+	deadline := time.Now().Add(readTimeout)
+	for {
+		t, err := c.c.ReadByte()
+		if err != nil {
+			return err
+		}
+		if t == tokenStart {
+			break
+		}
+		if t != 0xff {
+			return ErrRead // data error token
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+	}
+	if _, err := c.c.Read(p); err != nil {
+		return err
+	}
+	var crc [2]byte
+	if _, err := c.c.Read(crc[:]); err != nil {
+		return err
+	}
+	if crc16(p) != uint16(crc[0])<<8|uint16(crc[1]) {
+		return ErrCRC
+	}
+	return nil
+}
+
+// writeData writes the data block p preceded by the token t.
+func writeData(c *Card, t byte, p []byte) error {
+	crc := crc16(p)
+	hdr := [2]byte{0xff, t}
+	if _, err := c.c.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.c.Write(p); err != nil {
+		return err
+	}
+	tail := [2]byte{byte(crc >> 8), byte(crc)}
+	if _, err := c.c.Write(tail[:]); err != nil {
+		return err
+	}
+	resp, err := c.c.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch resp & 0x1f {
+	case 0x05: // data accepted
+	case 0x0b:
+		return ErrCRC
+	default:
+		return ErrWrite
+	}
+	return waitReady(c, writeTimeout)
+}
+
+// Type returns the type of the initialized card or NoCard.
+func (c *Card) Type() Type {
+	return c.typ
+}
+
+// CSD returns the content of the Card-Specific Data register.
+func (c *Card) CSD() [16]byte {
+	return c.csd
+}
+
+// CID returns the content of the Card Identification register.
+func (c *Card) CID() [16]byte {
+	return c.cid
+}
+
+// BlockSize implements the storage.BlockDevice interface. It returns
+// BlockSize.
+func (c *Card) BlockSize() int {
+	return BlockSize
+}
+
+// NumBlocks implements the storage.BlockDevice interface.
+func (c *Card) NumBlocks() int64 {
+	return c.nblk
+}
+
+// checkRange returns the number of blocks in p or an error.
+func checkRange(c *Card, p []byte, blk int64) (int, error) {
+	if c.typ == NoCard {
+		return 0, ErrNoInit
+	}
+	n := len(p) / BlockSize
+	if len(p)%BlockSize != 0 || blk < 0 || blk+int64(n) > c.nblk {
+		return 0, ErrRange
+	}
+	return n, nil
+}
+
+// ReadBlocks implements the storage.BlockDevice interface. It uses the
+// multiple block read command if len(p) > BlockSize.
+func (c *Card) ReadBlocks(p []byte, blk int64) error {
+	n, err := checkRange(c, p, blk)
+	if n == 0 {
+		return err
+	}
+	addr := uint32(blk << c.ashl)
+	if err = c.sel(); err != nil {
+		return err
+	}
+	if n == 1 {
+		if err = cmd(c, cmd17, addr); err == nil {
+			err = readData(c, p)
+		}
+		return end(c, err)
+	}
+	if err = cmd(c, cmd18, addr); err != nil {
+		return end(c, err)
+	}
+	for ; len(p) != 0; p = p[BlockSize:] {
+		if err = readData(c, p[:BlockSize]); err != nil {
+			break
+		}
+	}
+	if _, err1 := command(c, cmd12, 0); err == nil {
+		err = err1
+	}
+	return end(c, err)
+}
+
+// WriteBlocks implements the storage.BlockDevice interface. It uses the
+// multiple block write command if len(p) > BlockSize.
+func (c *Card) WriteBlocks(p []byte, blk int64) error {
+	n, err := checkRange(c, p, blk)
+	if n == 0 {
+		return err
+	}
+	addr := uint32(blk << c.ashl)
+	if err = c.sel(); err != nil {
+		return err
+	}
+	if n == 1 {
+		if err = cmd(c, cmd24, addr); err == nil {
+			err = writeData(c, tokenStart, p)
+		}
+		return end(c, err)
+	}
+	if err = cmd(c, cmd25, addr); err != nil {
+		return end(c, err)
+	}
+	for ; len(p) != 0; p = p[BlockSize:] {
+		if err = writeData(c, tokenStartMulti, p[:BlockSize]); err != nil {
+			break
+		}
+	}
+	stop := [2]byte{tokenStopTran, 0xff} // the second byte is Nbr
+	if _, err1 := c.c.Write(stop[:]); err == nil {
+		err = err1
+	}
+	if err1 := waitReady(c, writeTimeout); err == nil {
+		err = err1
+	}
+	return end(c, err)
+}
+
+// Sync implements the storage.BlockDevice interface. The Card doesn't cache
+// the written blocks so Sync only checks if the card is initialized.
+func (c *Card) Sync() error {
+	if c.typ == NoCard {
+		return ErrNoInit
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spinor
+
+type DriverError uint8
+
+const (
+	// ErrTimeout is returned if the flash remained busy for too long.
+	ErrTimeout DriverError = iota + 1
+
+	// ErrNoFlash is returned by Init if there is no response to the JEDEC
+	// Read Identification command.
+	ErrNoFlash
+
+	// ErrSFDP is returned by Init if the SFDP tables are invalid or there are
+	// no SFDP tables and the flash size can not be determined from the JEDEC
+	// ID.
+	ErrSFDP
+
+	// ErrRange is returned if the requested area is out of the flash memory.
+	ErrRange
+
+	// ErrAlign is returned by Erase if the area isn't aligned to the erase
+	// size.
+	ErrAlign
+
+	// ErrWriteEnable is returned if the flash did not accept the Write
+	// Enable command (e.g. the WP# pin is asserted).
+	ErrWriteEnable
+
+	// ErrAddrMode is returned by Init if the flash bigger than 16 MiB
+	// supports neither the B7h 4-byte addressing mode command nor the
+	// dedicated 4-byte address instructions.
+	ErrAddrMode
+)
+
+// Error implements error interface.
+func (e DriverError) Error() string {
+	switch e {
+	case ErrTimeout:
+		return "spinor: timeout"
+	case ErrNoFlash:
+		return "spinor: no flash"
+	case ErrSFDP:
+		return "spinor: bad SFDP"
+	case ErrRange:
+		return "spinor: out of range"
+	case ErrAlign:
+		return "spinor: unaligned erase"
+	case ErrWriteEnable:
+		return "spinor: write enable failed"
+	case ErrAddrMode:
+		return "spinor: unsupported addressing mode"
+	}
+	return ""
+}
+
+// Timeout reports whether e is ErrTimeout.
+func (e DriverError) Timeout() bool {
+	return e == ErrTimeout
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spinor
+
+import "github.com/embeddedgo/imxrt/hal/lpspi"
+
+// The Serial Flash Discoverable Parameters (JESD216) support.
+
+const (
+	sfdpSignature = 0x50444653 // "SFDP" in little-endian
+	bfptID        = 0xff00     // Basic Flash Parameter Table
+	bfptMaxLen    = 23         // the number of DWORDs known by this driver
+)
+
+type eraseType struct {
+	size int // 0 means unused
+	op   uint8
+}
+
+// params contains the flash parameters discovered from SFDP or guessed from
+// the JEDEC ID.
+type params struct {
+	size   int64
+	page   int
+	addr   uint8           // BFPT DWORD1[18:17], address bytes
+	erase  [4]eraseType    // sorted by size
+	reads  []lpspi.WideCmd // supported fast read commands, the widest first
+	qer    uint8           // BFPT DWORD15[22:20], Quad Enable Requirements
+	enter4 uint8           // BFPT DWORD16[31:24], Enter 4-Byte Addressing
+}
+
+// Address bytes (BFPT DWORD1[18:17]).
+const (
+	addr3    = 0
+	addr3or4 = 1
+	addr4    = 2
+)
+
+// fastRead is the 1-1-1 Fast Read command supported by all flash chips.
+var fastRead = lpspi.WideCmd{Cmd: 0x0b, Dummy: 8}
+
+// wideRead decodes the 16-bit fast read descriptor from BFPT (opcode, mode
+// clocks, dummy clocks). It returns false if the command can't be sent using
+// lpspi.Master.WideRead.
+func wideRead(x uint32, addrW, dataW lpspi.TCR) (c lpspi.WideCmd, ok bool) {
+	c.Cmd = uint8(x >> 8)
+	c.AddrW = addrW
+	c.DataW = dataW
+	// The mode bits are sent as zeros which doesn't enable the continuous
+	// read mode so they can be treated as the dummy cycles.
+	c.Dummy = int(x&0x1f + x>>5&7)
+	bits := c.Dummy << (dataW >> lpspi.WIDTHn)
+	ok = c.Cmd != 0 && (bits == 0 || bits >= 8 && (bits <= 32 || bits&31 != 1))
+	return
+}
+
+// parseBFPT parses the Basic Flash Parameter Table.
+func parseBFPT(bfpt []uint32) (p params, err error) {
+	if len(bfpt) < 9 {
+		return p, ErrSFDP
+	}
+	dw := func(n int) uint32 {
+		if n > len(bfpt) {
+			return 0
+		}
+		return bfpt[n-1]
+	}
+	dw1 := dw(1)
+	p.addr = uint8(dw1 >> 17 & 3)
+
+	// Density.
+	if d := dw(2); d>>31 == 0 {
+		p.size = (int64(d) + 1) / 8
+	} else {
+		n := d & 0x7fffffff
+		if n < 3 || n > 62 {
+			return p, ErrSFDP
+		}
+		p.size = 1 << (n - 3)
+	}
+
+	// Erase types.
+	k := 0
+	for _, x := range [2]uint32{dw(8), dw(9)} {
+		for i := 0; i < 2; i, x = i+1, x>>16 {
+			if n := x & 0xff; n != 0 && n < 31 {
+				p.erase[k] = eraseType{1 << n, uint8(x >> 8)}
+				k++
+			}
+		}
+	}
+	if k == 0 && dw1&3 == 1 {
+		p.erase[0] = eraseType{4096, uint8(dw1 >> 8)}
+		k++
+	}
+	if k == 0 {
+		return p, ErrSFDP
+	}
+	for i := 1; i < k; i++ {
+		for j := i; j > 0 && p.erase[j].size < p.erase[j-1].size; j-- {
+			p.erase[j], p.erase[j-1] = p.erase[j-1], p.erase[j]
+		}
+	}
+
+	// Page size.
+	p.page = 256
+	if len(bfpt) >= 11 {
+		p.page = 1 << (dw(11) >> 4 & 15)
+	}
+
+	// Fast reads, the widest first.
+	dw3, dw4 := dw(3), dw(4)
+	for _, r := range [...]struct {
+		support      uint32
+		x            uint32
+		addrW, dataW lpspi.TCR
+	}{
+		{1 << 21, dw3, lpspi.WIDTH2, lpspi.WIDTH2},       // 1-4-4
+		{1 << 22, dw3 >> 16, lpspi.WIDTH0, lpspi.WIDTH2}, // 1-1-4
+		{1 << 20, dw4 >> 16, lpspi.WIDTH1, lpspi.WIDTH1}, // 1-2-2
+		{1 << 16, dw4, lpspi.WIDTH0, lpspi.WIDTH1},       // 1-1-2
+	} {
+		if dw1&r.support == 0 {
+			continue
+		}
+		if c, ok := wideRead(r.x&0xffff, r.addrW, r.dataW); ok {
+			p.reads = append(p.reads, c)
+		}
+	}
+
+	p.qer = uint8(dw(15) >> 20 & 7)
+	p.enter4 = uint8(dw(16) >> 24)
+	return p, nil
+}
+
+// guessParams returns the parameters of the flash without SFDP based on its
+// JEDEC ID. Most manufacturers encode the log2 of the flash size in bytes in
+// the last ID byte.
+func guessParams(id [3]byte) (p params, err error) {
+	n := id[2]
+	if n < 16 || n > 32 {
+		return p, ErrSFDP
+	}
+	p.size = 1 << n
+	p.page = 256
+	p.addr = addr3
+	if n > 24 {
+		p.addr = addr3or4
+	}
+	p.erase[0] = eraseType{4096, 0x20}
+	p.erase[1] = eraseType{65536, 0xd8}
+	return p, nil
+}
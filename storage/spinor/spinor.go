@@ -0,0 +1,476 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spinor provides the driver for the serial NOR flash memories (e.g.
+// W25Q, MX25) connected to the LPSPI peripheral. The flash parameters (size,
+// page size, erase types, fast read commands, quad enable method, 4-byte
+// addressing) are discovered using the Serial Flash Discoverable Parameters
+// (SFDP). The Flash type implements the storage.Flash interface.
+//
+// The flash must be connected to the hardware controlled chip select (PCSx)
+// because the driver uses the lpspi.Master wide transfers (see
+// lpspi.Master.WideRead). The dual (2-bit) fast read commands use the SDO and
+// SDI pins as DATA0 and DATA1 lines. The quad (4-bit) ones additionally
+// require the PCS2 and PCS3 pins configured as DATA2 and DATA3 (see
+// lpspi.Master.SetQuad).
+package spinor
+
+import (
+	"encoding/binary"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/embeddedgo/imxrt/hal/lpspi"
+)
+
+// SPI NOR commands.
+const (
+	cmdWriteSR    = 0x01
+	cmdProgram    = 0x02
+	cmdReadSR     = 0x05
+	cmdWREN       = 0x06
+	cmdReadSR2    = 0x35
+	cmdWriteSR2   = 0x31
+	cmdReadSR3F   = 0x3f
+	cmdWriteSR3E  = 0x3e
+	cmdReadSFDP   = 0x5a
+	cmdReadID     = 0x9f
+	cmdEnter4Byte = 0xb7
+)
+
+// op4 returns the dedicated 4-byte address instruction that corresponds to
+// the 3-byte address one. It returns 0 if there is no such instruction.
+func op4(op uint8) uint8 {
+	switch op {
+	case 0x03, 0x02: // read, page program
+		return op + 0x10
+	case 0x0b, 0x3b, 0xbb, 0x6b, 0xeb: // fast reads
+		return op + 1
+	case 0x20: // 4 KiB erase
+		return 0x21
+	case 0x52: // 32 KiB erase
+		return 0x5c
+	case 0xd8: // 64 KiB erase
+		return 0xdc
+	}
+	return 0
+}
+
+// Status register 1 bits.
+const (
+	srWIP = 0x01 // write in progress
+	srWEL = 0x02 // write enable latch
+	srBP  = 0x3c // block protect bits (BP0-BP3 or BP0-BP2, TB)
+)
+
+const (
+	programTimeout = 100 * time.Millisecond
+	eraseTimeout   = 5 * time.Second
+	srTimeout      = 500 * time.Millisecond
+)
+
+// A Flash represents a serial NOR flash memory connected to the SPI bus.
+type Flash struct {
+	d    *lpspi.Master
+	mode lpspi.TCR
+	id   [3]byte
+	p    params
+	alen int
+	prog uint8 // page program command
+	read lpspi.WideCmd
+}
+
+// New returns a new driver for the flash connected to d. The mode parameter
+// specifies the SPI mode (CPOL, CPHA) and the chip select (TPCSx). The SCK
+// frequency does not exceed maxFreqHz.
+func New(d *lpspi.Master, mode lpspi.TCR, maxFreqHz int) *Flash {
+	mode &= lpspi.CPOL | lpspi.CPHA | lpspi.TPCS
+	return &Flash{d: d, mode: mode | d.Prescaler(maxFreqHz)}
+}
+
+func (f *Flash) lock() {
+	f.d.Lock()
+	f.d.Enable()
+}
+
+func (f *Flash) unlock(err error) error {
+	if err1 := f.d.Err(true); err == nil {
+		err = err1
+	}
+	f.d.Unlock()
+	return err
+}
+
+func (f *Flash) cmdRead(c *lpspi.WideCmd, p []byte) error {
+	f.d.WideRead(f.mode, c, p)
+	return f.d.Err(false)
+}
+
+func (f *Flash) cmdWrite(c *lpspi.WideCmd, p []byte) error {
+	f.d.WideWrite(f.mode, c, p)
+	return f.d.Err(false)
+}
+
+func (f *Flash) readReg(cmd uint8) (byte, error) {
+	var buf [1]byte
+	err := f.cmdRead(&lpspi.WideCmd{Cmd: cmd}, buf[:])
+	return buf[0], err
+}
+
+// waitBusy waits for the end of the program/erase/write operation. It calls
+// time.Sleep(sleep) between the status polls if sleep != 0.
+func (f *Flash) waitBusy(timeout, sleep time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		sr, err := f.readReg(cmdReadSR)
+		if err != nil {
+			return err
+		}
+		if sr&srWIP == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		if sleep != 0 {
+			time.Sleep(sleep)
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+func (f *Flash) writeEnable() error {
+	if err := f.cmdWrite(&lpspi.WideCmd{Cmd: cmdWREN}, nil); err != nil {
+		return err
+	}
+	sr, err := f.readReg(cmdReadSR)
+	if err == nil && sr&srWEL == 0 {
+		err = ErrWriteEnable
+	}
+	return err
+}
+
+// writeReg writes the status/configuration register(s) using cmd.
+func (f *Flash) writeReg(cmd uint8, val ...byte) error {
+	if err := f.writeEnable(); err != nil {
+		return err
+	}
+	if err := f.cmdWrite(&lpspi.WideCmd{Cmd: cmd}, val); err != nil {
+		return err
+	}
+	return f.waitBusy(srTimeout, 0)
+}
+
+// sr2Pair reports whether the status register 1 must be written together
+// with the status register 2 to preserve the QE bit.
+func (f *Flash) sr2Pair() bool {
+	switch f.p.qer {
+	case 1, 4, 5:
+		return true
+	}
+	return false
+}
+
+// writeSR1 writes the status register 1 preserving the status register 2 if
+// required.
+func (f *Flash) writeSR1(sr1 byte) error {
+	if !f.sr2Pair() {
+		return f.writeReg(cmdWriteSR, sr1)
+	}
+	sr2, err := f.readReg(cmdReadSR2)
+	if err != nil {
+		return err
+	}
+	return f.writeReg(cmdWriteSR, sr1, sr2)
+}
+
+// quadEnable sets the Quad Enable bit according to the Quad Enable
+// Requirements from SFDP.
+func (f *Flash) quadEnable() error {
+	switch f.p.qer {
+	case 1, 4, 5: // QE is bit 1 of SR2, written with SR1 using 01h
+		sr1, err := f.readReg(cmdReadSR)
+		if err != nil {
+			return err
+		}
+		sr2, err := f.readReg(cmdReadSR2)
+		if err != nil || sr2&0x02 != 0 {
+			return err
+		}
+		return f.writeReg(cmdWriteSR, sr1, sr2|0x02)
+	case 2: // QE is bit 6 of SR1
+		sr1, err := f.readReg(cmdReadSR)
+		if err != nil || sr1&0x40 != 0 {
+			return err
+		}
+		return f.writeReg(cmdWriteSR, sr1|0x40)
+	case 3: // QE is bit 7 of SR2, read with 3Fh, written with 3Eh
+		sr2, err := f.readReg(cmdReadSR3F)
+		if err != nil || sr2&0x80 != 0 {
+			return err
+		}
+		return f.writeReg(cmdWriteSR3E, sr2|0x80)
+	case 6: // QE is bit 1 of SR2, written with 31h
+		sr2, err := f.readReg(cmdReadSR2)
+		if err != nil || sr2&0x02 != 0 {
+			return err
+		}
+		return f.writeReg(cmdWriteSR2, sr2|0x02)
+	}
+	return nil
+}
+
+// readSFDP reads the SFDP data starting at addr.
+func (f *Flash) readSFDP(addr uint32, p []byte) error {
+	c := lpspi.WideCmd{Cmd: cmdReadSFDP, Addr: addr, AddrLen: 3, Dummy: 8}
+	return f.cmdRead(&c, p)
+}
+
+// discover reads the SFDP tables.
+func (f *Flash) discover() (p params, err error) {
+	var hdr [8]byte
+	if err = f.readSFDP(0, hdr[:]); err != nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) != sfdpSignature {
+		return guessParams(f.id)
+	}
+	nph := min(int(hdr[6])+1, 16)
+	for i := 0; i < nph; i++ {
+		var ph [8]byte
+		if err = f.readSFDP(uint32(8+i*8), ph[:]); err != nil {
+			return
+		}
+		if int(ph[7])<<8|int(ph[0]) != bfptID {
+			continue
+		}
+		n := min(int(ph[3]), bfptMaxLen)
+		var buf [bfptMaxLen * 4]byte
+		ptp := uint32(ph[4]) | uint32(ph[5])<<8 | uint32(ph[6])<<16
+		if err = f.readSFDP(ptp, buf[:n*4]); err != nil {
+			return
+		}
+		var bfpt [bfptMaxLen]uint32
+		for k := range bfpt[:n] {
+			bfpt[k] = binary.LittleEndian.Uint32(buf[k*4:])
+		}
+		return parseBFPT(bfpt[:n])
+	}
+	return guessParams(f.id)
+}
+
+// Init reads the JEDEC ID and the SFDP tables and configures the flash
+// according to the discovered parameters. The lines parameter specifies the
+// number of data lines (1, 2 or 4) that can be used by the fast read commands.
+// If lines is 4 and the flash supports the quad reads Init sets the Quad
+// Enable bit in the flash status register. The flash bigger than 16 MiB is
+// switched to the 4-byte addressing mode (B7h command) or, if it doesn't
+// support this mode, the dedicated 4-byte address instructions are used. Init
+// returns ErrAddrMode if the flash supports neither of them.
+func (f *Flash) Init(lines int) error {
+	f.lock()
+	err := f.init(lines)
+	return f.unlock(err)
+}
+
+func (f *Flash) init(lines int) (err error) {
+	if err = f.cmdRead(&lpspi.WideCmd{Cmd: cmdReadID}, f.id[:]); err != nil {
+		return
+	}
+	if f.id == [3]byte{} || f.id == [3]byte{0xff, 0xff, 0xff} {
+		return ErrNoFlash
+	}
+	if f.p, err = f.discover(); err != nil {
+		return
+	}
+
+	// Select the fast read command.
+	f.read = fastRead
+	for _, c := range f.p.reads {
+		w := 1 << (c.DataW >> lpspi.WIDTHn)
+		if w <= lines {
+			if w == 4 {
+				if err = f.quadEnable(); err != nil {
+					return
+				}
+			}
+			f.read = c
+			break
+		}
+	}
+
+	// Select the addressing mode.
+	f.alen = 3
+	f.prog = cmdProgram
+	switch {
+	case f.p.addr == addr4 || f.p.enter4&0x40 != 0:
+		f.alen = 4 // always 4-byte addressing
+	case f.p.size <= 1<<24:
+		// 3-byte addressing
+	case f.p.enter4&0x03 != 0:
+		if f.p.enter4&0x01 == 0 {
+			// Issue WREN before B7h (the method 0x02).
+			if err = f.cmdWrite(&lpspi.WideCmd{Cmd: cmdWREN}, nil); err != nil {
+				return
+			}
+		}
+		if err = f.cmdWrite(&lpspi.WideCmd{Cmd: cmdEnter4Byte}, nil); err != nil {
+			return
+		}
+		f.alen = 4
+	case f.p.enter4&0x20 != 0:
+		// Use the dedicated 4-byte address instruction set.
+		if op := op4(f.read.Cmd); op != 0 {
+			f.read.Cmd = op
+		} else {
+			f.read = fastRead
+			f.read.Cmd = op4(fastRead.Cmd)
+		}
+		for i := range f.p.erase {
+			e := &f.p.erase[i]
+			if e.size == 0 {
+				continue
+			}
+			if e.op = op4(e.op); e.op == 0 {
+				return ErrAddrMode
+			}
+		}
+		f.prog = op4(cmdProgram)
+		f.alen = 4
+	default:
+		return ErrAddrMode
+	}
+	f.read.AddrLen = f.alen
+	return nil
+}
+
+// JEDECID returns the manufacturer and device identification read by Init.
+func (f *Flash) JEDECID() [3]byte {
+	return f.id
+}
+
+// Size implements the storage.Flash interface.
+func (f *Flash) Size() int64 {
+	return f.p.size
+}
+
+// PageSize returns the size of the program page.
+func (f *Flash) PageSize() int {
+	return f.p.page
+}
+
+// EraseSize implements the storage.Flash interface.
+func (f *Flash) EraseSize() int {
+	return f.p.erase[0].size
+}
+
+// ReadCmd returns the fast read command selected by Init.
+func (f *Flash) ReadCmd() lpspi.WideCmd {
+	return f.read
+}
+
+// Protected reads the status register and reports whether any of the block
+// protect bits is set.
+func (f *Flash) Protected() (bool, error) {
+	f.lock()
+	sr1, err := f.readReg(cmdReadSR)
+	return sr1&srBP != 0, f.unlock(err)
+}
+
+// Unprotect clears the block protect bits in the status register so the whole
+// flash can be programmed and erased. It returns ErrWriteEnable if the status
+// register is protected (e.g. by the WP# pin).
+func (f *Flash) Unprotect() error {
+	f.lock()
+	sr1, err := f.readReg(cmdReadSR)
+	if err == nil && sr1&srBP != 0 {
+		err = f.writeSR1(sr1 &^ srBP)
+	}
+	return f.unlock(err)
+}
+
+// ReadAt implements the io.ReaderAt interface. It uses the fast read command
+// selected by Init.
+func (f *Flash) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off >= f.p.size {
+		return 0, io.EOF
+	}
+	n = len(p)
+	if rem := f.p.size - off; int64(n) > rem {
+		n = int(rem)
+		err = io.EOF
+	}
+	c := f.read
+	c.Addr = uint32(off)
+	f.lock()
+	if err1 := f.unlock(f.cmdRead(&c, p[:n])); err1 != nil {
+		return 0, err1
+	}
+	return n, err
+}
+
+// ProgramAt implements the storage.Flash interface. It splits the data into
+// the page program operations and waits for the end of each of them.
+func (f *Flash) ProgramAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > f.p.size {
+		return 0, ErrRange
+	}
+	f.lock()
+	for n < len(p) {
+		addr := off + int64(n)
+		m := min(len(p)-n, f.p.page-int(addr%int64(f.p.page)))
+		if err = f.writeEnable(); err != nil {
+			break
+		}
+		c := lpspi.WideCmd{Cmd: f.prog, Addr: uint32(addr), AddrLen: f.alen}
+		if err = f.cmdWrite(&c, p[n:n+m]); err != nil {
+			break
+		}
+		if err = f.waitBusy(programTimeout, 0); err != nil {
+			break
+		}
+		n += m
+	}
+	return n, f.unlock(err)
+}
+
+// Erase implements the storage.Flash interface. It uses the biggest erase
+// types allowed by the alignment of the erased area.
+func (f *Flash) Erase(off, size int64) error {
+	esz := int64(f.EraseSize())
+	if esz == 0 {
+		return ErrRange
+	}
+	if off < 0 || size < 0 || off+size > f.p.size {
+		return ErrRange
+	}
+	if off%esz != 0 || size%esz != 0 {
+		return ErrAlign
+	}
+	f.lock()
+	var err error
+	for size != 0 {
+		e := f.p.erase[0]
+		for _, et := range f.p.erase[1:] {
+			if s := int64(et.size); s != 0 && off%s == 0 && size >= s {
+				e = et
+			}
+		}
+		if err = f.writeEnable(); err != nil {
+			break
+		}
+		c := lpspi.WideCmd{Cmd: e.op, Addr: uint32(off), AddrLen: f.alen}
+		if err = f.cmdWrite(&c, nil); err != nil {
+			break
+		}
+		if err = f.waitBusy(eraseTimeout, time.Millisecond); err != nil {
+			break
+		}
+		off += int64(e.size)
+		size -= int64(e.size)
+	}
+	return f.unlock(err)
+}
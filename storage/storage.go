@@ -0,0 +1,55 @@
+// Copyright 2024 The Embedded Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package storage defines the interfaces implemented by the storage device
+// drivers provided in its subpackages.
+package storage
+
+import "io"
+
+// A BlockDevice represents a storage device that is read and written in
+// fixed size blocks (e.g. SD card). It's the interface expected by the block
+// based filesystems like FAT.
+type BlockDevice interface {
+	// BlockSize returns the size of the block in bytes.
+	BlockSize() int
+
+	// NumBlocks returns the number of blocks available on the device.
+	NumBlocks() int64
+
+	// ReadBlocks reads len(p) / BlockSize() consecutive blocks into p
+	// starting from the block number blk. The length of p must be a multiple
+	// of BlockSize.
+	ReadBlocks(p []byte, blk int64) error
+
+	// WriteBlocks writes len(p) / BlockSize() consecutive blocks from p
+	// starting from the block number blk. The length of p must be a multiple
+	// of BlockSize.
+	WriteBlocks(p []byte, blk int64) error
+
+	// Sync ensures that all written blocks are stored in a non-volatile way.
+	Sync() error
+}
+
+// A Flash represents a flash memory device (e.g. SPI NOR flash) that must be
+// erased before programming. It's the interface expected by the flash aware
+// (wear-levelling) filesystems.
+type Flash interface {
+	// ReadAt implements the io.ReaderAt interface.
+	io.ReaderAt
+
+	// ProgramAt programs len(p) bytes from p starting at offset off. The
+	// programmed area must be erased before.
+	ProgramAt(p []byte, off int64) (n int, err error)
+
+	// Erase erases size bytes starting at offset off. Both off and size must
+	// be multiples of EraseSize.
+	Erase(off, size int64) error
+
+	// EraseSize returns the size of the smallest erasable block in bytes.
+	EraseSize() int
+
+	// Size returns the size of the device in bytes.
+	Size() int64
+}